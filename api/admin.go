@@ -0,0 +1,197 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/promcluster/proxy/pkg/backend"
+	"github.com/promcluster/proxy/pkg/promql"
+	"github.com/promcluster/proxy/pkg/query"
+	pkgq "github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"go.uber.org/zap"
+)
+
+// adminUser is the user of the requests authenticated by the admin token.
+const adminUser = "admin"
+
+// Ring is the consistent hash ring of the backend endpoints.
+type Ring interface {
+	RingStatus() backend.RingStatus
+	Cordon(addr string) error
+	Uncordon(addr string) error
+}
+
+// SeriesRouter finds the endpoints owning a series on the ring.
+type SeriesRouter interface {
+	Lookup(lset model.LabelSet) (key string, owners []string, err error)
+}
+
+// adminPrefix is the path prefix of the admin API.
+const adminPrefix = "/api/v1/admin/"
+
+// isAdmin reports whether the request carries the admin token.
+func (s *Service) isAdmin(c *gin.Context) bool {
+	token := strings.TrimSpace(c.Request.Header.Get("Authorization"))
+	return s.adminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+s.adminToken)) == 1
+}
+
+// admin guards the admin API, which is disabled without admin token.
+func (s *Service) admin(c *gin.Context) {
+	if s.adminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !s.isAdmin(c) {
+		s.authFailed(c, c.GetString(ctxUserKey), authNotAdmin)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	s.auditLogger.Info("admin request",
+		zap.String("ip", s.clientIP(c.Request)),
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path))
+	c.Next()
+}
+
+// AdminRing returns the members of the hash ring and their ownership.
+func (s *Service) AdminRing(c *gin.Context) {
+	if s.ring == nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "no hash ring"))
+		return
+	}
+	s.respond(c, s.ring.RingStatus(), nil)
+}
+
+// AdminRingLookup returns the endpoints owning the series parameter, a
+// label set such as {__name__="up", job="node"}.
+func (s *Service) AdminRingLookup(c *gin.Context) {
+	if s.seriesRouter == nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "no hash ring"))
+		return
+	}
+	series := c.Query("series")
+	if series == "" {
+		s.respondError(c, query.Errorf(query.ErrBadData, "no series parameter provided"))
+		return
+	}
+	ms, err := promql.ParseMetricSelector(series)
+	if err != nil {
+		s.respondError(c, query.Errorf(query.ErrBadData, "invalid series %q: %v", series, err))
+		return
+	}
+	lset := make(model.LabelSet, len(ms))
+	for _, m := range ms {
+		if m.Type != labels.MatchEqual {
+			s.respondError(c, query.Errorf(query.ErrBadData, "series %q is not a label set", series))
+			return
+		}
+		if m.Value != "" {
+			lset[model.LabelName(m.Name)] = model.LabelValue(m.Value)
+		}
+	}
+
+	key, owners, err := s.seriesRouter.Lookup(lset)
+	if err != nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "%v", err))
+		return
+	}
+	s.respond(c, struct {
+		Series model.LabelSet `json:"series"`
+		Key    string         `json:"key"`
+		Owners []string       `json:"owners"`
+	}{lset, key, owners}, nil)
+}
+
+// AdminCordon flushes the buffered samples of the endpoint of the addr
+// parameter and removes it from the ring.
+func (s *Service) AdminCordon(c *gin.Context) {
+	s.cordon(c, true)
+}
+
+// AdminUncordon puts the endpoint of the addr parameter back into the ring.
+func (s *Service) AdminUncordon(c *gin.Context) {
+	s.cordon(c, false)
+}
+
+func (s *Service) cordon(c *gin.Context, cordon bool) {
+	if s.ring == nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "no hash ring"))
+		return
+	}
+	addr := c.Request.FormValue("addr")
+	if addr == "" {
+		s.respondError(c, query.Errorf(query.ErrBadData, "no addr parameter provided"))
+		return
+	}
+	f := s.ring.Uncordon
+	if cordon {
+		f = s.ring.Cordon
+	}
+	if err := f(addr); err != nil {
+		if err == backend.ErrUnknownEndpoint {
+			s.respondError(c, query.Errorf(query.ErrBadData, "%s: %v", addr, err))
+			return
+		}
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, s.ring.RingStatus(), nil)
+}
+
+// queueAdmin returns the admin operations of the write queue.
+func (s *Service) queueAdmin(c *gin.Context) (pkgq.Admin, bool) {
+	qa, ok := s.queue.(pkgq.Admin)
+	if !ok {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "queue does not support admin operations"))
+	}
+	return qa, ok
+}
+
+// AdminQueue returns the depth, files, positions and oldest message age
+// of the write queue.
+func (s *Service) AdminQueue(c *gin.Context) {
+	qa, ok := s.queueAdmin(c)
+	if !ok {
+		return
+	}
+	stats, err := qa.Stats()
+	if err != nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "%v", err))
+		return
+	}
+	s.respond(c, stats, nil)
+}
+
+// AdminQueuePause stops the workers consuming the write queue.
+func (s *Service) AdminQueuePause(c *gin.Context) {
+	s.queueOp(c, pkgq.Admin.Pause)
+}
+
+// AdminQueueResume resumes the workers consuming the write queue.
+func (s *Service) AdminQueueResume(c *gin.Context) {
+	s.queueOp(c, pkgq.Admin.Resume)
+}
+
+// AdminQueuePurge drops every pending message of the write queue, the
+// samples they hold are lost.
+func (s *Service) AdminQueuePurge(c *gin.Context) {
+	s.queueOp(c, pkgq.Admin.Purge)
+}
+
+func (s *Service) queueOp(c *gin.Context, op func(pkgq.Admin) error) {
+	qa, ok := s.queueAdmin(c)
+	if !ok {
+		return
+	}
+	if err := op(qa); err != nil {
+		s.respondError(c, query.Errorf(query.ErrUnavailable, "%v", err))
+		return
+	}
+	s.AdminQueue(c)
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/backend"
+	pkgq "github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+type fakeRing struct {
+	cordoned map[string]bool
+}
+
+func (r *fakeRing) RingStatus() backend.RingStatus {
+	st := backend.RingStatus{
+		Members:      []backend.RingMember{{Addr: "a:9090", Ownership: 0.4}, {Addr: "b:9090", Ownership: 0.6}},
+		VirtualNodes: 128,
+		LastChange:   time.Unix(1600000000, 0).UTC(),
+	}
+	for addr := range r.cordoned {
+		st.Cordoned = append(st.Cordoned, backend.CordonedEndpoint{Addr: addr, State: backend.StateCordoned})
+	}
+	return st
+}
+
+func (r *fakeRing) Cordon(addr string) error {
+	if addr != "a:9090" && addr != "b:9090" {
+		return backend.ErrUnknownEndpoint
+	}
+	r.cordoned[addr] = true
+	return nil
+}
+
+func (r *fakeRing) Uncordon(addr string) error {
+	delete(r.cordoned, addr)
+	return nil
+}
+
+func (r *fakeRing) Lookup(lset model.LabelSet) (string, []string, error) {
+	return lset.String(), []string{"b:9090"}, nil
+}
+
+func newAdminService(token string) *Service {
+	ring := &fakeRing{cordoned: make(map[string]bool)}
+	s := &Service{
+		router:       gin.New(),
+		adminToken:   token,
+		ring:         ring,
+		seriesRouter: ring,
+		logger:       zap.NewNop(),
+		auditLogger:  zap.NewNop(),
+	}
+	s.initHandler()
+	return s
+}
+
+// adminGet sends a GET request with the bearer token to the service.
+func adminGet(s *Service, path, token string) *httptest.ResponseRecorder {
+	return adminDo(s, http.MethodGet, path, token)
+}
+
+func adminDo(s *Service, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	if code := adminGet(newAdminService(""), "/api/v1/admin/ring", "").Code; code != http.StatusNotFound {
+		t.Errorf("got status %d without admin token, want 404", code)
+	}
+	s := newAdminService("secret")
+	if code := adminGet(s, "/api/v1/admin/ring", "wrong").Code; code != http.StatusForbidden {
+		t.Errorf("got status %d with a wrong token, want 403", code)
+	}
+	if code := adminGet(s, "/api/v1/admin/ring", "secret").Code; code != http.StatusOK {
+		t.Errorf("got status %d with the admin token, want 200", code)
+	}
+}
+
+func TestAdminTokenScope(t *testing.T) {
+	viper.Set("auth.user", "prom")
+	viper.Set("auth.token", "changeme")
+	defer viper.Set("auth.token", "")
+	ring := &fakeRing{cordoned: make(map[string]bool)}
+	s := &Service{
+		router:       gin.New(),
+		lockout:      newLockout(0, 0, 0, 0),
+		adminToken:   "secret",
+		ring:         ring,
+		seriesRouter: ring,
+		logger:       zap.NewNop(),
+		auditLogger:  zap.NewNop(),
+	}
+	s.router.Use(s.auth)
+	s.initHandler()
+
+	if code := adminGet(s, "/api/v1/admin/ring", "secret").Code; code != http.StatusOK {
+		t.Errorf("got status %d on the admin API, want 200", code)
+	}
+	if code := adminGet(s, "/api/v1/status/buildinfo", "secret").Code; code != http.StatusUnauthorized {
+		t.Errorf("got status %d with the admin token on another route, want 401", code)
+	}
+	if code := adminGet(s, "/api/v1/admin/ring", "changeme").Code; code != http.StatusForbidden {
+		t.Errorf("got status %d with the user token on the admin API, want 403", code)
+	}
+}
+
+func TestAdminRing(t *testing.T) {
+	s := newAdminService("secret")
+	rec := adminGet(s, "/api/v1/admin/ring", "secret")
+	var resp struct {
+		Data backend.RingStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Members) != 2 || resp.Data.Members[1].Ownership != 0.6 || resp.Data.VirtualNodes != 128 {
+		t.Errorf("got ring %+v", resp.Data)
+	}
+
+	cases := []struct {
+		series string
+		code   int
+		key    string
+	}{
+		{`{__name__="up", job="node"}`, http.StatusOK, `{__name__="up", job="node"}`},
+		{`up{job="node"}`, http.StatusOK, `{__name__="up", job="node"}`},
+		{`up{job=~"node"}`, http.StatusBadRequest, ""},
+		{``, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		rec := adminGet(s, "/api/v1/admin/ring/lookup?series="+url.QueryEscape(c.series), "secret")
+		if rec.Code != c.code {
+			t.Errorf("%s: got status %d, want %d", c.series, rec.Code, c.code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Data struct {
+				Key    string   `json:"key"`
+				Owners []string `json:"owners"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.Key != c.key || len(resp.Data.Owners) != 1 || resp.Data.Owners[0] != "b:9090" {
+			t.Errorf("%s: got %+v, want key %s owned by b:9090", c.series, resp.Data, c.key)
+		}
+	}
+}
+
+func TestAdminCordon(t *testing.T) {
+	s := newAdminService("secret")
+	if code := adminDo(s, http.MethodPost, "/api/v1/admin/endpoints/cordon?addr=c:9090", "secret").Code; code != http.StatusBadRequest {
+		t.Errorf("got status %d cordoning an unknown endpoint, want 400", code)
+	}
+	rec := adminDo(s, http.MethodPost, "/api/v1/admin/endpoints/cordon?addr=a:9090", "secret")
+	var resp struct {
+		Data backend.RingStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Cordoned) != 1 || resp.Data.Cordoned[0].Addr != "a:9090" {
+		t.Fatalf("got ring %+v, want a:9090 cordoned", resp.Data)
+	}
+	if code := adminDo(s, http.MethodPost, "/api/v1/admin/endpoints/uncordon?addr=a:9090", "secret").Code; code != http.StatusOK {
+		t.Fatalf("got status %d uncordoning, want 200", code)
+	}
+	if st := s.ring.RingStatus(); len(st.Cordoned) != 0 {
+		t.Fatalf("got cordoned endpoints %v, want none", st.Cordoned)
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	s := newAdminService("secret")
+	q := pkgq.NewChanQueue(prometheus.NewRegistry(), zap.NewNop())
+	s.queue = q
+	_ = q.Push([]byte("a"))
+	_ = q.Push([]byte("b"))
+
+	stats := func(rec *httptest.ResponseRecorder) pkgq.Stats {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", rec.Code)
+		}
+		var resp struct {
+			Data pkgq.Stats `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data
+	}
+	if st := stats(adminGet(s, "/api/v1/admin/queue", "secret")); st.Depth != 2 || st.Paused {
+		t.Fatalf("got %+v, want depth 2", st)
+	}
+	if st := stats(adminDo(s, http.MethodPost, "/api/v1/admin/queue/pause", "secret")); !st.Paused {
+		t.Fatalf("got %+v, want paused", st)
+	}
+	if st := stats(adminDo(s, http.MethodPost, "/api/v1/admin/queue/resume", "secret")); st.Paused {
+		t.Fatalf("got %+v, want resumed", st)
+	}
+	if st := stats(adminDo(s, http.MethodPost, "/api/v1/admin/queue/purge", "secret")); st.Depth != 0 {
+		t.Fatalf("got %+v, want an empty queue", st)
+	}
+	if code := adminDo(s, http.MethodPost, "/api/v1/admin/queue/purge", "").Code; code != http.StatusForbidden {
+		t.Errorf("got status %d purging without admin token, want 403", code)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+// Federate handles federation requests by collecting the latest sample
+// of the matching series from every backend.
+func (s *Service) Federate(c *gin.Context) {
+	if !s.queryEnable || s.querier == nil {
+		http.Error(c.Writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mfs, err := s.querier.Federate(c.Request.Context(), c.Request.Form)
+	if err != nil {
+		s.respondPlainError(c, "federate", err)
+		return
+	}
+
+	format := expfmt.NegotiateIncludingOpenMetrics(c.Request.Header)
+	c.Header("Content-Type", string(format))
+	c.Status(http.StatusOK)
+	enc := expfmt.NewEncoder(c.Writer, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			s.logger.Error("federate encode", zap.Error(err))
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			s.logger.Error("federate encode", zap.Error(err))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -12,6 +13,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/promcluster/proxy/pkg/query"
+	"github.com/promcluster/proxy/pkg/upstream"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/common/expfmt"
 
@@ -33,6 +37,11 @@ func init() {
 	_ = prometheus.Register(numOfSendSuccess)
 	_ = prometheus.Register(httpPushSize)
 	_ = prometheus.Register(httpPushDuration)
+	_ = prometheus.Register(authFailures)
+	_ = prometheus.Register(authLockouts)
+	_ = prometheus.Register(queryLimitExceeded)
+	_ = prometheus.Register(tenantQueries)
+	_ = prometheus.Register(tenantQueryDuration)
 }
 
 // Healthy handles healthy check requests.
@@ -271,19 +280,34 @@ func (s *Service) Delete(jobBase64Encoded bool) func(c *gin.Context) {
 	return h
 }
 
+// ProxyQuery proxies query requests to the query upstream.
 func (s *Service) ProxyQuery(c *gin.Context) {
-	if !s.queryEnable {
+	if !s.queryEnable || s.queryProxy == nil {
 		http.Error(c.Writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	s.queryProxy.ServeHTTP(c.Writer, c.Request)
+}
 
-	director := func(req *http.Request) {
-		req.Header.Add("X-Forwarded-Host", req.Host)
-		req.Header.Add("X-Origin-Host", s.queryAddr)
-		req.URL.Scheme = "http"
-		req.URL.Host = s.queryAddr
+// newQueryProxy creates the reverse proxy of the query upstream,
+// the upstream picks the replica of every request.
+func (s *Service) newQueryProxy(up *upstream.Upstream) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.Header.Add("X-Forwarded-Host", req.Host)
+		},
+		Transport: up,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			switch req.Context().Err() {
+			case context.DeadlineExceeded:
+				s.writeError(w, req.URL.Path, query.Errorf(query.ErrTimeout, "query timed out"))
+				return
+			case context.Canceled:
+				s.writeError(w, req.URL.Path, query.Errorf(query.ErrCanceled, "query canceled"))
+				return
+			}
+			s.logger.Error("query upstream", zap.String("path", req.URL.Path), zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
 	}
-
-	proxy := &httputil.ReverseProxy{Director: director}
-	proxy.ServeHTTP(c.Writer, c.Request)
 }
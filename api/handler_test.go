@@ -38,7 +38,7 @@ func TestSendHandler(t *testing.T) {
 	s, err := New(
 		prometheus.DefaultRegisterer,
 		config.APIConfiguration{Listen: ":9990", MaxBodySizeLimit: 1024 * 1024 * 10},
-		queue, ratelimit.NewUnlimited(), zap.NewExample())
+		queue, nil, nil, nil, nil, nil, ratelimit.NewUnlimited(), zap.NewExample())
 	if err != nil {
 		t.Fatal(err)
 	}
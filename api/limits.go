@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/promql"
+	"github.com/promcluster/proxy/pkg/query"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limit names of the limit exceeded metric.
+const (
+	limitQueryRange    = "maxQueryRange"
+	limitStep          = "minStep"
+	limitSeries        = "maxSeriesPerSelector"
+	limitResponseBytes = "maxResponseBytes"
+)
+
+// defaultLookbackTime is the prometheus lookback delta of instant selectors.
+const defaultLookbackTime = 5 * time.Minute
+
+// queryLimits enforces the query protection limits of the request's
+// tenant before the query reaches the backends.
+func (s *Service) queryLimits(c *gin.Context) {
+	l := s.limits.For(s.tenant(c))
+	if !s.queryEnable || l == (config.Limits{}) {
+		c.Next()
+		return
+	}
+
+	if err := parseFormKeepBody(c.Request); err != nil {
+		s.respondError(c, query.Errorf(query.ErrBadData, "%v", err))
+		c.Abort()
+		return
+	}
+	if l.QueryTimeout > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), l.QueryTimeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+	if err := s.checkLimits(c, l); err != nil {
+		s.respondError(c, err)
+		c.Abort()
+		return
+	}
+
+	if l.MaxResponseBytes <= 0 {
+		c.Next()
+		return
+	}
+	w := &limitedWriter{ResponseWriter: c.Writer, limit: l.MaxResponseBytes}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.exceeded {
+		queryLimitExceeded.WithLabelValues(limitResponseBytes).Inc()
+		// drop the headers of the discarded response.
+		for k := range w.Header() {
+			delete(w.Header(), k)
+		}
+		s.respondError(c, query.Errorf(query.ErrExecution,
+			"the response size exceeds the limit of %d bytes", l.MaxResponseBytes))
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.Status())
+	_, _ = w.ResponseWriter.Write(w.buf.Bytes())
+}
+
+// checkLimits checks the time range, step and selected series of the request.
+func (s *Service) checkLimits(c *gin.Context, l config.Limits) error {
+	form := c.Request.Form
+	now := time.Now()
+	start, end := now, now
+	var err error
+	if v := form.Get("start"); v != "" {
+		if start, err = query.ParseTime(v); err != nil {
+			return query.Errorf(query.ErrBadData, "invalid parameter \"start\": %v", err)
+		}
+	}
+	if v := form.Get("end"); v != "" {
+		if end, err = query.ParseTime(v); err != nil {
+			return query.Errorf(query.ErrBadData, "invalid parameter \"end\": %v", err)
+		}
+	}
+	if v := form.Get("time"); v != "" && c.FullPath() == "/api/v1/query" {
+		if start, err = query.ParseTime(v); err != nil {
+			return query.Errorf(query.ErrBadData, "invalid parameter \"time\": %v", err)
+		}
+		end = start
+	}
+
+	if c.FullPath() != "/api/v1/query" && l.MaxQueryRange > 0 && form.Get("start") != "" {
+		if length := end.Sub(start); length > l.MaxQueryRange {
+			queryLimitExceeded.WithLabelValues(limitQueryRange).Inc()
+			return query.Errorf(query.ErrBadData,
+				"the query time range exceeds the limit (query length: %s, limit: %s)", length, l.MaxQueryRange)
+		}
+	}
+	if c.FullPath() == "/api/v1/query_range" && l.MinStep > 0 {
+		step, err := query.ParseDuration(form.Get("step"))
+		if err != nil {
+			return query.Errorf(query.ErrBadData, "invalid parameter \"step\": %v", err)
+		}
+		if step < l.MinStep {
+			queryLimitExceeded.WithLabelValues(limitStep).Inc()
+			return query.Errorf(query.ErrBadData, "the query step %s is below the minimum step %s", step, l.MinStep)
+		}
+	}
+
+	if c.FullPath() == "/api/v1/series" || l.MaxSeriesPerSelector <= 0 || s.querier == nil {
+		return nil
+	}
+	return s.checkSeries(c.Request.Context(), form.Get("query"), start, end, l.MaxSeriesPerSelector)
+}
+
+// checkSeries looks up the series of every selector of the query
+// between start and end, and fails if any selects more than limit series.
+func (s *Service) checkSeries(ctx context.Context, q string, start, end time.Time, limit int) error {
+	e, err := promql.ParseExpr(q)
+	if err != nil {
+		// invalid queries are left to the backends to report.
+		return nil
+	}
+
+	type window struct{ start, end time.Time }
+	selectors := map[string]window{}
+	add := func(vs *promql.VectorSelector, rng time.Duration) {
+		sel := (&promql.VectorSelector{Name: vs.Name, Matchers: vs.Matchers}).String()
+		w := window{
+			start: start.Add(-vs.Offset - rng - defaultLookbackTime),
+			end:   end.Add(-vs.Offset),
+		}
+		if prev, ok := selectors[sel]; ok {
+			if prev.start.Before(w.start) {
+				w.start = prev.start
+			}
+			if prev.end.After(w.end) {
+				w.end = prev.end
+			}
+		}
+		selectors[sel] = w
+	}
+	promql.Inspect(e, func(n promql.Expr) bool {
+		switch n := n.(type) {
+		case *promql.VectorSelector:
+			add(n, 0)
+		case *promql.MatrixSelector:
+			add(&promql.VectorSelector{Name: n.Name, Matchers: n.Matchers, Offset: n.Offset}, n.Range)
+		}
+		return true
+	})
+
+	for sel, w := range selectors {
+		series, _, err := s.querier.Series(ctx, url.Values{
+			"match[]": []string{sel},
+			"start":   []string{formatTime(w.start)},
+			"end":     []string{formatTime(w.end)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(series) > limit {
+			queryLimitExceeded.WithLabelValues(limitSeries).Inc()
+			return query.Errorf(query.ErrExecution,
+				"the selector %s selects %d series, exceeding the limit of %d", sel, len(series), limit)
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
+
+// parseFormKeepBody parses the request form, keeping the body of POST
+// forms so that it can still be proxied.
+func parseFormKeepBody(r *http.Request) error {
+	if r.Body == nil || r.Method != http.MethodPost {
+		return r.ParseForm()
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	err = r.ParseForm()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return err
+}
+
+// limitedWriter buffers a response of up to limit bytes, the rest of
+// a larger response is discarded.
+type limitedWriter struct {
+	gin.ResponseWriter
+	limit    int
+	buf      bytes.Buffer
+	status   int
+	exceeded bool
+}
+
+func (w *limitedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *limitedWriter) WriteHeaderNow() {}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.exceeded {
+		return len(b), nil
+	}
+	if w.buf.Len()+len(b) > w.limit {
+		w.exceeded = true
+		w.buf = bytes.Buffer{}
+		return len(b), nil
+	}
+	return w.buf.Write(b)
+}
+
+func (w *limitedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *limitedWriter) Flush() {}
+
+func (w *limitedWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *limitedWriter) Size() int {
+	return w.buf.Len()
+}
+
+func (w *limitedWriter) Written() bool {
+	return w.status != 0
+}
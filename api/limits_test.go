@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/query"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type staticTargets []string
+
+func (t staticTargets) Addrs() []string { return t }
+
+// newFanoutService returns a fan-out service over a fake backend
+// holding series up{instance="0"} to up{instance="<n-1>"}.
+func newFanoutService(t *testing.T, n int, limits config.LimitsConfiguration) *Service {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var series, samples []string
+		for i := 0; i < n; i++ {
+			series = append(series, fmt.Sprintf(`{"__name__":"up","instance":"%d"}`, i))
+			samples = append(samples, fmt.Sprintf(`{"metric":{"instance":"%d"},"value":[1,"1"]}`, i))
+		}
+		if r.URL.Path == "/api/v1/series" {
+			fmt.Fprintf(w, `{"status":"success","data":[%s]}`, strings.Join(series, ","))
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, strings.Join(samples, ","))
+	}))
+	t.Cleanup(backend.Close)
+
+	s := &Service{
+		router:      gin.New(),
+		queryEnable: true,
+		queryMode:   config.QueryModeFanout,
+		querier:     query.NewQuerier(prometheus.NewRegistry(), staticTargets{backend.URL}, time.Second, false, nil, zap.NewNop()),
+		limits:      limits,
+		logger:      zap.NewNop(),
+	}
+	// the tenant header of the test requests is trusted.
+	s.tenantSources, _ = parseNetworks([]string{"192.0.2.1"})
+	s.initHandler()
+	return s
+}
+
+func TestQueryLimits(t *testing.T) {
+	s := newFanoutService(t, 3, config.LimitsConfiguration{
+		Limits: config.Limits{
+			MaxQueryRange:        24 * time.Hour,
+			MinStep:              time.Minute,
+			MaxSeriesPerSelector: 2,
+		},
+		Overrides: map[string]config.Limits{
+			"big":   {MaxSeriesPerSelector: 10},
+			"small": {MaxSeriesPerSelector: 10, MaxResponseBytes: 50},
+		},
+	})
+
+	cases := []struct {
+		url    string
+		tenant string
+		code   int
+		error  string
+	}{
+		{"/api/v1/query_range?query=sum(up)&start=0&end=172800&step=60", "", 400, "time range exceeds"},
+		{"/api/v1/query_range?query=sum(up)&start=0&end=3600&step=15", "", 400, "minimum step"},
+		{"/api/v1/query?query=sum(up)", "", 422, "selects 3 series"},
+		{"/api/v1/series?match[]=up&start=0&end=172800", "", 400, "time range exceeds"},
+		{"/api/v1/query?query=sum(up)", "small", 422, "response size exceeds"},
+		{"/api/v1/query?query=sum(up)", "big", 200, ""},
+		// the header of an untrusted client does not pick the limits.
+		{"/api/v1/query?query=sum(up)", "untrusted:big", 422, "selects 3 series"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		if strings.HasPrefix(c.tenant, "untrusted:") {
+			req.RemoteAddr = "203.0.113.7:1234"
+			c.tenant = strings.TrimPrefix(c.tenant, "untrusted:")
+		}
+		if c.tenant != "" {
+			req.Header.Set(tenantHeader, c.tenant)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s: got status %d, want %d: %s", c.url, rec.Code, c.code, rec.Body)
+			continue
+		}
+		if c.error != "" && !strings.Contains(rec.Body.String(), c.error) {
+			t.Errorf("%s: unexpected body %s", c.url, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// default interval between two sweeps of stale lockout entries.
+var lockoutSweepInterval = time.Minute
+
+// lockout tracks failed authentication attempts per client IP and
+// temporarily refuses clients which fail too often.
+//
+// A client is locked out once it reaches threshold failures within window.
+// Every further lockout of the same client doubles the lockout duration,
+// up to maxDuration.
+type lockout struct {
+	threshold   int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*clientFailures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type clientFailures struct {
+	failures    int
+	firstFailed time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// newLockout creates a lockout, it is disabled if threshold is less than 1.
+func newLockout(threshold int, window, duration, maxDuration time.Duration) *lockout {
+	if window <= 0 {
+		window = duration
+	}
+	if maxDuration < duration {
+		maxDuration = duration
+	}
+	return &lockout{
+		threshold:   threshold,
+		window:      window,
+		duration:    duration,
+		maxDuration: maxDuration,
+		clients:     make(map[string]*clientFailures),
+		now:         time.Now,
+	}
+}
+
+func (l *lockout) enabled() bool {
+	return l != nil && l.threshold > 0 && l.duration > 0
+}
+
+// locked reports whether ip is locked out and for how long.
+func (l *lockout) locked(ip string) (bool, time.Duration) {
+	if !l.enabled() {
+		return false, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	if !ok {
+		return false, 0
+	}
+	left := c.lockedUntil.Sub(l.now())
+	if left <= 0 {
+		return false, 0
+	}
+	return true, left
+}
+
+// fail records a failed attempt of ip, it returns the lockout duration
+// if this attempt locked the client out.
+func (l *lockout) fail(ip string) time.Duration {
+	if !l.enabled() {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientFailures{}
+		l.clients[ip] = c
+	}
+	if c.failures == 0 || now.Sub(c.firstFailed) > l.window {
+		c.failures = 0
+		c.firstFailed = now
+	}
+	c.failures++
+	if c.failures < l.threshold {
+		return 0
+	}
+
+	d := l.duration << uint(c.lockouts)
+	if d > l.maxDuration || d <= 0 {
+		d = l.maxDuration
+	}
+	c.lockouts++
+	c.failures = 0
+	c.lockedUntil = now.Add(d)
+	return d
+}
+
+// succeed forgets the failures of ip.
+func (l *lockout) succeed(ip string) {
+	if !l.enabled() {
+		return
+	}
+	l.mu.Lock()
+	delete(l.clients, ip)
+	l.mu.Unlock()
+}
+
+// need l.mu.Lock() before calling
+func (l *lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < lockoutSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, c := range l.clients {
+		// keep the lockout history until the longest lockout could pass.
+		if now.After(c.lockedUntil.Add(l.maxDuration)) && now.Sub(c.firstFailed) > l.window {
+			delete(l.clients, ip)
+		}
+	}
+}
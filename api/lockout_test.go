@@ -0,0 +1,127 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newLockout(3, time.Minute, time.Minute, 3*time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if d := l.fail("10.0.0.1"); d != 0 {
+			t.Fatalf("locked out after %d failures", i+1)
+		}
+	}
+	if d := l.fail("10.0.0.1"); d != time.Minute {
+		t.Fatalf("got lockout %v, want %v", d, time.Minute)
+	}
+	if locked, _ := l.locked("10.0.0.1"); !locked {
+		t.Fatal("client should be locked out")
+	}
+	if locked, _ := l.locked("10.0.0.2"); locked {
+		t.Fatal("other client should not be locked out")
+	}
+
+	// the second lockout doubles, the third is capped.
+	now = now.Add(2 * time.Minute)
+	if locked, _ := l.locked("10.0.0.1"); locked {
+		t.Fatal("lockout should expire")
+	}
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		var d time.Duration
+		for i := 0; i < 3; i++ {
+			d = l.fail("10.0.0.1")
+		}
+		if d != want {
+			t.Fatalf("got lockout %v, want %v", d, want)
+		}
+	}
+
+	l.succeed("10.0.0.1")
+	if locked, _ := l.locked("10.0.0.1"); locked {
+		t.Fatal("success should reset the client")
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newLockout(2, time.Minute, time.Minute, 0)
+	l.now = func() time.Time { return now }
+
+	l.fail("10.0.0.1")
+	now = now.Add(2 * time.Minute)
+	if d := l.fail("10.0.0.1"); d != 0 {
+		t.Fatal("failures outside of the window should not count")
+	}
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	l := newLockout(0, 0, 0, 0)
+	for i := 0; i < 100; i++ {
+		if d := l.fail("10.0.0.1"); d != 0 {
+			t.Fatal("disabled lockout should never lock")
+		}
+	}
+}
+
+func TestAuthClientIP(t *testing.T) {
+	viper.Set("auth.user", "prom")
+	viper.Set("auth.token", "secret")
+	defer viper.Set("auth.token", "")
+	nets, err := parseNetworks([]string{"10.0.0.0/8", "192.168.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{
+		router:         gin.New(),
+		lockout:        newLockout(1, time.Minute, time.Minute, 0),
+		trustedProxies: nets,
+		logger:         zap.NewNop(),
+		auditLogger:    zap.NewNop(),
+	}
+	s.router.Use(s.auth)
+	s.router.GET("/", func(c *gin.Context) {})
+	get := func(remote, xff, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// an untrusted client cannot dodge its lockout with a forged header.
+	get("203.0.113.7:1234", "198.51.100.1", "wrong")
+	if code := get("203.0.113.7:1234", "198.51.100.2", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d with a rotated X-Forwarded-For, want 429", code)
+	}
+	// nor lock a victim out by naming it.
+	if code := get("192.168.0.1:1234", "198.51.100.1", "secret"); code != http.StatusOK {
+		t.Errorf("got status %d for the forged client, want 200", code)
+	}
+
+	// the client behind a trusted proxy is locked out, not the proxy.
+	get("10.1.2.3:1234", "198.51.100.3, 10.9.9.9", "wrong")
+	if code := get("10.1.2.3:1234", "198.51.100.3", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d for the locked out client, want 429", code)
+	}
+	if code := get("10.1.2.3:1234", "198.51.100.4", "secret"); code != http.StatusOK {
+		t.Errorf("got status %d for another client of the proxy, want 200", code)
+	}
+
+	if _, err := parseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR should fail")
+	}
+}
@@ -49,4 +49,50 @@ var (
 		},
 		[]string{"method"},
 	)
+
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "auth_failures_total",
+			Help:      "The number of rejected authentication attempts by reason.",
+		},
+		[]string{"reason"},
+	)
+	authLockouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "auth_lockouts_total",
+			Help:      "The number of client IPs locked out after repeated authentication failures.",
+		},
+	)
+	tenantQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tenant_queries_total",
+			Help:      "The number of read requests by tenant, path and status code.",
+		},
+		[]string{"tenant", "path", "code"},
+	)
+	tenantQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tenant_query_duration_seconds",
+			Help:      "The read request latencies in seconds by tenant and path.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"tenant", "path"},
+	)
+	queryLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_limit_exceeded_total",
+			Help:      "The number of queries rejected by limit.",
+		},
+		[]string{"limit"},
+	)
 )
@@ -1,19 +1,145 @@
 package api
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 )
 
+// auth failure reasons.
+const (
+	authNoTokenConfigured = "noTokenConfigured"
+	authMissingCredential = "missingCredential"
+	authInvalidBearer     = "invalidBearerToken"
+	authInvalidBasicAuth  = "invalidBasicAuth"
+	authLockedOut         = "lockedOut"
+	authNotAdmin          = "notAdmin"
+)
+
+// ctxUserKey is the gin context key of the authenticated user.
+const ctxUserKey = "proxy.user"
+
+// tenantHeader names the tenant of a request.
+const tenantHeader = "X-Scope-OrgID"
+
+// tenant returns the tenant of the request: the authenticated user, or
+// the tenant header of the admin and the trusted tenant header sources.
+// The header of other clients is ignored, lest they pick the limits and
+// the share of another tenant.
+func (s *Service) tenant(c *gin.Context) string {
+	user := c.GetString(ctxUserKey)
+	if t := strings.TrimSpace(c.GetHeader(tenantHeader)); t != "" &&
+		(user == adminUser || s.tenantSource(c.Request)) {
+		return t
+	}
+	return user
+}
+
+// tenantSource reports whether the connection of a request comes from a
+// trusted tenant header source.
+func (s *Service) tenantSource(r *http.Request) bool {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(r.RemoteAddr)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range s.tenantSources {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request: the host of
+// the connection, or the X-Forwarded-For address closest to the proxy
+// which is not itself a trusted proxy if the connection comes from one.
+// The headers set by other clients are ignored, as they can be forged.
+func (s *Service) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(r.RemoteAddr)
+	}
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !s.trustedProxy(hop) {
+			return hop
+		}
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is in the trusted proxy networks.
+func (s *Service) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range s.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses CIDRs or single IP addresses.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 func (s *Service) auth(c *gin.Context) {
+	ip := s.clientIP(c.Request)
+	if locked, left := s.lockout.locked(ip); locked {
+		s.authFailed(c, "", authLockedOut)
+		c.Header("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
 	confUser := strings.TrimSpace(viper.GetString("auth.user"))
 	confToken := strings.TrimSpace(viper.GetString("auth.token"))
 
 	if confToken == "" {
+		s.authFailed(c, "", authNoTokenConfigured)
 		c.AbortWithStatus(401)
 		return
 	}
@@ -21,24 +147,66 @@ func (s *Service) auth(c *gin.Context) {
 	token := strings.TrimSpace(c.Request.Header.Get("Authorization"))
 
 	// Bearer Token support
-	if token == fmt.Sprintf("Bearer %s", confToken) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+confToken)) == 1 {
+		s.lockout.succeed(ip)
+		c.Set(ctxUserKey, confUser)
+		c.Next()
+		return
+	}
+
+	// the admin token only authenticates the admin API.
+	if strings.HasPrefix(c.Request.URL.Path, adminPrefix) && s.isAdmin(c) {
+		s.lockout.succeed(ip)
+		c.Set(ctxUserKey, adminUser)
 		c.Next()
 		return
 	}
 
 	// Basic Auth support
-	if u, p, ok := c.Request.BasicAuth(); ok && confToken == p && confUser == u {
+	u, p, ok := c.Request.BasicAuth()
+	if ok && subtle.ConstantTimeCompare([]byte(p), []byte(confToken))&
+		subtle.ConstantTimeCompare([]byte(u), []byte(confUser)) == 1 {
+		s.lockout.succeed(ip)
+		c.Set(ctxUserKey, u)
 		c.Next()
 		return
 	}
 
+	reason := authInvalidBasicAuth
+	switch {
+	case token == "":
+		reason = authMissingCredential
+	case strings.HasPrefix(token, "Bearer "):
+		reason = authInvalidBearer
+	}
+	s.authFailed(c, u, reason)
+	if d := s.lockout.fail(ip); d > 0 {
+		s.auditLogger.Warn("client locked out",
+			zap.String("ip", ip),
+			zap.String("user", u),
+			zap.Duration("duration", d))
+		authLockouts.Inc()
+	}
 	c.AbortWithStatus(401)
 }
 
+// authFailed records an audit event for a rejected request.
+func (s *Service) authFailed(c *gin.Context, user, reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+	s.auditLogger.Warn("authentication failed",
+		zap.String("user", user),
+		zap.String("ip", s.clientIP(c.Request)),
+		zap.String("method", c.Request.Method),
+		zap.String("route", c.FullPath()),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("userAgent", c.Request.UserAgent()),
+		zap.String("reason", reason))
+}
+
 func (s *Service) accessLog() gin.HandlerFunc {
 	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-			param.ClientIP,
+			s.clientIP(param.Request),
 			param.TimeStamp.Format(time.RFC1123),
 			param.Method,
 			param.Path,
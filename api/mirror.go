@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/mirror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mirrorQuery replays a sample of the read requests to the mirror
+// upstream, once the primary response is written.
+func (s *Service) mirrorQuery(c *gin.Context) {
+	if s.mirror == nil || !s.mirror.Sample() {
+		c.Next()
+		return
+	}
+	arrival := time.Now()
+	if err := parseFormKeepBody(c.Request); err != nil {
+		c.Next()
+		return
+	}
+	// instant queries are evaluated by the mirror at the arrival time of
+	// the primary request, and by the fanout querier as well. The time is
+	// added to the URL of the request too, the query upstream is sent the
+	// original request in proxy mode.
+	if c.Request.URL.Path == "/api/v1/query" && c.Request.Form.Get("time") == "" {
+		ms := arrival.UnixNano() / int64(time.Millisecond)
+		t := strconv.FormatFloat(float64(ms)/1e3, 'f', -1, 64)
+		c.Request.Form.Set("time", t)
+		q := c.Request.URL.Query()
+		q.Set("time", t)
+		c.Request.URL.RawQuery = q.Encode()
+	}
+	form := make(url.Values, len(c.Request.Form))
+	for k, v := range c.Request.Form {
+		form[k] = v
+	}
+
+	w := &teeWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.overflow {
+		return
+	}
+
+	body := w.buf.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return
+		}
+	}
+	s.mirror.Send(&mirror.Request{
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Form:   form,
+		Header: c.Request.Header.Clone(),
+		Status: w.Status(),
+		Body:   body,
+	})
+}
+
+// teeWriter keeps a copy of a response of up to mirror.MaxResponseBytes.
+type teeWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(b) > mirror.MaxResponseBytes {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
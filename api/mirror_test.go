@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/mirror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestMirrorQueryTime(t *testing.T) {
+	times := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times <- r.FormValue("time")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	s := newFanoutService(t, 1, config.LimitsConfiguration{})
+	m, err := mirror.New(prometheus.NewRegistry(), mirror.Config{Addr: upstream.URL, SampleRatio: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mirror = m
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	select {
+	case ts := <-times:
+		f, err := strconv.ParseFloat(ts, 64)
+		if err != nil {
+			t.Fatalf("got mirrored time %q, want the arrival time", ts)
+		}
+		arrival := time.Unix(0, int64(math.Round(f*1e3))*int64(time.Millisecond))
+		if arrival.Before(start.Truncate(time.Millisecond)) || arrival.After(time.Now()) {
+			t.Fatalf("got mirrored time %v, want the arrival time after %v", arrival, start)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+}
+
+func TestMirrorQueryTimeProxyMode(t *testing.T) {
+	primaryTimes, mirrorTimes := make(chan string, 1), make(chan string, 1)
+	handler := func(times chan string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			times <- r.FormValue("time")
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+		}
+	}
+	primary := httptest.NewServer(handler(primaryTimes))
+	defer primary.Close()
+	upstream := httptest.NewServer(handler(mirrorTimes))
+	defer upstream.Close()
+
+	u, err := url.Parse(primary.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mirror.New(prometheus.NewRegistry(), mirror.Config{Addr: upstream.URL, SampleRatio: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{
+		router:      gin.New(),
+		queryEnable: true,
+		queryMode:   config.QueryModeProxy,
+		queryProxy:  httputil.NewSingleHostReverseProxy(u),
+		mirror:      m,
+		logger:      zap.NewNop(),
+	}
+	s.initHandler()
+	// the reverse proxy needs a real connection.
+	proxy := httptest.NewServer(s.router)
+	defer proxy.Close()
+
+	// the query upstream is sent the time the mirror evaluates at.
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		var (
+			resp *http.Response
+			err  error
+		)
+		if method == http.MethodGet {
+			resp, err = http.Get(proxy.URL + "/api/v1/query?query=up")
+		} else {
+			resp, err = http.Post(proxy.URL+"/api/v1/query", "application/x-www-form-urlencoded", strings.NewReader("query=up"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", method, resp.StatusCode)
+		}
+		var pt, mt string
+		for _, c := range []struct {
+			times chan string
+			ts    *string
+		}{{primaryTimes, &pt}, {mirrorTimes, &mt}} {
+			select {
+			case *c.ts = <-c.times:
+			case <-time.After(time.Second):
+				t.Fatalf("%s: request not received", method)
+			}
+		}
+		if pt == "" || pt != mt {
+			t.Fatalf("%s: got primary time %q and mirrored time %q, want the same arrival time", method, pt, mt)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/query"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// fanoutEnabled reports whether reads are answered by the fan-out querier.
+func (s *Service) fanoutEnabled() bool {
+	return s.queryMode == config.QueryModeFanout && s.querier != nil
+}
+
+// FanoutQuery handles instant and range queries by sending them to
+// every backend and merging the results.
+func (s *Service) FanoutQuery(rangeQuery bool) func(c *gin.Context) {
+	h := func(c *gin.Context) {
+		if !s.parseQueryForm(c) {
+			return
+		}
+
+		var (
+			data     *query.QueryData
+			warnings []string
+			err      error
+		)
+		if rangeQuery {
+			data, warnings, err = s.querier.QueryRange(c.Request.Context(), c.Request.Form)
+		} else {
+			data, warnings, err = s.querier.Query(c.Request.Context(), c.Request.Form)
+		}
+		if err != nil {
+			s.respondError(c, err)
+			return
+		}
+		s.respond(c, data, warnings)
+	}
+	return h
+}
+
+// FrontendQueryRange handles range queries through the query frontend,
+// which splits them into cached sub-queries. The header of the request is
+// forwarded to the query upstream.
+func (s *Service) FrontendQueryRange(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	ctx := query.WithHeader(c.Request.Context(), c.Request.Header)
+	data, warnings, err := s.frontend.QueryRange(ctx, s.tenant(c), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// FanoutSeries handles series requests by merging the series of every backend.
+func (s *Service) FanoutSeries(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	data, warnings, err := s.querier.Series(c.Request.Context(), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// FanoutLabels handles label names requests by merging the names of every backend.
+func (s *Service) FanoutLabels(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	data, warnings, err := s.querier.LabelNames(c.Request.Context(), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// FanoutLabelValues handles label values requests by merging the values of every backend.
+func (s *Service) FanoutLabelValues(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	data, warnings, err := s.querier.LabelValues(c.Request.Context(), c.Param("name"), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// FanoutRules handles rules requests by merging the rule groups of every
+// backend. Rules are evaluated by the backends, so they are fanned out in
+// both query modes.
+func (s *Service) FanoutRules(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	data, warnings, err := s.querier.Rules(c.Request.Context(), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// FanoutAlerts handles alerts requests by merging the alerts of every backend.
+func (s *Service) FanoutAlerts(c *gin.Context) {
+	if !s.parseQueryForm(c) {
+		return
+	}
+	data, warnings, err := s.querier.Alerts(c.Request.Context(), c.Request.Form)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, data, warnings)
+}
+
+// parseQueryForm parses the request parameters of a read request,
+// it writes the error response and returns false on failure.
+func (s *Service) parseQueryForm(c *gin.Context) bool {
+	if !s.queryEnable {
+		http.Error(c.Writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		s.respondError(c, query.Errorf(query.ErrBadData, "%v", err))
+		return false
+	}
+	return true
+}
+
+// respond writes a successful Prometheus API response.
+func (s *Service) respond(c *gin.Context, data interface{}, warnings []string) {
+	b, err := json.Marshal(&struct {
+		Status   string      `json:"status"`
+		Data     interface{} `json:"data"`
+		Warnings []string    `json:"warnings,omitempty"`
+	}{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+	})
+	if err != nil {
+		s.respondError(c, query.Errorf(query.ErrInternal, "%v", err))
+		return
+	}
+	c.Data(http.StatusOK, "application/json", b)
+}
+
+// respondError writes a Prometheus API error response.
+func (s *Service) respondError(c *gin.Context, err error) {
+	s.writeError(c.Writer, c.Request.URL.Path, err)
+}
+
+// writeError writes a Prometheus API error response to w.
+func (s *Service) writeError(w http.ResponseWriter, path string, err error) {
+	e, ok := err.(*query.Error)
+	if !ok {
+		e = query.Errorf(query.ErrInternal, "%v", err)
+	}
+
+	var code int
+	switch e.Type {
+	case query.ErrBadData:
+		code = http.StatusBadRequest
+	case query.ErrExecution:
+		code = 422
+	case query.ErrCanceled, query.ErrTimeout, query.ErrUnavailable:
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusInternalServerError
+	}
+	if code != http.StatusBadRequest {
+		s.logger.Error("query", zap.String("path", path), zap.Error(err))
+	}
+
+	b, _ := json.Marshal(&query.Response{
+		Status:    "error",
+		ErrorType: e.Type,
+		Error:     e.Msg,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// respondPlainError writes the error of a non JSON API as plain text.
+func (s *Service) respondPlainError(c *gin.Context, op string, err error) {
+	code := http.StatusInternalServerError
+	if e, ok := err.(*query.Error); ok {
+		switch e.Type {
+		case query.ErrBadData:
+			code = http.StatusBadRequest
+		case query.ErrCanceled, query.ErrTimeout, query.ErrUnavailable:
+			code = http.StatusServiceUnavailable
+		}
+	}
+	if code != http.StatusBadRequest {
+		s.logger.Error(op, zap.Error(err))
+	}
+	http.Error(c.Writer, err.Error(), code)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/query"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// queryLog accounts every read request to its tenant, and logs the
+// requests taking at least the slow query threshold to the query log.
+func (s *Service) queryLog(c *gin.Context) {
+	if !s.queryEnable {
+		c.Next()
+		return
+	}
+	if c.Request.Method == http.MethodGet || c.ContentType() == "application/x-www-form-urlencoded" {
+		// errors are left to the handlers to report.
+		_ = parseFormKeepBody(c.Request)
+	}
+	ctx, stats := query.WithStats(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+
+	start := time.Now()
+	c.Next()
+	latency := time.Since(start)
+
+	t, path, status := s.tenant(c), c.FullPath(), c.Writer.Status()
+	tenantQueries.WithLabelValues(t, path, strconv.Itoa(status)).Inc()
+	tenantQueryDuration.WithLabelValues(t, path).Observe(latency.Seconds())
+
+	if s.queryLogger == nil || latency < s.slowQueryThreshold {
+		return
+	}
+	form := c.Request.Form
+	q := form.Get("query")
+	if q == "" {
+		q = strings.Join(form["match[]"], ",")
+	}
+	size := c.Writer.Size()
+	if size < 0 {
+		size = 0
+	}
+	s.queryLogger.Info("query",
+		zap.String("tenant", t),
+		zap.String("user", c.GetString(ctxUserKey)),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("query", q),
+		zap.String("start", form.Get("start")),
+		zap.String("end", form.Get("end")),
+		zap.String("time", form.Get("time")),
+		zap.String("step", form.Get("step")),
+		zap.Strings("shards", stats.Shards()),
+		zap.Int("responseBytes", size),
+		zap.Int("status", status),
+		zap.Duration("latency", latency),
+	)
+}
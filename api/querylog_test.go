@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestQueryLog(t *testing.T) {
+	s := newFanoutService(t, 1, config.LimitsConfiguration{})
+	core, logs := observer.New(zapcore.InfoLevel)
+	s.queryLogger = zap.New(core)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1", nil)
+	req.Header.Set(tenantHeader, "team-a")
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d records, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["tenant"] != "team-a" || fields["query"] != "up" || fields["time"] != "1" {
+		t.Fatalf("unexpected record %v", fields)
+	}
+	if shards, ok := fields["shards"].([]interface{}); !ok || len(shards) != 1 {
+		t.Fatalf("unexpected shards %v", fields["shards"])
+	}
+	if fields["responseBytes"] != int64(rec.Body.Len()) || fields["status"] != int64(http.StatusOK) {
+		t.Fatalf("unexpected record %v", fields)
+	}
+
+	// faster requests are not logged.
+	s.slowQueryThreshold = time.Hour
+	s.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	if n := logs.Len(); n != 1 {
+		t.Fatalf("got %d records, want 1", n)
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/promcluster/proxy/pkg/query"
+	"github.com/promcluster/proxy/pkg/remote"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+// RemoteRead handles prometheus remote read requests by reading from
+// every backend and merging the series.
+func (s *Service) RemoteRead(c *gin.Context) {
+	if !s.queryEnable || s.querier == nil {
+		http.Error(c.Writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if s.bodySizeLimit > 0 && c.Request.ContentLength > int64(s.bodySizeLimit) {
+		http.Error(c.Writer, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req remote.ReadRequest
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	streamed := false
+	for _, t := range req.AcceptedResponseTypes {
+		if t == remote.StreamedXORChunks {
+			streamed = true
+			break
+		}
+		if t == remote.Samples {
+			break
+		}
+	}
+	if streamed {
+		s.remoteReadStreamed(c, &req)
+		return
+	}
+	s.remoteReadSamples(c, &req)
+}
+
+// remoteReadSamples answers with a snappy compressed ReadResponse.
+func (s *Service) remoteReadSamples(c *gin.Context, req *remote.ReadRequest) {
+	resp := prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for i := range resp.Results {
+		resp.Results[i] = &prompb.QueryResult{}
+	}
+	err := s.querier.RemoteRead(c.Request.Context(), req, func(i int, cs *remote.ChunkedSeries) error {
+		q := req.Queries[i]
+		ts, err := remote.ToTimeSeries(cs, q.StartTimestampMs, q.EndTimestampMs)
+		if err != nil {
+			return query.Errorf(query.ErrInternal, "decode chunks: %v", err)
+		}
+		resp.Results[i].Timeseries = append(resp.Results[i].Timeseries, ts)
+		return nil
+	})
+	if err != nil {
+		s.respondPlainError(c, "remote read", err)
+		return
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Header("Content-Encoding", "snappy")
+	c.Data(http.StatusOK, "application/x-protobuf", snappy.Encode(nil, data))
+}
+
+// remoteReadStreamed streams ChunkedReadResponse frames as the series
+// are merged, a frame holds the series of a single query up to
+// remote.DefaultMaxFrameBytes.
+func (s *Service) remoteReadStreamed(c *gin.Context, req *remote.ReadRequest) {
+	w := remote.NewChunkedWriter(c.Writer, c.Writer)
+	var (
+		frame   remote.ChunkedReadResponse
+		size    int
+		started bool
+	)
+	flush := func() error {
+		if len(frame.ChunkedSeries) == 0 {
+			return nil
+		}
+		b, err := frame.Marshal()
+		if err != nil {
+			return err
+		}
+		if !started {
+			c.Header("Content-Type", remote.StreamedContentType)
+			c.Writer.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		frame.ChunkedSeries, size = frame.ChunkedSeries[:0], 0
+		return nil
+	}
+
+	err := s.querier.RemoteRead(c.Request.Context(), req, func(i int, cs *remote.ChunkedSeries) error {
+		if int64(i) != frame.QueryIndex {
+			if err := flush(); err != nil {
+				return err
+			}
+			frame.QueryIndex = int64(i)
+		}
+		frame.ChunkedSeries = append(frame.ChunkedSeries, cs)
+		size += cs.Size()
+		if size >= remote.DefaultMaxFrameBytes {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		if !started {
+			c.Header("Content-Type", remote.StreamedContentType)
+			c.Writer.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+	if started {
+		// the response is already on its way, the client sees a truncated stream.
+		s.logger.Error("remote read", zap.Error(err))
+		return
+	}
+	s.respondPlainError(c, "remote read", err)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/promcluster/proxy/pkg/query"
+	"github.com/promcluster/proxy/pkg/scheduler"
+
+	"github.com/gin-gonic/gin"
+)
+
+// schedule runs the read request once the query scheduler grants its
+// tenant a slot, requests shed by the scheduler are rejected with 429.
+func (s *Service) schedule(c *gin.Context) {
+	if s.scheduler == nil {
+		c.Next()
+		return
+	}
+	t := s.tenant(c)
+	l := s.limits.For(t)
+	release, err := s.scheduler.Acquire(c.Request.Context(), t, l.MaxConcurrentQueries, l.QueryWeight)
+	switch err {
+	case nil:
+	case scheduler.ErrQueueFull, scheduler.ErrQueueTimeout:
+		b, _ := json.Marshal(&query.Response{
+			Status:    "error",
+			ErrorType: query.ErrUnavailable,
+			Error:     err.Error(),
+		})
+		c.Data(http.StatusTooManyRequests, "application/json", b)
+		c.Abort()
+		return
+	default:
+		s.respondError(c, query.Errorf(query.ErrCanceled, "query canceled while queued: %v", err))
+		c.Abort()
+		return
+	}
+	defer release()
+	c.Next()
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/scheduler"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSchedule(t *testing.T) {
+	s := newFanoutService(t, 1, config.LimitsConfiguration{
+		Overrides: map[string]config.Limits{"team-a": {MaxConcurrentQueries: 1}},
+	})
+	s.scheduler = scheduler.New(prometheus.NewRegistry(), scheduler.Config{MaxQueueWait: 10 * time.Millisecond})
+
+	release, err := s.scheduler.Acquire(context.Background(), "team-a", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	for tenant, code := range map[string]int{"team-a": http.StatusTooManyRequests, "team-b": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set(tenantHeader, tenant)
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s: got status %d, want %d: %s", tenant, rec.Code, code, rec.Body)
+		}
+	}
+}
@@ -5,9 +5,17 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
 
 	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/log"
+	"github.com/promcluster/proxy/pkg/mirror"
+	"github.com/promcluster/proxy/pkg/query"
 	pkgq "github.com/promcluster/proxy/pkg/queue"
+	"github.com/promcluster/proxy/pkg/scheduler"
+	"github.com/promcluster/proxy/pkg/upstream"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -39,10 +47,33 @@ type Service struct {
 	pushGatewayEnable bool
 
 	queryEnable bool
-	queryAddr   string
+	queryMode   string
+	querier     *query.Querier
+	frontend    *query.Frontend
+	queryProxy  *httputil.ReverseProxy
 
-	registerer prometheus.Registerer
-	logger     *zap.Logger
+	lockout *lockout
+	// trustedProxies may set the client address in X-Forwarded-For.
+	trustedProxies []*net.IPNet
+	// tenantSources may set the tenant header.
+	tenantSources []*net.IPNet
+	adminToken    string
+	ring          Ring
+	seriesRouter  SeriesRouter
+
+	seriesUsage  SeriesUsage
+	recentErrors *log.RecentErrors
+
+	limits    config.LimitsConfiguration
+	scheduler *scheduler.Scheduler
+	mirror    *mirror.Mirror
+
+	queryLogger        *zap.Logger
+	slowQueryThreshold time.Duration
+
+	registerer  prometheus.Registerer
+	logger      *zap.Logger
+	auditLogger *zap.Logger
 }
 
 // New returns an uninitialized HTTP service.
@@ -50,9 +81,14 @@ func New(
 	reg prometheus.Registerer,
 	conf config.APIConfiguration,
 	q pkgq.Queue,
+	qr *query.Querier,
+	fe *query.Frontend,
+	up *upstream.Upstream,
+	ring Ring,
+	router SeriesRouter,
 	r ratelimit.Limiter,
 	l *zap.Logger) (*Service, error) {
-	return &Service{
+	s := &Service{
 		addr:              conf.Listen,
 		bodySizeLimit:     conf.MaxBodySizeLimit,
 		router:            gin.New(),
@@ -61,10 +97,52 @@ func New(
 		limiter:           r,
 		pushGatewayEnable: conf.PushGatewayEnable,
 		queryEnable:       conf.QueryEnable,
-		queryAddr:         conf.QueryAddr,
-		registerer:        reg,
-		logger:            l.With(zap.String("service", "api")),
-	}, nil
+		queryMode:         conf.QueryMode,
+		querier:           qr,
+		frontend:          fe,
+		lockout: newLockout(
+			config.C.Auth.LockoutThreshold,
+			config.C.Auth.LockoutWindow,
+			config.C.Auth.LockoutDuration,
+			config.C.Auth.MaxLockoutDuration),
+		adminToken:   strings.TrimSpace(config.C.Auth.AdminToken),
+		ring:         ring,
+		seriesRouter: router,
+		limits:       config.C.Limits,
+		registerer:   reg,
+		logger:       l.With(zap.String("service", "api")),
+		auditLogger:  l.With(zap.String("service", "audit")),
+	}
+	nets, err := parseNetworks(config.C.Auth.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	s.trustedProxies = nets
+	if s.tenantSources, err = parseNetworks(config.C.Auth.TenantHeaderSources); err != nil {
+		return nil, err
+	}
+	if up != nil {
+		s.queryProxy = s.newQueryProxy(up)
+	}
+	if conf.QueryScheduler.Enable {
+		s.scheduler = scheduler.New(reg, conf.QueryScheduler)
+	}
+	if conf.QueryMirror.Enable {
+		m, err := mirror.New(reg, conf.QueryMirror, l)
+		if err != nil {
+			return nil, err
+		}
+		s.mirror = m
+	}
+	if conf.QueryLog.Enable {
+		ql, err := log.NewFileLogger(conf.QueryLog.Path, conf.QueryLog.MaxSizeBytes, conf.QueryLog.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		s.queryLogger = ql.With(zap.String("service", "query-log"))
+		s.slowQueryThreshold = conf.QueryLog.SlowQueryThreshold
+	}
+	return s, nil
 }
 
 // Start the server
@@ -114,25 +192,63 @@ func (s *Service) Close(ctx context.Context) error {
 
 func (s *Service) initHandler() {
 	s.router.GET("/-/healthy", s.Healthy)
+	s.router.GET("/", s.Status)
 
 	v1 := s.router.Group("/api/v1/")
 	// remote write API
 	v1.POST("prom/write", s.ServePromWrite)
 
 	// query proxy API
-	v1.GET("query", s.ProxyQuery)
-	v1.POST("query", s.ProxyQuery)
+	instantQuery, rangeQuery := s.ProxyQuery, s.ProxyQuery
+	if s.fanoutEnabled() {
+		instantQuery, rangeQuery = s.FanoutQuery(false), s.FanoutQuery(true)
+	}
+	if s.frontend != nil {
+		rangeQuery = s.FrontendQueryRange
+	}
+	// read requests are logged, mirrored and scheduled.
+	read := func(h ...gin.HandlerFunc) []gin.HandlerFunc {
+		return append([]gin.HandlerFunc{s.queryLog, s.mirrorQuery, s.schedule}, h...)
+	}
+	v1.GET("query", read(s.queryLimits, instantQuery)...)
+	v1.POST("query", read(s.queryLimits, instantQuery)...)
+
+	v1.GET("query_range", read(s.queryLimits, rangeQuery)...)
+	v1.POST("query_range", read(s.queryLimits, rangeQuery)...)
 
-	v1.GET("query_range", s.ProxyQuery)
-	v1.POST("query_range", s.ProxyQuery)
+	labelValues, series, labels := s.ProxyQuery, s.ProxyQuery, s.ProxyQuery
+	if s.fanoutEnabled() {
+		labelValues, series, labels = s.FanoutLabelValues, s.FanoutSeries, s.FanoutLabels
+	}
+	v1.GET("label/:name/values", read(labelValues)...)
+
+	v1.GET("series", read(s.queryLimits, series)...)
+	v1.POST("series", read(s.queryLimits, series)...)
+
+	v1.GET("labels", read(labels)...)
+	v1.POST("labels", read(labels)...)
+
+	if s.querier != nil {
+		v1.GET("rules", read(s.FanoutRules)...)
+		v1.GET("alerts", read(s.FanoutAlerts)...)
+	}
 
-	v1.GET("label/:name/values", s.ProxyQuery)
+	// remote read API, responses are not JSON and not mirrored.
+	v1.POST("read", s.queryLog, s.schedule, s.RemoteRead)
 
-	v1.GET("series", s.ProxyQuery)
-	v1.POST("series", s.ProxyQuery)
+	// federation API
+	s.router.GET("/federate", s.queryLog, s.schedule, s.Federate)
 
-	v1.GET("labels", s.ProxyQuery)
-	v1.POST("labels", s.ProxyQuery)
+	// admin API
+	admin := s.router.Group(adminPrefix, s.admin)
+	admin.GET("ring", s.AdminRing)
+	admin.GET("ring/lookup", s.AdminRingLookup)
+	admin.POST("endpoints/cordon", s.AdminCordon)
+	admin.POST("endpoints/uncordon", s.AdminUncordon)
+	admin.GET("queue", s.AdminQueue)
+	admin.POST("queue/pause", s.AdminQueuePause)
+	admin.POST("queue/resume", s.AdminQueueResume)
+	admin.POST("queue/purge", s.AdminQueuePurge)
 
 	// Handlers for pushing and deleting metrics.
 	pushAPIPath := "/metrics"
@@ -18,7 +18,7 @@ func TestService(t *testing.T) {
 	s, err := New(
 		prometheus.DefaultRegisterer,
 		config.APIConfiguration{Listen: ":9994"},
-		queue, ratelimit.NewUnlimited(), zap.NewExample())
+		queue, nil, nil, nil, nil, nil, ratelimit.NewUnlimited(), zap.NewExample())
 	if err != nil {
 		t.Fatal(err)
 	}
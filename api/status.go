@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/backend"
+	"github.com/promcluster/proxy/pkg/log"
+	pkgq "github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"go.uber.org/zap"
+)
+
+// SeriesUsage reports the series met and the series limit, such as the
+// filter.MetricsFilter.
+type SeriesUsage interface {
+	Usage() (count, limit uint64)
+}
+
+// ReportStatus adds the series usage and the recent errors to the status
+// page.
+func (s *Service) ReportStatus(series SeriesUsage, errs *log.RecentErrors) {
+	s.seriesUsage, s.recentErrors = series, errs
+}
+
+type statusData struct {
+	Generated time.Time
+	Build     [][2]string
+	Config    string
+
+	Endpoints []endpointStatus
+	Ring      *backend.RingStatus
+	// Imbalance is the largest ownership share over the even share.
+	Imbalance float64
+
+	Queue      *pkgq.Stats
+	QueueError string
+
+	SeriesCount, SeriesLimit uint64
+	SeriesUsage              float64
+
+	Errors []log.Entry
+}
+
+type endpointStatus struct {
+	Addr      string
+	State     string
+	Ownership float64
+	// Sent and Failed count the requests to the endpoint.
+	Sent, Failed float64
+	// ErrorRate is the share of failed requests.
+	ErrorRate float64
+}
+
+// Status serves the status page of the on-call engineers.
+func (s *Service) Status(c *gin.Context) {
+	d := statusData{
+		Generated: time.Now(),
+		Build: [][2]string{
+			{"Version", version.Version},
+			{"Revision", version.Revision},
+			{"Branch", version.Branch},
+			{"Build user", version.BuildUser},
+			{"Build date", version.BuildDate},
+			{"Go version", version.GoVersion},
+		},
+	}
+	conf, err := config.Redacted(config.C)
+	if err != nil {
+		conf = err.Error()
+	}
+	d.Config = conf
+
+	if s.ring != nil {
+		st := s.ring.RingStatus()
+		d.Ring = &st
+		d.Endpoints, d.Imbalance = endpointsStatus(st)
+	}
+	if qa, ok := s.queue.(pkgq.Admin); ok {
+		if st, err := qa.Stats(); err != nil {
+			d.QueueError = err.Error()
+		} else {
+			d.Queue = &st
+		}
+	}
+	if s.seriesUsage != nil {
+		d.SeriesCount, d.SeriesLimit = s.seriesUsage.Usage()
+		if d.SeriesLimit > 0 {
+			d.SeriesUsage = float64(d.SeriesCount) / float64(d.SeriesLimit)
+		}
+	}
+	if s.recentErrors != nil {
+		d.Errors = s.recentErrors.Entries()
+	}
+
+	var buf bytes.Buffer
+	if err := statusTemplate.Execute(&buf, d); err != nil {
+		s.logger.Error("render status page", zap.Error(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// endpointsStatus returns the endpoints of the ring with their request
+// counts, and the imbalance of the ring.
+func endpointsStatus(st backend.RingStatus) ([]endpointStatus, float64) {
+	sent := sumBy(backend.EndpointSendSuccess, "endpoint")
+	failed := sumBy(backend.EndpointSendFailed, "endpoint")
+
+	var (
+		res []endpointStatus
+		max float64
+	)
+	add := func(addr, state string, ownership float64) {
+		e := endpointStatus{Addr: addr, State: state, Ownership: ownership, Sent: sent[addr], Failed: failed[addr]}
+		if total := e.Sent + e.Failed; total > 0 {
+			e.ErrorRate = e.Failed / total
+		}
+		res = append(res, e)
+	}
+	// draining endpoints are still members of the ring.
+	states := make(map[string]string, len(st.Cordoned))
+	for _, e := range st.Cordoned {
+		states[e.Addr] = e.State
+	}
+	for _, m := range st.Members {
+		state, ok := states[m.Addr]
+		if !ok {
+			state = "active"
+		}
+		delete(states, m.Addr)
+		add(m.Addr, state, m.Ownership)
+		if m.Ownership > max {
+			max = m.Ownership
+		}
+	}
+	for addr, state := range states {
+		add(addr, state, 0)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+
+	var imbalance float64
+	if len(st.Members) > 0 {
+		imbalance = max * float64(len(st.Members))
+	}
+	return res, imbalance
+}
+
+// sumBy sums the values of a counter by the values of a label.
+func sumBy(c prometheus.Collector, label string) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	res := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil || pb.Counter == nil {
+			continue
+		}
+		for _, lp := range pb.Label {
+			if lp.GetName() == label {
+				res[lp.GetValue()] += pb.Counter.GetValue()
+			}
+		}
+	}
+	return res
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", 100*f) },
+	"since":   func(t time.Time) string { return time.Since(t).Truncate(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Prometheus Proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+.bad { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Prometheus Proxy</h1>
+<p>Generated at {{.Generated.Format "2006-01-02 15:04:05 MST"}}.</p>
+
+<h2>Build</h2>
+<table>
+{{range .Build}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+
+<h2>Endpoints</h2>
+{{if .Ring}}<p>{{len .Ring.Members}} members, {{.Ring.VirtualNodes}} virtual nodes, last change {{.Ring.LastChange.Format "2006-01-02 15:04:05 MST"}}, largest share {{printf "%.2f" .Imbalance}} times the even share.</p>
+<table>
+<tr><th>Endpoint</th><th>State</th><th>Ownership</th><th>Sent</th><th>Failed</th><th>Error rate</th></tr>
+{{range .Endpoints}}<tr><td>{{.Addr}}</td><td>{{.State}}</td><td>{{percent .Ownership}}</td><td>{{printf "%.0f" .Sent}}</td><td>{{printf "%.0f" .Failed}}</td><td{{if gt .ErrorRate 0.0}} class="bad"{{end}}>{{percent .ErrorRate}}</td></tr>
+{{end}}</table>
+{{else}}<p>No hash ring.</p>
+{{end}}
+<h2>Queue</h2>
+{{with .Queue}}<table>
+<tr><th>Type</th><td>{{.Type}}</td></tr>
+<tr><th>Depth</th><td>{{.Depth}}</td></tr>
+<tr><th>Oldest message age</th><td>{{printf "%.0f" .OldestMessageAge}}s</td></tr>
+<tr><th>Files</th><td>{{.Files}} ({{.DiskBytes}} bytes)</td></tr>
+<tr><th>Read position</th><td>{{.ReadFileNum}}:{{.ReadPos}}</td></tr>
+<tr><th>Write position</th><td>{{.WriteFileNum}}:{{.WritePos}}</td></tr>
+<tr><th>Paused</th><td{{if .Paused}} class="bad"{{end}}>{{.Paused}}</td></tr>
+</table>
+{{else}}<p>{{if .QueueError}}{{.QueueError}}{{else}}No queue stats.{{end}}</p>
+{{end}}
+<h2>Series limit</h2>
+{{if .SeriesLimit}}<p>{{.SeriesCount}} of {{.SeriesLimit}} series ({{percent .SeriesUsage}}).</p>
+{{else}}<p>No series limit.</p>
+{{end}}
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+<tr><th>Age</th><th>Message</th><th>Fields</th></tr>
+{{range .Errors}}<tr><td>{{since .Time}}</td><td>{{.Message}}</td><td><code>{{.Fields}}</code></td></tr>
+{{end}}</table>
+{{else}}<p>No recent errors.</p>
+{{end}}
+<h2>Configuration</h2>
+<pre>{{.Config}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/promcluster/proxy/config"
+	"github.com/promcluster/proxy/pkg/log"
+	pkgq "github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type fakeSeriesUsage struct{}
+
+func (fakeSeriesUsage) Usage() (uint64, uint64) { return 25, 100 }
+
+func TestStatus(t *testing.T) {
+	token := config.C.Auth.Token
+	config.C.Auth.Token = "hunter2"
+	defer func() { config.C.Auth.Token = token }()
+
+	s := newAdminService("secret")
+	s.queue = pkgq.NewChanQueue(prometheus.NewRegistry(), zap.NewNop())
+	_ = s.queue.Push([]byte("a"))
+	recent := log.NewRecentErrors(10)
+	recent.Wrap(zap.NewNop()).Error("send failed", zap.Error(errors.New("connection <refused>")))
+	s.ReportStatus(fakeSeriesUsage{}, recent)
+
+	rec := adminGet(s, "/", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"a:9090", "b:9090", "60.0%",
+		"<tr><th>Depth</th><td>1</td></tr>",
+		"25 of 100 series (25.0%)",
+		"send failed", "connection &lt;refused&gt;",
+		"token: &lt;secret&gt;",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status page does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "hunter2") {
+		t.Error("status page leaks the auth token")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,17 +16,25 @@ import (
 	pkgc "github.com/promcluster/proxy/pkg/consumer"
 	"github.com/promcluster/proxy/pkg/filter"
 	"github.com/promcluster/proxy/pkg/log"
+	"github.com/promcluster/proxy/pkg/query"
 	pkgq "github.com/promcluster/proxy/pkg/queue"
+	"github.com/promcluster/proxy/pkg/ruler"
+	"github.com/promcluster/proxy/pkg/sharding"
+	"github.com/promcluster/proxy/pkg/upstream"
 	"github.com/promcluster/proxy/service/worker"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
 	"github.com/spf13/viper"
 	"go.uber.org/ratelimit"
+	"go.uber.org/zap"
 )
 
 var configFile string
 
+// recentErrorsSize is the number of errors shown on the status page.
+const recentErrorsSize = 50
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("proxy"))
 	flag.StringVar(&configFile, "config", "", "config file")
@@ -41,6 +50,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	recentErrors := log.NewRecentErrors(recentErrorsSize)
+	logger = recentErrors.Wrap(logger)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	reg := prometheus.DefaultRegisterer
@@ -50,6 +61,7 @@ func main() {
 		viper.GetString("SD.name"),
 		viper.GetInt("worker.num"),
 		time.Duration(viper.GetInt("SD.refreshInterval"))*time.Second,
+		config.C.RemoteWrite,
 		logger)
 
 	var queue pkgq.Queue
@@ -65,17 +77,58 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	consumer := pkgc.NewRemoteConsumer(ctx, reg, promBackend, []filter.Filter{lf}, logger)
+	shardKey := sharding.NewKey(config.C.Sharding)
+	consumer := pkgc.NewRemoteConsumer(ctx, reg, promBackend, []filter.Filter{lf}, shardKey, logger)
+	consumer.Replicate(config.C.Sharding.Replicas(), config.C.Sharding.Quorum())
 	err = worker.StartWorkers(ctx, reg, viper.GetInt("worker.num"), queue, consumer, logger)
 	if err != nil {
 		panic(err)
 	}
 
+	querier := query.NewQuerier(reg, promBackend, config.C.API.QueryTimeout, config.C.API.QueryPartialResponse,
+		config.C.API.QueryReplicaLabels, logger)
+	querier.Replicated(config.C.Sharding.Replicas())
+	if config.C.Sharding.PruneQueries {
+		querier.PruneShards(shardKey, consumer.Owners, promBackend.Cordoned)
+	}
+	var queryUpstream *upstream.Upstream
+	if config.C.API.QueryEnable {
+		queryUpstream, err = upstream.New(ctx, reg, config.C.API.QueryAddr, config.C.API.QueryUpstream, logger)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var frontend *query.Frontend
+	if config.C.API.QueryEnable && config.C.API.QueryFrontend.Enable {
+		next := querier.QueryRange
+		if config.C.API.QueryMode != config.QueryModeFanout {
+			// the upstream replaces the Authorization header by its credentials.
+			client := query.NewClient("http://query-upstream", &http.Client{Transport: queryUpstream})
+			client.ForwardHeader()
+			next = client.QueryRange
+		}
+		frontend, err = query.NewFrontend(reg, next, config.C.API.QueryFrontend, logger)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if config.C.Ruler.Enable {
+		r, err := ruler.New(reg, config.C.Ruler, querier.Query, queue, logger)
+		if err != nil {
+			logger.Fatal("load rules", zap.Error(err))
+		}
+		go r.Run(ctx)
+	}
+
 	limiter := ratelimit.New(viper.GetInt("api.rateLimit"))
-	service, err := api.New(reg, config.C.API, queue, limiter, logger)
+	service, err := api.New(reg, config.C.API, queue, querier, frontend, queryUpstream,
+		promBackend, consumer, limiter, logger)
 	if err != nil {
 		panic(err)
 	}
+	service.ReportStatus(lf, recentErrors)
 	err = service.Start(ctx)
 	if err != nil {
 		panic(err)
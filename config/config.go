@@ -1,10 +1,18 @@
 package config
 
 import (
+	"strings"
 	"time"
 
+	"github.com/promcluster/proxy/pkg/backend"
 	"github.com/promcluster/proxy/pkg/log"
+	"github.com/promcluster/proxy/pkg/mirror"
+	"github.com/promcluster/proxy/pkg/query"
 	"github.com/promcluster/proxy/pkg/queue"
+	"github.com/promcluster/proxy/pkg/ruler"
+	"github.com/promcluster/proxy/pkg/scheduler"
+	"github.com/promcluster/proxy/pkg/sharding"
+	"github.com/promcluster/proxy/pkg/upstream"
 )
 
 // C is global configuration object
@@ -12,12 +20,17 @@ var C Configuration
 
 // Configuration is global configuration struct
 type Configuration struct {
-	API    APIConfiguration    `yaml:"api"`
-	SD     ServiceDiscovery    `yaml:"SD"`
-	Worker WorkerConfiguration `yaml:"worker"`
-	Queue  queue.Config        `yaml:"queue"`
-	Auth   AuthConfiguration   `yaml:"auth"`
-	Log    log.Config          `yaml:"log"`
+	API      APIConfiguration    `yaml:"api"`
+	SD       ServiceDiscovery    `yaml:"SD"`
+	Worker   WorkerConfiguration `yaml:"worker"`
+	Queue    queue.Config        `yaml:"queue"`
+	Auth     AuthConfiguration   `yaml:"auth"`
+	Limits   LimitsConfiguration `yaml:"limits"`
+	Log      log.Config          `yaml:"log"`
+	Ruler    ruler.Config        `yaml:"ruler"`
+	Sharding sharding.Config     `yaml:"sharding"`
+	// RemoteWrite configures the writes to the backends.
+	RemoteWrite backend.Config `yaml:"remoteWrite"`
 }
 
 type APIConfiguration struct { //nolint: maligned
@@ -29,10 +42,46 @@ type APIConfiguration struct { //nolint: maligned
 	SeriesCountFlushInterval time.Duration `yaml:"seriesCountFlushInterval"`
 	PushGatewayEnable        bool          `yaml:"pushGatewayEnable"`
 
-	QueryEnable bool   `yaml:"queryEnable"`
-	QueryAddr   string `yaml:"queryAddr"`
+	QueryEnable  bool          `yaml:"queryEnable"`
+	QueryAddr    string        `yaml:"queryAddr"`
+	QueryMode    string        `yaml:"queryMode"`
+	QueryTimeout time.Duration `yaml:"queryTimeout"`
+	// QueryPartialResponse is the default of the partial_response
+	// parameter of fanned out queries.
+	QueryPartialResponse bool `yaml:"queryPartialResponse"`
+	// QueryReplicaLabels are the labels the series of HA replicas are
+	// deduplicated on.
+	QueryReplicaLabels []string `yaml:"queryReplicaLabels"`
+
+	QueryUpstream  upstream.Config      `yaml:"queryUpstream"`
+	QueryFrontend  query.FrontendConfig `yaml:"queryFrontend"`
+	QueryLog       QueryLogConfig       `yaml:"queryLog"`
+	QueryScheduler scheduler.Config     `yaml:"queryScheduler"`
+	QueryMirror    mirror.Config        `yaml:"queryMirror"`
+}
+
+// QueryLogConfig configures the log of the read requests.
+type QueryLogConfig struct {
+	Enable bool `yaml:"enable"`
+	// Path is the log file, records are written to stdout if empty.
+	Path string `yaml:"path"`
+	// MaxSizeBytes is the size the log file is rotated at.
+	MaxSizeBytes int64 `yaml:"maxSizeBytes"`
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int `yaml:"maxBackups"`
+	// SlowQueryThreshold only logs the requests taking at least as long,
+	// every request is logged if zero.
+	SlowQueryThreshold time.Duration `yaml:"slowQueryThreshold"`
 }
 
+// Query modes.
+const (
+	// QueryModeProxy proxies queries to the queryAddr.
+	QueryModeProxy = "proxy"
+	// QueryModeFanout sends queries to every backend and merges the results.
+	QueryModeFanout = "fanout"
+)
+
 type ServiceDiscovery struct {
 	Name            string `yaml:"name"`
 	RefreshInterval int    `yaml:"refreshInterval"`
@@ -46,4 +95,77 @@ type AuthConfiguration struct {
 	Enable bool   `yaml:"enable"`
 	User   string `yaml:"user"`
 	Token  string `yaml:"token"`
+	// AdminToken is the bearer token of the admin API, which is
+	// disabled if empty.
+	AdminToken string `yaml:"adminToken"`
+
+	LockoutThreshold   int           `yaml:"lockoutThreshold"`
+	LockoutWindow      time.Duration `yaml:"lockoutWindow"`
+	LockoutDuration    time.Duration `yaml:"lockoutDuration"`
+	MaxLockoutDuration time.Duration `yaml:"maxLockoutDuration"`
+	// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For
+	// header names the client locked out and audited, the connection
+	// address is used otherwise.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// TenantHeaderSources are the CIDRs of the clients, such as a tenant
+	// aware gateway, whose X-Scope-OrgID header names the tenant of their
+	// requests. The tenant of other requests is the authenticated user.
+	TenantHeaderSources []string `yaml:"tenantHeaderSources"`
+}
+
+// Limits protects the backends from expensive queries,
+// zero values are unlimited.
+type Limits struct {
+	MaxQueryRange        time.Duration `yaml:"maxQueryRange"`
+	MinStep              time.Duration `yaml:"minStep"`
+	MaxSeriesPerSelector int           `yaml:"maxSeriesPerSelector"`
+	MaxResponseBytes     int           `yaml:"maxResponseBytes"`
+	QueryTimeout         time.Duration `yaml:"queryTimeout"`
+	// MaxConcurrentQueries caps the running read requests of the
+	// tenant, the others wait in the query scheduler.
+	MaxConcurrentQueries int `yaml:"maxConcurrentQueries"`
+	// QueryWeight is the number of queued requests the tenant runs in
+	// its turn of the query scheduler, 1 if zero.
+	QueryWeight int `yaml:"queryWeight"`
+}
+
+type LimitsConfiguration struct {
+	Limits `yaml:",inline" mapstructure:",squash"`
+	// Overrides by tenant or user, non-zero values replace the defaults
+	// and negative values lift a limit.
+	Overrides map[string]Limits `yaml:"overrides"`
+}
+
+// For returns the limits of the tenant.
+func (c LimitsConfiguration) For(tenant string) Limits {
+	l := c.Limits
+	o, ok := c.Overrides[tenant]
+	if !ok {
+		// viper lower cases map keys.
+		if o, ok = c.Overrides[strings.ToLower(tenant)]; !ok {
+			return l
+		}
+	}
+	if o.MaxQueryRange != 0 {
+		l.MaxQueryRange = o.MaxQueryRange
+	}
+	if o.MinStep != 0 {
+		l.MinStep = o.MinStep
+	}
+	if o.MaxSeriesPerSelector != 0 {
+		l.MaxSeriesPerSelector = o.MaxSeriesPerSelector
+	}
+	if o.MaxResponseBytes != 0 {
+		l.MaxResponseBytes = o.MaxResponseBytes
+	}
+	if o.QueryTimeout != 0 {
+		l.QueryTimeout = o.QueryTimeout
+	}
+	if o.MaxConcurrentQueries != 0 {
+		l.MaxConcurrentQueries = o.MaxConcurrentQueries
+	}
+	if o.QueryWeight != 0 {
+		l.QueryWeight = o.QueryWeight
+	}
+	return l
 }
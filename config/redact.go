@@ -0,0 +1,83 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces the values of the secrets and redactedPassword the
+// passwords of URLs.
+const (
+	redacted         = "<secret>"
+	redactedPassword = "xxxxx"
+)
+
+// Redacted returns the YAML of c with its tokens, passwords, secrets and
+// URL passwords redacted.
+func Redacted(c Configuration) (string, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return "", err
+	}
+	redact(doc)
+	b, err = yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			if k, ok := item.Key.(string); ok && isSecret(k) && item.Value != nil && item.Value != "" {
+				v[i].Value = redacted
+				continue
+			}
+			if s, ok := item.Value.(string); ok {
+				v[i].Value = redactURL(s)
+				continue
+			}
+			redact(item.Value)
+		}
+	case []interface{}:
+		for i, e := range v {
+			if s, ok := e.(string); ok {
+				v[i] = redactURL(s)
+				continue
+			}
+			redact(e)
+		}
+	}
+}
+
+// isSecret reports whether the key holds a secret rather than a path to it.
+func isSecret(key string) bool {
+	k := strings.ToLower(key)
+	if strings.HasSuffix(k, "file") {
+		return false
+	}
+	return strings.Contains(k, "token") || strings.Contains(k, "password") || strings.Contains(k, "secret")
+}
+
+// redactURL redacts the password of a URL.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedPassword)
+	}
+	return u.String()
+}
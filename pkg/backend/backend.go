@@ -2,7 +2,9 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -54,12 +56,21 @@ type Backend interface {
 // PromServer implments Backend interface.
 type PromServer struct {
 	name        string
-	c           consistent.Consistent
+	c           *consistent.Crc32
 	provider    *dns.Provider
 	interval    time.Duration
 	concurrency int
+	conf        Config
+	// hints are the hints of unreachable endpoints, nil if disabled.
+	hints *hintStore
 
-	endpoints  map[string]Endpoint
+	endpoints map[string]Endpoint
+	// ringChanged is when the ring members last changed.
+	ringChanged time.Time
+	// resolved are the addresses of the last DNS resolution, the ring
+	// holds those not cordoned.
+	resolved   []string
+	cordoned   map[string]string
 	mu         sync.RWMutex
 	registerer prometheus.Registerer
 	logger     *zap.Logger
@@ -72,6 +83,7 @@ func NewPromServer(
 	name string,
 	concurrency int,
 	interval time.Duration,
+	conf Config,
 	logger *zap.Logger) *PromServer {
 	reg.MustRegister(
 		SDDNSFailed,
@@ -80,18 +92,35 @@ func NewPromServer(
 		EndpointSendFailed,
 		EndpointSendSuccess,
 		EndpointSendDuration,
+		EndpointSendRetries,
+		EndpointSamplesDropped,
+		EndpointBufferBytes,
+		EndpointHintsBytes,
+		EndpointSamplesHinted,
+		EndpointHintsReplayed,
 	)
 	p := &PromServer{
 		c:           consistent.NewCrc32(),
 		name:        name,
 		concurrency: concurrency,
+		conf:        conf,
 		provider:    dns.NewProvider("golang", logger),
 		interval:    interval,
 		endpoints:   make(map[string]Endpoint),
+		cordoned:    make(map[string]string),
 		registerer:  reg,
 		logger:      logger.With(zap.String("service", "backend")),
 	}
 
+	switch {
+	case conf.HintsPath != "" && conf.BufferPath != "":
+		// the buffers keep every batch until delivered, hints are redundant.
+		p.logger.Warn("hintsPath is ignored as bufferPath is set",
+			zap.String("hintsPath", conf.HintsPath), zap.String("bufferPath", conf.BufferPath))
+	case conf.HintsPath != "":
+		p.hints = newHintStore(conf.HintsPath, conf.withDefaults().HintsMaxBytes)
+	}
+
 	go p.refreshDNS(ctx)
 	return p
 }
@@ -117,6 +146,161 @@ func (p *PromServer) Endpoints(hash string, rep int) ([]Endpoint, error) {
 	return res, nil
 }
 
+// Addrs returns the sorted addresses of all endpoints.
+func (p *PromServer) Addrs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]string, 0, len(p.endpoints))
+	for addr := range p.endpoints {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// RingStatus is the state of the hash ring of the endpoints.
+type RingStatus struct {
+	Members []RingMember `json:"members"`
+	// VirtualNodes is the number of points of every member on the ring.
+	VirtualNodes int       `json:"virtualNodes"`
+	LastChange   time.Time `json:"lastChange"`
+	// Cordoned endpoints are out of the ring once drained, draining ones
+	// are still members.
+	Cordoned []CordonedEndpoint `json:"cordoned"`
+}
+
+// CordonedEndpoint is an endpoint leaving or out of the ring.
+type CordonedEndpoint struct {
+	Addr string `json:"addr"`
+	// State is draining until the buffered samples are flushed and the
+	// endpoint leaves the ring.
+	State string `json:"state"`
+}
+
+// RingMember is an endpoint of the ring.
+type RingMember struct {
+	Addr string `json:"addr"`
+	// Ownership is the share of the hash space the member owns.
+	Ownership float64 `json:"ownership"`
+}
+
+// RingStatus returns the state of the hash ring.
+func (p *PromServer) RingStatus() RingStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ownership := p.c.Ownership()
+	st := RingStatus{
+		Members:      []RingMember{},
+		VirtualNodes: p.c.NumberOfReplicas,
+		LastChange:   p.ringChanged,
+		Cordoned:     []CordonedEndpoint{},
+	}
+	for _, m := range p.c.Members() {
+		st.Members = append(st.Members, RingMember{Addr: m, Ownership: ownership[m]})
+	}
+	for addr, state := range p.cordoned {
+		st.Cordoned = append(st.Cordoned, CordonedEndpoint{Addr: addr, State: state})
+	}
+	sort.Slice(st.Cordoned, func(i, j int) bool { return st.Cordoned[i].Addr < st.Cordoned[j].Addr })
+	return st
+}
+
+// Cordoned returns the sorted addresses of the cordoned and draining
+// endpoints.
+func (p *PromServer) Cordoned() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]string, 0, len(p.cordoned))
+	for addr := range p.cordoned {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Cordon states.
+const (
+	StateDraining = "draining"
+	StateCordoned = "cordoned"
+)
+
+// ErrUnknownEndpoint is returned for addresses that are not endpoints.
+var ErrUnknownEndpoint = errors.New("unknown endpoint")
+
+// Cordon removes an endpoint from the ring so that it owns no series, even
+// while DNS returns it. Its buffered samples are flushed in the background
+// first, the endpoint stays in the ring while draining. The series routed
+// to it before it left the ring are still sent by the endpoint.
+func (p *PromServer) Cordon(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.endpoints[addr]
+	if !ok {
+		return ErrUnknownEndpoint
+	}
+	if _, ok := p.cordoned[addr]; ok {
+		return nil
+	}
+	p.cordoned[addr] = StateDraining
+	p.logger.Info("cordon endpoint", zap.String("addr", addr))
+
+	go func() {
+		e.Flush()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.cordoned[addr] == StateDraining {
+			p.cordoned[addr] = StateCordoned
+			p.setRing()
+			p.logger.Info("endpoint drained", zap.String("addr", addr))
+		}
+	}()
+	return nil
+}
+
+// Uncordon puts a cordoned endpoint back into the ring.
+func (p *PromServer) Uncordon(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cordoned[addr]; !ok {
+		if _, ok := p.endpoints[addr]; !ok {
+			return ErrUnknownEndpoint
+		}
+		return nil
+	}
+	delete(p.cordoned, addr)
+	p.setRing()
+	p.logger.Info("uncordon endpoint", zap.String("addr", addr))
+	return nil
+}
+
+// setRing sets the ring members to the resolved endpoints which are not
+// cordoned, draining endpoints stay members. p.mu must be held.
+func (p *PromServer) setRing() {
+	members := make([]string, 0, len(p.resolved))
+	for _, addr := range p.resolved {
+		if p.cordoned[addr] != StateCordoned {
+			members = append(members, addr)
+		}
+	}
+	before := p.c.Members()
+	p.c.Set(members)
+	if !equalStrings(before, p.c.Members()) {
+		p.ringChanged = time.Now()
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *PromServer) refreshDNS(ctx context.Context) {
 	if err := p.resolve(ctx); err != nil {
 		p.logger.Error("init DNS resolve", zap.Error(err))
@@ -145,6 +329,11 @@ func (p *PromServer) closeEndpoints() {
 		e.Stop()
 		delete(p.endpoints, k)
 	}
+	if p.hints != nil {
+		if err := p.hints.close(); err != nil {
+			p.logger.Error("close hints", zap.Error(err))
+		}
+	}
 }
 
 func (p *PromServer) resolve(ctx context.Context) error {
@@ -158,7 +347,12 @@ func (p *PromServer) resolve(ctx context.Context) error {
 	for _, addr := range res {
 		seen[addr] = struct{}{}
 		if _, ok := p.endpoints[addr]; !ok {
-			e := NewHTTPEndpoint(addr, p.concurrency, p.logger)
+			e := NewHTTPEndpoint(addr, p.concurrency, p.conf, p.logger)
+			if p.hints != nil {
+				if e.hints, err = p.hints.open(addr); err != nil {
+					p.logger.Error("open endpoint hints", zap.String("endpoint", addr), zap.Error(err))
+				}
+			}
 			go e.Start()
 			p.endpoints[addr] = e
 		}
@@ -171,7 +365,8 @@ func (p *PromServer) resolve(ctx context.Context) error {
 			delete(p.endpoints, k)
 		}
 	}
-	p.c.Set(res)
+	p.resolved = res
+	p.setRing()
 	EndpointNum.Set(float64(len(p.endpoints)))
 	p.mu.Unlock()
 
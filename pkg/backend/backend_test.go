@@ -3,16 +3,20 @@ package backend
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/promcluster/proxy/pkg/backend/consistent"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
 	"go.uber.org/zap"
 )
 
 func TestBackend(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	b := NewPromServer(ctx, prometheus.DefaultRegisterer, "dns+qq.com:80", 2, 1*time.Second, zap.NewExample())
+	b := NewPromServer(ctx, prometheus.DefaultRegisterer, "dns+qq.com:80", 2, 1*time.Second, Config{}, zap.NewExample())
 	time.Sleep(2 * time.Second)
 	es, err := b.Endpoints("test", 1)
 	if err != nil {
@@ -21,3 +25,74 @@ func TestBackend(t *testing.T) {
 	fmt.Println(es)
 	cancel()
 }
+
+// flushEndpoint blocks Flush until released.
+type flushEndpoint struct {
+	addr             string
+	flushed, release chan struct{}
+}
+
+func (e *flushEndpoint) Start()                                                   {}
+func (e *flushEndpoint) Stop()                                                    {}
+func (e *flushEndpoint) Send([]*prompb.Label, []prompb.Sample, func(error)) error { return nil }
+func (e *flushEndpoint) Flush()                                                   { close(e.flushed); <-e.release }
+func (e *flushEndpoint) Addr() string                                             { return e.addr }
+
+func TestCordon(t *testing.T) {
+	addrs := []string{"a:9090", "b:9090"}
+	p := &PromServer{
+		c:         consistent.NewCrc32(),
+		endpoints: make(map[string]Endpoint),
+		cordoned:  make(map[string]string),
+		logger:    zap.NewNop(),
+	}
+	for _, addr := range addrs {
+		p.endpoints[addr] = &flushEndpoint{addr: addr, flushed: make(chan struct{}), release: make(chan struct{})}
+	}
+	p.resolved = addrs
+	p.setRing()
+
+	if err := p.Cordon("c:9090"); err != ErrUnknownEndpoint {
+		t.Fatalf("got error %v, want %v", err, ErrUnknownEndpoint)
+	}
+	if err := p.Cordon("a:9090"); err != nil {
+		t.Fatal(err)
+	}
+	// the endpoint stays in the ring while draining.
+	e := p.endpoints["a:9090"].(*flushEndpoint)
+	<-e.flushed
+	st := p.RingStatus()
+	if len(st.Members) != 2 || len(st.Cordoned) != 1 || st.Cordoned[0].State != StateDraining {
+		t.Fatalf("got ring %+v, want a:9090 draining in the ring", st)
+	}
+	close(e.release)
+	deadline := time.Now().Add(time.Second)
+	for len(p.RingStatus().Members) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		es, err := p.Endpoints(strconv.Itoa(i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if es[0].Addr() != "b:9090" {
+			t.Fatalf("series %d owned by cordoned endpoint %s", i, es[0].Addr())
+		}
+	}
+
+	// DNS still returning the endpoint keeps it out of the ring.
+	p.mu.Lock()
+	p.setRing()
+	p.mu.Unlock()
+	st = p.RingStatus()
+	if len(st.Members) != 1 || len(st.Cordoned) != 1 || st.Cordoned[0].Addr != "a:9090" || st.Cordoned[0].State != StateCordoned {
+		t.Fatalf("got ring %+v, want a:9090 cordoned", st)
+	}
+
+	if err := p.Uncordon("a:9090"); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.RingStatus(); len(st.Members) != 2 || len(st.Cordoned) != 0 {
+		t.Fatalf("got ring %+v, want both endpoints in the ring", st)
+	}
+}
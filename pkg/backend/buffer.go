@@ -0,0 +1,433 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// segmentBuffer is the on-disk FIFO of the encoded batches of an endpoint.
+// Like the diskQueue, batches are length prefixed records appended to
+// numbered segment files, the read position is kept in a metadata file.
+// A record header holds the length of the batch and its sample count.
+type segmentBuffer struct {
+	dir          string
+	segmentBytes int64
+	// maxBytes caps the pending bytes, unlimited if zero.
+	maxBytes int64
+
+	mu sync.Mutex
+	// sizes are the sizes of the segment files from readSeg to writeSeg.
+	sizes    map[int64]int64
+	readSeg  int64
+	readPos  int64
+	writeSeg int64
+	w        *os.File
+	r        *os.File
+	rSeg     int64
+	closed   bool
+
+	// notify is signalled on append.
+	notify chan struct{}
+}
+
+const (
+	segmentSuffix   = ".seg"
+	bufferMetaFile  = "buffer.meta"
+	recordHeaderLen = 8
+)
+
+// record is a batch read from a segmentBuffer at seg and pos.
+type record struct {
+	seg, pos int64
+	data     []byte
+	samples  int
+}
+
+// openSegmentBuffer opens the buffer in dir, keeping the batches of a
+// previous run.
+func openSegmentBuffer(dir string, segmentBytes, maxBytes int64) (*segmentBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	b := &segmentBuffer{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		maxBytes:     maxBytes,
+		sizes:        make(map[int64]int64),
+		notify:       make(chan struct{}, 1),
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var segs []int64
+	for _, n := range names {
+		seg, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(n), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(n)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, seg)
+		b.sizes[seg] = fi.Size()
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	if len(segs) > 0 {
+		b.readSeg, b.writeSeg = segs[0], segs[len(segs)-1]
+	}
+
+	if err := b.retrieveMetaData(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, seg := range segs {
+		if seg < b.readSeg {
+			b.removeSegment(seg)
+		}
+	}
+	if b.readSeg > b.writeSeg {
+		b.writeSeg = b.readSeg
+	}
+
+	// a record torn by a crash is cut off the last segment.
+	if size, ok := b.sizes[b.writeSeg]; ok {
+		valid, err := b.validLength(b.writeSeg, size)
+		if err != nil {
+			return nil, err
+		}
+		if valid < size {
+			if err := os.Truncate(b.segmentName(b.writeSeg), valid); err != nil {
+				return nil, err
+			}
+			b.sizes[b.writeSeg] = valid
+		}
+	}
+	if b.readSeg == b.writeSeg && b.readPos > b.sizes[b.writeSeg] {
+		b.readPos = b.sizes[b.writeSeg]
+	}
+	if err := b.openWriter(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *segmentBuffer) segmentName(seg int64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%06d%s", seg, segmentSuffix))
+}
+
+func (b *segmentBuffer) openWriter() error {
+	f, err := os.OpenFile(b.segmentName(b.writeSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	b.w = f
+	return nil
+}
+
+// validLength returns the length of the complete records of a segment.
+func (b *segmentBuffer) validLength(seg, size int64) (int64, error) {
+	f, err := os.Open(b.segmentName(seg))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var (
+		pos int64
+		hdr [recordHeaderLen]byte
+	)
+	for pos+recordHeaderLen <= size {
+		if _, err := f.ReadAt(hdr[:], pos); err != nil {
+			break
+		}
+		next := pos + recordHeaderLen + int64(binary.BigEndian.Uint32(hdr[:4]))
+		if next > size {
+			break
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// append appends a batch of samples, it returns the number of samples of
+// the oldest segments dropped to stay below maxBytes.
+func (b *segmentBuffer) append(data []byte, samples int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errors.New("buffer closed")
+	}
+
+	if b.sizes[b.writeSeg] >= b.segmentBytes {
+		if err := b.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	buf := make([]byte, recordHeaderLen+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:recordHeaderLen], uint32(samples))
+	copy(buf[recordHeaderLen:], data)
+	if _, err := b.w.Write(buf); err != nil {
+		return 0, err
+	}
+	b.sizes[b.writeSeg] += int64(len(buf))
+
+	dropped := b.enforceLimit()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// sync syncs the segment written to.
+func (b *segmentBuffer) sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	return b.w.Sync()
+}
+
+// rotate starts a new segment, the full one is synced.
+func (b *segmentBuffer) rotate() error {
+	if err := b.w.Sync(); err != nil {
+		return err
+	}
+	if err := b.w.Close(); err != nil {
+		return err
+	}
+	b.writeSeg++
+	return b.openWriter()
+}
+
+// enforceLimit drops the oldest segments while the pending bytes exceed
+// maxBytes, the segment written to is kept.
+func (b *segmentBuffer) enforceLimit() int {
+	dropped := 0
+	for b.maxBytes > 0 && b.pending() > b.maxBytes && b.readSeg < b.writeSeg {
+		dropped += b.countSamples(b.readSeg, b.readPos)
+		b.removeSegment(b.readSeg)
+		b.readSeg++
+		b.readPos = 0
+	}
+	if dropped > 0 {
+		_ = b.persistMetaData()
+	}
+	return dropped
+}
+
+// countSamples returns the samples of the records of a segment from pos.
+func (b *segmentBuffer) countSamples(seg, pos int64) int {
+	f, err := os.Open(b.segmentName(seg))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n := 0
+	var hdr [recordHeaderLen]byte
+	for pos+recordHeaderLen <= b.sizes[seg] {
+		if _, err := f.ReadAt(hdr[:], pos); err != nil {
+			break
+		}
+		n += int(binary.BigEndian.Uint32(hdr[4:]))
+		pos += recordHeaderLen + int64(binary.BigEndian.Uint32(hdr[:4]))
+	}
+	return n
+}
+
+// pending returns the bytes not read yet.
+func (b *segmentBuffer) pending() int64 {
+	var n int64
+	for seg := b.readSeg; seg <= b.writeSeg; seg++ {
+		n += b.sizes[seg]
+	}
+	return n - b.readPos
+}
+
+// Pending returns the bytes not read yet.
+func (b *segmentBuffer) Pending() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending()
+}
+
+// empty reports whether every batch was read.
+func (b *segmentBuffer) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending() == 0
+}
+
+// peek returns the oldest batch without removing it, false if the buffer
+// is empty. A corrupt segment is skipped with an error.
+func (b *segmentBuffer) peek() (record, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if b.closed || (b.readSeg == b.writeSeg && b.readPos >= b.sizes[b.writeSeg]) {
+			return record{}, false, nil
+		}
+		if b.readPos >= b.sizes[b.readSeg] {
+			b.nextSegment()
+			continue
+		}
+		rec, err := b.read()
+		if err != nil {
+			// the rest of the segment cannot be trusted.
+			if b.readSeg < b.writeSeg {
+				b.nextSegment()
+			} else {
+				b.readPos = b.sizes[b.readSeg]
+				_ = b.persistMetaData()
+			}
+			return record{}, false, err
+		}
+		return rec, true, nil
+	}
+}
+
+func (b *segmentBuffer) read() (record, error) {
+	if b.r == nil || b.rSeg != b.readSeg {
+		if b.r != nil {
+			b.r.Close()
+		}
+		f, err := os.Open(b.segmentName(b.readSeg))
+		if err != nil {
+			b.r = nil
+			return record{}, err
+		}
+		b.r, b.rSeg = f, b.readSeg
+	}
+	var hdr [recordHeaderLen]byte
+	if _, err := b.r.ReadAt(hdr[:], b.readPos); err != nil {
+		return record{}, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:4]))
+	if b.readPos+recordHeaderLen+n > b.sizes[b.readSeg] {
+		return record{}, fmt.Errorf("record of %d bytes at %d overruns segment %d", n, b.readPos, b.readSeg)
+	}
+	data := make([]byte, n)
+	if _, err := b.r.ReadAt(data, b.readPos+recordHeaderLen); err != nil && err != io.EOF {
+		return record{}, err
+	}
+	return record{
+		seg:     b.readSeg,
+		pos:     b.readPos,
+		data:    data,
+		samples: int(binary.BigEndian.Uint32(hdr[4:])),
+	}, nil
+}
+
+// commit removes a peeked batch, unless it was dropped meanwhile.
+func (b *segmentBuffer) commit(rec record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || rec.seg != b.readSeg || rec.pos != b.readPos {
+		return
+	}
+	b.readPos += recordHeaderLen + int64(len(rec.data))
+	if b.readSeg < b.writeSeg && b.readPos >= b.sizes[b.readSeg] {
+		b.nextSegment()
+		return
+	}
+	_ = b.persistMetaData()
+}
+
+// nextSegment removes the read segment and reads the next one.
+func (b *segmentBuffer) nextSegment() {
+	b.removeSegment(b.readSeg)
+	b.readSeg++
+	b.readPos = 0
+	_ = b.persistMetaData()
+}
+
+func (b *segmentBuffer) removeSegment(seg int64) {
+	if b.r != nil && b.rSeg == seg {
+		b.r.Close()
+		b.r = nil
+	}
+	_ = os.Remove(b.segmentName(seg))
+	delete(b.sizes, seg)
+}
+
+// close syncs the buffer, the batches left are read on the next open.
+func (b *segmentBuffer) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.r != nil {
+		b.r.Close()
+	}
+	err := b.w.Sync()
+	if cerr := b.w.Close(); err == nil {
+		err = cerr
+	}
+	if perr := b.persistMetaData(); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func (b *segmentBuffer) retrieveMetaData() error {
+	f, err := os.Open(filepath.Join(b.dir, bufferMetaFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var seg, pos int64
+	if _, err := fmt.Fscanf(f, "%d,%d\n", &seg, &pos); err != nil {
+		return err
+	}
+	if seg >= b.readSeg {
+		b.readSeg, b.readPos = seg, pos
+	}
+	return nil
+}
+
+// persistMetaData atomically writes the read position.
+func (b *segmentBuffer) persistMetaData() error {
+	name := filepath.Join(b.dir, bufferMetaFile)
+	tmp := fmt.Sprintf("%s.%d.tmp", name, rand.Int()) //nolint: gosec
+	if err := writeFile(tmp, fmt.Sprintf("%d,%d\n", b.readSeg, b.readPos)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func writeFile(name, content string) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// bufferDir returns the buffer directory name of an endpoint address.
+func bufferDir(addr string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, addr)
+}
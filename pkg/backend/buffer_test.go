@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSegmentBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := openSegmentBuffer(dir, 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := b.append([]byte(fmt.Sprintf("batch-%d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		rec, ok, err := b.peek()
+		if err != nil || !ok {
+			t.Fatalf("peek %d: %v %v", i, ok, err)
+		}
+		if string(rec.data) != fmt.Sprintf("batch-%d", i) || rec.samples != i {
+			t.Fatalf("got %q with %d samples, want batch-%d", rec.data, rec.samples, i)
+		}
+		b.commit(rec)
+	}
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batches left are read after a restart, a torn record is cut.
+	f, err := os.OpenFile(b.segmentName(b.writeSeg), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	b, err = openSegmentBuffer(dir, 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	for i := 4; i < 10; i++ {
+		rec, ok, err := b.peek()
+		if err != nil || !ok {
+			t.Fatalf("peek %d: %v %v", i, ok, err)
+		}
+		if string(rec.data) != fmt.Sprintf("batch-%d", i) {
+			t.Fatalf("got %q, want batch-%d", rec.data, i)
+		}
+		b.commit(rec)
+	}
+	if _, ok, _ := b.peek(); ok || !b.empty() {
+		t.Fatal("buffer should be empty")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want the write segment and metadata", len(files))
+	}
+}
+
+func TestSegmentBufferLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every segment holds 2 records of 15 bytes.
+	b, err := openSegmentBuffer(dir, 30, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	dropped := 0
+	for i := 0; i < 6; i++ {
+		n, err := b.append([]byte(fmt.Sprintf("batch-%d", i)), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += n
+	}
+	if dropped != 6 {
+		t.Fatalf("got %d samples dropped, want 6", dropped)
+	}
+	rec, ok, err := b.peek()
+	if err != nil || !ok || string(rec.data) != "batch-2" {
+		t.Fatalf("got %q %v %v, want batch-2", rec.data, ok, err)
+	}
+}
@@ -0,0 +1,64 @@
+package backend
+
+import "time"
+
+// defaults of the zero Config values.
+var (
+	defaultMinBackoff   = 30 * time.Millisecond
+	defaultMaxBackoff   = 5 * time.Second
+	defaultMaxRetryTime = time.Minute
+	// defaultBufferMaxBytes is 1 GB.
+	defaultBufferMaxBytes int64 = 1 << 30
+	defaultHintsMaxBytes  int64 = 1 << 30
+	defaultProbeInterval        = 5 * time.Second
+)
+
+// Config configuration
+type Config struct {
+	// MinBackoff is the delay before the first retry of a failed batch,
+	// doubled on every retry up to MaxBackoff.
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// MaxRetryTime caps the time a batch is retried for, it is dropped
+	// once the next retry would start later.
+	MaxRetryTime time.Duration `yaml:"maxRetryTime"`
+	// BufferPath enables the on-disk buffers of the endpoints, in a
+	// directory per endpoint below it. Buffered batches survive restarts,
+	// are sent in order and retried until delivered or rejected.
+	BufferPath string `yaml:"bufferPath"`
+	// BufferMaxBytes caps the pending bytes of an endpoint buffer, its
+	// oldest segments are dropped beyond.
+	BufferMaxBytes int64 `yaml:"bufferMaxBytes"`
+	// HintsPath enables hinted handoff without BufferPath: the batches of
+	// an unreachable endpoint are stored as hints in a directory per
+	// endpoint below it, and replayed in order once it is healthy again.
+	HintsPath     string `yaml:"hintsPath"`
+	HintsMaxBytes int64  `yaml:"hintsMaxBytes"`
+	// HintsProbeInterval is how often unreachable endpoints are probed.
+	HintsProbeInterval time.Duration `yaml:"hintsProbeInterval"`
+}
+
+func (c Config) withDefaults() Config {
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = defaultMaxBackoff
+		if c.MaxBackoff < c.MinBackoff {
+			c.MaxBackoff = c.MinBackoff
+		}
+	}
+	if c.MaxRetryTime <= 0 {
+		c.MaxRetryTime = defaultMaxRetryTime
+	}
+	if c.BufferMaxBytes <= 0 {
+		c.BufferMaxBytes = defaultBufferMaxBytes
+	}
+	if c.HintsMaxBytes <= 0 {
+		c.HintsMaxBytes = defaultHintsMaxBytes
+	}
+	if c.HintsProbeInterval <= 0 {
+		c.HintsProbeInterval = defaultProbeInterval
+	}
+	return c
+}
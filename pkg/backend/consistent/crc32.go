@@ -114,14 +114,30 @@ func (c *Crc32) Members() []string {
 	c.RLock()
 	defer c.RUnlock()
 	m := make([]string, 0, len(c.members))
-	i := 0
 	for k := range c.members {
-		m[i] = k
-		i++
+		m = append(m, k)
 	}
+	sort.Strings(m)
 	return m
 }
 
+// Ownership returns the share of the hash space owned by every member,
+// a point owns the keys hashing from the previous point up to itself.
+func (c *Crc32) Ownership() map[string]float64 {
+	c.RLock()
+	defer c.RUnlock()
+	res := make(map[string]float64, len(c.members))
+	n := len(c.sortedHashes)
+	for i, h := range c.sortedHashes {
+		prev := c.sortedHashes[(i+n-1)%n]
+		res[c.circle[h]] += float64(h-prev) / (1 << 32)
+	}
+	if n == 1 {
+		res[c.circle[c.sortedHashes[0]]] = 1
+	}
+	return res
+}
+
 // Get returns an element close to where name hashes to in the circle.
 func (c *Crc32) Get(name string) (string, error) {
 	c.RLock()
@@ -0,0 +1,48 @@
+package consistent
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCrc32Ownership(t *testing.T) {
+	c := NewCrc32()
+	c.Set([]string{"a:9090", "b:9090", "c:9090"})
+
+	ownership := c.Ownership()
+	if len(ownership) != 3 {
+		t.Fatalf("got ownership of %d members, want 3", len(ownership))
+	}
+	var sum float64
+	for _, share := range ownership {
+		sum += share
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Fatalf("got a total ownership of %v, want 1", sum)
+	}
+
+	// the shares match the keys each member gets.
+	counts := make(map[string]int)
+	n := 30000
+	for i := 0; i < n; i++ {
+		m, err := c.Get(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m]++
+	}
+	for m, share := range ownership {
+		if got := float64(counts[m]) / float64(n); math.Abs(got-share) > 0.02 {
+			t.Errorf("%s: got %v of the keys, want %v", m, got, share)
+		}
+	}
+
+	c.Set([]string{"a:9090"})
+	if got := c.Ownership()["a:9090"]; got != 1 {
+		t.Errorf("got ownership %v of a single member, want 1", got)
+	}
+	if got := c.Members(); len(got) != 1 || got[0] != "a:9090" {
+		t.Errorf("got members %v, want [a:9090]", got)
+	}
+}
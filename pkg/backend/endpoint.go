@@ -2,11 +2,17 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -45,6 +51,60 @@ var (
 		},
 		[]string{"code", "method", "backend"},
 	)
+	EndpointSendRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_send_retries_total",
+			Help:      "The number of retried batch sends.",
+		},
+		[]string{"endpoint"},
+	)
+	EndpointSamplesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_samples_dropped_total",
+			Help:      "The number of samples dropped by reason.",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	EndpointBufferBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_buffer_bytes",
+			Help:      "The bytes of the batches pending in the on-disk buffer.",
+		},
+		[]string{"endpoint"},
+	)
+	EndpointHintsBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_hints_bytes",
+			Help:      "The bytes of the hints pending for an unreachable endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+	EndpointSamplesHinted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_samples_hinted_total",
+			Help:      "The number of samples stored as hints while the endpoint was unreachable.",
+		},
+		[]string{"endpoint"},
+	)
+	EndpointHintsReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "endpoint_hints_replayed_samples_total",
+			Help:      "The number of hinted samples replayed to the endpoint.",
+		},
+		[]string{"endpoint"},
+	)
 )
 
 // default time series batch send number.
@@ -53,34 +113,92 @@ var defaultBatchSend = 100
 // default flush samples duration.
 var flushSamplesDuration = 60 * time.Second
 
+// default size of the segment files of the endpoint buffers.
+var defaultSegmentBytes int64 = 16 << 20
+
+// bufferSyncInterval is how often the endpoint buffers are synced to disk.
+var bufferSyncInterval = time.Second
+
 // Endpoint interface.
 type Endpoint interface {
 	// Start endpoint send data.
 	Start()
 	// Stop endpoint.
 	Stop()
-	// Send samples to endpoints.
-	Send([]*prompb.Label, []prompb.Sample) error
+	// Send queues samples to the endpoint. If set, ack is called once
+	// they are delivered, or stored in the buffer to be delivered later,
+	// with nil, with ErrHinted once they are stored as hints, and with the
+	// reason they were dropped otherwise. It is not called if Send fails.
+	Send(l []*prompb.Label, s []prompb.Sample, ack func(error)) error
+	// Flush sends the buffered samples at once.
+	Flush()
 	// Addr returns endpoint's address.
 	Addr() string
 }
 
+// ErrEndpointStopped is returned for samples sent to a stopped endpoint.
+var ErrEndpointStopped = errors.New("endpoint stopped")
+
+// ErrHinted acknowledges samples stored as hints, held by the proxy rather
+// than by the endpoint until it is reachable again.
+var ErrHinted = errors.New("samples hinted")
+
+// queued is a series queued to an endpoint.
+type queued struct {
+	ts  prompb.TimeSeries
+	ack func(error)
+}
+
+// batch is a batch of series and the acks of their senders.
+type batch struct {
+	series []*prompb.TimeSeries
+	acks   []func(error)
+}
+
+func (b *batch) add(q queued) {
+	ts := q.ts
+	b.series = append(b.series, &ts)
+	if q.ack != nil {
+		b.acks = append(b.acks, q.ack)
+	}
+}
+
+// ack reports the outcome of the batch to its senders.
+func (b *batch) ack(err error) {
+	for _, ack := range b.acks {
+		ack(err)
+	}
+}
+
 // HTTPEndpoint implements an HTTP endpoint.
 type HTTPEndpoint struct {
 	client      *http.Client
 	addr        string
-	cache       chan prompb.TimeSeries
+	conf        Config
+	cache       chan queued
 	concurrency int
 	logger      *zap.Logger
 	done        chan struct{}
+	// mu guards stopped, no series are queued once it is set.
+	mu      sync.RWMutex
+	stopped bool
+	// flush requests are closed once the buffered samples are sent.
+	flush chan chan struct{}
+	// buffer holds the batches on disk until they are sent, if enabled.
+	buffer *segmentBuffer
+	// hints hold the batches written while the endpoint is unreachable,
+	// if hinted handoff is enabled.
+	hints       *segmentBuffer
+	unreachable int32
 }
 
-// NewHTTPEndpoint creates an HTTP endpoint.
-func NewHTTPEndpoint(addr string, concurrency int, logger *zap.Logger) *HTTPEndpoint {
+// NewHTTPEndpoint creates an HTTP endpoint sending at most concurrency
+// batches at once, retried as configured by conf.
+func NewHTTPEndpoint(addr string, concurrency int, conf Config, logger *zap.Logger) *HTTPEndpoint {
 	if concurrency < 1 {
 		concurrency = 1
 	}
-	return &HTTPEndpoint{
+	e := &HTTPEndpoint{
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 			Transport: &http.Transport{
@@ -89,109 +207,528 @@ func NewHTTPEndpoint(addr string, concurrency int, logger *zap.Logger) *HTTPEndp
 			},
 		},
 		addr:        addr,
+		conf:        conf.withDefaults(),
 		concurrency: concurrency,
-		cache:       make(chan prompb.TimeSeries, defaultBatchSend*2),
+		cache:       make(chan queued, defaultBatchSend*2),
 		done:        make(chan struct{}),
+		flush:       make(chan chan struct{}),
 		logger:      logger.With(zap.String("service", "endpoint")),
 	}
-}
-
-func (e *HTTPEndpoint) rollback(data []*prompb.TimeSeries) {
-	for _, ts := range data {
-		e.cache <- *ts
+	if e.conf.BufferPath != "" {
+		dir := filepath.Join(e.conf.BufferPath, bufferDir(addr))
+		b, err := openSegmentBuffer(dir, defaultSegmentBytes, e.conf.BufferMaxBytes)
+		if err != nil {
+			e.logger.Error("open endpoint buffer, sending unbuffered", zap.String("endpoint", addr), zap.Error(err))
+		} else {
+			e.buffer = b
+		}
 	}
+	return e
 }
 
-// Start starts the task.
+// Start starts the task. A batch is sent once full, or as soon as no
+// more series are queued if a sender waits for its ack.
 func (e *HTTPEndpoint) Start() {
 	e.logger.Info("start endpoint", zap.String("addr", e.addr))
-	var timeSeriesData []*prompb.TimeSeries
+	pending := &batch{}
 	limiter := NewLimit(e.concurrency)
+	send := func(b *batch) {
+		limiter.Take()
+		go func() {
+			defer limiter.Release()
+			b.ack(e.doSend(b.series))
+		}()
+	}
+	if e.buffer != nil {
+		go e.replay()
+		send = func(b *batch) {
+			b.ack(e.bufferBatch(b.series))
+		}
+	}
+	if e.hints != nil {
+		go e.handoff()
+		direct := send
+		send = func(b *batch) {
+			if e.handingOff() {
+				b.ack(e.hintBatch(b.series))
+				return
+			}
+			direct(b)
+		}
+	}
 	ticker := time.NewTicker(flushSamplesDuration)
+	var syncC <-chan time.Time
+	if e.buffer != nil {
+		syncTicker := time.NewTicker(bufferSyncInterval)
+		defer syncTicker.Stop()
+		syncC = syncTicker.C
+	}
 	for {
 		select {
+		case <-syncC:
+			if err := e.buffer.sync(); err != nil {
+				e.logger.Error("sync endpoint buffer", zap.String("endpoint", e.addr), zap.Error(err))
+			}
 		case <-e.done:
+			pending.ack(ErrEndpointStopped)
+			if e.buffer != nil {
+				if err := e.buffer.close(); err != nil {
+					e.logger.Error("close endpoint buffer", zap.String("endpoint", e.addr), zap.Error(err))
+				}
+			}
 			return
 		case m := <-e.cache:
-			timeSeriesData = append(timeSeriesData, &m)
-			if len(timeSeriesData) < defaultBatchSend {
+			pending.add(m)
+			if len(pending.series) < defaultBatchSend && (len(pending.acks) == 0 || len(e.cache) > 0) {
 				continue
 			}
-			limiter.Take()
-			tmp := make([]*prompb.TimeSeries, len(timeSeriesData))
-			copy(tmp, timeSeriesData)
-			go func([]*prompb.TimeSeries) {
-				defer limiter.Release()
-				e.doSend(tmp)
-			}(tmp)
-			timeSeriesData = []*prompb.TimeSeries{}
+			send(pending)
+			pending = &batch{}
 		case t := <-ticker.C:
 			e.logger.Info("flush samples by ticker", zap.String("ticker", t.String()))
-			if len(timeSeriesData) == 0 {
+			if len(pending.series) == 0 {
 				continue
 			}
-			limiter.Take()
-			tmp := make([]*prompb.TimeSeries, len(timeSeriesData))
-			copy(tmp, timeSeriesData)
-			go func([]*prompb.TimeSeries) {
-				defer limiter.Release()
-				e.doSend(tmp)
-			}(tmp)
-			timeSeriesData = []*prompb.TimeSeries{}
+			send(pending)
+			pending = &batch{}
+		case flushed := <-e.flush:
+			for len(e.cache) > 0 {
+				pending.add(<-e.cache)
+				if len(pending.series) == defaultBatchSend {
+					send(pending)
+					pending = &batch{}
+				}
+			}
+			if len(pending.series) > 0 {
+				send(pending)
+				pending = &batch{}
+			}
+			// every slot is free once the requests in flight are done.
+			go func() {
+				defer close(flushed)
+				if e.buffer != nil {
+					e.waitBuffer()
+					return
+				}
+				for i := 0; i < e.concurrency; i++ {
+					limiter.Take()
+				}
+				for i := 0; i < e.concurrency; i++ {
+					limiter.Release()
+				}
+			}()
 		}
 	}
 }
 
-func (e *HTTPEndpoint) doSend(tmp []*prompb.TimeSeries) {
-	client := e.client
+// doSend sends a batch, retrying the failures of the connection, 5xx and
+// 429 responses with exponential backoff until MaxRetryTime. The batches
+// failing for good are dropped. It returns nil once the batch is
+// delivered, and ErrHinted once it is hinted.
+func (e *HTTPEndpoint) doSend(batch []*prompb.TimeSeries) error {
+	e.logger.Info("send to endpoint", zap.String("endpoint", e.addr), zap.Int("size", len(batch)))
+	data, err := encode(batch)
+	if err != nil {
+		EndpointSendFailed.WithLabelValues(e.addr, "protoMarshalFailed").Inc()
+		e.logger.Error("endpoint batch send", zap.Error(err))
+		return e.drop(countSamples(batch), dropMarshal)
+	}
+	reason := e.retry(data, true, e.hints != nil)
+	switch {
+	case reason == "":
+		return nil
+	case e.hints != nil && (reason == dropUnreachable || reason == dropStopped):
+		if err := e.hint(data, countSamples(batch)); err != nil {
+			return err
+		}
+		return ErrHinted
+	}
+	return e.drop(countSamples(batch), reason)
+}
 
-	e.logger.Info("send to endpoint", zap.String("endpoint", e.addr), zap.Int("size", len(tmp)))
+// encode returns the snappy compressed write request of a batch.
+func encode(batch []*prompb.TimeSeries) ([]byte, error) {
 	var wq prompb.WriteRequest
-	wq.Timeseries = tmp
+	wq.Timeseries = batch
 	data, err := proto.Marshal(&wq)
 	if err != nil {
-		EndpointSendFailed.WithLabelValues(e.addr, "protoMarshalFailed").Inc()
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// retry sends an encoded batch until it is delivered, rejected, the
+// endpoint stops or, if capped, MaxRetryTime is exceeded. With handoff, it
+// marks the endpoint unreachable once it cannot be connected to or
+// MaxRetryTime is exceeded. It returns the reason the batch was not
+// delivered, empty if it was.
+func (e *HTTPEndpoint) retry(data []byte, capped, handoff bool) string {
+	backoff := e.conf.MinBackoff
+	deadline := time.Now().Add(e.conf.MaxRetryTime)
+	for {
+		err := e.post(data)
+		if err == nil {
+			EndpointSendSuccess.WithLabelValues(e.addr).Inc()
+			return ""
+		}
 		e.logger.Error("endpoint batch send", zap.Error(err))
-		return
+		var rerr *recoverableError
+		if !errors.As(err, &rerr) {
+			return dropRejected
+		}
+		if handoff && rerr.unreachable {
+			e.setReachable(false)
+			return dropUnreachable
+		}
+
+		// jitter spreads the retries of the endpoints over half the backoff.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if rerr.retryAfter > 0 {
+			wait = rerr.retryAfter
+		}
+		if capped && time.Now().Add(wait).After(deadline) {
+			if handoff {
+				e.setReachable(false)
+				return dropUnreachable
+			}
+			return dropRetryTimeExceeded
+		}
+		EndpointSendRetries.WithLabelValues(e.addr).Inc()
+		select {
+		case <-time.After(wait):
+		case <-e.done:
+			return dropStopped
+		}
+		// the endpoint may stop while the retry timer fires.
+		select {
+		case <-e.done:
+			return dropStopped
+		default:
+		}
+		backoff *= 2
+		if backoff > e.conf.MaxBackoff {
+			backoff = e.conf.MaxBackoff
+		}
 	}
-	res := snappy.Encode(nil, data)
+}
+
+// bufferBatch appends a batch to the buffer, the oldest batches are
+// dropped once the buffer is full. It returns nil once the batch is
+// buffered.
+func (e *HTTPEndpoint) bufferBatch(batch []*prompb.TimeSeries) error {
+	n := countSamples(batch)
+	data, err := encode(batch)
+	if err != nil {
+		EndpointSendFailed.WithLabelValues(e.addr, "protoMarshalFailed").Inc()
+		e.logger.Error("endpoint batch buffer", zap.Error(err))
+		return e.drop(n, dropMarshal)
+	}
+	dropped, err := e.buffer.append(data, n)
+	if err != nil {
+		e.logger.Error("endpoint batch buffer", zap.String("endpoint", e.addr), zap.Error(err))
+		return e.drop(n, dropBufferFailed)
+	}
+	if dropped > 0 {
+		e.drop(dropped, dropBufferFull)
+	}
+	EndpointBufferBytes.WithLabelValues(e.addr).Set(float64(e.buffer.Pending()))
+	return nil
+}
+
+// replay sends the buffered batches one at a time in order, whatever the
+// concurrency of the endpoint. They are retried until delivered or
+// rejected, the batch in flight stays in the buffer when the endpoint
+// stops and may thus be delivered twice.
+func (e *HTTPEndpoint) replay() {
+	for {
+		rec, ok, err := e.buffer.peek()
+		if err != nil {
+			e.logger.Error("read endpoint buffer", zap.String("endpoint", e.addr), zap.Error(err))
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		if !ok {
+			select {
+			case <-e.buffer.notify:
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		reason := e.retry(rec.data, false, false)
+		if reason == dropStopped {
+			return
+		}
+		if reason != "" {
+			e.drop(rec.samples, reason)
+		}
+		e.buffer.commit(rec)
+		EndpointBufferBytes.WithLabelValues(e.addr).Set(float64(e.buffer.Pending()))
+	}
+}
+
+// handingOff reports whether batches are hinted rather than sent: the
+// endpoint is unreachable or its hints are being replayed, newer batches
+// are hinted to keep them in order.
+func (e *HTTPEndpoint) handingOff() bool {
+	return !e.reachable() || !e.hints.empty()
+}
+
+func (e *HTTPEndpoint) reachable() bool {
+	return atomic.LoadInt32(&e.unreachable) == 0
+}
+
+func (e *HTTPEndpoint) setReachable(ok bool) {
+	if ok && atomic.CompareAndSwapInt32(&e.unreachable, 1, 0) {
+		e.logger.Info("endpoint reachable, replay hints", zap.String("endpoint", e.addr))
+	}
+	if !ok && atomic.CompareAndSwapInt32(&e.unreachable, 0, 1) {
+		e.logger.Warn("endpoint unreachable, hint batches", zap.String("endpoint", e.addr))
+	}
+}
+
+// hintBatch stores a batch as a hint, it returns ErrHinted once stored.
+func (e *HTTPEndpoint) hintBatch(batch []*prompb.TimeSeries) error {
+	n := countSamples(batch)
+	data, err := encode(batch)
+	if err != nil {
+		EndpointSendFailed.WithLabelValues(e.addr, "protoMarshalFailed").Inc()
+		e.logger.Error("endpoint batch hint", zap.Error(err))
+		return e.drop(n, dropMarshal)
+	}
+	if err := e.hint(data, n); err != nil {
+		return err
+	}
+	return ErrHinted
+}
+
+// hint stores an encoded batch of samples as a hint, the oldest hints are
+// dropped once the store is full. It returns nil once the batch is stored.
+func (e *HTTPEndpoint) hint(data []byte, samples int) error {
+	dropped, err := e.hints.append(data, samples)
+	if err != nil {
+		e.logger.Error("endpoint batch hint", zap.String("endpoint", e.addr), zap.Error(err))
+		return e.drop(samples, dropUnreachable)
+	}
+	if dropped > 0 {
+		e.drop(dropped, dropHintsFull)
+	}
+	EndpointSamplesHinted.WithLabelValues(e.addr).Add(float64(samples))
+	EndpointHintsBytes.WithLabelValues(e.addr).Set(float64(e.hints.Pending()))
+	return nil
+}
+
+// handoff probes the endpoint while it is unreachable, and replays its
+// hints in order once it is reachable again. The hints are retried with
+// backoff and Retry-After like any batch, an endpoint which cannot be
+// connected to is marked unreachable again.
+func (e *HTTPEndpoint) handoff() {
+	ticker := time.NewTicker(e.conf.HintsProbeInterval)
+	defer ticker.Stop()
+	for {
+		if !e.reachable() {
+			select {
+			case <-ticker.C:
+			case <-e.done:
+				return
+			}
+			if err := e.probe(); err != nil {
+				e.logger.Debug("probe endpoint", zap.String("endpoint", e.addr), zap.Error(err))
+				continue
+			}
+			e.setReachable(true)
+		}
+
+		rec, ok, err := e.hints.peek()
+		if err != nil {
+			e.logger.Error("read endpoint hints", zap.String("endpoint", e.addr), zap.Error(err))
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		if !ok {
+			select {
+			case <-e.hints.notify:
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		switch reason := e.retry(rec.data, false, true); reason {
+		case "":
+			EndpointHintsReplayed.WithLabelValues(e.addr).Add(float64(rec.samples))
+		case dropUnreachable:
+			continue
+		case dropStopped:
+			return
+		default:
+			e.drop(rec.samples, reason)
+		}
+		e.hints.commit(rec)
+		EndpointHintsBytes.WithLabelValues(e.addr).Set(float64(e.hints.Pending()))
+	}
+}
+
+// probe checks whether the endpoint is ready.
+func (e *HTTPEndpoint) probe() error {
+	resp, err := e.client.Get(e.addr + "/-/ready")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// waitBuffer waits until every buffered batch is sent or the endpoint stops.
+func (e *HTTPEndpoint) waitBuffer() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !e.buffer.empty() {
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// recoverableError is a failure worth retrying, after retryAfter if the
+// endpoint asked for it. An unreachable endpoint could not be connected to.
+type recoverableError struct {
+	error
+	retryAfter  time.Duration
+	unreachable bool
+}
+
+// post sends an encoded write request once.
+func (e *HTTPEndpoint) post(data []byte) error {
 	url := fmt.Sprintf("%s/api/v1/write", e.addr)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(res))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
 	if err != nil {
 		EndpointSendFailed.WithLabelValues(e.addr, "newRequestFailed").Inc()
-		e.logger.Error("batch send new req", zap.Error(err))
-		go e.rollback(tmp)
-		return
+		return err
 	}
 	start := time.Now()
-	resp, err := client.Do(req)
+	resp, err := e.client.Do(req)
 	if err != nil {
 		EndpointSendFailed.WithLabelValues(e.addr, "httpClientFailed").Inc()
-		e.logger.Error("endpoint batch send", zap.Error(err))
-		time.Sleep(1 * time.Second)
-		go e.rollback(tmp)
-		return
+		// timeouts are retried like 5xx, the endpoint may just be slow.
+		var nerr net.Error
+		timeout := errors.As(err, &nerr) && nerr.Timeout()
+		return &recoverableError{error: err, unreachable: !timeout}
 	}
 	defer func() {
 		_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
 		resp.Body.Close()
 	}()
-	if resp.StatusCode/100 != 2 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		EndpointSendFailed.WithLabelValues(e.addr, "httpStatusFailed").Inc()
-		e.logger.Error("status code not OK", zap.Int("code", resp.StatusCode), zap.String("body", string(body)))
-		return
+	EndpointSendDuration.WithLabelValues(strconv.Itoa(resp.StatusCode), req.Method, e.addr).Observe(time.Since(start).Seconds())
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	EndpointSendFailed.WithLabelValues(e.addr, "httpStatusFailed").Inc()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrMsgLen))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return &recoverableError{error: err, retryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+// maxErrMsgLen is the length of the response bodies kept in errors.
+const maxErrMsgLen = 256
+
+// retryAfter parses a Retry-After header, seconds or an HTTP date, zero
+// if absent or invalid.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// reasons of dropped samples.
+const (
+	dropMarshal           = "marshal"
+	dropRejected          = "rejected"
+	dropRetryTimeExceeded = "retryTimeExceeded"
+	dropStopped           = "stopped"
+	dropBufferFull        = "bufferFull"
+	dropBufferFailed      = "bufferFailed"
+	dropUnreachable       = "unreachable"
+	dropHintsFull         = "hintsFull"
+)
+
+// countSamples returns the number of samples of a batch.
+func countSamples(batch []*prompb.TimeSeries) int {
+	n := 0
+	for _, ts := range batch {
+		n += len(ts.Samples)
+	}
+	return n
+}
+
+// drop counts n samples dropped for reason, and returns the error
+// acknowledging them.
+func (e *HTTPEndpoint) drop(n int, reason string) error {
+	EndpointSamplesDropped.WithLabelValues(e.addr, reason).Add(float64(n))
+	e.logger.Warn("drop batch", zap.String("endpoint", e.addr), zap.String("reason", reason), zap.Int("samples", n))
+	if reason == dropStopped {
+		return ErrEndpointStopped
 	}
-	e.logger.Info("success consum message size:", zap.Int("size", len(data)))
-	EndpointSendSuccess.WithLabelValues(e.addr).Inc()
-	elapsed := time.Since(start).Seconds()
-	EndpointSendDuration.WithLabelValues(strconv.Itoa(resp.StatusCode), req.Method, e.addr).Observe(elapsed)
+	return fmt.Errorf("%s: samples dropped: %s", e.addr, reason)
 }
 
-// Stop stops the task.
+// Stop stops the task, the queued series not yet sent are acknowledged
+// with ErrEndpointStopped.
 func (e *HTTPEndpoint) Stop() {
 	e.logger.Info("exit endpoint", zap.String("addr", e.addr))
 	close(e.done)
+	e.mu.Lock()
+	e.stopped = true
+	e.mu.Unlock()
+	for {
+		select {
+		case m := <-e.cache:
+			if m.ack != nil {
+				m.ack(ErrEndpointStopped)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Flush sends the buffered samples at once and waits for the requests
+// in flight.
+func (e *HTTPEndpoint) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+	case <-e.done:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-e.done:
+	}
 }
 
 // Addr returns the endpoint's address.
@@ -199,16 +736,21 @@ func (e *HTTPEndpoint) Addr() string {
 	return e.addr
 }
 
-// Send sends samples to endpoint.
-func (e *HTTPEndpoint) Send(l []*prompb.Label, s []prompb.Sample) error {
+// Send queues samples to the endpoint, it fails once the endpoint is stopped.
+func (e *HTTPEndpoint) Send(l []*prompb.Label, s []prompb.Sample, ack func(error)) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.stopped {
+		return ErrEndpointStopped
+	}
 	var timeseries prompb.TimeSeries
 	timeseries.Labels = l
 	timeseries.Samples = s
 	select {
-	case e.cache <- timeseries:
+	case e.cache <- queued{ts: timeseries, ack: ack}:
 		return nil
 	case <-e.done:
 		e.logger.Info("endpoint closed, exit Send")
-		return nil
+		return ErrEndpointStopped
 	}
 }
@@ -1,15 +1,413 @@
 package backend
 
 import (
-	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
 )
 
 func TestEndpoint(t *testing.T) {
-	e := NewHTTPEndpoint("http://127.0.0.1", 1, zap.NewExample())
+	e := NewHTTPEndpoint("http://127.0.0.1", 1, Config{}, zap.NewExample())
 	if e.Addr() != "http://127.0.0.1" {
 		t.Fatal("get bad address")
 	}
 	go e.Start()
 	e.Stop()
 }
+
+func TestEndpointFlush(t *testing.T) {
+	var received int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		atomic.AddInt32(&received, int32(len(req.Timeseries)))
+	}))
+	defer s.Close()
+
+	e := NewHTTPEndpoint(s.URL, 2, Config{}, zap.NewNop())
+	go e.Start()
+	defer e.Stop()
+	for i := 0; i < 3; i++ {
+		if err := e.Send([]*prompb.Label{{Name: "__name__", Value: "up"}}, []prompb.Sample{{Value: 1}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Flush()
+	if n := atomic.LoadInt32(&received); n != 3 {
+		t.Fatalf("got %d series after flush, want 3", n)
+	}
+}
+
+func TestEndpointAck(t *testing.T) {
+	var status int32 = http.StatusOK
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer s.Close()
+
+	conf := Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetryTime: 10 * time.Millisecond}
+	e := NewHTTPEndpoint(s.URL, 1, conf, zap.NewNop())
+	go e.Start()
+	send := func() error {
+		acked := make(chan error, 1)
+		if err := e.Send([]*prompb.Label{{Name: "__name__", Value: "up"}}, []prompb.Sample{{Value: 1}}, func(err error) { acked <- err }); err != nil {
+			return err
+		}
+		// the batch is sent without waiting for more series.
+		select {
+		case err := <-acked:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("series not acknowledged")
+		}
+		return nil
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("got error %v for a delivered series", err)
+	}
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if err := send(); err == nil {
+		t.Fatal("got no error for a dropped series")
+	}
+	e.Stop()
+	if err := send(); err != ErrEndpointStopped {
+		t.Fatalf("got error %v after stop, want %v", err, ErrEndpointStopped)
+	}
+}
+
+func TestEndpointRetry(t *testing.T) {
+	conf := Config{MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, MaxRetryTime: time.Second}
+	batch := []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1}, {Value: 2}},
+	}}
+
+	cases := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		conf       Config
+		requests   int32
+		dropped    string
+	}{
+		{name: "5xx retried", statuses: []int{500, 503, 200}, conf: conf, requests: 3},
+		{name: "429 retried", statuses: []int{429, 204}, conf: conf, requests: 2},
+		{name: "4xx not retried", statuses: []int{400, 200}, conf: conf, requests: 1, dropped: dropRejected},
+		// the first retry waits at most 40ms, the second ends after 60ms.
+		{name: "retry time capped", statuses: []int{500},
+			conf:     Config{MinBackoff: 40 * time.Millisecond, MaxBackoff: 80 * time.Millisecond, MaxRetryTime: 50 * time.Millisecond},
+			requests: 2, dropped: dropRetryTimeExceeded},
+		{name: "Retry-After honoured", statuses: []int{429, 200}, retryAfter: "3600", conf: conf, requests: 1, dropped: dropRetryTimeExceeded},
+	}
+	for _, c := range cases {
+		var requests int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&requests, 1)
+			status := c.statuses[len(c.statuses)-1]
+			if int(n) <= len(c.statuses) {
+				status = c.statuses[n-1]
+			}
+			if c.retryAfter != "" {
+				w.Header().Set("Retry-After", c.retryAfter)
+			}
+			w.WriteHeader(status)
+		}))
+
+		e := NewHTTPEndpoint(s.URL, 1, c.conf, zap.NewNop())
+		err := e.doSend(batch)
+		s.Close()
+
+		if (err != nil) != (c.dropped != "") {
+			t.Errorf("%s: got error %v, want the batch dropped as %q", c.name, err, c.dropped)
+		}
+		if n := atomic.LoadInt32(&requests); n != c.requests {
+			t.Errorf("%s: got %d requests, want %d", c.name, n, c.requests)
+		}
+		for _, reason := range []string{dropRejected, dropRetryTimeExceeded} {
+			want := 0.0
+			if reason == c.dropped {
+				want = 2
+			}
+			if got := testutil.ToFloat64(EndpointSamplesDropped.WithLabelValues(s.URL, reason)); got != want {
+				t.Errorf("%s: got %v samples dropped as %s, want %v", c.name, got, reason, want)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("7"); d != 7*time.Second {
+		t.Errorf("got %v, want 7s", d)
+	}
+	if d := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("got %v, want about 1h", d)
+	}
+	if d := retryAfter("soon"); d != 0 {
+		t.Errorf("got %v for an invalid header, want 0", d)
+	}
+}
+
+func TestEndpointBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		down     int32 = 1
+		mu       sync.Mutex
+		received []float64
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, b)
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		for _, ts := range req.Timeseries {
+			received = append(received, ts.Samples[0].Value)
+		}
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	conf := Config{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, MaxRetryTime: time.Millisecond, BufferPath: dir}
+	send := func(e *HTTPEndpoint, from, to int) {
+		for i := from; i < to; i++ {
+			if err := e.Send([]*prompb.Label{{Name: "__name__", Value: "up"}}, []prompb.Sample{{Value: float64(i)}}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the batches of the outage outlive the endpoint.
+	e := NewHTTPEndpoint(s.URL, 1, conf, zap.NewNop())
+	go e.Start()
+	send(e, 0, 150)
+	flushed := make(chan struct{})
+	go func() {
+		e.Flush()
+		close(flushed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	e.Stop()
+	<-flushed
+	// a request in flight when stopping would be delivered twice.
+	time.Sleep(50 * time.Millisecond)
+
+	atomic.StoreInt32(&down, 0)
+	e = NewHTTPEndpoint(s.URL, 1, conf, zap.NewNop())
+	go e.Start()
+	defer e.Stop()
+	send(e, 150, 200)
+	e.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 200 {
+		t.Fatalf("got %d series, want 200", len(received))
+	}
+	for i, v := range received {
+		if v != float64(i) {
+			t.Fatalf("got sample %v at %d, want in order", v, i)
+		}
+	}
+	if got := testutil.ToFloat64(EndpointSamplesDropped.WithLabelValues(s.URL, dropRetryTimeExceeded)); got != 0 {
+		t.Errorf("got %v samples dropped, want none", got)
+	}
+}
+
+func TestEndpointHints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		down     int32 = 1
+		mu       sync.Mutex
+		received []float64
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/-/ready" {
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, b)
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		for _, ts := range req.Timeseries {
+			received = append(received, ts.Samples[0].Value)
+		}
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	store := newHintStore(dir, 0)
+	defer store.close()
+	conf := Config{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, MaxRetryTime: 20 * time.Millisecond,
+		HintsProbeInterval: 10 * time.Millisecond}
+	e := NewHTTPEndpoint(s.URL, 1, conf, zap.NewNop())
+	if e.hints, err = store.open(s.URL); err != nil {
+		t.Fatal(err)
+	}
+	go e.Start()
+	defer e.Stop()
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := e.Send([]*prompb.Label{{Name: "__name__", Value: "up"}}, []prompb.Sample{{Value: float64(i)}}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e.Flush()
+	}
+
+	// the batches of the owner failing past MaxRetryTime are hinted.
+	send(0, 100)
+	send(100, 250)
+	if e.reachable() {
+		t.Fatal("endpoint should be unreachable")
+	}
+	if got := testutil.ToFloat64(EndpointSamplesHinted.WithLabelValues(s.URL)); got != 250 {
+		t.Fatalf("got %v samples hinted, want 250", got)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for !e.hints.empty() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	send(250, 300)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 300 {
+		t.Fatalf("got %d series, want 300", len(received))
+	}
+	for i, v := range received {
+		if v != float64(i) {
+			t.Fatalf("got sample %v at %d, want in order", v, i)
+		}
+	}
+	if got := testutil.ToFloat64(EndpointHintsReplayed.WithLabelValues(s.URL)); got != 250 {
+		t.Errorf("got %v samples replayed, want 250", got)
+	}
+}
+
+func TestEndpointHintsRecoverable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first write of every phase answers status, with Retry-After.
+	var (
+		mu         sync.Mutex
+		status     int
+		retryAfter string
+		writes     []time.Time
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/ready" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		writes = append(writes, time.Now())
+		if status != 0 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(status)
+			status = 0
+		}
+	}))
+	defer s.Close()
+	phase := func(code int, after string) {
+		mu.Lock()
+		defer mu.Unlock()
+		status, retryAfter, writes = code, after, nil
+	}
+
+	store := newHintStore(dir, 0)
+	defer store.close()
+	conf := Config{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, MaxRetryTime: time.Minute,
+		HintsProbeInterval: 10 * time.Millisecond}
+	e := NewHTTPEndpoint(s.URL, 1, conf, zap.NewNop())
+	if e.hints, err = store.open(s.URL); err != nil {
+		t.Fatal(err)
+	}
+	go e.Start()
+	defer e.Stop()
+	send := func() {
+		if err := e.Send([]*prompb.Label{{Name: "__name__", Value: "up"}}, []prompb.Sample{{Value: 1}}, nil); err != nil {
+			t.Fatal(err)
+		}
+		e.Flush()
+	}
+
+	// a single 503 is retried, the endpoint stays reachable.
+	phase(http.StatusServiceUnavailable, "")
+	send()
+	if !e.reachable() || !e.hints.empty() {
+		t.Fatal("endpoint handed off on a single 503")
+	}
+	mu.Lock()
+	if len(writes) != 2 {
+		t.Fatalf("got %d writes, want the batch retried once", len(writes))
+	}
+	mu.Unlock()
+
+	// the replayed hints honour Retry-After.
+	if err := e.hint([]byte("hint"), 1); err != nil {
+		t.Fatal(err)
+	}
+	phase(http.StatusTooManyRequests, "1")
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.hints.empty() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(writes) != 2 || writes[1].Sub(writes[0]) < time.Second {
+		t.Fatalf("got hint writes at %v, want the retry after 1s", writes)
+	}
+}
@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// hintStore keeps the hints of the endpoints: the batches written while
+// their owner was unreachable, in a segment buffer per owner address. The
+// buffers outlive the endpoints, so the hints of a backend briefly removed
+// from DNS while restarting are replayed once it is back.
+type hintStore struct {
+	path     string
+	maxBytes int64
+
+	mu    sync.Mutex
+	hints map[string]*segmentBuffer
+}
+
+func newHintStore(path string, maxBytes int64) *hintStore {
+	return &hintStore{
+		path:     path,
+		maxBytes: maxBytes,
+		hints:    make(map[string]*segmentBuffer),
+	}
+}
+
+// open returns the hints of an owner, those of a previous run included.
+func (s *hintStore) open(addr string) (*segmentBuffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.hints[addr]; ok {
+		return b, nil
+	}
+	b, err := openSegmentBuffer(filepath.Join(s.path, bufferDir(addr)), defaultSegmentBytes, s.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	s.hints[addr] = b
+	return b, nil
+}
+
+// close closes the hints of every owner.
+func (s *hintStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for addr, b := range s.hints {
+		if cerr := b.close(); err == nil {
+			err = cerr
+		}
+		delete(s.hints, addr)
+	}
+	return err
+}
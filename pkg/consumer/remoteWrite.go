@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/promcluster/proxy/pkg/backend"
 	"github.com/promcluster/proxy/pkg/filter"
+	"github.com/promcluster/proxy/pkg/sharding"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
@@ -20,9 +22,6 @@ import (
 var namespace = "proxy"
 var subsystem = "consumer"
 
-// default copies number
-var defaultReplicationFactor = 1
-
 var (
 	consumeMessageFailed = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -42,33 +41,69 @@ var (
 		},
 		[]string{"endpoint"},
 	)
+	replicaSendFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replica_send_failed_total",
+			Help:      "The number of series a replica failed to accept.",
+		},
+		[]string{"endpoint"},
+	)
+	writeQuorumFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "write_quorum_failed_total",
+			Help:      "The number of messages retried as a series missed the write quorum.",
+		},
+	)
 )
 
 // RemoteConsumer writes data to remote.
 type RemoteConsumer struct {
 	backend backend.Backend
 	filters []filter.Filter
+	key     *sharding.Key
+	// replicas is the replication factor, quorum the number of replicas
+	// which must accept a series.
+	replicas int
+	quorum   int
 
 	logger     *zap.Logger
 	registerer prometheus.Registerer
 }
 
-// NewRemoteConsumer creates a new consumer.
+// NewRemoteConsumer creates a new consumer sending every series to the
+// endpoints owning its shard key.
 func NewRemoteConsumer(
 	ctx context.Context,
 	reg prometheus.Registerer,
 	b backend.Backend,
 	fs []filter.Filter,
+	key *sharding.Key,
 	l *zap.Logger) *RemoteConsumer {
-	reg.MustRegister(consumeMessageFailed, consumeMessageSuccess)
+	reg.MustRegister(consumeMessageFailed, consumeMessageSuccess, replicaSendFailed, writeQuorumFailed)
 	return &RemoteConsumer{
 		backend:    b,
 		registerer: reg,
 		filters:    fs,
+		key:        key,
+		replicas:   1,
+		quorum:     1,
 		logger:     l,
 	}
 }
 
+// Replicate writes every series to the factor distinct endpoints owning
+// it, a message is delivered once quorum of them acknowledged every
+// series as delivered or stored in their buffer. The series stored as
+// hints for an unreachable endpoint do not count towards the quorum,
+// they are held by the proxy rather than by a replica.
+func (r *RemoteConsumer) Replicate(factor, quorum int) {
+	r.replicas, r.quorum = factor, quorum
+}
+
 // HandleMessage implements Consumer interface.
 // if return true, workers will retry.
 func (r *RemoteConsumer) HandleMessage(msg []byte) (bool, error) {
@@ -95,8 +130,12 @@ func (r *RemoteConsumer) HandleMessage(msg []byte) (bool, error) {
 		return false, errors.New("empty timeseries")
 	}
 
+	// with replication, the acks of the endpoints are awaited until the
+	// write quorum of every series is reached, or cannot be reached
+	// anymore, the other acks arrive in the background.
+	q := newWriteQuorum(len(req.Timeseries))
 NEXT:
-	for _, ts := range req.Timeseries {
+	for i, ts := range req.Timeseries {
 		lbs := ts.GetLabels()
 		lset := make(model.LabelSet)
 		for _, l := range lbs {
@@ -124,15 +163,20 @@ NEXT:
 			}
 		}
 
-		// Don't use json encode labels.
-		// Labels need to be sorted.
-		endpoints, err := r.backend.Endpoints(filter.LabelsString(&lset), defaultReplicationFactor)
+		endpoints, err := r.backend.Endpoints(r.key.Of(lset), r.replicas)
 		if err != nil {
 			r.logger.Error("get endpoints from backend", zap.Error(err))
 			consumeMessageFailed.WithLabelValues("getEndpoints").Inc()
 			return true, err
 		}
 
+		// a ring with fewer members than the replication factor
+		// lowers the quorum.
+		quorum := r.quorum
+		if quorum > len(endpoints) {
+			quorum = len(endpoints)
+		}
+		q.expect(i, quorum, len(endpoints))
 		for _, e := range endpoints {
 			r.logger.Debug(
 				"Samples Detail",
@@ -140,14 +184,142 @@ NEXT:
 				zap.Any("Samples", ts.Samples),
 				zap.String("Endpoint", e.Addr()),
 			)
-			err = e.Send(lbs, ts.Samples)
+			var ack func(error)
+			if r.replicas > 1 {
+				ack = r.ack(e.Addr(), q, i)
+			}
+			err = e.Send(lbs, ts.Samples, ack)
 			if err != nil {
-				r.logger.Error("send to endpoints", zap.Error(err))
-				consumeMessageFailed.WithLabelValues("sendEndpoints").Inc()
+				r.replicaFailed(e.Addr(), err)
+				q.ack(i, false)
 				continue
 			}
+			if ack == nil {
+				q.ack(i, true)
+			}
 			consumeMessageSuccess.WithLabelValues(e.Addr()).Inc()
 		}
 	}
+
+	if missed := q.wait(); missed > 0 {
+		writeQuorumFailed.Inc()
+		return true, fmt.Errorf("%d of %d series missed the write quorum of %d", missed, len(req.Timeseries), r.quorum)
+	}
 	return false, nil
 }
+
+// ack returns the ack of a series sent to an endpoint, counting it in
+// the write quorum if delivered.
+func (r *RemoteConsumer) ack(addr string, q *writeQuorum, i int) func(error) {
+	return func(err error) {
+		switch {
+		case errors.Is(err, backend.ErrHinted):
+			r.logger.Debug("series hinted", zap.String("endpoint", addr))
+		case err != nil:
+			r.replicaFailed(addr, err)
+		}
+		q.ack(i, err == nil)
+	}
+}
+
+// writeQuorum tracks the acks of the series of a message.
+type writeQuorum struct {
+	mu sync.Mutex
+	// need holds the acks every series still needs to reach its quorum,
+	// pending the acks it still awaits.
+	need, pending []int
+	// unmet is the number of series which did not reach their quorum yet,
+	// missed of them which cannot reach it anymore.
+	unmet, missed int
+	sealed        bool
+	done          chan struct{}
+}
+
+func newWriteQuorum(series int) *writeQuorum {
+	return &writeQuorum{
+		need:    make([]int, series),
+		pending: make([]int, series),
+		done:    make(chan struct{}),
+	}
+}
+
+// expect sets the quorum of series i, sent to n endpoints.
+func (q *writeQuorum) expect(i, quorum, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.need[i], q.pending[i] = quorum, n
+	if quorum > 0 {
+		q.unmet++
+	}
+}
+
+// ack counts the ack of series i by an endpoint.
+func (q *writeQuorum) ack(i int, delivered bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[i]--
+	switch {
+	case q.need[i] <= 0:
+	case delivered:
+		q.need[i]--
+		if q.need[i] == 0 {
+			q.unmet--
+		}
+	case q.need[i] == q.pending[i]+1:
+		// the first failure the quorum cannot make up for.
+		q.missed++
+	}
+	q.check()
+}
+
+// wait waits until every series reached its quorum, or one cannot reach
+// it anymore, and returns the number of series which missed it.
+func (q *writeQuorum) wait() int {
+	q.mu.Lock()
+	q.sealed = true
+	q.check()
+	q.mu.Unlock()
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.missed
+}
+
+func (q *writeQuorum) check() {
+	if !q.sealed || (q.unmet > 0 && q.missed == 0) {
+		return
+	}
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+}
+
+// replicaFailed counts a series an endpoint failed to accept.
+func (r *RemoteConsumer) replicaFailed(addr string, err error) {
+	r.logger.Error("send to endpoints", zap.String("endpoint", addr), zap.Error(err))
+	consumeMessageFailed.WithLabelValues("sendEndpoints").Inc()
+	replicaSendFailed.WithLabelValues(addr).Inc()
+}
+
+// Owners returns the addresses of the endpoints owning a shard key.
+func (r *RemoteConsumer) Owners(key string) ([]string, error) {
+	endpoints, err := r.backend.Endpoints(key, r.replicas)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.Addr())
+	}
+	return addrs, nil
+}
+
+// Lookup returns the shard key of a series and the endpoints owning it.
+func (r *RemoteConsumer) Lookup(lset model.LabelSet) (string, []string, error) {
+	key := r.key.Of(lset)
+	owners, err := r.Owners(key)
+	return key, owners, err
+}
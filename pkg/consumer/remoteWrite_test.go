@@ -2,11 +2,16 @@ package consumer
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/promcluster/proxy/pkg/backend"
 	"github.com/promcluster/proxy/pkg/filter"
+	"github.com/promcluster/proxy/pkg/sharding"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
@@ -32,7 +37,7 @@ func TestRemoteConsumer(t *testing.T) {
 	res := snappy.Encode(nil, data)
 	m := &mockBackend{}
 	f := filter.NewEmptyFilter()
-	r := NewRemoteConsumer(context.TODO(), prometheus.DefaultRegisterer, m, []filter.Filter{f}, zap.NewExample())
+	r := NewRemoteConsumer(context.TODO(), prometheus.DefaultRegisterer, m, []filter.Filter{f}, sharding.NewKey(sharding.Config{}), zap.NewExample())
 	_, err = r.HandleMessage(res)
 	if err != nil {
 		t.Fatal(err)
@@ -51,8 +56,220 @@ func (e *mockEndpoint) Start() {}
 
 func (e *mockEndpoint) Stop() {}
 
+func (e *mockEndpoint) Flush() {}
+
 func (e *mockEndpoint) Addr() string { return "test" }
 
-func (e *mockEndpoint) Send([]*prompb.Label, []prompb.Sample) error {
+func (e *mockEndpoint) Send(_ []*prompb.Label, _ []prompb.Sample, ack func(error)) error {
+	if ack != nil {
+		go ack(nil)
+	}
+	return nil
+}
+
+// replicaBackend owns every key by its endpoints, in order.
+type replicaBackend struct {
+	endpoints []backend.Endpoint
+}
+
+func (m *replicaBackend) Endpoints(key string, rep int) ([]backend.Endpoint, error) {
+	if rep > len(m.endpoints) {
+		rep = len(m.endpoints)
+	}
+	return m.endpoints[:rep], nil
+}
+
+type replicaEndpoint struct {
+	mockEndpoint
+	addr string
+	err  error
+	// acked is the error the series are acknowledged with.
+	acked error
+	sent  int
+}
+
+func (e *replicaEndpoint) Addr() string { return e.addr }
+
+func (e *replicaEndpoint) Send(_ []*prompb.Label, _ []prompb.Sample, ack func(error)) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.sent++
+	if ack != nil {
+		go ack(e.acked)
+	}
 	return nil
 }
+
+func TestRemoteConsumerQuorum(t *testing.T) {
+	var wq prompb.WriteRequest
+	wq.Timeseries = []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "lname", Value: "v1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: time.Now().Unix() * 1000}},
+	}}
+	data, err := proto.Marshal(&wq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := snappy.Encode(nil, data)
+
+	down := errors.New("down")
+	cases := []struct {
+		errs     []error
+		acks     []error
+		replicas int
+		quorum   int
+		retry    bool
+	}{
+		{errs: []error{nil, nil, nil}, replicas: 3, quorum: 2},
+		{errs: []error{nil, nil, nil}, replicas: 2, quorum: 2},
+		{errs: []error{nil, down, nil}, replicas: 3, quorum: 2},
+		{errs: []error{nil, down, down}, replicas: 3, quorum: 2, retry: true},
+		{errs: []error{nil, down, down}, replicas: 3, quorum: 1},
+		// the quorum is capped by the members of the ring.
+		{errs: []error{nil}, replicas: 3, quorum: 2},
+		// hinted series do not count towards the quorum.
+		{errs: []error{nil, nil, nil}, acks: []error{nil, backend.ErrHinted, backend.ErrHinted}, replicas: 3, quorum: 2, retry: true},
+		{errs: []error{nil, nil, nil}, acks: []error{nil, backend.ErrHinted, nil}, replicas: 3, quorum: 2},
+	}
+	for i, c := range cases {
+		b := &replicaBackend{}
+		var eps []*replicaEndpoint
+		for j, err := range c.errs {
+			e := &replicaEndpoint{addr: fmt.Sprintf("e%d", j), err: err}
+			if c.acks != nil {
+				e.acked = c.acks[j]
+			}
+			eps = append(eps, e)
+			b.endpoints = append(b.endpoints, e)
+		}
+		r := NewRemoteConsumer(context.TODO(), prometheus.NewRegistry(), b, nil, sharding.NewKey(sharding.Config{}), zap.NewNop())
+		r.Replicate(c.replicas, c.quorum)
+		retry, err := r.HandleMessage(msg)
+		if retry != c.retry || (err != nil) != c.retry {
+			t.Errorf("case %d: got retry %v and error %v, want retry %v", i, retry, err, c.retry)
+		}
+		for j, e := range eps {
+			want := 0
+			if j < c.replicas && e.err == nil {
+				want = 1
+			}
+			if e.sent != want {
+				t.Errorf("case %d: replica %s got %d series, want %d", i, e.addr, e.sent, want)
+			}
+		}
+	}
+}
+
+func TestRemoteConsumerQuorumDelivery(t *testing.T) {
+	var wq prompb.WriteRequest
+	wq.Timeseries = []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "lname", Value: "v1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: time.Now().Unix() * 1000}},
+	}}
+	data, err := proto.Marshal(&wq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := snappy.Encode(nil, data)
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	conf := backend.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetryTime: 10 * time.Millisecond}
+	b := &replicaBackend{}
+	for _, url := range []string{ok.URL, failing.URL} {
+		e := backend.NewHTTPEndpoint(url, 1, conf, zap.NewNop())
+		go e.Start()
+		defer e.Stop()
+		b.endpoints = append(b.endpoints, e)
+	}
+	r := NewRemoteConsumer(context.TODO(), prometheus.NewRegistry(), b, nil, sharding.NewKey(sharding.Config{}), zap.NewNop())
+
+	// the failing replica does not count towards the quorum.
+	r.Replicate(2, 2)
+	if retry, err := r.HandleMessage(msg); !retry || err == nil {
+		t.Fatalf("got retry %v and error %v, want the message retried", retry, err)
+	}
+	r.Replicate(2, 1)
+	if retry, err := r.HandleMessage(msg); retry || err != nil {
+		t.Fatalf("got retry %v and error %v, want the message delivered", retry, err)
+	}
+
+	// a stopped replica fails the quorum too.
+	stopped := backend.NewHTTPEndpoint(ok.URL, 1, conf, zap.NewNop())
+	stopped.Stop()
+	b.endpoints[0] = stopped
+	if retry, err := r.HandleMessage(msg); !retry || err == nil {
+		t.Fatalf("got retry %v and error %v with the replicas stopped or failing, want the message retried", retry, err)
+	}
+}
+
+func TestRemoteConsumerQuorumReturnsEarly(t *testing.T) {
+	var wq prompb.WriteRequest
+	wq.Timeseries = []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "lname", Value: "v1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: time.Now().Unix() * 1000}},
+	}}
+	data, err := proto.Marshal(&wq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := snappy.Encode(nil, data)
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	// the down replica retries for longer than the test waits.
+	conf := backend.Config{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, MaxRetryTime: time.Minute}
+	delivering := backend.NewHTTPEndpoint(ok.URL, 1, conf, zap.NewNop())
+	retrying := backend.NewHTTPEndpoint(down.URL, 1, conf, zap.NewNop())
+	stopped := backend.NewHTTPEndpoint(ok.URL, 1, conf, zap.NewNop())
+	stopped.Stop()
+	for _, e := range []backend.Endpoint{delivering, retrying} {
+		go e.Start()
+		defer e.Stop()
+	}
+	b := &replicaBackend{endpoints: []backend.Endpoint{delivering, retrying}}
+	r := NewRemoteConsumer(context.TODO(), prometheus.NewRegistry(), b, nil, sharding.NewKey(sharding.Config{}), zap.NewNop())
+
+	handle := func() (bool, error) {
+		type result struct {
+			retry bool
+			err   error
+		}
+		res := make(chan result, 1)
+		go func() {
+			retry, err := r.HandleMessage(msg)
+			res <- result{retry, err}
+		}()
+		select {
+		case res := <-res:
+			return res.retry, res.err
+		case <-time.After(time.Second):
+			t.Fatal("message still awaiting the retrying replica")
+		}
+		return false, nil
+	}
+
+	// the message is delivered once the quorum is reached.
+	r.Replicate(2, 1)
+	if retry, err := handle(); retry || err != nil {
+		t.Fatalf("got retry %v and error %v, want the message delivered", retry, err)
+	}
+
+	// and retried as soon as the quorum cannot be reached.
+	b.endpoints = []backend.Endpoint{stopped, retrying}
+	r.Replicate(2, 2)
+	if retry, err := handle(); !retry || err == nil {
+		t.Fatalf("got retry %v and error %v, want the message retried", retry, err)
+	}
+}
@@ -106,6 +106,15 @@ func (m *MetricsFilter) Filt(labels *model.LabelSet) error {
 	return nil
 }
 
+// Usage returns the number of series met since the last flush and the
+// series limit, zero if the filter is disabled.
+func (m *MetricsFilter) Usage() (count, limit uint64) {
+	if m.disabled {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&m.seriesCount), m.maxSeriesCount
+}
+
 // Purge resets series counter.
 func (m *MetricsFilter) Purge() {
 	ticker := time.NewTicker(m.flushInterval)
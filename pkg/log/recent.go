@@ -0,0 +1,112 @@
+package log
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Entry is a recorded log entry.
+type Entry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	// Fields are the JSON encoded fields of the entry.
+	Fields string
+}
+
+// RecentErrors records the last error level entries of a logger.
+type RecentErrors struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// NewRecentErrors creates a recorder of the last size error entries.
+func NewRecentErrors(size int) *RecentErrors {
+	return &RecentErrors{entries: make([]Entry, size)}
+}
+
+// Wrap returns a logger also writing its error entries to r.
+func (r *RecentErrors) Wrap(l *zap.Logger) *zap.Logger {
+	return l.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, &recentCore{
+			LevelEnabler: zapcore.ErrorLevel,
+			enc:          zapcore.NewJSONEncoder(zapcore.EncoderConfig{}),
+			recent:       r,
+		})
+	}))
+}
+
+// Entries returns the recorded entries, the newest first.
+func (r *RecentErrors) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	res := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return res
+}
+
+func (r *RecentErrors) add(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// recentCore is the zapcore.Core recording entries into a RecentErrors.
+type recentCore struct {
+	zapcore.LevelEnabler
+	enc    zapcore.Encoder
+	recent *RecentErrors
+}
+
+func (c *recentCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &recentCore{LevelEnabler: c.LevelEnabler, enc: enc, recent: c.recent}
+}
+
+func (c *recentCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *recentCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+	c.recent.add(Entry{
+		Time:    e.Time,
+		Level:   e.Level.String(),
+		Message: e.Message,
+		Fields:  strings.TrimSpace(buf.String()),
+	})
+	buf.Free()
+	return nil
+}
+
+func (c *recentCore) Sync() error {
+	return nil
+}
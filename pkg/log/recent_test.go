@@ -0,0 +1,28 @@
+package log
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRecentErrors(t *testing.T) {
+	r := NewRecentErrors(2)
+	l := r.Wrap(zap.NewNop()).With(zap.String("service", "test"))
+	l.Info("ignored")
+	l.Error("first", zap.Error(errors.New("a")))
+	l.Error("second")
+	l.Error("third", zap.Int("n", 3))
+
+	got := r.Entries()
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got))
+	}
+	if got[0].Message != "third" || got[1].Message != "second" {
+		t.Fatalf("got %q and %q, want the newest first", got[0].Message, got[1].Message)
+	}
+	if want := `{"service":"test","n":3}`; got[0].Fields != want {
+		t.Fatalf("got fields %s, want %s", got[0].Fields, want)
+	}
+}
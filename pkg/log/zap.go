@@ -32,6 +32,22 @@ func InitLogger(cfg Config) (*zap.Logger, error) {
 	return logger, nil
 }
 
+// NewFileLogger creates an info level logger writing JSON records to
+// the rotating file at path, or to stdout if path is empty.
+func NewFileLogger(path string, maxBytes int64, maxBackups int) (*zap.Logger, error) {
+	var w zapcore.WriteSyncer = os.Stdout
+	if path != "" {
+		f, err := NewRotatingFile(path, maxBytes, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	encConf := zap.NewProductionEncoderConfig()
+	encConf.EncodeTime = SimpleTimeEncoder
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encConf), w, zapcore.InfoLevel)), nil
+}
+
 // SimpleTimeEncoder serializes a time.Time to a simplified format without timezone.
 func SimpleTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
 	enc.AppendString(t.Format("2006-01-02 15:04:05.000"))
@@ -0,0 +1,211 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// maxDiffs limits the differences reported for a response.
+const maxDiffs = 10
+
+// Diff compares two Prometheus API JSON responses and returns their
+// differences, at most maxDiffs. Numbers and numeric strings, such as
+// sample values, are equal within the relative tolerance, sample
+// timestamps must be equal. Arrays are
+// compared regardless of their order, except [timestamp, value] samples
+// and the samples of "values"; series are matched by their labels.
+func Diff(a, b []byte, tolerance float64) ([]string, error) {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return nil, fmt.Errorf("decode primary response: %w", err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return nil, fmt.Errorf("decode mirror response: %w", err)
+	}
+	d := &differ{tolerance: tolerance}
+	d.compare("", "", va, vb)
+	return d.diffs, nil
+}
+
+type differ struct {
+	tolerance float64
+	diffs     []string
+}
+
+func (d *differ) add(path, format string, args ...interface{}) {
+	if len(d.diffs) < maxDiffs {
+		d.diffs = append(d.diffs, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *differ) compare(path, key string, a, b interface{}) {
+	if len(d.diffs) >= maxDiffs {
+		return
+	}
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			d.add(path, "%s != %s", canonical(a), canonical(b))
+			return
+		}
+		for _, k := range sortedKeys(va, vb) {
+			x, inA := va[k]
+			y, inB := vb[k]
+			switch {
+			case !inB:
+				d.add(join(path, k), "missing in mirror")
+			case !inA:
+				d.add(join(path, k), "only in mirror")
+			default:
+				d.compare(join(path, k), k, x, y)
+			}
+		}
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			d.add(path, "%s != %s", canonical(a), canonical(b))
+			return
+		}
+		if isSample(va) && isSample(vb) {
+			d.compareSample(path, va, vb)
+			return
+		}
+		if key == "value" || key == "values" || isSample(va) {
+			d.compareOrdered(path, va, vb)
+			return
+		}
+		d.compareUnordered(path, va, vb)
+	default:
+		if !d.equal(a, b) {
+			d.add(path, "%s != %s", canonical(a), canonical(b))
+		}
+	}
+}
+
+func (d *differ) compareOrdered(path string, a, b []interface{}) {
+	if len(a) != len(b) {
+		d.add(path, "%d elements != %d elements", len(a), len(b))
+		return
+	}
+	for i := range a {
+		d.compare(fmt.Sprintf("%s[%d]", path, i), "", a[i], b[i])
+	}
+}
+
+// compareSample compares the timestamps of two samples exactly, the
+// tolerance only applies to their values.
+func (d *differ) compareSample(path string, a, b []interface{}) {
+	if a[0] != b[0] {
+		d.add(path+"[0]", "%s != %s", canonical(a[0]), canonical(b[0]))
+	}
+	d.compare(path+"[1]", "", a[1], b[1])
+}
+
+// compareUnordered matches the elements of a and b by their key.
+func (d *differ) compareUnordered(path string, a, b []interface{}) {
+	byKey := make(map[string][]interface{}, len(b))
+	for _, e := range b {
+		k := elementKey(e)
+		byKey[k] = append(byKey[k], e)
+	}
+	for _, e := range a {
+		k := elementKey(e)
+		match := byKey[k]
+		if len(match) == 0 {
+			d.add(path+"["+k+"]", "missing in mirror")
+			continue
+		}
+		byKey[k] = match[1:]
+		d.compare(path+"["+k+"]", "", e, match[0])
+	}
+	keys := make([]string, 0, len(byKey))
+	for k, rest := range byKey {
+		if len(rest) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		d.add(path+"["+k+"]", "only in mirror")
+	}
+}
+
+// isSample reports whether a is a [timestamp, "value"] sample,
+// the result of scalar queries.
+func isSample(a []interface{}) bool {
+	if len(a) != 2 {
+		return false
+	}
+	_, ts := a[0].(float64)
+	_, v := a[1].(string)
+	return ts && v
+}
+
+// elementKey identifies an array element, series by their labels.
+func elementKey(e interface{}) string {
+	if m, ok := e.(map[string]interface{}); ok {
+		if metric, ok := m["metric"]; ok {
+			return canonical(metric)
+		}
+	}
+	return canonical(e)
+}
+
+func (d *differ) equal(a, b interface{}) bool {
+	if a == b {
+		return true
+	}
+	fa, okA := number(a)
+	fb, okB := number(b)
+	if !okA || !okB {
+		return false
+	}
+	if math.IsNaN(fa) || math.IsNaN(fb) {
+		return math.IsNaN(fa) && math.IsNaN(fb)
+	}
+	if fa == fb {
+		return true
+	}
+	return math.Abs(fa-fb) <= d.tolerance*math.Max(math.Abs(fa), math.Abs(fb))
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func canonical(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func sortedKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,220 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/upstream"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var namespace = "proxy"
+var subsystem = "mirror"
+
+// results of the mirrored requests.
+const (
+	resultMatch    = "match"
+	resultMismatch = "mismatch"
+	resultError    = "error"
+	resultDropped  = "dropped"
+)
+
+var mirrorRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "requests_total",
+		Help:      "The number of mirrored requests by path and comparison result.",
+	},
+	[]string{"path", "result"},
+)
+
+// defaults of the zero Config values.
+var (
+	defaultTimeout       = 2 * time.Minute
+	defaultMaxConcurrent = 10
+)
+
+// MaxResponseBytes limits the size of the compared responses.
+const MaxResponseBytes = 16 * 1024 * 1024
+
+// Config configuration
+type Config struct {
+	Enable bool `yaml:"enable"`
+	// Addr is the base URL of the mirror query upstream.
+	Addr string `yaml:"addr"`
+	// SampleRatio is the share of the read requests mirrored, from 0 to 1.
+	SampleRatio float64 `yaml:"sampleRatio"`
+	// Tolerance is the relative difference tolerated between numbers.
+	Tolerance float64       `yaml:"tolerance"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// MaxConcurrent mirrored requests, further requests are dropped.
+	MaxConcurrent int `yaml:"maxConcurrent"`
+
+	TLS         upstream.TLSConfig `yaml:"tls"`
+	BearerToken string             `yaml:"bearerToken"`
+}
+
+// Request is a read request answered by the primary upstream.
+type Request struct {
+	Method string
+	Path   string
+	Form   url.Values
+	Header http.Header
+
+	// Status and Body of the primary response.
+	Status int
+	Body   []byte
+}
+
+// Mirror replays a sample of the read requests to a second upstream and
+// compares its responses with the primary ones.
+type Mirror struct {
+	addr   string
+	conf   Config
+	client *http.Client
+	sem    chan struct{}
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	logger *zap.Logger
+}
+
+// New creates a mirror of conf.Addr.
+func New(reg prometheus.Registerer, conf Config, logger *zap.Logger) (*Mirror, error) {
+	reg.MustRegister(mirrorRequests)
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultTimeout
+	}
+	if conf.MaxConcurrent <= 0 {
+		conf.MaxConcurrent = defaultMaxConcurrent
+	}
+	tlsConfig, err := conf.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	addr := strings.TrimRight(conf.Addr, "/")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Mirror{
+		addr: addr,
+		conf: conf,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				MaxIdleConnsPerHost: conf.MaxConcurrent,
+				IdleConnTimeout:     10 * time.Minute,
+			},
+		},
+		sem:    make(chan struct{}, conf.MaxConcurrent),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger: logger.With(zap.String("service", "mirror")),
+	}, nil
+}
+
+// Sample reports whether a request is mirrored.
+func (m *Mirror) Sample() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rand.Float64() < m.conf.SampleRatio
+}
+
+// Send replays the request to the mirror in the background, it is
+// dropped if MaxConcurrent requests are already mirrored.
+func (m *Mirror) Send(r *Request) {
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		mirrorRequests.WithLabelValues(r.Path, resultDropped).Inc()
+		return
+	}
+	go func() {
+		defer func() { <-m.sem }()
+		m.compare(r)
+	}()
+}
+
+func (m *Mirror) compare(r *Request) {
+	status, body, err := m.do(r)
+	if err != nil {
+		mirrorRequests.WithLabelValues(r.Path, resultError).Inc()
+		m.logger.Warn("mirror request", zap.String("path", r.Path), zap.Error(err))
+		return
+	}
+
+	var diffs []string
+	if status != r.Status {
+		diffs = append(diffs, "status: "+strconv.Itoa(r.Status)+" != "+strconv.Itoa(status))
+	} else if d, err := Diff(r.Body, body, m.conf.Tolerance); err != nil {
+		diffs = append(diffs, err.Error())
+	} else {
+		diffs = d
+	}
+	if len(diffs) == 0 {
+		mirrorRequests.WithLabelValues(r.Path, resultMatch).Inc()
+		return
+	}
+	mirrorRequests.WithLabelValues(r.Path, resultMismatch).Inc()
+	m.logger.Warn("mirror mismatch",
+		zap.String("path", r.Path),
+		zap.String("query", r.Form.Encode()),
+		zap.Strings("diffs", diffs))
+}
+
+// do sends the request to the mirror and returns its response.
+func (m *Mirror) do(r *Request) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.conf.Timeout)
+	defer cancel()
+
+	var (
+		req *http.Request
+		err error
+	)
+	if r.Method == http.MethodPost {
+		req, err = http.NewRequest(http.MethodPost, m.addr+r.Path, strings.NewReader(r.Form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(r.Method, m.addr+r.Path+"?"+r.Form.Encode(), nil)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, vs := range r.Header {
+		if k == "Authorization" || k == "Accept-Encoding" || k == "Content-Length" || k == "Content-Type" {
+			continue
+		}
+		req.Header[k] = vs
+	}
+	if m.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.conf.BearerToken)
+	}
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
+		resp.Body.Close()
+	}()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxResponseBytes))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
@@ -0,0 +1,100 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestDiff(t *testing.T) {
+	primary := `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"job":"a"},"value":[1,"1.0000001"]},
+		{"metric":{"job":"b"},"value":[1,"2"]}]}}`
+	cases := []struct {
+		mirror string
+		diffs  []string
+	}{
+		// order and tolerated float differences.
+		{`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"job":"b"},"value":[1,"2"]},
+			{"metric":{"job":"a"},"value":[1,"1"]}]}}`, nil},
+		{`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"job":"a"},"value":[1,"1"]},
+			{"metric":{"job":"c"},"value":[1,"3"]}]}}`, []string{
+			`data.result[{"job":"b"}]: missing in mirror`,
+			`data.result[{"job":"c"}]: only in mirror`,
+		}},
+		{`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"job":"a"},"value":[1,"1.1"]},
+			{"metric":{"job":"b"},"value":[2,"2"]}]}}`, []string{
+			`data.result[{"job":"a"}].value[1]: "1.0000001" != "1.1"`,
+			`data.result[{"job":"b"}].value[0]: 1 != 2`,
+		}},
+		// timestamps are compared exactly.
+		{`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"job":"a"},"value":[1.0000001,"1"]},
+			{"metric":{"job":"b"},"value":[1,"2"]}]}}`, []string{
+			`data.result[{"job":"a"}].value[0]: 1 != 1.0000001`,
+		}},
+	}
+	for i, c := range cases {
+		diffs, err := Diff([]byte(primary), []byte(c.mirror), 1e-6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(diffs) != fmt.Sprint(c.diffs) {
+			t.Errorf("case %d: got diffs %q, want %q", i, diffs, c.diffs)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Scope-OrgID") != "team-a" || r.FormValue("query") != "up" {
+			t.Errorf("unexpected request %s %v", r.Header, r.Form)
+		}
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1,"2"]}}`)
+	}))
+	defer s.Close()
+
+	m, err := New(prometheus.NewRegistry(), Config{Addr: s.URL, SampleRatio: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Sample() {
+		t.Fatal("expected request to be sampled")
+	}
+	for _, body := range []string{
+		`{"status":"success","data":{"resultType":"scalar","result":[1,"2"]}}`,
+		`{"status":"success","data":{"resultType":"scalar","result":[1,"3"]}}`,
+	} {
+		m.Send(&Request{
+			Method: http.MethodPost,
+			Path:   "/api/v1/query",
+			Form:   url.Values{"query": []string{"up"}},
+			Header: http.Header{"X-Scope-Orgid": []string{"team-a"}},
+			Status: http.StatusOK,
+			Body:   []byte(body),
+		})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		match := testutil.ToFloat64(mirrorRequests.WithLabelValues("/api/v1/query", resultMatch))
+		mismatch := testutil.ToFloat64(mirrorRequests.WithLabelValues("/api/v1/query", resultMismatch))
+		if match == 1 && mismatch == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v matches and %v mismatches, want 1 and 1", match, mismatch)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
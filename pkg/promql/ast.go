@@ -0,0 +1,335 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ValueType is the type an expression evaluates to.
+type ValueType string
+
+// The valid value types.
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// Expr is a node of a parsed PromQL expression.
+type Expr interface {
+	// Type returns the type the expression evaluates to.
+	Type() ValueType
+	// String returns the expression in PromQL syntax.
+	String() string
+}
+
+// NumberLiteral is a scalar literal.
+type NumberLiteral struct {
+	Val float64
+}
+
+// StringLiteral is a string literal.
+type StringLiteral struct {
+	Val string
+}
+
+// VectorSelector selects the series matching its matchers.
+type VectorSelector struct {
+	Name     string
+	Matchers []*labels.Matcher
+	Offset   time.Duration
+}
+
+// MatrixSelector selects a range of samples of a vector selector.
+type MatrixSelector struct {
+	Name     string
+	Matchers []*labels.Matcher
+	Range    time.Duration
+	Offset   time.Duration
+}
+
+// SubqueryExpr evaluates its expression over a range.
+type SubqueryExpr struct {
+	Expr   Expr
+	Range  time.Duration
+	Step   time.Duration
+	Offset time.Duration
+}
+
+// Call is a function call.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// AggregateExpr is an aggregation over a vector.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+}
+
+// BinaryExpr is a binary operation.
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	// VectorMatching is nil if no matching modifier is given.
+	VectorMatching *VectorMatching
+}
+
+// VectorMatching describes how the samples of two vectors are matched.
+type VectorMatching struct {
+	// Card is "one-to-one", "group_left" or "group_right".
+	Card string
+	On   bool
+	// Labels are the on or ignoring labels.
+	Labels []string
+	// Include are the labels of group_left or group_right.
+	Include []string
+}
+
+// ParenExpr wraps an expression in parentheses.
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr is a unary + or -.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// Type implements Expr.
+func (e *NumberLiteral) Type() ValueType { return ValueTypeScalar }
+
+// Type implements Expr.
+func (e *StringLiteral) Type() ValueType { return ValueTypeString }
+
+// Type implements Expr.
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+
+// Type implements Expr.
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+
+// Type implements Expr.
+func (e *SubqueryExpr) Type() ValueType { return ValueTypeMatrix }
+
+// Type implements Expr.
+func (e *Call) Type() ValueType {
+	if scalarFunctions[e.Func] {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+// Type implements Expr.
+func (e *AggregateExpr) Type() ValueType { return ValueTypeVector }
+
+// Type implements Expr.
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+// Type implements Expr.
+func (e *ParenExpr) Type() ValueType { return e.Expr.Type() }
+
+// Type implements Expr.
+func (e *UnaryExpr) Type() ValueType { return e.Expr.Type() }
+
+// scalarFunctions are the functions returning a scalar.
+var scalarFunctions = map[string]bool{
+	"pi":     true,
+	"scalar": true,
+	"time":   true,
+}
+
+// aggregators are the aggregation operators,
+// the value tells whether the aggregation takes a parameter.
+var aggregators = map[string]bool{
+	"sum":          false,
+	"avg":          false,
+	"count":        false,
+	"min":          false,
+	"max":          false,
+	"group":        false,
+	"stddev":       false,
+	"stdvar":       false,
+	"topk":         true,
+	"bottomk":      true,
+	"count_values": true,
+	"quantile":     true,
+}
+
+// IsComparison reports whether op is a comparison operator.
+func IsComparison(op string) bool {
+	switch op {
+	case "==", "!=", ">", "<", ">=", "<=":
+		return true
+	}
+	return false
+}
+
+// IsSetOperator reports whether op is a set operator.
+func IsSetOperator(op string) bool {
+	switch op {
+	case "and", "or", "unless":
+		return true
+	}
+	return false
+}
+
+func (e *NumberLiteral) String() string {
+	return strconv.FormatFloat(e.Val, 'g', -1, 64)
+}
+
+func (e *StringLiteral) String() string {
+	return strconv.Quote(e.Val)
+}
+
+func (e *VectorSelector) String() string {
+	return selectorString(e.Name, e.Matchers) + offsetString(e.Offset)
+}
+
+func (e *MatrixSelector) String() string {
+	return fmt.Sprintf("%s[%s]%s", selectorString(e.Name, e.Matchers), durationString(e.Range), offsetString(e.Offset))
+}
+
+func (e *SubqueryExpr) String() string {
+	step := ""
+	if e.Step > 0 {
+		step = durationString(e.Step)
+	}
+	return fmt.Sprintf("%s[%s:%s]%s", e.Expr, durationString(e.Range), step, offsetString(e.Offset))
+}
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, a := range e.Args {
+		args = append(args, a.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.Func, strings.Join(args, ", "))
+}
+
+func (e *AggregateExpr) String() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Without {
+		fmt.Fprintf(&b, " without (%s) ", strings.Join(e.Grouping, ", "))
+	} else if len(e.Grouping) > 0 {
+		fmt.Fprintf(&b, " by (%s) ", strings.Join(e.Grouping, ", "))
+	}
+	b.WriteString("(")
+	if e.Param != nil {
+		fmt.Fprintf(&b, "%s, ", e.Param)
+	}
+	fmt.Fprintf(&b, "%s)", e.Expr)
+	return b.String()
+}
+
+func (e *BinaryExpr) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s ", e.LHS, e.Op)
+	if e.ReturnBool {
+		b.WriteString("bool ")
+	}
+	if m := e.VectorMatching; m != nil {
+		if m.On {
+			fmt.Fprintf(&b, "on (%s) ", strings.Join(m.Labels, ", "))
+		} else {
+			fmt.Fprintf(&b, "ignoring (%s) ", strings.Join(m.Labels, ", "))
+		}
+		if m.Card == "group_left" || m.Card == "group_right" {
+			fmt.Fprintf(&b, "%s (%s) ", m.Card, strings.Join(m.Include, ", "))
+		}
+	}
+	b.WriteString(e.RHS.String())
+	return b.String()
+}
+
+func (e *ParenExpr) String() string {
+	return fmt.Sprintf("(%s)", e.Expr)
+}
+
+func (e *UnaryExpr) String() string {
+	return e.Op + e.Expr.String()
+}
+
+func selectorString(name string, ms []*labels.Matcher) string {
+	strs := make([]string, 0, len(ms))
+	for _, m := range ms {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value == name {
+			continue
+		}
+		strs = append(strs, m.String())
+	}
+	if len(strs) == 0 && name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(strs, ", "))
+}
+
+func offsetString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return " offset " + durationString(d)
+}
+
+// durationString formats d with the largest PromQL duration unit
+// dividing it, single units are understood by every Prometheus version.
+func durationString(d time.Duration) string {
+	units := []struct {
+		unit string
+		d    time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if d != 0 && d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.unit)
+		}
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// Inspect traverses e in depth-first order, it stops descending
+// into a node if f returns false.
+func Inspect(e Expr, f func(Expr) bool) {
+	if e == nil || !f(e) {
+		return
+	}
+	switch n := e.(type) {
+	case *SubqueryExpr:
+		Inspect(n.Expr, f)
+	case *Call:
+		for _, a := range n.Args {
+			Inspect(a, f)
+		}
+	case *AggregateExpr:
+		Inspect(n.Param, f)
+		Inspect(n.Expr, f)
+	case *BinaryExpr:
+		Inspect(n.LHS, f)
+		Inspect(n.RHS, f)
+	case *ParenExpr:
+		Inspect(n.Expr, f)
+	case *UnaryExpr:
+		Inspect(n.Expr, f)
+	}
+}
@@ -0,0 +1,322 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// itemType identifies the type of lexed items.
+type itemType int
+
+const (
+	itemEOF itemType = iota
+	itemIdentifier
+	itemNumber
+	itemDuration
+	itemString
+
+	itemLeftParen
+	itemRightParen
+	itemLeftBrace
+	itemRightBrace
+	itemLeftBracket
+	itemRightBracket
+	itemComma
+	itemColon
+	itemAssign
+
+	// operators.
+	itemADD
+	itemSUB
+	itemMUL
+	itemDIV
+	itemMOD
+	itemPOW
+	itemEQL
+	itemNEQ
+	itemLTE
+	itemLSS
+	itemGTE
+	itemGTR
+	itemEQLRegex
+	itemNEQRegex
+	itemLAND
+	itemLOR
+	itemLUnless
+
+	// keywords.
+	itemBy
+	itemWithout
+	itemOn
+	itemIgnoring
+	itemGroupLeft
+	itemGroupRight
+	itemBool
+	itemOffset
+)
+
+var keywords = map[string]itemType{
+	"and":         itemLAND,
+	"or":          itemLOR,
+	"unless":      itemLUnless,
+	"by":          itemBy,
+	"without":     itemWithout,
+	"on":          itemOn,
+	"ignoring":    itemIgnoring,
+	"group_left":  itemGroupLeft,
+	"group_right": itemGroupRight,
+	"bool":        itemBool,
+	"offset":      itemOffset,
+}
+
+// item is a token of a PromQL expression.
+type item struct {
+	typ itemType
+	pos int
+	val string
+}
+
+func (i item) String() string {
+	if i.typ == itemEOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", i.val)
+}
+
+// isLabel reports whether the item can be used as a label name,
+// keywords are valid label names.
+func (i item) isLabel() bool {
+	if i.typ == itemIdentifier {
+		return !strings.Contains(i.val, ":")
+	}
+	_, ok := keywords[strings.ToLower(i.val)]
+	return ok
+}
+
+// lex splits input into items, the last item is always itemEOF.
+func lex(input string) ([]item, error) {
+	var items []item
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '#':
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			it, n, err := lexNumberOrDuration(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, it)
+			pos = n
+			continue
+		case isAlpha(c) || (c == ':' && pos+1 < len(input) && (isAlpha(input[pos+1]) || input[pos+1] == ':')):
+			start := pos
+			for pos < len(input) && (isAlphaNumeric(input[pos]) || input[pos] == ':') {
+				pos++
+			}
+			val := input[start:pos]
+			typ := itemIdentifier
+			if kw, ok := keywords[strings.ToLower(val)]; ok {
+				typ = kw
+			} else if l := strings.ToLower(val); l == "inf" || l == "nan" {
+				typ = itemNumber
+			}
+			items = append(items, item{typ: typ, pos: start, val: val})
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			s, n, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item{typ: itemString, pos: pos, val: s})
+			pos = n
+			continue
+		}
+
+		typ, n := lexOperator(input, pos)
+		if n == 0 {
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+		}
+		items = append(items, item{typ: typ, pos: pos, val: input[pos : pos+n]})
+		pos += n
+	}
+	return append(items, item{typ: itemEOF, pos: pos}), nil
+}
+
+func lexOperator(input string, pos int) (itemType, int) {
+	two := ""
+	if pos+1 < len(input) {
+		two = input[pos : pos+2]
+	}
+	switch two {
+	case "==":
+		return itemEQL, 2
+	case "!=":
+		return itemNEQ, 2
+	case "<=":
+		return itemLTE, 2
+	case ">=":
+		return itemGTE, 2
+	case "=~":
+		return itemEQLRegex, 2
+	case "!~":
+		return itemNEQRegex, 2
+	}
+	switch input[pos] {
+	case '(':
+		return itemLeftParen, 1
+	case ')':
+		return itemRightParen, 1
+	case '{':
+		return itemLeftBrace, 1
+	case '}':
+		return itemRightBrace, 1
+	case '[':
+		return itemLeftBracket, 1
+	case ']':
+		return itemRightBracket, 1
+	case ',':
+		return itemComma, 1
+	case ':':
+		return itemColon, 1
+	case '=':
+		return itemAssign, 1
+	case '+':
+		return itemADD, 1
+	case '-':
+		return itemSUB, 1
+	case '*':
+		return itemMUL, 1
+	case '/':
+		return itemDIV, 1
+	case '%':
+		return itemMOD, 1
+	case '^':
+		return itemPOW, 1
+	case '<':
+		return itemLSS, 1
+	case '>':
+		return itemGTR, 1
+	}
+	return itemEOF, 0
+}
+
+// lexNumberOrDuration lexes a number, or a duration if the digits
+// are directly followed by a time unit.
+func lexNumberOrDuration(input string, pos int) (item, int, error) {
+	start := pos
+	if strings.HasPrefix(strings.ToLower(input[pos:]), "0x") {
+		pos += 2
+		for pos < len(input) && strings.IndexByte("0123456789abcdefABCDEF", input[pos]) >= 0 {
+			pos++
+		}
+		return item{typ: itemNumber, pos: start, val: input[start:pos]}, pos, nil
+	}
+
+	// durations are sequences of digits and units, e.g. 1h30m.
+	if n := scanDuration(input, pos); n > pos {
+		return item{typ: itemDuration, pos: start, val: input[start:n]}, n, nil
+	}
+
+	for pos < len(input) && (isDigit(input[pos]) || input[pos] == '.') {
+		pos++
+	}
+	if pos < len(input) && (input[pos] == 'e' || input[pos] == 'E') {
+		pos++
+		if pos < len(input) && (input[pos] == '+' || input[pos] == '-') {
+			pos++
+		}
+		for pos < len(input) && isDigit(input[pos]) {
+			pos++
+		}
+	}
+	if pos < len(input) && (isAlpha(input[pos]) || input[pos] == ':') {
+		return item{}, 0, fmt.Errorf("bad number or duration syntax %q", input[start:pos+1])
+	}
+	return item{typ: itemNumber, pos: start, val: input[start:pos]}, pos, nil
+}
+
+// scanDuration returns the end of the duration starting at pos,
+// or pos if there is none.
+func scanDuration(input string, pos int) int {
+	end := pos
+	for {
+		i := end
+		for i < len(input) && isDigit(input[i]) {
+			i++
+		}
+		if i == end {
+			break
+		}
+		unit := 0
+		switch {
+		case strings.HasPrefix(input[i:], "ms"):
+			unit = 2
+		case i < len(input) && strings.IndexByte("smhdwy", input[i]) >= 0:
+			unit = 1
+		}
+		if unit == 0 {
+			break
+		}
+		i += unit
+		if i < len(input) && isAlpha(input[i]) {
+			break
+		}
+		end = i
+	}
+	return end
+}
+
+// lexString lexes a quoted string and returns its unquoted value.
+func lexString(input string, pos int) (string, int, error) {
+	quote := input[pos]
+	i := pos + 1
+	for i < len(input) {
+		switch input[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			raw := input[pos : i+1]
+			s, err := unquote(raw)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s: %v", raw, err)
+			}
+			return s, i + 1, nil
+		}
+		i++
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string at position %d", pos)
+}
+
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		// rewrite into a double quoted string.
+		body := s[1 : len(s)-1]
+		body = strings.Replace(body, `\'`, `'`, -1)
+		body = strings.Replace(body, `"`, `\"`, -1)
+		s = `"` + body + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isAlphaNumeric(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
@@ -0,0 +1,524 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ParseError is returned for invalid expressions.
+type ParseError struct {
+	Pos int
+	Err string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at char %d: %s", e.Pos+1, e.Err)
+}
+
+// ParseExpr parses a PromQL expression.
+//
+// The parser understands the PromQL syntax well enough to analyse
+// queries at the proxy, it does not type check function arguments.
+func ParseExpr(input string) (Expr, error) {
+	items, err := lex(input)
+	if err != nil {
+		return nil, &ParseError{Err: err.Error()}
+	}
+	p := &parser{items: items}
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if it := p.peek(); it.typ != itemEOF {
+		return nil, p.errorf(it, "unexpected %s", it)
+	}
+	return e, nil
+}
+
+// ParseMetricSelector parses a vector selector, e.g. a match[] parameter.
+func ParseMetricSelector(input string) ([]*labels.Matcher, error) {
+	e, err := ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := e.(*VectorSelector)
+	if !ok {
+		return nil, &ParseError{Err: fmt.Sprintf("%q is not a vector selector", input)}
+	}
+	return vs.Matchers, nil
+}
+
+type parser struct {
+	items []item
+	pos   int
+}
+
+func (p *parser) peek() item {
+	return p.items[p.pos]
+}
+
+func (p *parser) next() item {
+	it := p.items[p.pos]
+	if it.typ != itemEOF {
+		p.pos++
+	}
+	return it
+}
+
+func (p *parser) errorf(it item, format string, args ...interface{}) error {
+	return &ParseError{Pos: it.pos, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(typ itemType, context string) (item, error) {
+	it := p.next()
+	if it.typ != typ {
+		return it, p.errorf(it, "unexpected %s in %s", it, context)
+	}
+	return it, nil
+}
+
+// precedence returns the precedence of a binary operator, 0 if
+// the item is not one.
+func precedence(typ itemType) int {
+	switch typ {
+	case itemLOR:
+		return 1
+	case itemLAND, itemLUnless:
+		return 2
+	case itemEQL, itemNEQ, itemLTE, itemLSS, itemGTE, itemGTR:
+		return 3
+	case itemADD, itemSUB:
+		return 4
+	case itemMUL, itemDIV, itemMOD:
+		return 5
+	case itemPOW:
+		return 6
+	}
+	return 0
+}
+
+// parseExpr parses binary expressions whose operators bind at least minPrec.
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		prec := precedence(op.typ)
+		if prec == 0 || prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		be := &BinaryExpr{Op: strings.ToLower(op.val), LHS: lhs}
+		if p.peek().typ == itemBool {
+			p.next()
+			if !IsComparison(be.Op) {
+				return nil, p.errorf(op, "bool modifier can only be used on comparison operators")
+			}
+			be.ReturnBool = true
+		}
+		if err := p.parseVectorMatching(be); err != nil {
+			return nil, err
+		}
+
+		// ^ is right associative.
+		nextPrec := prec + 1
+		if op.typ == itemPOW {
+			nextPrec = prec
+		}
+		if be.RHS, err = p.parseExpr(nextPrec); err != nil {
+			return nil, err
+		}
+		if be.LHS.Type() == ValueTypeString || be.RHS.Type() == ValueTypeString {
+			return nil, p.errorf(op, "binary expression must not contain strings")
+		}
+		if IsComparison(be.Op) && !be.ReturnBool && be.Type() == ValueTypeScalar {
+			return nil, p.errorf(op, "comparisons between scalars must use bool modifier")
+		}
+		lhs = be
+	}
+}
+
+func (p *parser) parseVectorMatching(be *BinaryExpr) error {
+	switch p.peek().typ {
+	case itemOn, itemIgnoring:
+		be.VectorMatching = &VectorMatching{Card: "one-to-one", On: p.next().typ == itemOn}
+		ls, err := p.parseLabels()
+		if err != nil {
+			return err
+		}
+		be.VectorMatching.Labels = ls
+	default:
+		return nil
+	}
+
+	switch p.peek().typ {
+	case itemGroupLeft, itemGroupRight:
+		be.VectorMatching.Card = strings.ToLower(p.next().val)
+		if p.peek().typ == itemLeftParen {
+			ls, err := p.parseLabels()
+			if err != nil {
+				return err
+			}
+			be.VectorMatching.Include = ls
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	switch it := p.peek(); it.typ {
+	case itemADD, itemSUB:
+		p.next()
+		// unary operators bind weaker than ^.
+		e, err := p.parseExpr(precedence(itemPOW))
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := e.(*NumberLiteral); ok {
+			if it.typ == itemSUB {
+				n.Val = -n.Val
+			}
+			return n, nil
+		}
+		return &UnaryExpr{Op: it.val, Expr: e}, nil
+	}
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return p.parsePostfix(e)
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	it := p.next()
+	switch it.typ {
+	case itemNumber:
+		v, err := parseNumber(it.val)
+		if err != nil {
+			return nil, p.errorf(it, "%v", err)
+		}
+		return &NumberLiteral{Val: v}, nil
+	case itemString:
+		return &StringLiteral{Val: it.val}, nil
+	case itemLeftParen:
+		e, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(itemRightParen, "paren expression"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: e}, nil
+	case itemLeftBrace:
+		p.pos--
+		return p.parseVectorSelector("")
+	case itemIdentifier:
+		next := p.peek().typ
+		if _, ok := aggregators[strings.ToLower(it.val)]; ok &&
+			(next == itemLeftParen || next == itemBy || next == itemWithout) {
+			return p.parseAggregate(strings.ToLower(it.val))
+		}
+		if next == itemLeftParen {
+			return p.parseCall(it.val)
+		}
+		return p.parseVectorSelector(it.val)
+	}
+	return nil, p.errorf(it, "unexpected %s", it)
+}
+
+// parsePostfix parses range selectors, subqueries and offsets following e.
+func (p *parser) parsePostfix(e Expr) (Expr, error) {
+	for {
+		switch it := p.peek(); it.typ {
+		case itemLeftBracket:
+			p.next()
+			rng, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			if p.peek().typ == itemColon {
+				p.next()
+				sq := &SubqueryExpr{Expr: e, Range: rng}
+				if p.peek().typ == itemDuration {
+					if sq.Step, err = p.parseDuration(); err != nil {
+						return nil, err
+					}
+				}
+				if _, err := p.expect(itemRightBracket, "subquery"); err != nil {
+					return nil, err
+				}
+				e = sq
+				continue
+			}
+			if _, err := p.expect(itemRightBracket, "range selector"); err != nil {
+				return nil, err
+			}
+			vs, ok := e.(*VectorSelector)
+			if !ok || vs.Offset != 0 {
+				return nil, p.errorf(it, "ranges only allowed for vector selectors")
+			}
+			e = &MatrixSelector{Name: vs.Name, Matchers: vs.Matchers, Range: rng}
+		case itemOffset:
+			p.next()
+			d, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			switch n := e.(type) {
+			case *VectorSelector:
+				n.Offset = d
+			case *MatrixSelector:
+				n.Offset = d
+			case *SubqueryExpr:
+				n.Offset = d
+			default:
+				return nil, p.errorf(it, "offset modifier must be preceded by a selector or subquery")
+			}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) parseDuration() (time.Duration, error) {
+	it, err := p.expect(itemDuration, "duration")
+	if err != nil {
+		return 0, err
+	}
+	d, err := ParseDuration(it.val)
+	if err != nil {
+		return 0, p.errorf(it, "%v", err)
+	}
+	return d, nil
+}
+
+func (p *parser) parseVectorSelector(name string) (Expr, error) {
+	vs := &VectorSelector{Name: name}
+	if p.peek().typ == itemLeftBrace {
+		ms, err := p.parseMatchers()
+		if err != nil {
+			return nil, err
+		}
+		vs.Matchers = ms
+	}
+	if name != "" {
+		for _, m := range vs.Matchers {
+			if m.Name == labels.MetricName {
+				return nil, p.errorf(p.peek(), "metric name must not be set twice: %q", name)
+			}
+		}
+		m, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, name)
+		if err != nil {
+			return nil, err
+		}
+		vs.Matchers = append(vs.Matchers, m)
+	}
+
+	// a vector selector must contain at least one non-empty matcher.
+	notEmpty := false
+	for _, m := range vs.Matchers {
+		if !m.Matches("") {
+			notEmpty = true
+			break
+		}
+	}
+	if !notEmpty {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one non-empty matcher")
+	}
+	return vs, nil
+}
+
+func (p *parser) parseMatchers() ([]*labels.Matcher, error) {
+	if _, err := p.expect(itemLeftBrace, "label matching"); err != nil {
+		return nil, err
+	}
+	var ms []*labels.Matcher
+	for p.peek().typ != itemRightBrace {
+		name := p.next()
+		if !name.isLabel() {
+			return nil, p.errorf(name, "unexpected %s in label matching, expected label", name)
+		}
+
+		var typ labels.MatchType
+		switch op := p.next(); op.typ {
+		case itemAssign:
+			typ = labels.MatchEqual
+		case itemNEQ:
+			typ = labels.MatchNotEqual
+		case itemEQLRegex:
+			typ = labels.MatchRegexp
+		case itemNEQRegex:
+			typ = labels.MatchNotRegexp
+		default:
+			return nil, p.errorf(op, "unexpected %s in label matching, expected label matching operator", op)
+		}
+
+		val, err := p.expect(itemString, "label matching")
+		if err != nil {
+			return nil, err
+		}
+		m, err := labels.NewMatcher(typ, name.val, val.val)
+		if err != nil {
+			return nil, p.errorf(val, "%v", err)
+		}
+		ms = append(ms, m)
+
+		if p.peek().typ != itemComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(itemRightBrace, "label matching"); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// parseLabels parses a parenthesised list of label names.
+func (p *parser) parseLabels() ([]string, error) {
+	if _, err := p.expect(itemLeftParen, "grouping"); err != nil {
+		return nil, err
+	}
+	ls := []string{}
+	for p.peek().typ != itemRightParen {
+		it := p.next()
+		if !it.isLabel() {
+			return nil, p.errorf(it, "unexpected %s in grouping, expected label", it)
+		}
+		ls = append(ls, it.val)
+		if p.peek().typ != itemComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(itemRightParen, "grouping"); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	ae := &AggregateExpr{Op: op}
+	modifiersFirst := false
+	if t := p.peek().typ; t == itemBy || t == itemWithout {
+		p.next()
+		ae.Without = t == itemWithout
+		ls, err := p.parseLabels()
+		if err != nil {
+			return nil, err
+		}
+		ae.Grouping = ls
+		modifiersFirst = true
+	}
+
+	if _, err := p.expect(itemLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+	var err error
+	if aggregators[op] {
+		if ae.Param, err = p.parseExpr(0); err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(itemComma, "aggregation"); err != nil {
+			return nil, err
+		}
+	}
+	if ae.Expr, err = p.parseExpr(0); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(itemRightParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if t := p.peek().typ; !modifiersFirst && (t == itemBy || t == itemWithout) {
+		p.next()
+		ae.Without = t == itemWithout
+		ls, err := p.parseLabels()
+		if err != nil {
+			return nil, err
+		}
+		ae.Grouping = ls
+	}
+	if ae.Expr.Type() != ValueTypeVector {
+		return nil, &ParseError{Err: fmt.Sprintf("expected vector in aggregation %q, got %s", op, ae.Expr.Type())}
+	}
+	return ae, nil
+}
+
+func (p *parser) parseCall(name string) (Expr, error) {
+	if _, err := p.expect(itemLeftParen, "function call"); err != nil {
+		return nil, err
+	}
+	call := &Call{Func: name}
+	for p.peek().typ != itemRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.peek().typ != itemComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(itemRightParen, "function call"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func parseNumber(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf":
+		return math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	if strings.HasPrefix(strings.ToLower(s), "0x") {
+		v, err := strconv.ParseInt(s[2:], 16, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// ParseDuration parses a PromQL duration, e.g. 5m or 1h30m.
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	if s == "" || scanDuration(s, 0) != len(s) {
+		return 0, fmt.Errorf("not a valid duration string: %q", s)
+	}
+	var d time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		j := i + 1
+		if strings.HasPrefix(s[i:], "ms") {
+			j = i + 2
+		}
+		d += time.Duration(n) * units[s[i:j]]
+		s = s[j:]
+	}
+	return d, nil
+}
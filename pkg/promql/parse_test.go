@@ -0,0 +1,98 @@
+package promql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpr(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{`up`, `up`},
+		{`up{job="api", instance=~"10.*"}`, `up{job="api", instance=~"10.*"}`},
+		{`{__name__="up"}`, `{__name__="up"}`},
+		{`rate(http_requests_total[5m] offset 1h)`, `rate(http_requests_total[5m] offset 1h)`},
+		{`sum(rate(x[5m])) by (job)`, `sum by (job) (rate(x[5m]))`},
+		{`sum without (instance) (x)`, `sum without (instance) (x)`},
+		{`topk(5, x)`, `topk(5, x)`},
+		{`a + b * c`, `a + b * c`},
+		{`(a + b) * c`, `(a + b) * c`},
+		{`a / on (job) group_left (team) b`, `a / on (job) group_left (team) b`},
+		{`a > bool 1`, `a > bool 1`},
+		{`-x ^ 2`, `-x ^ 2`},
+		{`max_over_time(rate(x[1m])[1h:5m])`, `max_over_time(rate(x[1m])[1h:5m])`},
+		{`x and on (by) y`, `x and on (by) y`},
+		{`label_replace(up, 'dst', "$1", "src", "(.*)")`, `label_replace(up, "dst", "$1", "src", "(.*)")`},
+		{`1 + 2 * 3`, `1 + 2 * 3`},
+		{`x[90m]`, `x[90m]`},
+		{`x[1h30m]`, `x[90m]`},
+	}
+	for _, c := range cases {
+		e, err := ParseExpr(c.input)
+		if err != nil {
+			t.Fatalf("%s: %v", c.input, err)
+		}
+		if got := e.String(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.input, got, c.want)
+		}
+	}
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	e, err := ParseExpr(`a + b * c > bool 2 ^ 3 ^ 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := e.(*BinaryExpr)
+	if be.Op != ">" || !be.ReturnBool {
+		t.Fatalf("unexpected root %s", be.Op)
+	}
+	if lhs := be.LHS.(*BinaryExpr); lhs.Op != "+" || lhs.RHS.(*BinaryExpr).Op != "*" {
+		t.Fatalf("unexpected lhs %s", lhs)
+	}
+	// ^ is right associative.
+	if rhs := be.RHS.(*BinaryExpr); rhs.Op != "^" || rhs.RHS.(*BinaryExpr).Op != "^" {
+		t.Fatalf("unexpected rhs %s", rhs)
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`up{`,
+		`{job=""}`,
+		`sum(`,
+		`rate(x[5m]`,
+		`1 > 2`,
+		`(x + 1)[5m]`,
+		`x{job="a"}{job="b"}`,
+		`"a" + 1`,
+		`5 5`,
+	} {
+		if _, err := ParseExpr(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"5m":    5 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"100ms": 100 * time.Millisecond,
+		"2w":    14 * 24 * time.Hour,
+	} {
+		got, err := ParseDuration(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: got %v, want %v", s, got, want)
+		}
+	}
+	if _, err := ParseDuration("5"); err == nil {
+		t.Error("expected error for missing unit")
+	}
+}
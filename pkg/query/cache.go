@@ -0,0 +1,207 @@
+package query
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Cache types.
+const (
+	CacheMemory = "memory"
+	CacheDisk   = "disk"
+)
+
+// Cache is a bounded key value cache of query results.
+type Cache interface {
+	Fetch(key string) ([]byte, bool)
+	Store(key string, value []byte)
+}
+
+// lru tracks the least recently used entries of a cache bounded by size.
+type lru struct {
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte // nil for disk entries.
+	size  int64
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*lruEntry, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return e.Value.(*lruEntry), true
+}
+
+// add adds the entry and returns the evicted entries.
+func (l *lru) add(entry *lruEntry) []*lruEntry {
+	if e, ok := l.items[entry.key]; ok {
+		l.size -= e.Value.(*lruEntry).size
+		l.ll.Remove(e)
+	}
+	l.items[entry.key] = l.ll.PushFront(entry)
+	l.size += entry.size
+
+	var evicted []*lruEntry
+	for l.size > l.maxBytes && l.ll.Len() > 0 {
+		e := l.ll.Back()
+		old := e.Value.(*lruEntry)
+		l.ll.Remove(e)
+		delete(l.items, old.key)
+		l.size -= old.size
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) {
+	if e, ok := l.items[key]; ok {
+		l.size -= e.Value.(*lruEntry).size
+		l.ll.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+// memoryCache is an in-memory LRU cache.
+type memoryCache struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+// NewMemoryCache creates an in-memory cache of up to maxBytes.
+func NewMemoryCache(maxBytes int64) Cache {
+	return &memoryCache{lru: newLRU(maxBytes)}
+}
+
+func (c *memoryCache) Fetch(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *memoryCache) Store(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.add(&lruEntry{key: key, value: value, size: int64(len(key) + len(value))})
+}
+
+// diskCache is an LRU cache storing every entry in a file of dir,
+// named by the hash of its key. The file starts with the key so that
+// hash collisions are detected.
+type diskCache struct {
+	dir string
+	mu  sync.Mutex
+	lru *lru
+}
+
+// NewDiskCache creates a cache of up to maxBytes in dir, the entries
+// left by a previous run are kept.
+func NewDiskCache(dir string, maxBytes int64) (Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// oldest first, so that the most recent entries end up in front.
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+
+	c := &diskCache{dir: dir, lru: newLRU(maxBytes)}
+	for _, fi := range fis {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != "" {
+			continue
+		}
+		c.evict(c.lru.add(&lruEntry{key: fi.Name(), size: fi.Size()}))
+	}
+	return c, nil
+}
+
+func cacheFileName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *diskCache) Fetch(key string) ([]byte, bool) {
+	name := cacheFileName(key)
+	c.mu.Lock()
+	_, ok := c.lru.get(name)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		c.mu.Lock()
+		c.lru.remove(name)
+		c.mu.Unlock()
+		return nil, false
+	}
+	prefix := key + "\n"
+	if len(b) < len(prefix) || string(b[:len(prefix)]) != prefix {
+		return nil, false
+	}
+	return b[len(prefix):], true
+}
+
+func (c *diskCache) Store(key string, value []byte) {
+	name := cacheFileName(key)
+	path := filepath.Join(c.dir, name)
+	tmp := path + ".tmp"
+	data := append([]byte(key+"\n"), value...)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	evicted := c.lru.add(&lruEntry{key: name, size: int64(len(data))})
+	c.mu.Unlock()
+	c.evict(evicted)
+}
+
+func (c *diskCache) evict(entries []*lruEntry) {
+	for _, e := range entries {
+		os.Remove(filepath.Join(c.dir, e.key))
+	}
+}
+
+// NewCache creates the cache of the configuration, it returns nil if
+// caching is disabled.
+func NewCache(conf CacheConfig) (Cache, error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case CacheMemory:
+		return NewMemoryCache(conf.MaxSizeBytes), nil
+	case CacheDisk:
+		return NewDiskCache(conf.Path, conf.MaxSizeBytes)
+	}
+	return nil, fmt.Errorf("unknown cache type %q", conf.Type)
+}
@@ -0,0 +1,196 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Prometheus API error types.
+const (
+	ErrBadData     = "bad_data"
+	ErrExecution   = "execution"
+	ErrCanceled    = "canceled"
+	ErrTimeout     = "timeout"
+	ErrInternal    = "internal"
+	ErrUnavailable = "unavailable"
+)
+
+// Response is the envelope of a Prometheus HTTP API response.
+type Response struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+}
+
+// Error is an error returned by a Prometheus HTTP API.
+type Error struct {
+	Type string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Msg)
+}
+
+// Errorf returns an API error of type typ.
+func Errorf(typ, format string, args ...interface{}) *Error {
+	return &Error{Type: typ, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Client is a Prometheus HTTP API client of a single server.
+type Client struct {
+	addr   string
+	client *http.Client
+	// forwardHeader sends the header of the incoming request along.
+	forwardHeader bool
+}
+
+// NewClient creates a client of the server at addr,
+// addr is an URL prefix without trailing slash, e.g. http://prometheus:9090.
+func NewClient(addr string, client *http.Client) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{addr: strings.TrimRight(addr, "/"), client: client}
+}
+
+// ForwardHeader makes the client send the header of the incoming request
+// carried by the context of every request along, see WithHeader.
+func (c *Client) ForwardHeader() {
+	c.forwardHeader = true
+}
+
+type headerKey struct{}
+
+// WithHeader returns a context carrying the header of the incoming request.
+func WithHeader(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, h)
+}
+
+// unforwardedHeaders are the hop-by-hop headers and the headers of the
+// incoming body, which are not forwarded.
+var unforwardedHeaders = map[string]bool{
+	"Accept-Encoding":     true,
+	"Connection":          true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// forward copies the header of the incoming request of ctx to req.
+func forward(ctx context.Context, req *http.Request) {
+	h, ok := ctx.Value(headerKey{}).(http.Header)
+	if !ok {
+		return
+	}
+	for k, vs := range h {
+		if unforwardedHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		req.Header[k] = append([]string(nil), vs...)
+	}
+}
+
+// Addr returns the server's address.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Get calls the API at path and decodes its envelope.
+// Query, query_range, series and labels are sent as POST forms
+// so that long queries do not exceed URL limits.
+func (c *Client) Get(ctx context.Context, path string, params url.Values) (*Response, error) {
+	var (
+		req *http.Request
+		err error
+	)
+	u := c.addr + path
+	if usePost(path) {
+		req, err = http.NewRequest(http.MethodPost, u, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		if len(params) > 0 {
+			u += "?" + params.Encode()
+		}
+		req, err = http.NewRequest(http.MethodGet, u, nil)
+	}
+	if err != nil {
+		return nil, Errorf(ErrInternal, "%v", err)
+	}
+	if c.forwardHeader {
+		forward(ctx, req)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, requestError(ctx, c.addr, err)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
+		resp.Body.Close()
+	}()
+
+	var r Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		if resp.StatusCode/100 != 2 {
+			return nil, Errorf(ErrUnavailable, "%s: unexpected status code %d", c.addr, resp.StatusCode)
+		}
+		return nil, Errorf(ErrInternal, "%s: decode response: %v", c.addr, err)
+	}
+	if r.Status != "success" {
+		typ := r.ErrorType
+		if typ == "" {
+			typ = ErrInternal
+		}
+		return nil, &Error{Type: typ, Msg: fmt.Sprintf("%s: %s", c.addr, r.Error)}
+	}
+	return &r, nil
+}
+
+// QueryRange evaluates a range query on the server.
+func (c *Client) QueryRange(ctx context.Context, params url.Values) (*QueryData, []string, error) {
+	resp, err := c.Get(ctx, "/api/v1/query_range", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var d QueryData
+	if err := json.Unmarshal(resp.Data, &d); err != nil {
+		return nil, nil, Errorf(ErrInternal, "%s: decode query result: %v", c.addr, err)
+	}
+	return &d, resp.Warnings, nil
+}
+
+// requestError maps a failed request to the API error of its context.
+func requestError(ctx context.Context, addr string, err error) *Error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return Errorf(ErrTimeout, "%s: %v", addr, err)
+	}
+	if ctx.Err() == context.Canceled {
+		return Errorf(ErrCanceled, "%s: %v", addr, err)
+	}
+	return Errorf(ErrUnavailable, "%s: %v", addr, err)
+}
+
+func usePost(path string) bool {
+	switch path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/labels":
+		return true
+	}
+	return false
+}
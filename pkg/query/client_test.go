@@ -0,0 +1,46 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestClientForwardHeader(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer s.Close()
+
+	in := http.Header{}
+	in.Set("X-Scope-OrgID", "team-a")
+	in.Set("Authorization", "Bearer client")
+	in.Set("Content-Type", "application/json")
+	ctx := WithHeader(context.Background(), in)
+	params := url.Values{"query": {"up"}, "start": {"0"}, "end": {"60"}, "step": {"15"}}
+
+	c := NewClient(s.URL, http.DefaultClient)
+	if _, _, err := c.QueryRange(ctx, params); err != nil {
+		t.Fatal(err)
+	}
+	if h := <-headers; h.Get("X-Scope-OrgID") != "" {
+		t.Fatalf("got tenant %q forwarded without ForwardHeader", h.Get("X-Scope-OrgID"))
+	}
+
+	c.ForwardHeader()
+	if _, _, err := c.QueryRange(ctx, params); err != nil {
+		t.Fatal(err)
+	}
+	h := <-headers
+	if h.Get("X-Scope-OrgID") != "team-a" || h.Get("Authorization") != "Bearer client" {
+		t.Fatalf("got header %v, want the tenant and credentials forwarded", h)
+	}
+	if ct := h.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+		t.Fatalf("got content type %q, want the form's", ct)
+	}
+}
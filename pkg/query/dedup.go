@@ -0,0 +1,286 @@
+package query
+
+import (
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/promcluster/proxy/pkg/remote"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// HA replicas of a sender write the same series, only differing by their
+// replica labels. Deduplication merges the series of every replica into a
+// single series without the replica labels. The samples are taken from
+// one replica at a time, switching to another replica only when the
+// current one has a gap, so that the sampling frequency is not doubled.
+
+// dedupParam names the parameter disabling deduplication.
+const dedupParam = "dedup"
+
+// initialPenalty is the penalty in milliseconds of a replica before the
+// sampling interval is known.
+const initialPenalty = 5000
+
+// dedupLabels returns the replica labels to deduplicate the request on,
+// the dedup parameter turns deduplication off.
+func (q *Querier) dedupLabels(params url.Values) ([]string, error) {
+	if len(q.replicaLabels) == 0 {
+		return nil, nil
+	}
+	if v := params.Get(dedupParam); v != "" {
+		dedup, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, Errorf(ErrBadData, "invalid parameter %q: %v", dedupParam, err)
+		}
+		if !dedup {
+			return nil, nil
+		}
+	}
+	return q.replicaLabels, nil
+}
+
+// withoutReplica returns m without the replica labels.
+func withoutReplica(m model.Metric, replicaLabels []string) model.Metric {
+	res := m
+	for _, l := range replicaLabels {
+		if _, ok := m[model.LabelName(l)]; !ok {
+			continue
+		}
+		if len(res) == len(m) {
+			res = m.Clone()
+		}
+		delete(res, model.LabelName(l))
+	}
+	return res
+}
+
+// dedupMatrix merges the series of every replica.
+func dedupMatrix(m model.Matrix, replicaLabels []string) model.Matrix {
+	if len(replicaLabels) == 0 {
+		return m
+	}
+	groups := make(map[model.Fingerprint][]*model.SampleStream)
+	var order []model.Fingerprint
+	for _, ss := range m {
+		metric := withoutReplica(ss.Metric, replicaLabels)
+		fp := metric.Fingerprint()
+		if _, ok := groups[fp]; !ok {
+			order = append(order, fp)
+		}
+		groups[fp] = append(groups[fp], &model.SampleStream{Metric: metric, Values: ss.Values})
+	}
+
+	res := make(model.Matrix, 0, len(order))
+	for _, fp := range order {
+		replicas := groups[fp]
+		values := replicas[0].Values
+		for _, r := range replicas[1:] {
+			values = dedupSamples(values, r.Values)
+		}
+		res = append(res, &model.SampleStream{Metric: replicas[0].Metric, Values: values})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Metric.Before(res[j].Metric)
+	})
+	return res
+}
+
+// dedupVector keeps a single sample of the series of every replica,
+// the one of the replica sorting first.
+func dedupVector(v model.Vector, replicaLabels []string) model.Vector {
+	if len(replicaLabels) == 0 {
+		return v
+	}
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Metric.Before(v[j].Metric)
+	})
+	seen := make(map[model.Fingerprint]struct{}, len(v))
+	res := make(model.Vector, 0, len(v))
+	for _, s := range v {
+		metric := withoutReplica(s.Metric, replicaLabels)
+		fp := metric.Fingerprint()
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		seen[fp] = struct{}{}
+		res = append(res, &model.Sample{Metric: metric, Value: s.Value, Timestamp: s.Timestamp})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Metric.Before(res[j].Metric)
+	})
+	return res
+}
+
+// dedupData deduplicates the series of a query result.
+func dedupData(d *QueryData, replicaLabels []string) *QueryData {
+	switch r := d.Result.(type) {
+	case model.Matrix:
+		d.Result = dedupMatrix(r, replicaLabels)
+	case model.Vector:
+		d.Result = dedupVector(r, replicaLabels)
+	}
+	return d
+}
+
+// dedupLabelSets merges the label sets only differing by their replica labels.
+func dedupLabelSets(ls []model.LabelSet, replicaLabels []string) []model.LabelSet {
+	if len(replicaLabels) == 0 {
+		return ls
+	}
+	stripped := make([]model.LabelSet, 0, len(ls))
+	for _, l := range ls {
+		stripped = append(stripped, model.LabelSet(withoutReplica(model.Metric(l), replicaLabels)))
+	}
+	return mergeLabelSets([][]model.LabelSet{stripped})
+}
+
+// dedupSamples merges the samples of two replicas. The replica with the
+// earliest sample is followed until it has a gap: after every sample,
+// the other replica is penalized by twice the sampling interval, so
+// that its samples are only used where the current replica has none.
+func dedupSamples(a, b []model.SamplePair) []model.SamplePair {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	res := make([]model.SamplePair, 0, len(a))
+	var (
+		i, j       int
+		penA, penB int64
+		lastT      int64 = math.MinInt64
+	)
+	seek := func(s []model.SamplePair, k int, t int64) int {
+		for k < len(s) && int64(s[k].Timestamp) < t {
+			k++
+		}
+		return k
+	}
+	for {
+		if lastT != math.MinInt64 {
+			i = seek(a, i, lastT+1+penA)
+			j = seek(b, j, lastT+1+penB)
+		}
+		switch {
+		case i >= len(a) && j >= len(b):
+			return res
+		case i >= len(a):
+			res = append(res, b[j])
+			lastT, penB = int64(b[j].Timestamp), 0
+			continue
+		case j >= len(b):
+			res = append(res, a[i])
+			lastT, penA = int64(a[i].Timestamp), 0
+			continue
+		}
+
+		ta, tb := int64(a[i].Timestamp), int64(b[j].Timestamp)
+		if ta <= tb {
+			if lastT != math.MinInt64 {
+				penB = 2 * (ta - lastT)
+			} else {
+				penB = initialPenalty
+			}
+			res = append(res, a[i])
+			lastT, penA = ta, 0
+			continue
+		}
+		if lastT != math.MinInt64 {
+			penA = 2 * (tb - lastT)
+		} else {
+			penA = initialPenalty
+		}
+		res = append(res, b[j])
+		lastT, penB = tb, 0
+	}
+}
+
+// readDedup buffers the series of a remote read query, and merges the
+// series of every replica once all of them are read. Replicas sort apart
+// by their labels, so deduplicated reads are not streamed.
+type readDedup struct {
+	replicaLabels []string
+	groups        map[string][]*remote.ChunkedSeries
+}
+
+func newReadDedup(replicaLabels []string) *readDedup {
+	return &readDedup{replicaLabels: replicaLabels, groups: make(map[string][]*remote.ChunkedSeries)}
+}
+
+func (d *readDedup) add(_ int, s *remote.ChunkedSeries) error {
+	labels := make([]prompb.Label, 0, len(s.Labels))
+	for _, l := range s.Labels {
+		if !containsString(d.replicaLabels, l.Name) {
+			labels = append(labels, l)
+		}
+	}
+	key := labelsKey(labels)
+	d.groups[key] = append(d.groups[key], &remote.ChunkedSeries{Labels: labels, Chunks: s.Chunks})
+	return nil
+}
+
+// flush calls fn with the merged series of query index i in label order.
+func (d *readDedup) flush(i int, fn SeriesFunc) error {
+	groups := make([][]*remote.ChunkedSeries, 0, len(d.groups))
+	for _, g := range d.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return remote.CompareLabels(groups[i][0].Labels, groups[j][0].Labels) < 0
+	})
+
+	for _, g := range groups {
+		s := g[0]
+		if len(g) > 1 {
+			var values []model.SamplePair
+			for _, r := range g {
+				samples, err := remote.DecodeChunks(r.Chunks)
+				if err != nil {
+					return Errorf(ErrInternal, "decode chunks: %v", err)
+				}
+				values = dedupSamples(values, toSamplePairs(samples))
+			}
+			chunks, err := remote.EncodeChunks(fromSamplePairs(values))
+			if err != nil {
+				return Errorf(ErrInternal, "encode chunks: %v", err)
+			}
+			s = &remote.ChunkedSeries{Labels: s.Labels, Chunks: chunks}
+		}
+		if err := fn(i, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func labelsKey(labels []prompb.Label) string {
+	var b []byte
+	for _, l := range labels {
+		b = append(b, l.Name...)
+		b = append(b, 0xff)
+		b = append(b, l.Value...)
+		b = append(b, 0xff)
+	}
+	return string(b)
+}
+
+func toSamplePairs(samples []prompb.Sample) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(samples))
+	for _, s := range samples {
+		res = append(res, model.SamplePair{Timestamp: model.Time(s.Timestamp), Value: model.SampleValue(s.Value)})
+	}
+	return res
+}
+
+func fromSamplePairs(values []model.SamplePair) []prompb.Sample {
+	res := make([]prompb.Sample, 0, len(values))
+	for _, v := range values {
+		res = append(res, prompb.Sample{Timestamp: int64(v.Timestamp), Value: float64(v.Value)})
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package query
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+func seconds(ts ...int64) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(ts))
+	for _, t := range ts {
+		res = append(res, model.SamplePair{Timestamp: model.Time(t * 1000), Value: model.SampleValue(t)})
+	}
+	return res
+}
+
+func TestDedupSamples(t *testing.T) {
+	// a has a gap from 40s to 60s, b is scraped a second later. b is
+	// penalized by twice the interval of a, and a by the interval of b
+	// once b is followed.
+	a := seconds(0, 10, 20, 30, 70, 80, 90, 100)
+	b := seconds(1, 11, 21, 31, 41, 51, 61, 71, 81, 91, 101)
+
+	got := dedupSamples(a, b)
+	want := seconds(0, 10, 20, 30, 51, 61, 71, 81, 91, 101)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestQuerierDedup(t *testing.T) {
+	a := newQueryShard(t, map[string]string{
+		`up`:                        `{"metric":{"__name__":"up","replica":"1"},"value":[1,"1"]}`,
+		`sum by (replica) (x)`:      `{"metric":{"replica":"1"},"value":[1,"3"]}`,
+		`sum by (job, replica) (x)`: `{"metric":{"job":"a","replica":"2"},"value":[1,"1"]}`,
+	})
+	b := newQueryShard(t, map[string]string{
+		`up`: `{"metric":{"__name__":"up","replica":"2"},"value":[1,"1"]}`,
+		`sum by (replica) (x)`: `{"metric":{"replica":"1"},"value":[1,"2"]},
+			{"metric":{"replica":"2"},"value":[1,"5"]}`,
+		`sum by (job, replica) (x)`: `{"metric":{"job":"a","replica":"1"},"value":[1,"1"]}`,
+	})
+	q := NewQuerier(prometheus.NewRegistry(), staticTargets{a.URL, b.URL}, time.Second, false, []string{"replica"}, zap.NewNop())
+
+	cases := []struct {
+		query  string
+		params url.Values
+		want   string
+	}{
+		{`up`, nil, `up => 1 @[1]`},
+		{`up`, url.Values{"dedup": []string{"false"}}, "up{replica=\"1\"} => 1 @[1]\nup{replica=\"2\"} => 1 @[1]"},
+		{`sum(x)`, nil, `{} => 5 @[1]`},
+		{`sum by (job) (x)`, nil, `{job="a"} => 1 @[1]`},
+	}
+	for _, c := range cases {
+		params := url.Values{"query": []string{c.query}, "time": []string{"1"}}
+		for k, v := range c.params {
+			params[k] = v
+		}
+		d, _, err := q.Query(context.Background(), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Result.(model.Vector).String(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package query
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/promcluster/proxy/pkg/promql"
+
+	"github.com/prometheus/common/model"
+)
+
+// The aggregations and functions which cannot be combined from partial
+// shard results are evaluated at the proxy, over the series fetched from
+// every shard. They follow the semantics of the Prometheus engine.
+
+// aggregate evaluates the aggregation over m at every timestamp, param
+// holds the value of its parameter.
+func (n *proxyAggNode) aggregate(m model.Matrix, param *planValue) model.Matrix {
+	ms := []model.Matrix{m}
+	switch n.op {
+	case "topk", "bottomk":
+		k := func(t model.Time) int {
+			switch v := param.s(t); {
+			case v >= math.MaxInt32:
+				return math.MaxInt32
+			case v >= 1:
+				return int(v)
+			}
+			return 0
+		}
+		return selectK(n.op, k, groupSamples(ms, n.grouping, n.without))
+	case "count_values":
+		res := make(seriesSet)
+		for k, g := range groupSamples(ms, n.grouping, n.without) {
+			for _, s := range g.samples {
+				metric := g.metric.Clone()
+				metric[model.LabelName(n.label)] = model.LabelValue(strconv.FormatFloat(s.v, 'f', -1, 64))
+				res.add(metric, k.t, 1, add)
+			}
+		}
+		return res.matrix()
+	}
+
+	res := make(seriesSet)
+	for k, g := range groupSamples(ms, n.grouping, n.without) {
+		var phi float64
+		if param != nil {
+			phi = param.s(k.t)
+		}
+		res.add(g.metric, k.t, n.reduce(g.samples, phi), func(cur, v float64) float64 { return v })
+	}
+	return res.matrix()
+}
+
+// reduce aggregates the samples of a group into a single value, phi is
+// the quantile.
+func (n *proxyAggNode) reduce(samples []sample, phi float64) float64 {
+	switch n.op {
+	case "sum":
+		var sum float64
+		for _, s := range samples {
+			sum += s.v
+		}
+		return sum
+	case "count":
+		return float64(len(samples))
+	case "group":
+		return 1
+	case "min", "max":
+		v := samples[0].v
+		for _, s := range samples[1:] {
+			if math.IsNaN(v) || (n.op == "min" && s.v < v) || (n.op == "max" && s.v > v) {
+				v = s.v
+			}
+		}
+		return v
+	case "avg", "stddev", "stdvar":
+		var count, mean, variance float64
+		for _, s := range samples {
+			count++
+			delta := s.v - mean
+			mean += delta / count
+			variance += delta * (s.v - mean)
+		}
+		switch n.op {
+		case "stdvar":
+			return variance / count
+		case "stddev":
+			return math.Sqrt(variance / count)
+		}
+		return mean
+	case "quantile":
+		vs := make([]float64, len(samples))
+		for i, s := range samples {
+			vs[i] = s.v
+		}
+		return quantile(phi, vs)
+	}
+	return math.NaN()
+}
+
+// quantile returns the φ-quantile of vs, interpolating between the
+// two nearest values.
+func quantile(phi float64, vs []float64) float64 {
+	switch {
+	case len(vs) == 0:
+		return math.NaN()
+	case phi < 0:
+		return math.Inf(-1)
+	case phi > 1:
+		return math.Inf(+1)
+	}
+	sort.Float64s(vs)
+	n := float64(len(vs))
+	rank := phi * (n - 1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+	weight := rank - math.Floor(rank)
+	return vs[int(lower)]*(1-weight) + vs[int(upper)]*weight
+}
+
+// bucket is a cumulative histogram bucket.
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile evaluates histogram_quantile over the bucket series
+// of m at the quantile phi of every timestamp, the series without a valid
+// le label are ignored.
+func histogramQuantile(phi func(model.Time) float64, m model.Matrix) model.Matrix {
+	type histogram struct {
+		metric  model.Metric
+		buckets []bucket
+	}
+	histograms := make(map[groupKey]*histogram)
+	for _, ss := range m {
+		upperBound, err := strconv.ParseFloat(string(ss.Metric[model.BucketLabel]), 64)
+		if err != nil {
+			continue
+		}
+		metric := ss.Metric.Clone()
+		delete(metric, model.BucketLabel)
+		delete(metric, model.MetricNameLabel)
+		fp := metric.Fingerprint()
+		for _, p := range ss.Values {
+			k := groupKey{fp: fp, t: p.Timestamp}
+			h, ok := histograms[k]
+			if !ok {
+				h = &histogram{metric: metric}
+				histograms[k] = h
+			}
+			h.buckets = append(h.buckets, bucket{upperBound: upperBound, count: float64(p.Value)})
+		}
+	}
+
+	res := make(seriesSet)
+	for k, h := range histograms {
+		res.add(h.metric, k.t, bucketQuantile(phi(k.t), h.buckets), func(cur, v float64) float64 { return v })
+	}
+	return res.matrix()
+}
+
+// bucketQuantile returns the φ-quantile of a histogram, interpolating
+// linearly within the bucket the quantile falls into.
+func bucketQuantile(phi float64, buckets []bucket) float64 {
+	switch {
+	case phi < 0:
+		return math.Inf(-1)
+	case phi > 1:
+		return math.Inf(+1)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if !math.IsInf(buckets[len(buckets)-1].upperBound, +1) {
+		return math.NaN()
+	}
+
+	// merge buckets of equal upper bounds and force the counts to be monotonic.
+	merged := buckets[:1]
+	for _, b := range buckets[1:] {
+		if last := &merged[len(merged)-1]; b.upperBound == last.upperBound {
+			last.count += b.count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	buckets = merged
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+
+	rank := phi * buckets[len(buckets)-1].count
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	switch {
+	case b == len(buckets)-1:
+		return buckets[len(buckets)-2].upperBound
+	case b == 0 && buckets[0].upperBound <= 0:
+		return buckets[0].upperBound
+	}
+	start, end, count := 0.0, buckets[b].upperBound, buckets[b].count
+	if b > 0 {
+		start = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return start + (end-start)*(rank/count)
+}
+
+// planValue is the value of an evaluated plan node, either a scalar by
+// timestamp or a matrix.
+type planValue struct {
+	scalar bool
+	s      func(model.Time) float64
+	m      model.Matrix
+}
+
+// evalPlan evaluates the plan at every timestamp of r.
+func evalPlan(n planNode, r evalRange) (*planValue, error) {
+	switch n := n.(type) {
+	case *scalarNode:
+		return &planValue{scalar: true, s: func(model.Time) float64 { return n.v }}, nil
+	case *timeNode:
+		return &planValue{scalar: true, s: timeSeconds}, nil
+	case *aggNode:
+		return &planValue{m: dedupMatrix(n.combine(), n.replicaLabels)}, nil
+	case *fetchNode:
+		return &planValue{m: dedupMatrix(mergeMatrices(n.parts[0]), n.replicaLabels)}, nil
+	case *proxyAggNode:
+		var param *planValue
+		if n.param != nil {
+			v, err := evalPlan(n.param, r)
+			if err != nil {
+				return nil, err
+			}
+			param = v
+		}
+		v, err := evalPlan(n.expr, r)
+		if err != nil {
+			return nil, err
+		}
+		return &planValue{m: n.aggregate(v.m, param)}, nil
+	case *quantileNode:
+		phi, err := evalPlan(n.phi, r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := evalPlan(n.expr, r)
+		if err != nil {
+			return nil, err
+		}
+		return &planValue{m: histogramQuantile(phi.s, v.m)}, nil
+	case *binaryNode:
+		lhs, err := evalPlan(n.lhs, r)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := evalPlan(n.rhs, r)
+		if err != nil {
+			return nil, err
+		}
+		return n.eval(lhs, rhs)
+	case *callNode:
+		args, err := evalArgs(n.args, r)
+		if err != nil {
+			return nil, err
+		}
+		return evalCall(n, args, r)
+	case *windowNode:
+		v, err := evalPlan(n.expr, n.inner)
+		if err != nil {
+			return nil, err
+		}
+		return &planValue{m: window(v.m, r.start-n.offset-n.rng, r.end-n.offset)}, nil
+	case *rangeNode:
+		w, err := evalPlan(n.window, r)
+		if err != nil {
+			return nil, err
+		}
+		args, err := evalArgs(n.args, r)
+		if err != nil {
+			return nil, err
+		}
+		return evalRangeCall(n, w, args, r)
+	}
+	return nil, Errorf(ErrInternal, "unknown plan node %T", n)
+}
+
+func evalArgs(ns []planNode, r evalRange) ([]*planValue, error) {
+	res := make([]*planValue, len(ns))
+	for i, a := range ns {
+		v, err := evalPlan(a, r)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+// window returns the samples of m from start to end.
+func window(m model.Matrix, start, end int64) model.Matrix {
+	res := make(model.Matrix, 0, len(m))
+	for _, ss := range m {
+		stream := &model.SampleStream{Metric: ss.Metric}
+		for _, p := range ss.Values {
+			if int64(p.Timestamp) >= start && int64(p.Timestamp) <= end {
+				stream.Values = append(stream.Values, p)
+			}
+		}
+		if len(stream.Values) > 0 {
+			res = append(res, stream)
+		}
+	}
+	return res
+}
+
+func (n *binaryNode) eval(lhs, rhs *planValue) (*planValue, error) {
+	comparison := promql.IsComparison(n.op)
+	dropName := !comparison || n.returnBool
+
+	switch {
+	case lhs.scalar && rhs.scalar:
+		return &planValue{scalar: true, s: func(t model.Time) float64 {
+			v, _ := binop(n.op, lhs.s(t), rhs.s(t), true)
+			return v
+		}}, nil
+	case lhs.scalar || rhs.scalar:
+		res := make(seriesSet)
+		vec, sv := lhs.m, rhs.s
+		if lhs.scalar {
+			vec, sv = rhs.m, lhs.s
+		}
+		for _, ss := range vec {
+			metric := ss.Metric
+			if dropName {
+				metric = dropMetricName(metric)
+			}
+			for _, p := range ss.Values {
+				l, r := float64(p.Value), sv(p.Timestamp)
+				if lhs.scalar {
+					l, r = r, l
+				}
+				v, keep := binop(n.op, l, r, n.returnBool)
+				if comparison && !n.returnBool {
+					// a filtering comparison keeps the vector's value.
+					v = float64(p.Value)
+				}
+				if !keep {
+					continue
+				}
+				if err := res.insert(metric, p.Timestamp, v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &planValue{m: res.matrix()}, nil
+	}
+
+	// vector to vector, the samples are matched at every timestamp.
+	m := n.matching
+	if m == nil {
+		m = &promql.VectorMatching{Card: "one-to-one"}
+	}
+	lt, rt := samplesAt(lhs.m), samplesAt(rhs.m)
+	res := make(seriesSet)
+	if promql.IsSetOperator(n.op) {
+		for t, ls := range lt {
+			if err := setOp(n.op, t, ls, rt[t], m, res); err != nil {
+				return nil, err
+			}
+		}
+		if n.op == "or" {
+			for t, rs := range rt {
+				if _, ok := lt[t]; ok {
+					continue
+				}
+				if err := setOp(n.op, t, nil, rs, m, res); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &planValue{m: res.matrix()}, nil
+	}
+	for t, ls := range lt {
+		if rs, ok := rt[t]; ok {
+			if err := n.match(t, ls, rs, m, dropName, res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &planValue{m: res.matrix()}, nil
+}
+
+// setOp evaluates a set operation over the samples of a timestamp.
+func setOp(op string, t model.Time, ls, rs []sample, m *promql.VectorMatching, res seriesSet) error {
+	sigs := make(map[model.Fingerprint]bool, len(rs))
+	for _, s := range rs {
+		sigs[signature(s.metric, m.On, m.Labels).Fingerprint()] = true
+	}
+	if op == "or" {
+		left := make(map[model.Fingerprint]bool, len(ls))
+		for _, s := range ls {
+			left[signature(s.metric, m.On, m.Labels).Fingerprint()] = true
+			if err := res.insert(s.metric, t, s.v); err != nil {
+				return err
+			}
+		}
+		for _, s := range rs {
+			if left[signature(s.metric, m.On, m.Labels).Fingerprint()] {
+				continue
+			}
+			if err := res.insert(s.metric, t, s.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range ls {
+		if sigs[signature(s.metric, m.On, m.Labels).Fingerprint()] != (op == "and") {
+			continue
+		}
+		if err := res.insert(s.metric, t, s.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match evaluates an arithmetic or comparison operation over the samples
+// of a timestamp, every sample of the many side is matched with a single
+// sample of the one side.
+func (n *binaryNode) match(t model.Time, ls, rs []sample, m *promql.VectorMatching, dropName bool, res seriesSet) error {
+	if m.Card == "group_right" {
+		ls, rs = rs, ls
+	}
+	one := make(map[model.Fingerprint]sample, len(rs))
+	for _, s := range rs {
+		sig := signature(s.metric, m.On, m.Labels)
+		fp := sig.Fingerprint()
+		if _, dup := one[fp]; dup {
+			side := "right"
+			if m.Card == "group_right" {
+				side = "left"
+			}
+			return Errorf(ErrExecution, "found duplicate series for the match group %s on the %s hand-side of the operation: %s;"+
+				"many-to-many matching not allowed: matching labels must be unique on one side", sig, side, s.metric)
+		}
+		one[fp] = s
+	}
+
+	matched := make(map[model.Fingerprint]map[model.Fingerprint]bool, len(ls))
+	for _, l := range ls {
+		fp := signature(l.metric, m.On, m.Labels).Fingerprint()
+		r, ok := one[fp]
+		if !ok {
+			continue
+		}
+		lv, rv := l.v, r.v
+		if m.Card == "group_right" {
+			lv, rv = rv, lv
+		}
+		v, keep := binop(n.op, lv, rv, n.returnBool)
+		if !keep {
+			continue
+		}
+		metric := resultMetric(l.metric, r.metric, dropName, m)
+		inserted, exists := matched[fp]
+		if m.Card == "one-to-one" {
+			if exists {
+				return Errorf(ErrExecution, "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matched[fp] = nil
+		} else {
+			mfp := metric.Fingerprint()
+			if !exists {
+				inserted = make(map[model.Fingerprint]bool)
+				matched[fp] = inserted
+			} else if inserted[mfp] {
+				return Errorf(ErrExecution, "multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			inserted[mfp] = true
+		}
+		if err := res.insert(metric, t, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signature returns the labels two series are matched on.
+func signature(m model.Metric, on bool, labels []string) model.Metric {
+	if on {
+		return groupingMetric(m, labels, false)
+	}
+	return groupingMetric(m, labels, true)
+}
+
+// resultMetric returns the labels of the result of matching the sample
+// of the many side with one of the one side.
+func resultMetric(many, one model.Metric, dropName bool, m *promql.VectorMatching) model.Metric {
+	res := many.Clone()
+	if dropName {
+		delete(res, model.MetricNameLabel)
+	}
+	if m.Card == "one-to-one" {
+		if m.On {
+			res = groupingMetric(res, m.Labels, false)
+		} else {
+			for _, l := range m.Labels {
+				delete(res, model.LabelName(l))
+			}
+		}
+	}
+	for _, l := range m.Include {
+		if v, ok := one[model.LabelName(l)]; ok && v != "" {
+			res[model.LabelName(l)] = v
+		} else {
+			delete(res, model.LabelName(l))
+		}
+	}
+	return res
+}
+
+func dropMetricName(m model.Metric) model.Metric {
+	if _, ok := m[model.MetricNameLabel]; !ok {
+		return m
+	}
+	res := m.Clone()
+	delete(res, model.MetricNameLabel)
+	return res
+}
+
+// binop applies op, for comparisons it returns whether the sample is kept,
+// with returnBool the comparison result is returned as 0 or 1.
+func binop(op string, l, r float64, returnBool bool) (float64, bool) {
+	var cmp bool
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	case "^":
+		return math.Pow(l, r), true
+	case "==":
+		cmp = l == r
+	case "!=":
+		cmp = l != r
+	case ">":
+		cmp = l > r
+	case "<":
+		cmp = l < r
+	case ">=":
+		cmp = l >= r
+	case "<=":
+		cmp = l <= r
+	}
+	if returnBool {
+		if cmp {
+			return 1, true
+		}
+		return 0, true
+	}
+	return l, cmp
+}
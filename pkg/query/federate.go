@@ -0,0 +1,132 @@
+package query
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const federatePath = "/federate"
+
+// Federate collects the latest sample of every series matching the
+// match[] selectors of params from every shard. A series found on
+// several shards keeps its most recent sample.
+func (q *Querier) Federate(ctx context.Context, params url.Values) ([]*dto.MetricFamily, error) {
+	if len(params["match[]"]) == 0 {
+		return nil, Errorf(ErrBadData, "no match[] parameter provided")
+	}
+	addrs := q.shards(federatePath, paramSelectors(params))
+	if len(addrs) == 0 {
+		return nil, Errorf(ErrUnavailable, "no backend endpoint available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+
+	results := make([]map[string]*dto.MetricFamily, len(addrs))
+	err := q.parallel(ctx, federatePath, addrs, func(i int, addr string) error {
+		var err error
+		results[i], err = q.federate(ctx, addr, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeFamilies(results), nil
+}
+
+// federate scrapes the federation endpoint of the shard at addr.
+func (q *Querier) federate(ctx context.Context, addr string, params url.Values) (map[string]*dto.MetricFamily, error) {
+	c := NewClient(addr, q.client)
+	req, err := http.NewRequest(http.MethodGet, c.Addr()+federatePath+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, Errorf(ErrInternal, "%v", err)
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+
+	resp, err := q.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, requestError(ctx, c.Addr(), err)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		typ := ErrUnavailable
+		if resp.StatusCode == http.StatusBadRequest {
+			typ = ErrBadData
+		}
+		return nil, Errorf(typ, "%s: federate: %s: %s", c.Addr(), resp.Status, msg)
+	}
+
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, requestError(ctx, c.Addr(), err)
+		}
+		return nil, Errorf(ErrInternal, "%s: decode federation response: %v", c.Addr(), err)
+	}
+	return mfs, nil
+}
+
+// mergeFamilies merges the metric families of every shard, keeping the
+// most recent sample of every series. Families are sorted by name and
+// series by labels.
+func mergeFamilies(results []map[string]*dto.MetricFamily) []*dto.MetricFamily {
+	families := map[string]*dto.MetricFamily{}
+	series := map[string]map[model.Fingerprint]*dto.Metric{}
+	for _, mfs := range results {
+		for name, mf := range mfs {
+			f, ok := families[name]
+			if !ok {
+				f = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				families[name] = f
+				series[name] = map[model.Fingerprint]*dto.Metric{}
+			}
+			for _, m := range mf.Metric {
+				fp := metricFingerprint(name, m)
+				if prev, ok := series[name][fp]; ok && prev.GetTimestampMs() >= m.GetTimestampMs() {
+					continue
+				}
+				series[name][fp] = m
+			}
+		}
+	}
+
+	res := make([]*dto.MetricFamily, 0, len(families))
+	for name, f := range families {
+		for _, m := range series[name] {
+			f.Metric = append(f.Metric, m)
+		}
+		sort.Slice(f.Metric, func(i, j int) bool {
+			return metricLabels(f.Metric[i]).Before(metricLabels(f.Metric[j]))
+		})
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetName() < res[j].GetName() })
+	return res
+}
+
+func metricLabels(m *dto.Metric) model.Metric {
+	ls := make(model.Metric, len(m.Label))
+	for _, l := range m.Label {
+		ls[model.LabelName(l.GetName())] = model.LabelValue(l.GetValue())
+	}
+	return ls
+}
+
+func metricFingerprint(name string, m *dto.Metric) model.Fingerprint {
+	ls := metricLabels(m)
+	ls[model.MetricNameLabel] = model.LabelValue(name)
+	return ls.Fingerprint()
+}
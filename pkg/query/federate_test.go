@@ -0,0 +1,49 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestQuerierFederate(t *testing.T) {
+	a := newShard(t, `# TYPE up untyped
+up{instance="a"} 1 1000
+up{instance="b"} 0 1000
+`)
+	b := newShard(t, `# TYPE up untyped
+up{instance="a"} 0 2000
+up{instance="c"} 1 2000
+# TYPE x untyped
+x 5 2000
+`)
+	q := newTestQuerier(a.URL, b.URL)
+
+	mfs, err := q.Federate(context.Background(), url.Values{"match[]": []string{"{job=~\".+\"}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `# TYPE up untyped
+up{instance="a"} 0 2000
+up{instance="b"} 0 1000
+up{instance="c"} 1 2000
+# TYPE x untyped
+x 5 2000
+`
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if _, err := q.Federate(context.Background(), url.Values{}); err == nil {
+		t.Fatal("expected error without match[]")
+	}
+}
@@ -0,0 +1,303 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+var (
+	frontendSplitQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "frontend_split_queries_total",
+			Help:      "The number of sub-queries range queries were split into.",
+		},
+	)
+	frontendCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "frontend_cache_hits_total",
+			Help:      "The number of sub-queries answered from the results cache.",
+		},
+	)
+	frontendCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "frontend_cache_misses_total",
+			Help:      "The number of cacheable sub-queries missing from the results cache.",
+		},
+	)
+)
+
+// defaults of the zero FrontendConfig values.
+var (
+	defaultSplitInterval  = 24 * time.Hour
+	defaultMaxParallelism = 14
+	defaultMaxFreshness   = 10 * time.Minute
+)
+
+// FrontendConfig configuration
+type FrontendConfig struct {
+	Enable bool `yaml:"enable"`
+	// SplitInterval is the length of the sub-queries.
+	SplitInterval time.Duration `yaml:"splitInterval"`
+	// MaxParallelism is the number of sub-queries of a query run in parallel.
+	MaxParallelism int `yaml:"maxParallelism"`
+	// MaxFreshness excludes the intervals ending less than MaxFreshness
+	// ago from caching, their samples may still be ingested.
+	MaxFreshness time.Duration `yaml:"maxFreshness"`
+
+	Cache CacheConfig `yaml:"cache"`
+}
+
+// CacheConfig configuration
+type CacheConfig struct {
+	// Type is memory, disk, or empty to disable caching.
+	Type         string `yaml:"type"`
+	MaxSizeBytes int64  `yaml:"maxSizeBytes"`
+	// Path is the directory of the disk cache.
+	Path string `yaml:"path"`
+}
+
+// RangeFunc evaluates a range query.
+type RangeFunc func(ctx context.Context, params url.Values) (*QueryData, []string, error)
+
+// Frontend splits range queries into interval sized sub-queries which
+// run in parallel, the results of completed intervals are cached.
+type Frontend struct {
+	next  RangeFunc
+	cache Cache
+	conf  FrontendConfig
+	now   func() time.Time
+
+	logger *zap.Logger
+}
+
+// NewFrontend creates a frontend sending the sub-queries to next.
+func NewFrontend(
+	reg prometheus.Registerer,
+	next RangeFunc,
+	conf FrontendConfig,
+	logger *zap.Logger) (*Frontend, error) {
+	reg.MustRegister(frontendSplitQueries, frontendCacheHits, frontendCacheMisses)
+	if conf.SplitInterval <= 0 {
+		conf.SplitInterval = defaultSplitInterval
+	}
+	if conf.MaxParallelism <= 0 {
+		conf.MaxParallelism = defaultMaxParallelism
+	}
+	if conf.MaxFreshness <= 0 {
+		conf.MaxFreshness = defaultMaxFreshness
+	}
+	cache, err := NewCache(conf.Cache)
+	if err != nil {
+		return nil, err
+	}
+	return &Frontend{
+		next:   next,
+		cache:  cache,
+		conf:   conf,
+		now:    time.Now,
+		logger: logger.With(zap.String("service", "frontend")),
+	}, nil
+}
+
+// subQuery is an interval of a range query.
+type subQuery struct {
+	start, end int64 // milliseconds, aligned to the step.
+	key        string
+	result     model.Matrix
+	warnings   []string
+	err        error
+}
+
+// QueryRange evaluates a range query of tenant. The start and end are
+// aligned to the step so that the intervals of successive queries match.
+func (f *Frontend) QueryRange(ctx context.Context, tenant string, params url.Values) (*QueryData, []string, error) {
+	start, end, step, err := rangeParams(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	start -= start % step
+	end -= end % step
+
+	subs := f.split(tenant, keyParams(params), start, end, step)
+	frontendSplitQueries.Add(float64(len(subs)))
+
+	sem := make(chan struct{}, f.conf.MaxParallelism)
+	var wg sync.WaitGroup
+	for _, sq := range subs {
+		wg.Add(1)
+		go func(sq *subQuery) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			f.run(ctx, params, step, sq)
+		}(sq)
+	}
+	wg.Wait()
+
+	ms := make([]model.Matrix, 0, len(subs))
+	var ws [][]string
+	for _, sq := range subs {
+		if sq.err != nil {
+			return nil, nil, sq.err
+		}
+		ms = append(ms, sq.result)
+		ws = append(ws, sq.warnings)
+	}
+	warnings := mergeStrings(ws)
+	if len(warnings) == 0 {
+		warnings = nil
+	}
+	return &QueryData{ResultType: model.ValMatrix, Result: trimMatrix(mergeMatrices(ms), start, end)}, warnings, nil
+}
+
+// split splits [start, end] into intervals. Intervals ended for
+// MaxFreshness are cacheable and are queried whole, so that the cached
+// results serve every query overlapping them.
+func (f *Frontend) split(tenant, params string, start, end, step int64) []*subQuery {
+	interval := int64(f.conf.SplitInterval / time.Millisecond)
+	fresh := f.now().Add(-f.conf.MaxFreshness).UnixNano() / int64(time.Millisecond)
+
+	var subs []*subQuery
+	for t := start; t <= end; {
+		begin := t - t%interval
+		// the first and last step aligned timestamps of the interval.
+		first := begin + (step-begin%step)%step
+		last := begin + interval - 1
+		last -= last % step
+
+		sq := &subQuery{start: t, end: last}
+		if sq.end > end {
+			sq.end = end
+		}
+		if f.cache != nil && begin+interval <= fresh {
+			sq.start, sq.end = first, last
+			sq.key = fmt.Sprintf("%s:%d:%d:%d:%s", tenant, step, begin, interval, params)
+		}
+		subs = append(subs, sq)
+		t = last + step
+	}
+	return subs
+}
+
+// unkeyedParams are left out of the cache keys: the range is keyed by
+// interval and the timeout does not change the result.
+var unkeyedParams = map[string]bool{"start": true, "end": true, "step": true, "timeout": true}
+
+// keyParams returns the encoded parameters of a query which change its
+// result, such as the query, dedup and partial_response.
+func keyParams(params url.Values) string {
+	p := make(url.Values, len(params))
+	for k, v := range params {
+		if !unkeyedParams[k] {
+			p[k] = v
+		}
+	}
+	return p.Encode()
+}
+
+// run evaluates the sub-query, through the cache if it is cacheable.
+func (f *Frontend) run(ctx context.Context, params url.Values, step int64, sq *subQuery) {
+	if sq.key != "" {
+		if b, ok := f.cache.Fetch(sq.key); ok {
+			var m model.Matrix
+			if err := json.Unmarshal(b, &m); err == nil {
+				frontendCacheHits.Inc()
+				sq.result = m
+				return
+			}
+		}
+		frontendCacheMisses.Inc()
+	}
+
+	p := make(url.Values, len(params))
+	for k, v := range params {
+		p[k] = v
+	}
+	p.Set("start", formatMillis(sq.start))
+	p.Set("end", formatMillis(sq.end))
+	p.Set("step", formatMillis(step))
+
+	d, warnings, err := f.next(ctx, p)
+	if err != nil {
+		sq.err = err
+		return
+	}
+	m, ok := d.Result.(model.Matrix)
+	if !ok {
+		sq.err = Errorf(ErrInternal, "unexpected result type %q of range query", d.ResultType)
+		return
+	}
+	sq.result, sq.warnings = m, warnings
+
+	// results with warnings may be incomplete.
+	if sq.key != "" && len(warnings) == 0 {
+		b, err := json.Marshal(m)
+		if err != nil {
+			f.logger.Error("encode cached result", zap.Error(err))
+			return
+		}
+		f.cache.Store(sq.key, b)
+	}
+}
+
+// rangeParams returns the start, end and step of a range query in milliseconds.
+func rangeParams(params url.Values) (int64, int64, int64, error) {
+	start, err := ParseTime(params.Get("start"))
+	if err != nil {
+		return 0, 0, 0, Errorf(ErrBadData, "invalid parameter \"start\": %v", err)
+	}
+	end, err := ParseTime(params.Get("end"))
+	if err != nil {
+		return 0, 0, 0, Errorf(ErrBadData, "invalid parameter \"end\": %v", err)
+	}
+	if end.Before(start) {
+		return 0, 0, 0, Errorf(ErrBadData, "invalid parameter \"end\": end timestamp must not be before start time")
+	}
+	step, err := ParseDuration(params.Get("step"))
+	if err != nil {
+		return 0, 0, 0, Errorf(ErrBadData, "invalid parameter \"step\": %v", err)
+	}
+	if step < time.Millisecond {
+		return 0, 0, 0, Errorf(ErrBadData,
+			"invalid parameter \"step\": zero or negative query resolution step widths are not accepted")
+	}
+	return start.UnixNano() / int64(time.Millisecond), end.UnixNano() / int64(time.Millisecond),
+		int64(step / time.Millisecond), nil
+}
+
+func formatMillis(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1e3, 'f', -1, 64)
+}
+
+// trimMatrix drops the samples outside [start, end] and the series left empty.
+func trimMatrix(m model.Matrix, start, end int64) model.Matrix {
+	res := m[:0]
+	for _, ss := range m {
+		values := ss.Values[:0]
+		for _, v := range ss.Values {
+			if int64(v.Timestamp) >= start && int64(v.Timestamp) <= end {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			ss.Values = values
+			res = append(res, ss)
+		}
+	}
+	return res
+}
@@ -0,0 +1,144 @@
+package query
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// stepRange answers range queries with a sample at every step and
+// records the queried ranges.
+type stepRange struct {
+	mu     sync.Mutex
+	ranges [][2]string
+}
+
+func (r *stepRange) query(_ context.Context, params url.Values) (*QueryData, []string, error) {
+	r.mu.Lock()
+	r.ranges = append(r.ranges, [2]string{params.Get("start"), params.Get("end")})
+	r.mu.Unlock()
+
+	start, end, step, err := rangeParams(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	ss := &model.SampleStream{Metric: model.Metric{"job": "a"}}
+	for t := start; t <= end; t += step {
+		ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(t)})
+	}
+	return &QueryData{ResultType: model.ValMatrix, Result: model.Matrix{ss}}, nil, nil
+}
+
+func (r *stepRange) calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.ranges)
+	r.ranges = nil
+	return n
+}
+
+func TestFrontendQueryRange(t *testing.T) {
+	r := &stepRange{}
+	f, err := NewFrontend(prometheus.NewRegistry(), r.query, FrontendConfig{
+		SplitInterval: 24 * time.Hour,
+		Cache:         CacheConfig{Type: CacheMemory, MaxSizeBytes: 1 << 20},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := int64(24 * 3600)
+	now := time.Unix(10*day+3600, 0)
+	f.now = func() time.Time { return now }
+
+	// three days ending now, the start is aligned down to the step.
+	params := url.Values{
+		"query": []string{"up"},
+		"start": []string{formatMillis((7*day + 3600 + 7) * 1000)},
+		"end":   []string{formatMillis((10*day + 3600) * 1000)},
+		"step":  []string{"60"},
+	}
+	for i, want := range []int{4, 1} {
+		d, _, err := f.QueryRange(context.Background(), "tenant", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := r.calls(); n != want {
+			t.Fatalf("query %d: got %d sub-queries, want %d", i, n, want)
+		}
+		values := d.Result.(model.Matrix)[0].Values
+		if len(values) != 3*24*60+1 {
+			t.Fatalf("query %d: got %d samples, want %d", i, len(values), 3*24*60+1)
+		}
+		if first := int64(values[0].Timestamp); first != (7*day+3600)*1000 {
+			t.Fatalf("query %d: got first sample at %d", i, first)
+		}
+	}
+
+	// other tenants do not share the cached results.
+	if _, _, err := f.QueryRange(context.Background(), "other", params); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.calls(); n != 4 {
+		t.Fatalf("got %d sub-queries, want 4", n)
+	}
+
+	// neither do the queries differing by a parameter changing the result.
+	for _, p := range []struct{ name, value string }{
+		{"query", "down"},
+		{dedupParam, "false"},
+		{partialResponseParam, "true"},
+	} {
+		changed := url.Values{}
+		for k, v := range params {
+			changed[k] = v
+		}
+		changed.Set(p.name, p.value)
+		for i, want := range []int{4, 1} {
+			if _, _, err := f.QueryRange(context.Background(), "tenant", changed); err != nil {
+				t.Fatal(err)
+			}
+			if n := r.calls(); n != want {
+				t.Fatalf("%s=%s, query %d: got %d sub-queries, want %d", p.name, p.value, i, n, want)
+			}
+		}
+	}
+
+	// the timeout does not change the result.
+	params.Set("timeout", "10s")
+	if _, _, err := f.QueryRange(context.Background(), "tenant", params); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.calls(); n != 1 {
+		t.Fatalf("got %d sub-queries with a timeout, want 1", n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]Cache{
+		"memory": NewMemoryCache(20),
+		"disk":   disk,
+	} {
+		c.Store("a", []byte("0123456789"))
+		if v, ok := c.Fetch("a"); !ok || string(v) != "0123456789" {
+			t.Fatalf("%s: got %q, %v", name, v, ok)
+		}
+		// b evicts a, the least recently used entry.
+		c.Store("b", []byte("0123456789"))
+		if _, ok := c.Fetch("a"); ok {
+			t.Fatalf("%s: a not evicted", name)
+		}
+		if _, ok := c.Fetch("b"); !ok {
+			t.Fatalf("%s: b missing", name)
+		}
+	}
+}
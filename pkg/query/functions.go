@@ -0,0 +1,531 @@
+package query
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/promql"
+
+	"github.com/prometheus/common/model"
+)
+
+// funcSignature holds the argument types of a function, the last optional
+// ones may be omitted and the last one of a variadic function repeated.
+type funcSignature struct {
+	args     []promql.ValueType
+	optional int
+	variadic bool
+}
+
+var (
+	vectorArg = []promql.ValueType{promql.ValueTypeVector}
+	matrixArg = []promql.ValueType{promql.ValueTypeMatrix}
+)
+
+// instantFunctions are the functions over instant vectors and scalars
+// evaluated at the proxy.
+var instantFunctions = map[string]funcSignature{
+	"absent":             {args: vectorArg},
+	"absent_over_time":   {args: matrixArg},
+	"clamp":              {args: []promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar, promql.ValueTypeScalar}},
+	"clamp_max":          {args: []promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar}},
+	"clamp_min":          {args: []promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar}},
+	"histogram_quantile": {args: []promql.ValueType{promql.ValueTypeScalar, promql.ValueTypeVector}},
+	"label_join": {
+		args:     []promql.ValueType{promql.ValueTypeVector, promql.ValueTypeString, promql.ValueTypeString, promql.ValueTypeString},
+		variadic: true,
+	},
+	"label_replace": {args: []promql.ValueType{
+		promql.ValueTypeVector, promql.ValueTypeString, promql.ValueTypeString, promql.ValueTypeString, promql.ValueTypeString,
+	}},
+	"pi":        {},
+	"round":     {args: []promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar}, optional: 1},
+	"scalar":    {args: vectorArg},
+	"sort":      {args: vectorArg},
+	"sort_desc": {args: vectorArg},
+	"time":      {},
+	"timestamp": {args: vectorArg},
+	"vector":    {args: []promql.ValueType{promql.ValueTypeScalar}},
+}
+
+// mathFunctions are the functions applied to every sample value.
+var mathFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"exp":   math.Exp,
+	"sqrt":  math.Sqrt,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"sgn": func(v float64) float64 {
+		switch {
+		case v < 0:
+			return -1
+		case v > 0:
+			return 1
+		}
+		return v
+	},
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"sinh":  math.Sinh,
+	"cosh":  math.Cosh,
+	"tanh":  math.Tanh,
+	"asinh": math.Asinh,
+	"acosh": math.Acosh,
+	"atanh": math.Atanh,
+	"deg":   func(v float64) float64 { return v * 180 / math.Pi },
+	"rad":   func(v float64) float64 { return v * math.Pi / 180 },
+}
+
+// dateFunctions are the functions of the UTC time of every sample value,
+// the evaluation time without argument.
+var dateFunctions = map[string]func(time.Time) float64{
+	"days_in_month": func(t time.Time) float64 {
+		return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	},
+	"day_of_month": func(t time.Time) float64 { return float64(t.Day()) },
+	"day_of_week":  func(t time.Time) float64 { return float64(t.Weekday()) },
+	"hour":         func(t time.Time) float64 { return float64(t.Hour()) },
+	"minute":       func(t time.Time) float64 { return float64(t.Minute()) },
+	"month":        func(t time.Time) float64 { return float64(t.Month()) },
+	"year":         func(t time.Time) float64 { return float64(t.Year()) },
+}
+
+// rangeFunctions are the functions over range vectors.
+var rangeFunctions = map[string]funcSignature{
+	"changes":            {args: matrixArg},
+	"delta":              {args: matrixArg},
+	"deriv":              {args: matrixArg},
+	"holt_winters":       {args: []promql.ValueType{promql.ValueTypeMatrix, promql.ValueTypeScalar, promql.ValueTypeScalar}},
+	"idelta":             {args: matrixArg},
+	"increase":           {args: matrixArg},
+	"irate":              {args: matrixArg},
+	"predict_linear":     {args: []promql.ValueType{promql.ValueTypeMatrix, promql.ValueTypeScalar}},
+	"rate":               {args: matrixArg},
+	"resets":             {args: matrixArg},
+	"avg_over_time":      {args: matrixArg},
+	"count_over_time":    {args: matrixArg},
+	"last_over_time":     {args: matrixArg},
+	"max_over_time":      {args: matrixArg},
+	"min_over_time":      {args: matrixArg},
+	"present_over_time":  {args: matrixArg},
+	"quantile_over_time": {args: []promql.ValueType{promql.ValueTypeScalar, promql.ValueTypeMatrix}},
+	"stddev_over_time":   {args: matrixArg},
+	"stdvar_over_time":   {args: matrixArg},
+	"sum_over_time":      {args: matrixArg},
+}
+
+// checkCall checks the function and the argument types of a call.
+func checkCall(e *promql.Call) error {
+	sig, ok := instantFunctions[e.Func]
+	if !ok {
+		sig, ok = rangeFunctions[e.Func]
+	}
+	if !ok {
+		if _, ok = mathFunctions[e.Func]; ok {
+			sig = funcSignature{args: vectorArg}
+		} else if _, ok = dateFunctions[e.Func]; ok {
+			sig = funcSignature{args: vectorArg, optional: 1}
+		}
+	}
+	if !ok {
+		return Errorf(ErrBadData, "unknown function with name %q", e.Func)
+	}
+
+	min, max := len(sig.args)-sig.optional, len(sig.args)
+	switch {
+	case sig.variadic:
+		min--
+		if len(e.Args) < min {
+			return Errorf(ErrBadData, "expected at least %d argument(s) in call to %q, got %d", min, e.Func, len(e.Args))
+		}
+	case min == max && len(e.Args) != min:
+		return Errorf(ErrBadData, "expected %d argument(s) in call to %q, got %d", min, e.Func, len(e.Args))
+	case len(e.Args) < min:
+		return Errorf(ErrBadData, "expected at least %d argument(s) in call to %q, got %d", min, e.Func, len(e.Args))
+	case len(e.Args) > max:
+		return Errorf(ErrBadData, "expected at most %d argument(s) in call to %q, got %d", max, e.Func, len(e.Args))
+	}
+	for i, a := range e.Args {
+		want := sig.args[len(sig.args)-1]
+		if i < len(sig.args) {
+			want = sig.args[i]
+		}
+		if got := a.Type(); got != want {
+			return Errorf(ErrBadData, "expected type %s in call to function %q, got %s", typeName(want), e.Func, typeName(got))
+		}
+	}
+	return nil
+}
+
+// evalCall evaluates a function over instant vectors and scalars at every
+// timestamp of r.
+func evalCall(n *callNode, args []*planValue, r evalRange) (*planValue, error) {
+	res := make(seriesSet)
+	each := func(f func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool)) (*planValue, error) {
+		for _, ss := range args[0].m {
+			for _, p := range ss.Values {
+				metric, v, keep := f(ss.Metric, p.Timestamp, float64(p.Value))
+				if !keep {
+					continue
+				}
+				if err := res.insert(metric, p.Timestamp, v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &planValue{m: res.matrix()}, nil
+	}
+
+	if f, ok := mathFunctions[n.fn]; ok {
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			return dropMetricName(metric), f(v), true
+		})
+	}
+	if f, ok := dateFunctions[n.fn]; ok {
+		if len(args) == 0 {
+			args = []*planValue{vectorOf(&planValue{scalar: true, s: timeSeconds}, r)}
+		}
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			return dropMetricName(metric), f(time.Unix(int64(v), 0).UTC()), true
+		})
+	}
+
+	switch n.fn {
+	case "absent":
+		present := samplesAt(args[0].m)
+		for _, t := range r.timestamps() {
+			if len(present[t]) == 0 {
+				res.add(n.labels, t, 1, nil)
+			}
+		}
+		return &planValue{m: res.matrix()}, nil
+	case "clamp", "clamp_max", "clamp_min":
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			switch n.fn {
+			case "clamp":
+				min, max := args[1].s(t), args[2].s(t)
+				if max < min {
+					return nil, 0, false
+				}
+				v = math.Max(min, math.Min(max, v))
+			case "clamp_max":
+				v = math.Min(args[1].s(t), v)
+			case "clamp_min":
+				v = math.Max(args[1].s(t), v)
+			}
+			return dropMetricName(metric), v, true
+		})
+	case "label_join":
+		dst, sep, src := n.strs[0], n.strs[1], n.strs[2:]
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			vs := make([]string, len(src))
+			for i, l := range src {
+				vs[i] = string(metric[model.LabelName(l)])
+			}
+			return setLabel(metric, dst, strings.Join(vs, sep)), v, true
+		})
+	case "label_replace":
+		dst, repl, src := n.strs[0], n.strs[1], n.strs[2]
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			val := string(metric[model.LabelName(src)])
+			idx := n.regex.FindStringSubmatchIndex(val)
+			if idx == nil {
+				return metric, v, true
+			}
+			res := n.regex.ExpandString(nil, repl, val, idx)
+			return setLabel(metric, dst, string(res)), v, true
+		})
+	case "round":
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			toNearest := 1.0
+			if len(args) > 1 {
+				toNearest = args[1].s(t)
+			}
+			// dividing by the inverse is more precise for fractions.
+			inv := 1 / toNearest
+			return dropMetricName(metric), math.Floor(v*inv+0.5) / inv, true
+		})
+	case "scalar":
+		return scalarOf(args[0].m), nil
+	case "sort", "sort_desc":
+		return args[0], nil
+	case "timestamp":
+		return each(func(metric model.Metric, t model.Time, v float64) (model.Metric, float64, bool) {
+			return dropMetricName(metric), float64(t) / 1e3, true
+		})
+	case "vector":
+		return vectorOf(args[0], r), nil
+	}
+	return nil, Errorf(ErrInternal, "unknown function %q", n.fn)
+}
+
+// setLabel returns a copy of m with the label set, or removed if empty.
+func setLabel(m model.Metric, name, value string) model.Metric {
+	res := m.Clone()
+	if value == "" {
+		delete(res, model.LabelName(name))
+		return res
+	}
+	res[model.LabelName(name)] = model.LabelValue(value)
+	return res
+}
+
+// timeSeconds is the time() function.
+func timeSeconds(t model.Time) float64 {
+	return float64(t) / 1e3
+}
+
+// scalarOf returns the scalar() of m, the value of its only sample at every
+// timestamp or NaN.
+func scalarOf(m model.Matrix) *planValue {
+	samples := samplesAt(m)
+	return &planValue{scalar: true, s: func(t model.Time) float64 {
+		if ss := samples[t]; len(ss) == 1 {
+			return ss[0].v
+		}
+		return math.NaN()
+	}}
+}
+
+// vectorOf returns the vector() of a scalar over r.
+func vectorOf(v *planValue, r evalRange) *planValue {
+	stream := &model.SampleStream{Metric: model.Metric{}}
+	for _, t := range r.timestamps() {
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(v.s(t))})
+	}
+	return &planValue{m: model.Matrix{stream}}
+}
+
+// evalRangeCall evaluates a function over the windows of a range vector
+// at every timestamp of r.
+func evalRangeCall(n *rangeNode, window *planValue, args []*planValue, r evalRange) (*planValue, error) {
+	res := make(seriesSet)
+	for _, ss := range window.m {
+		metric := ss.Metric
+		if n.fn != "last_over_time" {
+			metric = dropMetricName(metric)
+		}
+		for _, t := range r.timestamps() {
+			start, end := int64(t)-n.window.offset-n.window.rng, int64(t)-n.window.offset
+			var pts []model.SamplePair
+			for _, p := range ss.Values {
+				if int64(p.Timestamp) >= start && int64(p.Timestamp) <= end {
+					pts = append(pts, p)
+				}
+			}
+			if len(pts) == 0 {
+				continue
+			}
+			params := make([]float64, len(args))
+			for i, a := range args {
+				params[i] = a.s(t)
+			}
+			v, ok, err := rangeValue(n.fn, pts, start, end, params)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if err := res.insert(metric, t, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &planValue{m: res.matrix()}, nil
+}
+
+// rangeValue returns the value of a range function over the samples of a
+// series within the window from start to end, and whether it has one.
+func rangeValue(fn string, pts []model.SamplePair, start, end int64, params []float64) (float64, bool, error) {
+	vs := make([]float64, len(pts))
+	for i, p := range pts {
+		vs[i] = float64(p.Value)
+	}
+	switch fn {
+	case "rate", "increase", "delta":
+		if len(pts) < 2 {
+			return 0, false, nil
+		}
+		return extrapolatedRate(fn, pts, start, end), true, nil
+	case "irate", "idelta":
+		if len(pts) < 2 {
+			return 0, false, nil
+		}
+		last, prev := pts[len(pts)-1], pts[len(pts)-2]
+		v := float64(last.Value - prev.Value)
+		if fn == "idelta" {
+			return v, true, nil
+		}
+		if last.Value < prev.Value {
+			// a counter reset.
+			v = float64(last.Value)
+		}
+		interval := last.Timestamp.Sub(prev.Timestamp)
+		if interval == 0 {
+			return 0, false, nil
+		}
+		return v / interval.Seconds(), true, nil
+	case "deriv":
+		if len(pts) < 2 {
+			return 0, false, nil
+		}
+		slope, _ := linearRegression(pts, pts[0].Timestamp)
+		return slope, true, nil
+	case "predict_linear":
+		if len(pts) < 2 {
+			return 0, false, nil
+		}
+		slope, intercept := linearRegression(pts, model.Time(end))
+		return slope*params[0] + intercept, true, nil
+	case "holt_winters":
+		return holtWinters(vs, params[0], params[1])
+	case "changes", "resets":
+		var n float64
+		for i := 1; i < len(vs); i++ {
+			cur, prev := vs[i], vs[i-1]
+			if fn == "resets" && cur < prev {
+				n++
+			}
+			if fn == "changes" && cur != prev && !(math.IsNaN(cur) && math.IsNaN(prev)) {
+				n++
+			}
+		}
+		return n, true, nil
+	case "avg_over_time", "stddev_over_time", "stdvar_over_time":
+		var count, mean, variance float64
+		for _, v := range vs {
+			count++
+			delta := v - mean
+			mean += delta / count
+			variance += delta * (v - mean)
+		}
+		switch fn {
+		case "stdvar_over_time":
+			return variance / count, true, nil
+		case "stddev_over_time":
+			return math.Sqrt(variance / count), true, nil
+		}
+		return mean, true, nil
+	case "count_over_time":
+		return float64(len(vs)), true, nil
+	case "last_over_time":
+		return vs[len(vs)-1], true, nil
+	case "present_over_time":
+		return 1, true, nil
+	case "max_over_time", "min_over_time":
+		v := vs[0]
+		for _, cur := range vs[1:] {
+			if math.IsNaN(v) || (fn == "max_over_time" && cur > v) || (fn == "min_over_time" && cur < v) {
+				v = cur
+			}
+		}
+		return v, true, nil
+	case "quantile_over_time":
+		return quantile(params[0], vs), true, nil
+	case "sum_over_time":
+		var sum float64
+		for _, v := range vs {
+			sum += v
+		}
+		return sum, true, nil
+	}
+	return 0, false, Errorf(ErrInternal, "unknown function %q", fn)
+}
+
+// extrapolatedRate evaluates rate, increase and delta, extrapolating the
+// samples to the window boundaries.
+func extrapolatedRate(fn string, pts []model.SamplePair, start, end int64) float64 {
+	counter := fn != "delta"
+	var correction, last float64
+	for _, p := range pts {
+		if counter && float64(p.Value) < last {
+			correction += last
+		}
+		last = float64(p.Value)
+	}
+	first := pts[0]
+	v := last - float64(first.Value) + correction
+
+	toStart := float64(int64(first.Timestamp)-start) / 1e3
+	toEnd := float64(end-int64(pts[len(pts)-1].Timestamp)) / 1e3
+	sampled := float64(pts[len(pts)-1].Timestamp-first.Timestamp) / 1e3
+	avg := sampled / float64(len(pts)-1)
+	if counter && v > 0 && first.Value >= 0 {
+		// a counter does not extrapolate below zero.
+		if toZero := sampled * (float64(first.Value) / v); toZero < toStart {
+			toStart = toZero
+		}
+	}
+
+	threshold := avg * 1.1
+	interval := sampled
+	if toStart < threshold {
+		interval += toStart
+	} else {
+		interval += avg / 2
+	}
+	if toEnd < threshold {
+		interval += toEnd
+	} else {
+		interval += avg / 2
+	}
+	v *= interval / sampled
+	if fn == "rate" {
+		v /= float64(end-start) / 1e3
+	}
+	return v
+}
+
+// linearRegression returns the least squares slope and intercept of the
+// samples, with the time in seconds relative to interceptTime.
+func linearRegression(pts []model.SamplePair, interceptTime model.Time) (float64, float64) {
+	var n, sumX, sumY, sumXY, sumX2 float64
+	for _, p := range pts {
+		x := float64(p.Timestamp-interceptTime) / 1e3
+		n++
+		sumY += float64(p.Value)
+		sumX += x
+		sumXY += x * float64(p.Value)
+		sumX2 += x * x
+	}
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+	slope := covXY / varX
+	return slope, sumY/n - slope*sumX/n
+}
+
+// holtWinters returns the double exponential smoothing of vs.
+func holtWinters(vs []float64, sf, tf float64) (float64, bool, error) {
+	if sf <= 0 || sf >= 1 {
+		return 0, false, Errorf(ErrExecution, "invalid smoothing factor. Expected: 0 < sf < 1, got: %s", formatFloat(sf))
+	}
+	if tf <= 0 || tf >= 1 {
+		return 0, false, Errorf(ErrExecution, "invalid trend factor. Expected: 0 < tf < 1, got: %s", formatFloat(tf))
+	}
+	if len(vs) < 2 {
+		return 0, false, nil
+	}
+	var s0 float64
+	s1, b := vs[0], vs[1]-vs[0]
+	for i := 1; i < len(vs); i++ {
+		if i > 1 {
+			b = tf*(s1-s0) + (1-tf)*b
+		}
+		s0, s1 = s1, sf*vs[i]+(1-sf)*(s1+b)
+	}
+	return s1, true, nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,192 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// QueryData is the data of a query or query_range response.
+type QueryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *QueryData) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		ResultType model.ValueType `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	d.ResultType = raw.ResultType
+	switch raw.ResultType {
+	case model.ValVector:
+		var v model.Vector
+		if err := json.Unmarshal(raw.Result, &v); err != nil {
+			return err
+		}
+		d.Result = v
+	case model.ValMatrix:
+		var m model.Matrix
+		if err := json.Unmarshal(raw.Result, &m); err != nil {
+			return err
+		}
+		d.Result = m
+	case model.ValScalar:
+		var s model.Scalar
+		if err := json.Unmarshal(raw.Result, &s); err != nil {
+			return err
+		}
+		d.Result = &s
+	case model.ValString:
+		var s model.String
+		if err := json.Unmarshal(raw.Result, &s); err != nil {
+			return err
+		}
+		d.Result = &s
+	default:
+		return fmt.Errorf("unknown result type %q", raw.ResultType)
+	}
+	return nil
+}
+
+// mergeData merges the results of the same query evaluated on every shard.
+func mergeData(ds []*QueryData) (*QueryData, error) {
+	if len(ds) == 0 {
+		return nil, Errorf(ErrInternal, "no result to merge")
+	}
+	typ := ds[0].ResultType
+	for _, d := range ds[1:] {
+		if d.ResultType != typ {
+			return nil, Errorf(ErrInternal, "mismatched result types %q and %q", typ, d.ResultType)
+		}
+	}
+
+	switch typ {
+	case model.ValVector:
+		vs := make([]model.Vector, 0, len(ds))
+		for _, d := range ds {
+			vs = append(vs, d.Result.(model.Vector))
+		}
+		return &QueryData{ResultType: typ, Result: mergeVectors(vs)}, nil
+	case model.ValMatrix:
+		ms := make([]model.Matrix, 0, len(ds))
+		for _, d := range ds {
+			ms = append(ms, d.Result.(model.Matrix))
+		}
+		return &QueryData{ResultType: typ, Result: mergeMatrices(ms)}, nil
+	default:
+		// scalars and strings do not depend on series,
+		// every shard evaluates them the same.
+		return ds[0], nil
+	}
+}
+
+// mergeVectors returns the union of vs, a series present
+// on several shards is kept once.
+func mergeVectors(vs []model.Vector) model.Vector {
+	seen := make(map[model.Fingerprint]struct{})
+	var res model.Vector
+	for _, v := range vs {
+		for _, s := range v {
+			fp := s.Metric.Fingerprint()
+			if _, ok := seen[fp]; ok {
+				continue
+			}
+			seen[fp] = struct{}{}
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Metric.Before(res[j].Metric)
+	})
+	return res
+}
+
+// mergeMatrices returns the union of ms, the samples of
+// a series present on several shards are merged by timestamp.
+func mergeMatrices(ms []model.Matrix) model.Matrix {
+	streams := make(map[model.Fingerprint]*model.SampleStream)
+	var res model.Matrix
+	for _, m := range ms {
+		for _, ss := range m {
+			fp := ss.Metric.Fingerprint()
+			cur, ok := streams[fp]
+			if !ok {
+				streams[fp] = ss
+				res = append(res, ss)
+				continue
+			}
+			cur.Values = mergeSamplePairs(cur.Values, ss.Values)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Metric.Before(res[j].Metric)
+	})
+	return res
+}
+
+// mergeSamplePairs merges two sorted sample lists,
+// for equal timestamps the sample of a wins.
+func mergeSamplePairs(a, b []model.SamplePair) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Timestamp < b[j].Timestamp:
+			res = append(res, a[i])
+			i++
+		case a[i].Timestamp > b[j].Timestamp:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+// mergeLabelSets returns the sorted union of the label set lists.
+func mergeLabelSets(ls [][]model.LabelSet) []model.LabelSet {
+	seen := make(map[model.Fingerprint]struct{})
+	res := []model.LabelSet{}
+	for _, l := range ls {
+		for _, s := range l {
+			fp := s.Fingerprint()
+			if _, ok := seen[fp]; ok {
+				continue
+			}
+			seen[fp] = struct{}{}
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Before(res[j])
+	})
+	return res
+}
+
+// mergeStrings returns the sorted union of the string lists.
+func mergeStrings(ls [][]string) []string {
+	seen := make(map[string]struct{})
+	res := []string{}
+	for _, l := range ls {
+		for _, s := range l {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			res = append(res, s)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,127 @@
+package query
+
+import (
+	"net/url"
+
+	"github.com/promcluster/proxy/pkg/promql"
+	"github.com/promcluster/proxy/pkg/remote"
+	"github.com/promcluster/proxy/pkg/sharding"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+var prunedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "pruned_requests_total",
+		Help:      "The number of requests sent only to the shards owning their shard keys.",
+	},
+	[]string{"path"},
+)
+
+// Owners returns the addresses of the shards owning a shard key.
+type Owners func(key string) ([]string, error)
+
+// PruneShards sends the requests whose selectors all pin the labels of
+// key only to the shards owning the selected series, and to the cordoned
+// shards which still hold the series they owned before leaving the ring.
+func (q *Querier) PruneShards(key *sharding.Key, owners Owners, cordoned func() []string) {
+	q.shardKey, q.owners, q.cordoned = key, owners, cordoned
+}
+
+// shards returns the addresses of the shards a request with the
+// selectors is sent to, every shard unless the request is pruned.
+func (q *Querier) shards(path string, selectors [][]*labels.Matcher) []string {
+	addrs := q.targets.Addrs()
+	if q.shardKey == nil || len(selectors) == 0 {
+		return addrs
+	}
+	owned := make(map[string]bool)
+	for _, ms := range selectors {
+		key, ok := q.shardKey.Select(ms)
+		if !ok {
+			return addrs
+		}
+		owners, err := q.owners(key)
+		if err != nil {
+			q.logger.Warn("shard owners", zap.String("key", key), zap.Error(err))
+			return addrs
+		}
+		for _, o := range owners {
+			owned[o] = true
+		}
+	}
+	if q.cordoned != nil {
+		for _, addr := range q.cordoned() {
+			owned[addr] = true
+		}
+	}
+	var res []string
+	for _, addr := range addrs {
+		if owned[addr] {
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 {
+		return addrs
+	}
+	if len(res) < len(addrs) {
+		prunedRequests.WithLabelValues(path).Inc()
+	}
+	return res
+}
+
+// paramSelectors returns the selectors of the query or match[]
+// parameters, nil if any is invalid.
+func paramSelectors(params url.Values) [][]*labels.Matcher {
+	var res [][]*labels.Matcher
+	if qs := params.Get("query"); qs != "" {
+		e, err := promql.ParseExpr(qs)
+		if err != nil {
+			return nil
+		}
+		promql.Inspect(e, func(e promql.Expr) bool {
+			switch n := e.(type) {
+			case *promql.VectorSelector:
+				res = append(res, n.Matchers)
+			case *promql.MatrixSelector:
+				res = append(res, n.Matchers)
+			}
+			return true
+		})
+		return res
+	}
+	for _, m := range params["match[]"] {
+		ms, err := promql.ParseMetricSelector(m)
+		if err != nil {
+			return nil
+		}
+		res = append(res, ms)
+	}
+	return res
+}
+
+// readSelectors returns the selectors of the queries of a remote read,
+// nil if any is invalid.
+func readSelectors(req *remote.ReadRequest) [][]*labels.Matcher {
+	res := make([][]*labels.Matcher, 0, len(req.Queries))
+	for _, rq := range req.Queries {
+		ms := make([]*labels.Matcher, 0, len(rq.Matchers))
+		for _, m := range rq.Matchers {
+			if m.Type != prompb.LabelMatcher_EQ {
+				continue
+			}
+			lm, err := labels.NewMatcher(labels.MatchEqual, m.Name, m.Value)
+			if err != nil {
+				return nil
+			}
+			ms = append(ms, lm)
+		}
+		res = append(res, ms)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/promcluster/proxy/pkg/sharding"
+)
+
+func TestQuerierPruneShards(t *testing.T) {
+	var hits [2]int32
+	var addrs []string
+	for i := range hits {
+		i := i
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+		}))
+		t.Cleanup(s.Close)
+		addrs = append(addrs, s.URL)
+	}
+
+	var cordoned []string
+	q := newTestQuerier(addrs...)
+	q.PruneShards(sharding.NewKey(sharding.Config{Labels: []string{"__name__", "namespace"}}),
+		func(key string) ([]string, error) {
+			if key == `{__name__="up", namespace="a"}` {
+				return []string{addrs[0]}, nil
+			}
+			return []string{addrs[1]}, nil
+		},
+		func() []string { return cordoned })
+
+	cases := []struct {
+		query    string
+		cordoned []string
+		hits     [2]int32
+	}{
+		{`sum(up{namespace="a"})`, nil, [2]int32{1, 0}},
+		{`up{namespace="a"} / up{namespace="b"}`, nil, [2]int32{1, 1}},
+		{`rate(up{namespace="b"}[5m])`, nil, [2]int32{0, 1}},
+		{`sum(up)`, nil, [2]int32{1, 1}},
+		// a cordoned shard still holds the series it owned.
+		{`sum(up{namespace="b"})`, []string{addrs[0]}, [2]int32{1, 1}},
+	}
+	for _, c := range cases {
+		hits, cordoned = [2]int32{}, c.cordoned
+		if _, _, err := q.Query(context.Background(), url.Values{"query": []string{c.query}}); err != nil {
+			t.Fatal(err)
+		}
+		if hits != c.hits {
+			t.Errorf("%s: got shard requests %v, want %v", c.query, hits, c.hits)
+		}
+	}
+}
@@ -0,0 +1,1016 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/promql"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Series are hash-sharded by their full label set, so every series lives on
+// exactly one shard. An aggregation over series-local expressions can be
+// evaluated on every shard and the partial results combined at the proxy.
+// Replicated series live on several shards, the aggregations over them are
+// evaluated at the proxy over the merged replicas instead.
+//
+// A plan is a tree of such aggregations, series-local expressions fetched
+// from every shard, and the operations evaluated over them at the proxy:
+// number literals, binary and set operations, aggregations, functions and
+// subqueries. Only queries which are invalid are rejected, the others are
+// never merged from partial shard results.
+//
+// With deduplication, the aggregations are pushed down grouped by the
+// replica labels as well, and the replicas of the combined results are
+// merged before the plan is evaluated.
+
+// defaultSubqueryStep is the step of subqueries without one, the default
+// evaluation interval of Prometheus.
+const defaultSubqueryStep = int64(time.Minute / time.Millisecond)
+
+// evalRange holds the timestamps a plan node is evaluated at, every step
+// from start to end in milliseconds. The step of instant queries is 0.
+type evalRange struct {
+	start, end, step int64
+}
+
+// queryRange returns the evaluation range of a query or query_range request.
+func queryRange(path string, params url.Values) (evalRange, error) {
+	if path == "/api/v1/query_range" {
+		start, end, step, err := rangeParams(params)
+		return evalRange{start: start, end: end, step: step}, err
+	}
+	t, err := ParseTime(params.Get("time"))
+	if err != nil {
+		return evalRange{}, Errorf(ErrBadData, "invalid parameter \"time\": %v", err)
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+	return evalRange{start: ms, end: ms}, nil
+}
+
+func (r evalRange) timestamps() []model.Time {
+	if r.step <= 0 {
+		return []model.Time{model.Time(r.start)}
+	}
+	var ts []model.Time
+	for t := r.start; t <= r.end; t += r.step {
+		ts = append(ts, model.Time(t))
+	}
+	return ts
+}
+
+// empty reports whether r holds no timestamp, a subquery range may not.
+func (r evalRange) empty() bool {
+	return r.start > r.end
+}
+
+// request returns the path and the parameters evaluating query over r,
+// the other parameters are kept.
+func (r evalRange) request(params url.Values, query string) (string, url.Values) {
+	p := make(url.Values, len(params)+3)
+	for k, v := range params {
+		switch k {
+		case "time", "start", "end", "step":
+		default:
+			p[k] = v
+		}
+	}
+	p.Set("query", query)
+	if r.step <= 0 {
+		p.Set("time", formatMillis(r.start))
+		return "/api/v1/query", p
+	}
+	p.Set("start", formatMillis(r.start))
+	p.Set("end", formatMillis(r.end))
+	p.Set("step", formatMillis(r.step))
+	return "/api/v1/query_range", p
+}
+
+// planNode is a node of a push-down plan.
+type planNode interface{}
+
+// aggNode is an aggregation evaluated on every shard.
+type aggNode struct {
+	op       string
+	grouping []string
+	without  bool
+	k        int
+	// replicaLabels are merged out of the combined results.
+	replicaLabels []string
+	// queries are sent to every shard, avg needs sum and count.
+	shardQueries
+}
+
+// shardQueries holds the queries a plan node sends to every shard,
+// evaluated over r.
+type shardQueries struct {
+	queries []string
+	r       evalRange
+	// parts holds the results of every query on every shard.
+	parts [][]model.Matrix
+}
+
+// fetchNode is a series-local expression evaluated on every shard, the
+// series found on several shards are merged.
+type fetchNode struct {
+	shardQueries
+	replicaLabels []string
+}
+
+// proxyAggNode is an aggregation evaluated at the proxy.
+type proxyAggNode struct {
+	op       string
+	grouping []string
+	without  bool
+	// param is the scalar k of topk and bottomk or the quantile, label
+	// the label of count_values.
+	param planNode
+	label string
+	expr  planNode
+}
+
+// quantileNode is a histogram_quantile call evaluated at the proxy.
+type quantileNode struct {
+	phi, expr planNode
+}
+
+type scalarNode struct {
+	v float64
+}
+
+// timeNode is the time() function, the evaluation timestamp in seconds.
+type timeNode struct{}
+
+type binaryNode struct {
+	op         string
+	lhs, rhs   planNode
+	returnBool bool
+	matching   *promql.VectorMatching
+}
+
+// callNode is a function over instant vectors and scalars evaluated at
+// the proxy, strs holds its string arguments.
+type callNode struct {
+	fn   string
+	args []planNode
+	strs []string
+	// labels are the labels of the series of absent.
+	labels model.Metric
+	// regex is the regular expression of label_replace.
+	regex *regexp.Regexp
+}
+
+// windowNode is a range vector: the samples of the series of expr within
+// rng before every evaluation timestamp, shifted by offset. expr is
+// evaluated over inner, the timestamps of every window.
+type windowNode struct {
+	expr        planNode
+	inner       evalRange
+	rng, offset int64
+}
+
+// rangeNode is a function over a range vector evaluated at the proxy.
+type rangeNode struct {
+	fn     string
+	window *windowNode
+	// args are the scalar arguments, in order.
+	args []planNode
+}
+
+// shardUnsafeFunctions are the functions whose result depends on more than
+// one series, or which create series out of nothing, and the sort functions
+// whose order is lost in the merged shard results.
+var shardUnsafeFunctions = map[string]bool{
+	"absent":             true,
+	"absent_over_time":   true,
+	"histogram_quantile": true,
+	"scalar":             true,
+	"sort":               true,
+	"sort_desc":          true,
+	"vector":             true,
+}
+
+// shardSafe reports whether e can be evaluated on every shard independently,
+// and the union of the results equals the result over all series.
+func shardSafe(e promql.Expr) bool {
+	safe := true
+	promql.Inspect(e, func(n promql.Expr) bool {
+		switch n := n.(type) {
+		case *promql.AggregateExpr:
+			safe = false
+		case *promql.BinaryExpr:
+			if n.LHS.Type() != promql.ValueTypeScalar && n.RHS.Type() != promql.ValueTypeScalar {
+				safe = false
+			}
+		case *promql.Call:
+			if shardUnsafeFunctions[n.Func] {
+				safe = false
+			}
+		}
+		return safe
+	})
+	return safe
+}
+
+// Validate returns the error of an expression the proxy cannot evaluate,
+// e.g. calls of unknown functions or with invalid arguments.
+func Validate(e promql.Expr) error {
+	if shardSafe(e) {
+		return nil
+	}
+	_, err := planQuery(e, nil, false, evalRange{})
+	return err
+}
+
+// planner builds the plan of a query.
+type planner struct {
+	replicaLabels []string
+	// replicated disables the push-down of aggregations, the shards hold
+	// several replicas of every series.
+	replicated bool
+	// r is the evaluation range of the planned expression.
+	r evalRange
+}
+
+// planQuery builds the plan of e evaluated over r and deduplicated on the
+// replica labels, it fails if e is invalid. Aggregations over replicated
+// series are evaluated at the proxy over the merged replicas.
+func planQuery(e promql.Expr, replicaLabels []string, replicated bool, r evalRange) (planNode, error) {
+	p := &planner{replicaLabels: replicaLabels, replicated: replicated, r: r}
+	if e.Type() != promql.ValueTypeMatrix {
+		return p.plan(e)
+	}
+	if r.step > 0 {
+		return nil, Errorf(ErrBadData, "invalid expression type \"range vector\" for range query, must be Scalar or instant Vector")
+	}
+	return p.planWindow(e)
+}
+
+// with returns a planner of the expressions evaluated over r.
+func (p *planner) with(r evalRange) *planner {
+	res := *p
+	res.r = r
+	return &res
+}
+
+func (p *planner) fetch(query string) *fetchNode {
+	return &fetchNode{shardQueries: shardQueries{queries: []string{query}, r: p.r}, replicaLabels: p.replicaLabels}
+}
+
+func (p *planner) plan(e promql.Expr) (planNode, error) {
+	if e.Type() == promql.ValueTypeVector && shardSafe(e) {
+		return p.fetch(e.String()), nil
+	}
+	switch e := e.(type) {
+	case *promql.ParenExpr:
+		return p.plan(e.Expr)
+	case *promql.NumberLiteral:
+		return &scalarNode{v: e.Val}, nil
+	case *promql.UnaryExpr:
+		n, err := p.plan(e.Expr)
+		if err != nil || e.Op == "+" {
+			return n, err
+		}
+		return &binaryNode{op: "*", lhs: n, rhs: &scalarNode{v: -1}}, nil
+	case *promql.BinaryExpr:
+		return p.planBinary(e)
+	case *promql.AggregateExpr:
+		if !p.replicated {
+			if n, ok := p.planAggregate(e); ok {
+				return n, nil
+			}
+		}
+		return p.planProxyAggregate(e)
+	case *promql.Call:
+		return p.planCall(e)
+	}
+	return nil, Errorf(ErrBadData, "unexpected %s %s", typeName(e.Type()), e)
+}
+
+func (p *planner) planBinary(e *promql.BinaryExpr) (planNode, error) {
+	scalar := e.LHS.Type() == promql.ValueTypeScalar || e.RHS.Type() == promql.ValueTypeScalar
+	m := e.VectorMatching
+	switch {
+	case promql.IsSetOperator(e.Op) && scalar:
+		return nil, Errorf(ErrBadData, "set operator %q not allowed in binary scalar expression", e.Op)
+	case m != nil && scalar:
+		return nil, Errorf(ErrBadData, "vector matching only allowed between instant vectors")
+	case m != nil && promql.IsSetOperator(e.Op) && m.Card != "one-to-one":
+		return nil, Errorf(ErrBadData, "no grouping allowed for %q operation", e.Op)
+	}
+	lhs, err := p.plan(e.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := p.plan(e.RHS)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{
+		op:         e.Op,
+		lhs:        lhs,
+		rhs:        rhs,
+		returnBool: e.ReturnBool,
+		matching:   m,
+	}, nil
+}
+
+// planProxyAggregate plans an aggregation evaluated at the proxy over
+// the series of its expression.
+func (p *planner) planProxyAggregate(e *promql.AggregateExpr) (planNode, error) {
+	n := &proxyAggNode{op: e.Op, grouping: e.Grouping, without: e.Without}
+	switch e.Op {
+	case "sum", "min", "max", "count", "avg", "group", "stddev", "stdvar":
+	case "topk", "bottomk", "quantile":
+		if e.Param.Type() != promql.ValueTypeScalar {
+			return nil, Errorf(ErrBadData, "expected type scalar in aggregation parameter, got %s", typeName(e.Param.Type()))
+		}
+		param, err := p.plan(e.Param)
+		if err != nil {
+			return nil, err
+		}
+		n.param = param
+	case "count_values":
+		l, ok := stringValue(e.Param)
+		if !ok {
+			return nil, Errorf(ErrBadData, "expected type string in aggregation parameter, got %s", typeName(e.Param.Type()))
+		}
+		if !model.LabelName(l).IsValid() {
+			return nil, Errorf(ErrBadData, "invalid label name %q", l)
+		}
+		n.label = l
+	default:
+		return nil, Errorf(ErrBadData, "unknown aggregation %q", e.Op)
+	}
+	if e.Expr.Type() != promql.ValueTypeVector {
+		return nil, Errorf(ErrBadData, "expected type instant vector in aggregation expression, got %s", typeName(e.Expr.Type()))
+	}
+	expr, err := p.plan(e.Expr)
+	if err != nil {
+		return nil, err
+	}
+	n.expr = expr
+	return n, nil
+}
+
+func (p *planner) planAggregate(e *promql.AggregateExpr) (planNode, bool) {
+	if !shardSafe(e.Expr) {
+		return nil, false
+	}
+	if len(p.replicaLabels) > 0 {
+		e = groupByReplica(e, p.replicaLabels)
+	}
+	n := &aggNode{op: e.Op, grouping: e.Grouping, without: e.Without, replicaLabels: p.replicaLabels}
+	n.r = p.r
+	switch e.Op {
+	case "sum", "min", "max", "count":
+		n.queries = []string{e.String()}
+	case "avg":
+		sum, count := *e, *e
+		sum.Op, count.Op = "sum", "count"
+		n.queries = []string{sum.String(), count.String()}
+	case "topk", "bottomk":
+		k, ok := e.Param.(*promql.NumberLiteral)
+		if !ok || k.Val < 1 || k.Val > math.MaxInt32 {
+			return nil, false
+		}
+		n.k = int(k.Val)
+		n.queries = []string{e.String()}
+	default:
+		return nil, false
+	}
+	return n, true
+}
+
+// planCall plans a function call which is not series-local.
+func (p *planner) planCall(e *promql.Call) (planNode, error) {
+	if err := checkCall(e); err != nil {
+		return nil, err
+	}
+	switch e.Func {
+	case "time":
+		return &timeNode{}, nil
+	case "pi":
+		return &scalarNode{v: math.Pi}, nil
+	case "histogram_quantile":
+		phi, err := p.plan(e.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		n, err := p.plan(e.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &quantileNode{phi: phi, expr: n}, nil
+	case "absent", "absent_over_time":
+		// absent is evaluated over the count of the series, which is
+		// pushed down, rather than over the series.
+		arg := e.Args[0]
+		if e.Func == "absent_over_time" {
+			arg = &promql.Call{Func: "count_over_time", Args: e.Args}
+		}
+		n, err := p.plan(&promql.AggregateExpr{Op: "count", Expr: arg})
+		if err != nil {
+			return nil, err
+		}
+		return &callNode{fn: "absent", args: []planNode{n}, labels: absentLabels(e.Args[0])}, nil
+	}
+	if _, ok := rangeFunctions[e.Func]; ok {
+		return p.planRangeCall(e)
+	}
+
+	n := &callNode{fn: e.Func}
+	for _, a := range e.Args {
+		if s, ok := stringValue(a); ok {
+			n.strs = append(n.strs, s)
+			continue
+		}
+		arg, err := p.plan(a)
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+	}
+	switch e.Func {
+	case "label_replace":
+		if !model.LabelName(n.strs[0]).IsValid() {
+			return nil, Errorf(ErrBadData, "invalid destination label name in label_replace(): %s", n.strs[0])
+		}
+		re, err := regexp.Compile("^(?:" + n.strs[3] + ")$")
+		if err != nil {
+			return nil, Errorf(ErrBadData, "invalid regular expression in label_replace(): %s", n.strs[3])
+		}
+		n.regex = re
+	case "label_join":
+		for i, l := range n.strs {
+			if i != 1 && !model.LabelName(l).IsValid() {
+				return nil, Errorf(ErrBadData, "invalid label name in label_join(): %s", l)
+			}
+		}
+	}
+	return n, nil
+}
+
+// planRangeCall plans a function over a range vector.
+func (p *planner) planRangeCall(e *promql.Call) (planNode, error) {
+	n := &rangeNode{fn: e.Func}
+	for _, a := range e.Args {
+		if a.Type() == promql.ValueTypeMatrix {
+			w, err := p.planWindow(a)
+			if err != nil {
+				return nil, err
+			}
+			n.window = w
+			continue
+		}
+		arg, err := p.plan(a)
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+	}
+	return n, nil
+}
+
+// planWindow plans a range vector. The samples of a range selector are
+// fetched from every shard at once, with an instant query of a range
+// covering every window. A subquery is evaluated at the timestamps
+// aligned to its step within any window.
+func (p *planner) planWindow(e promql.Expr) (*windowNode, error) {
+	switch e := unparen(e).(type) {
+	case *promql.MatrixSelector:
+		w := &windowNode{
+			rng:    int64(e.Range / time.Millisecond),
+			offset: int64(e.Offset / time.Millisecond),
+			inner:  evalRange{start: p.r.end, end: p.r.end},
+		}
+		sel := *e
+		sel.Range += time.Duration(p.r.end-p.r.start) * time.Millisecond
+		w.expr = p.with(w.inner).fetch(sel.String())
+		return w, nil
+	case *promql.SubqueryExpr:
+		if e.Expr.Type() != promql.ValueTypeVector {
+			return nil, Errorf(ErrBadData, "subquery is only allowed on instant vector, got %s", typeName(e.Expr.Type()))
+		}
+		w := &windowNode{rng: int64(e.Range / time.Millisecond), offset: int64(e.Offset / time.Millisecond)}
+		step := int64(e.Step / time.Millisecond)
+		if step <= 0 {
+			step = defaultSubqueryStep
+		}
+		start := p.r.start - w.offset - w.rng
+		w.inner = evalRange{start: step * (start / step), end: p.r.end - w.offset, step: step}
+		if w.inner.start < start {
+			w.inner.start += step
+		}
+		expr, err := p.with(w.inner).plan(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		w.expr = expr
+		return w, nil
+	}
+	return nil, Errorf(ErrBadData, "expected type range vector, got %s", typeName(e.Type()))
+}
+
+// absentLabels returns the labels of the series of absent, the labels
+// of the equality matchers of a selector found only once.
+func absentLabels(e promql.Expr) model.Metric {
+	var ms []*labels.Matcher
+	switch e := unparen(e).(type) {
+	case *promql.VectorSelector:
+		ms = e.Matchers
+	case *promql.MatrixSelector:
+		ms = e.Matchers
+	}
+	res := model.Metric{}
+	seen := make(map[string]bool, len(ms))
+	for _, m := range ms {
+		if m.Name == labels.MetricName || m.Type != labels.MatchEqual {
+			continue
+		}
+		if seen[m.Name] {
+			delete(res, model.LabelName(m.Name))
+			continue
+		}
+		seen[m.Name] = true
+		res[model.LabelName(m.Name)] = model.LabelValue(m.Value)
+	}
+	return res
+}
+
+func unparen(e promql.Expr) promql.Expr {
+	for {
+		p, ok := e.(*promql.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.Expr
+	}
+}
+
+// stringValue returns the value of a string literal.
+func stringValue(e promql.Expr) (string, bool) {
+	s, ok := unparen(e).(*promql.StringLiteral)
+	if !ok {
+		return "", false
+	}
+	return s.Val, true
+}
+
+// typeName names a value type the way Prometheus errors do.
+func typeName(t promql.ValueType) string {
+	switch t {
+	case promql.ValueTypeVector:
+		return "instant vector"
+	case promql.ValueTypeMatrix:
+		return "range vector"
+	}
+	return string(t)
+}
+
+// groupByReplica returns a copy of e keeping the replica labels.
+func groupByReplica(e *promql.AggregateExpr, replicaLabels []string) *promql.AggregateExpr {
+	res := *e
+	res.Grouping = nil
+	if e.Without {
+		for _, l := range e.Grouping {
+			if !containsString(replicaLabels, l) {
+				res.Grouping = append(res.Grouping, l)
+			}
+		}
+		return &res
+	}
+	res.Grouping = append(res.Grouping, e.Grouping...)
+	for _, l := range replicaLabels {
+		if !containsString(res.Grouping, l) {
+			res.Grouping = append(res.Grouping, l)
+		}
+	}
+	return &res
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func aggNodes(n planNode) []*aggNode {
+	var res []*aggNode
+	walkPlan(n, func(n planNode) {
+		if a, ok := n.(*aggNode); ok {
+			res = append(res, a)
+		}
+	})
+	return res
+}
+
+// remotes returns the queries of the plan sent to every shard.
+func remotes(n planNode) []*shardQueries {
+	var res []*shardQueries
+	walkPlan(n, func(n planNode) {
+		switch n := n.(type) {
+		case *aggNode:
+			res = append(res, &n.shardQueries)
+		case *fetchNode:
+			res = append(res, &n.shardQueries)
+		}
+	})
+	return res
+}
+
+// walkPlan calls f for every node of the plan, depth first.
+func walkPlan(n planNode, f func(planNode)) {
+	if n == nil {
+		return
+	}
+	f(n)
+	switch n := n.(type) {
+	case *binaryNode:
+		walkPlan(n.lhs, f)
+		walkPlan(n.rhs, f)
+	case *proxyAggNode:
+		walkPlan(n.param, f)
+		walkPlan(n.expr, f)
+	case *quantileNode:
+		walkPlan(n.phi, f)
+		walkPlan(n.expr, f)
+	case *callNode:
+		for _, a := range n.args {
+			walkPlan(a, f)
+		}
+	case *windowNode:
+		walkPlan(n.expr, f)
+	case *rangeNode:
+		walkPlan(n.window, f)
+		for _, a := range n.args {
+			walkPlan(a, f)
+		}
+	}
+}
+
+// pushdown sends the queries of the plan to every shard and evaluates
+// the plan over r on their results.
+func (q *Querier) pushdown(ctx context.Context, params url.Values, root planNode, r evalRange) (*QueryData, []string, error) {
+	type job struct {
+		r *shardQueries
+		i int
+	}
+	var jobs []job
+	for _, r := range remotes(root) {
+		r.parts = make([][]model.Matrix, len(r.queries))
+		if r.r.empty() {
+			continue
+		}
+		for i := range r.queries {
+			jobs = append(jobs, job{r: r, i: i})
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		ws   [][]string
+	)
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			path, p := j.r.r.request(params, j.r.queries[j.i])
+			results, err := q.fanout(ctx, path, p)
+			var ms []model.Matrix
+			if err == nil {
+				ms, err = resultMatrices(results)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			j.r.parts[j.i] = ms
+			ws = append(ws, warnings(results))
+		}(j)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, nil, errs[0]
+	}
+
+	res, err := evalPlan(root, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var warns []string
+	if w := mergeStrings(ws); len(w) > 0 {
+		warns = w
+	}
+	return queryData(root, res, r), warns, nil
+}
+
+// queryData returns the result of the plan evaluated over r, the result
+// of an instant query ordered by sort or sort_desc keeps their order.
+func queryData(root planNode, v *planValue, r evalRange) *QueryData {
+	m := v.m
+	if v.scalar {
+		if r.step <= 0 {
+			t := model.Time(r.start)
+			return &QueryData{ResultType: model.ValScalar, Result: &model.Scalar{Value: model.SampleValue(v.s(t)), Timestamp: t}}
+		}
+		stream := &model.SampleStream{Metric: model.Metric{}}
+		for _, t := range r.timestamps() {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(v.s(t))})
+		}
+		m = model.Matrix{stream}
+	}
+	if _, window := root.(*windowNode); window || r.step > 0 {
+		return &QueryData{ResultType: model.ValMatrix, Result: m}
+	}
+	vec := matrixToVector(m)
+	if c, ok := root.(*callNode); ok && (c.fn == "sort" || c.fn == "sort_desc") {
+		sortByValue(vec, c.fn == "sort_desc")
+	}
+	return &QueryData{ResultType: model.ValVector, Result: vec}
+}
+
+// sortByValue sorts v by value, NaN last.
+func sortByValue(v model.Vector, desc bool) {
+	sort.SliceStable(v, func(i, j int) bool {
+		a, b := float64(v[i].Value), float64(v[j].Value)
+		if math.IsNaN(b) {
+			return !math.IsNaN(a)
+		}
+		if desc {
+			return a > b
+		}
+		return a < b
+	})
+}
+
+// resultMatrices decodes the shard results as matrices,
+// instant vectors become single point matrices.
+func resultMatrices(results []shardResult) ([]model.Matrix, error) {
+	ms := make([]model.Matrix, 0, len(results))
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var d QueryData
+		if err := json.Unmarshal(r.resp.Data, &d); err != nil {
+			return nil, Errorf(ErrInternal, "%s: decode query result: %v", r.addr, err)
+		}
+		switch v := d.Result.(type) {
+		case model.Matrix:
+			ms = append(ms, v)
+		case model.Vector:
+			ms = append(ms, vectorToMatrix(v))
+		default:
+			return nil, Errorf(ErrInternal, "%s: unexpected result type %q", r.addr, d.ResultType)
+		}
+	}
+	return ms, nil
+}
+
+func vectorToMatrix(v model.Vector) model.Matrix {
+	m := make(model.Matrix, 0, len(v))
+	for _, s := range v {
+		m = append(m, &model.SampleStream{
+			Metric: s.Metric,
+			Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}},
+		})
+	}
+	return m
+}
+
+func matrixToVector(m model.Matrix) model.Vector {
+	v := make(model.Vector, 0, len(m))
+	for _, ss := range m {
+		if len(ss.Values) == 0 {
+			continue
+		}
+		v = append(v, &model.Sample{Metric: ss.Metric, Value: ss.Values[0].Value, Timestamp: ss.Values[0].Timestamp})
+	}
+	return v
+}
+
+// series is a series under evaluation at the proxy.
+type series struct {
+	metric model.Metric
+	points map[model.Time]float64
+}
+
+type seriesSet map[model.Fingerprint]*series
+
+func (s seriesSet) add(m model.Metric, t model.Time, v float64, f func(cur, v float64) float64) {
+	fp := m.Fingerprint()
+	ss, ok := s[fp]
+	if !ok {
+		ss = &series{metric: m, points: make(map[model.Time]float64)}
+		s[fp] = ss
+	}
+	if cur, ok := ss.points[t]; ok {
+		v = f(cur, v)
+	}
+	ss.points[t] = v
+}
+
+// insert adds a sample to the result of an operation, which must not hold
+// two samples of a series at a timestamp.
+func (s seriesSet) insert(m model.Metric, t model.Time, v float64) error {
+	if ss, ok := s[m.Fingerprint()]; ok {
+		if _, dup := ss.points[t]; dup {
+			return Errorf(ErrExecution, "vector cannot contain metrics with the same labelset")
+		}
+	}
+	s.add(m, t, v, nil)
+	return nil
+}
+
+func (s seriesSet) matrix() model.Matrix {
+	m := make(model.Matrix, 0, len(s))
+	for _, ss := range s {
+		if len(ss.points) == 0 {
+			continue
+		}
+		stream := &model.SampleStream{Metric: ss.metric, Values: make([]model.SamplePair, 0, len(ss.points))}
+		for t, v := range ss.points {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(v)})
+		}
+		sort.Slice(stream.Values, func(i, j int) bool {
+			return stream.Values[i].Timestamp < stream.Values[j].Timestamp
+		})
+		m = append(m, stream)
+	}
+	sort.Slice(m, func(i, j int) bool {
+		return m[i].Metric.Before(m[j].Metric)
+	})
+	return m
+}
+
+// fold combines the points of equal series and timestamps with f.
+func fold(ms []model.Matrix, f func(cur, v float64) float64) seriesSet {
+	s := make(seriesSet)
+	for _, m := range ms {
+		for _, ss := range m {
+			for _, p := range ss.Values {
+				s.add(ss.Metric, p.Timestamp, float64(p.Value), f)
+			}
+		}
+	}
+	return s
+}
+
+func add(cur, v float64) float64 { return cur + v }
+
+// combine merges the partial results of the shards.
+func (a *aggNode) combine() model.Matrix {
+	switch a.op {
+	case "sum", "count":
+		return fold(a.parts[0], add).matrix()
+	case "min":
+		return fold(a.parts[0], func(cur, v float64) float64 {
+			if v < cur || math.IsNaN(cur) {
+				return v
+			}
+			return cur
+		}).matrix()
+	case "max":
+		return fold(a.parts[0], func(cur, v float64) float64 {
+			if v > cur || math.IsNaN(cur) {
+				return v
+			}
+			return cur
+		}).matrix()
+	case "avg":
+		sums, counts := fold(a.parts[0], add), fold(a.parts[1], add)
+		for fp, s := range sums {
+			c, ok := counts[fp]
+			if !ok {
+				delete(sums, fp)
+				continue
+			}
+			for t, v := range s.points {
+				n, found := c.points[t]
+				if !found {
+					delete(s.points, t)
+					continue
+				}
+				s.points[t] = v / n
+			}
+		}
+		return sums.matrix()
+	case "topk", "bottomk":
+		return selectK(a.op, func(model.Time) int { return a.k }, groupSamples(a.parts[0], a.grouping, a.without))
+	}
+	return nil
+}
+
+// sample is a sample of a series under evaluation at the proxy.
+type sample struct {
+	metric model.Metric
+	v      float64
+}
+
+// samplesAt returns the samples of m by timestamp.
+func samplesAt(m model.Matrix) map[model.Time][]sample {
+	res := make(map[model.Time][]sample)
+	for _, ss := range m {
+		for _, p := range ss.Values {
+			res[p.Timestamp] = append(res[p.Timestamp], sample{metric: ss.Metric, v: float64(p.Value)})
+		}
+	}
+	return res
+}
+
+// groupKey identifies the samples of an aggregation group at a timestamp.
+type groupKey struct {
+	fp model.Fingerprint
+	t  model.Time
+}
+
+// group holds the samples of an aggregation group at a timestamp.
+type group struct {
+	metric  model.Metric
+	samples []sample
+}
+
+// groupSamples groups the samples of ms by the labels an aggregation
+// groups by and by timestamp.
+func groupSamples(ms []model.Matrix, grouping []string, without bool) map[groupKey]*group {
+	groups := make(map[groupKey]*group)
+	for _, m := range ms {
+		for _, ss := range m {
+			metric := groupingMetric(ss.Metric, grouping, without)
+			fp := metric.Fingerprint()
+			for _, p := range ss.Values {
+				k := groupKey{fp: fp, t: p.Timestamp}
+				g, ok := groups[k]
+				if !ok {
+					g = &group{metric: metric}
+					groups[k] = g
+				}
+				g.samples = append(g.samples, sample{metric: ss.Metric, v: float64(p.Value)})
+			}
+		}
+	}
+	return groups
+}
+
+// selectK selects the k largest or smallest series of every group at
+// every timestamp, k is given by timestamp.
+func selectK(op string, k func(model.Time) int, groups map[groupKey]*group) model.Matrix {
+	res := make(seriesSet)
+	for key, g := range groups {
+		cs := g.samples
+		sort.SliceStable(cs, func(i, j int) bool {
+			// NaN sorts last in both directions.
+			if math.IsNaN(cs[j].v) {
+				return !math.IsNaN(cs[i].v)
+			}
+			if op == "topk" {
+				return cs[i].v > cs[j].v
+			}
+			return cs[i].v < cs[j].v
+		})
+		if n := k(key.t); len(cs) > n {
+			cs = cs[:n]
+		}
+		for _, c := range cs {
+			res.add(c.metric, key.t, c.v, func(cur, v float64) float64 { return v })
+		}
+	}
+	return res.matrix()
+}
+
+// groupingMetric returns the labels of m an aggregation groups by.
+func groupingMetric(m model.Metric, grouping []string, without bool) model.Metric {
+	res := make(model.Metric, len(grouping))
+	if without {
+		for k, v := range m {
+			res[k] = v
+		}
+		delete(res, model.MetricNameLabel)
+		for _, l := range grouping {
+			delete(res, model.LabelName(l))
+		}
+		return res
+	}
+	for _, l := range grouping {
+		if v, ok := m[model.LabelName(l)]; ok {
+			res[model.LabelName(l)] = v
+		}
+	}
+	return res
+}
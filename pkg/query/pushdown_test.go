@@ -0,0 +1,370 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/promql"
+
+	"github.com/prometheus/common/model"
+)
+
+// newQueryShard starts a fake prometheus answering queries with the
+// vector results from answers, keyed by query.
+func newQueryShard(t *testing.T, answers map[string]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, ok := answers[r.FormValue("query")]
+		if !ok {
+			t.Errorf("unexpected query %q", r.FormValue("query"))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, result)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPlanPushdown(t *testing.T) {
+	cases := []struct {
+		query   string
+		queries []string
+	}{
+		{`sum(rate(x[5m]))`, []string{`sum(rate(x[5m]))`}},
+		{`avg by (job) (x)`, []string{`sum by (job) (x)`, `count by (job) (x)`}},
+		{`topk(3, x)`, []string{`topk(3, x)`}},
+		{`sum(x) / sum(y)`, []string{`sum(x)`, `sum(y)`}},
+		{`max(x) * 100`, []string{`max(x)`}},
+		{`x`, []string{`x`}},
+		{`max(sum by (job) (x))`, []string{`sum by (job) (x)`}},
+		{`sum(x / y)`, []string{`x`, `y`}},
+		{`quantile(0.9, x)`, []string{`x`}},
+		{`histogram_quantile(0.9, sum by (le) (rate(x[5m])))`, []string{`sum by (le) (rate(x[5m]))`}},
+		{`histogram_quantile(0.9, rate(x[5m]))`, []string{`rate(x[5m])`}},
+		{`sum(x) and sum(y)`, []string{`sum(x)`, `sum(y)`}},
+		{`absent(x)`, []string{`count(x)`}},
+		{`x + on (i) group_left y`, []string{`x`, `y`}},
+		{`sort_desc(sum by (job) (x))`, []string{`sum by (job) (x)`}},
+		{`max_over_time(sum(x)[1h:5m])`, []string{`sum(x)`}},
+		{`topk(scalar(sum(y)), x)`, []string{`sum(y)`, `x`}},
+	}
+	for _, c := range cases {
+		e, err := promql.ParseExpr(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := planQuery(e, nil, false, evalRange{})
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		var queries []string
+		for _, r := range remotes(n) {
+			queries = append(queries, r.queries...)
+		}
+		if fmt.Sprint(queries) != fmt.Sprint(c.queries) {
+			t.Errorf("%s: got queries %v, want %v", c.query, queries, c.queries)
+		}
+	}
+
+	// aggregations over replicated series fetch the series.
+	e, _ := promql.ParseExpr(`sum(rate(x[5m])) / 2`)
+	n, err := planQuery(e, nil, true, evalRange{})
+	if err != nil || len(aggNodes(n)) != 0 || fmt.Sprint(remotes(n)[0].queries) != "[rate(x[5m])]" {
+		t.Errorf("unexpected replicated plan %v, %v", n, err)
+	}
+
+	// invalid queries are rejected.
+	for _, query := range []string{
+		`unknown(sum(x))`,
+		`sum(x) and 1`,
+		`sum(x) + on (i) 1`,
+		`label_replace(sum(x), "dst", "", "src", "(")`,
+		`round(sum(x), 1, 2)`,
+		`rate(sum(x))`,
+	} {
+		e, err := promql.ParseExpr(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := planQuery(e, nil, false, evalRange{}); err == nil {
+			t.Errorf("%s: expected error", query)
+		} else if e, ok := err.(*Error); !ok || e.Type != ErrBadData {
+			t.Errorf("%s: got error %v, want bad_data", query, err)
+		}
+	}
+}
+
+func TestQuerierPushdown(t *testing.T) {
+	a := newQueryShard(t, map[string]string{
+		`sum by (job) (x)`:   `{"metric":{"job":"a"},"value":[100,"3"]},{"metric":{"job":"b"},"value":[100,"1"]}`,
+		`count by (job) (x)`: `{"metric":{"job":"a"},"value":[100,"2"]},{"metric":{"job":"b"},"value":[100,"1"]}`,
+		`topk(1, x)`:         `{"metric":{"__name__":"x","i":"1"},"value":[100,"5"]}`,
+	})
+	b := newQueryShard(t, map[string]string{
+		`sum by (job) (x)`:   `{"metric":{"job":"a"},"value":[100,"5"]}`,
+		`count by (job) (x)`: `{"metric":{"job":"a"},"value":[100,"2"]}`,
+		`topk(1, x)`:         `{"metric":{"__name__":"x","i":"2"},"value":[100,"7"]}`,
+	})
+	q := newTestQuerier(a.URL, b.URL)
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`sum by (job) (x)`, `{job="a"} => 8 @[100]` + "\n" + `{job="b"} => 1 @[100]`},
+		{`avg by (job) (x)`, `{job="a"} => 2 @[100]` + "\n" + `{job="b"} => 1 @[100]`},
+		{`topk(1, x)`, `x{i="2"} => 7 @[100]`},
+		{`sum by (job) (x) / count by (job) (x) * 10`, `{job="a"} => 20 @[100]` + "\n" + `{job="b"} => 10 @[100]`},
+		{`sum by (job) (x) > 2`, `{job="a"} => 8 @[100]`},
+	}
+	for _, c := range cases {
+		d, _, err := q.Query(context.Background(), url.Values{"query": []string{c.query}})
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got := d.Result.(model.Vector).String(); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.query, got, c.want)
+		}
+	}
+}
+
+func TestQuerierPushdownPinnedTime(t *testing.T) {
+	// the shards evaluate at their own clock unless the time is set.
+	var (
+		mu    sync.Mutex
+		times = make(map[string]bool)
+	)
+	newShard := func(now string, sum, count int) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ts := r.FormValue("time")
+			mu.Lock()
+			times[ts] = true
+			mu.Unlock()
+			if ts == "" {
+				ts = now
+			}
+			v := sum
+			if strings.HasPrefix(r.FormValue("query"), "count") {
+				v = count
+			}
+			fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[%s,"%d"]}]}}`, ts, v)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a, b := newShard("100", 6, 2), newShard("101", 2, 2)
+	q := newTestQuerier(a.URL, b.URL)
+
+	d, _, err := q.Query(context.Background(), url.Values{"query": []string{`avg(x)`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := d.Result.(model.Vector)
+	if len(v) != 1 || v[0].Value != 2 {
+		t.Fatalf("got %v, want the average 2 over both shards", v)
+	}
+	if len(times) != 1 || times[""] {
+		t.Fatalf("got evaluation times %v, want a single pinned time", times)
+	}
+
+	// the range of range queries is left to the frontend to align.
+	p := pinTime("/api/v1/query_range", url.Values{"start": {"95"}, "end": {"205"}, "step": {"10"}}, time.Now())
+	if p.Get("start") != "95" || p.Get("end") != "205" || p.Get("time") != "" {
+		t.Fatalf("got range %s-%s, want 95-205", p.Get("start"), p.Get("end"))
+	}
+}
+
+func TestQuerierProxyEvaluation(t *testing.T) {
+	// x{i="2"} and y{i="2"} live on different shards.
+	a := newQueryShard(t, map[string]string{
+		`x`:                  `{"metric":{"__name__":"x","i":"1"},"value":[100,"1"]},{"metric":{"__name__":"x","i":"2"},"value":[100,"3"]}`,
+		`y`:                  `{"metric":{"__name__":"y","i":"1"},"value":[100,"2"]}`,
+		`sum by (le) (b)`:    `{"metric":{"le":"1"},"value":[100,"2"]},{"metric":{"le":"+Inf"},"value":[100,"4"]}`,
+		`count by (job) (x)`: `{"metric":{"job":"a"},"value":[100,"2"]}`,
+		`sum(x)`:             `{"metric":{},"value":[100,"4"]}`,
+		`sum(y)`:             `{"metric":{},"value":[100,"2"]}`,
+		`sum(z)`:             ``,
+		`sum by (job) (x)`:   `{"metric":{"job":"a"},"value":[100,"3"]},{"metric":{"job":"b"},"value":[100,"1"]}`,
+		`count(x)`:           `{"metric":{},"value":[100,"2"]}`,
+		`count(x{job="a"})`:  ``,
+	})
+	b := newQueryShard(t, map[string]string{
+		`x`:                  `{"metric":{"__name__":"x","i":"3"},"value":[100,"5"]}`,
+		`y`:                  `{"metric":{"__name__":"y","i":"2"},"value":[100,"3"]},{"metric":{"__name__":"y","i":"3"},"value":[100,"5"]}`,
+		`sum by (le) (b)`:    `{"metric":{"le":"1"},"value":[100,"2"]},{"metric":{"le":"+Inf"},"value":[100,"4"]}`,
+		`count by (job) (x)`: `{"metric":{"job":"a"},"value":[100,"1"]},{"metric":{"job":"b"},"value":[100,"2"]}`,
+		`sum(x)`:             `{"metric":{},"value":[100,"5"]}`,
+		`sum(y)`:             `{"metric":{},"value":[100,"8"]}`,
+		`sum(z)`:             ``,
+		`sum by (job) (x)`:   `{"metric":{"job":"a"},"value":[100,"5"]}`,
+		`count(x)`:           `{"metric":{},"value":[100,"1"]}`,
+		`count(x{job="a"})`:  ``,
+	})
+	q := newTestQuerier(a.URL, b.URL)
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`x / y`, `{i="1"} => 0.5 @[100]` + "\n" + `{i="2"} => 1 @[100]` + "\n" + `{i="3"} => 1 @[100]`},
+		{`sum(x / y)`, `{} => 2.5 @[100]`},
+		{`quantile(0.5, x)`, `{} => 3 @[100]`},
+		{`stdvar(x) * 3`, `{} => 8 @[100]`},
+		{`count_values("v", x)`, `{v="1"} => 1 @[100]` + "\n" + `{v="3"} => 1 @[100]` + "\n" + `{v="5"} => 1 @[100]`},
+		{`max(count by (job) (x))`, `{} => 3 @[100]`},
+		{`histogram_quantile(0.25, sum by (le) (b))`, `{} => 0.5 @[100]`},
+		{`sum(x) or vector(0)`, `{} => 9 @[100]`},
+		{`sum(z) or vector(0)`, `{} => 0 @[100]`},
+		{`sum(x) and sum(y)`, `{} => 9 @[100]`},
+		{`sum(x) unless sum(y)`, ``},
+		{`x + on (i) group_left y`, `{i="1"} => 3 @[100]` + "\n" + `{i="2"} => 6 @[100]` + "\n" + `{i="3"} => 10 @[100]`},
+		{`sum by (job) (x) * on () group_left sum(y)`, `{job="a"} => 80 @[100]` + "\n" + `{job="b"} => 10 @[100]`},
+		{`sort(sum by (job) (x))`, `{job="b"} => 1 @[100]` + "\n" + `{job="a"} => 8 @[100]`},
+		{`sort_desc(sum by (job) (x))`, `{job="a"} => 8 @[100]` + "\n" + `{job="b"} => 1 @[100]`},
+		{`round(sum(x) / 4)`, `{} => 2 @[100]`},
+		{`label_replace(sum by (job) (x), "team", "t-$1", "job", "(.*)")`, `{job="a", team="t-a"} => 8 @[100]` + "\n" + `{job="b", team="t-b"} => 1 @[100]`},
+		{`absent(x{job="a"})`, `{job="a"} => 1 @[100]`},
+		{`absent(x)`, ``},
+		{`topk(scalar(count(x)) - 1, x)`, `x{i="2"} => 3 @[100]` + "\n" + `x{i="3"} => 5 @[100]`},
+		{`sum(x) * time()`, `{} => 900 @[100]`},
+	}
+	for _, c := range cases {
+		d, _, err := q.Query(context.Background(), url.Values{"query": []string{c.query}, "time": []string{"100"}})
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got := d.Result.(model.Vector).String(); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.query, got, c.want)
+		}
+	}
+
+	// scalar results stay scalars.
+	d, _, err := q.Query(context.Background(), url.Values{"query": []string{`scalar(sum(x)) * 2`}, "time": []string{"100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := d.Result.(*model.Scalar); !ok || s.Value != 18 {
+		t.Fatalf("got %v, want the scalar 18", d.Result)
+	}
+}
+
+// newRangeShard starts a fake prometheus answering range queries with the
+// series of answers, keyed by query and metric. Every series has a sample
+// at the steps its values, keyed by the time in seconds, are given for.
+func newRangeShard(t *testing.T, answers map[string]map[string]map[int64]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		series, ok := answers[r.FormValue("query")]
+		if !ok {
+			t.Errorf("unexpected query %q", r.FormValue("query"))
+		}
+		start, end, step, err := rangeParams(r.Form)
+		if err != nil {
+			t.Error(err)
+		}
+		var result []string
+		for metric, values := range series {
+			var points []string
+			for ts := start; ts <= end; ts += step {
+				if v, ok := values[ts/1000]; ok {
+					points = append(points, fmt.Sprintf(`[%d,"%s"]`, ts/1000, v))
+				}
+			}
+			if len(points) > 0 {
+				result = append(result, fmt.Sprintf(`{"metric":%s,"values":[%s]}`, metric, strings.Join(points, ",")))
+			}
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(result, ","))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestQuerierProxyEvaluationRange(t *testing.T) {
+	a := newRangeShard(t, map[string]map[string]map[int64]string{
+		`sum(x)`:            {`{}`: {0: "11", 30: "12", 60: "13", 90: "14", 120: "15"}},
+		`sum by (i) (x)`:    {`{"i":"1"}`: {60: "3", 120: "5"}},
+		`y`:                 {`{"__name__":"y","i":"1","j":"a"}`: {60: "1"}},
+		`count(x{job="a"})`: {`{}`: {60: "1"}},
+	})
+	b := newRangeShard(t, map[string]map[string]map[int64]string{
+		`sum(x)`:            {`{}`: {0: "1", 30: "1", 60: "1", 90: "1", 120: "1"}},
+		`sum by (i) (x)`:    {`{"i":"2"}`: {60: "7", 120: "7"}},
+		`y`:                 {`{"__name__":"y","i":"1","j":"b"}`: {120: "2"}},
+		`count(x{job="a"})`: {},
+	})
+	q := newTestQuerier(a.URL, b.URL)
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`max_over_time(sum(x)[1m:30s])`, `{} => [14@60 16@120]`},
+		{`delta(sum(x)[1m:30s])`, `{} => [2@60 2@120]`},
+		// y{i="1"} is a different series at every step.
+		{`sum by (i) (x) / on (i) y`, `{i="1"} => [3@60 2.5@120]`},
+		{`absent(x{job="a"})`, `{job="a"} => [1@120]`},
+		{`sum(x) > bool 14`, `{} => [0@60 1@120]`},
+	}
+	for _, c := range cases {
+		d, _, err := q.QueryRange(context.Background(), url.Values{
+			"query": []string{c.query}, "start": []string{"60"}, "end": []string{"120"}, "step": []string{"60"},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		var got []string
+		for _, ss := range d.Result.(model.Matrix) {
+			var vs []string
+			for _, p := range ss.Values {
+				vs = append(vs, fmt.Sprintf("%v@%d", p.Value, p.Timestamp.Unix()))
+			}
+			got = append(got, fmt.Sprintf("%s => %v", ss.Metric, vs))
+		}
+		if strings.Join(got, "\n") != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.query, strings.Join(got, "\n"), c.want)
+		}
+	}
+
+	// range vectors are only valid results of instant queries.
+	_, _, err := q.QueryRange(context.Background(), url.Values{
+		"query": []string{`sum(x)[1m:30s]`}, "start": []string{"60"}, "end": []string{"120"}, "step": []string{"60"},
+	})
+	if e, ok := err.(*Error); !ok || e.Type != ErrBadData {
+		t.Fatalf("got error %v, want bad_data", err)
+	}
+}
+
+func TestQuerierReplicatedAggregation(t *testing.T) {
+	// every series is held by two of the three shards.
+	a := newQueryShard(t, map[string]string{`x`: `{"metric":{"__name__":"x","i":"1"},"value":[100,"3"]},{"metric":{"__name__":"x","i":"2"},"value":[100,"4"]}`})
+	b := newQueryShard(t, map[string]string{`x`: `{"metric":{"__name__":"x","i":"1"},"value":[100,"3"]}`})
+	c := newQueryShard(t, map[string]string{`x`: `{"metric":{"__name__":"x","i":"2"},"value":[100,"4"]}`})
+	q := newTestQuerier(a.URL, b.URL, c.URL)
+	q.Replicated(2)
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`sum(x)`, `{} => 7 @[100]`},
+		{`count(x)`, `{} => 2 @[100]`},
+		{`avg(x) * 2`, `{} => 7 @[100]`},
+		{`topk(1, x)`, `x{i="2"} => 4 @[100]`},
+		{`x`, `x{i="1"} => 3 @[100]` + "\n" + `x{i="2"} => 4 @[100]`},
+	}
+	for _, c := range cases {
+		d, _, err := q.Query(context.Background(), url.Values{"query": []string{c.query}, "time": []string{"100"}})
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got := d.Result.(model.Vector).String(); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.query, got, c.want)
+		}
+	}
+}
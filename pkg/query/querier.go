@@ -0,0 +1,369 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/promql"
+	"github.com/promcluster/proxy/pkg/sharding"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+var namespace = "proxy"
+var subsystem = "query"
+
+var (
+	shardRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "shard_request_duration_seconds",
+			Help:      "The fanned out HTTP request to prometheus store latencies in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"path", "endpoint"},
+	)
+	shardRequestFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "shard_request_failed",
+			Help:      "The failed number of fanned out requests by error type.",
+		},
+		[]string{"path", "endpoint", "type"},
+	)
+	partialResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "partial_responses_total",
+			Help:      "The number of responses missing the data of failed shards.",
+		},
+		[]string{"path"},
+	)
+)
+
+// default timeout of a fanned out request.
+var defaultQueryTimeout = 2 * time.Minute
+
+// Targets provides the addresses of every shard.
+type Targets interface {
+	Addrs() []string
+}
+
+// Querier answers Prometheus API requests by sending them to every
+// shard in parallel and merging the results.
+type Querier struct {
+	targets Targets
+	client  *http.Client
+	timeout time.Duration
+	// partialResponse is the default of the partial_response parameter.
+	partialResponse bool
+	// replicaLabels are the labels HA replicas are deduplicated on.
+	replicaLabels []string
+	// shardKey, owners and cordoned prune the shards of requests, if set.
+	shardKey *sharding.Key
+	owners   Owners
+	cordoned func() []string
+	// replicated is set if series are written to several shards, their
+	// aggregations cannot be pushed down.
+	replicated bool
+
+	registerer prometheus.Registerer
+	logger     *zap.Logger
+}
+
+// NewQuerier creates a new fan-out querier over the shards from targets.
+// If partialResponse is set, requests without the partial_response
+// parameter are answered with the data of the available shards. The
+// series of HA replicas are deduplicated on replicaLabels, if any.
+func NewQuerier(
+	reg prometheus.Registerer,
+	t Targets,
+	timeout time.Duration,
+	partialResponse bool,
+	replicaLabels []string,
+	logger *zap.Logger) *Querier {
+	reg.MustRegister(shardRequestDuration, shardRequestFailed, partialResponses, prunedRequests)
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+	return &Querier{
+		targets: t,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 30,
+				IdleConnTimeout:     10 * time.Minute,
+			},
+		},
+		timeout:         timeout,
+		partialResponse: partialResponse,
+		replicaLabels:   replicaLabels,
+		registerer:      reg,
+		logger:          logger.With(zap.String("service", "querier")),
+	}
+}
+
+// Replicated tells the querier series are written to rf shards, a shard
+// is not the single owner of its series then.
+func (q *Querier) Replicated(rf int) {
+	q.replicated = rf > 1
+}
+
+// shardResult is the response of a single shard, resp is nil if the
+// shard failed.
+type shardResult struct {
+	addr string
+	resp *Response
+	err  error
+}
+
+// partialResponseParam names the parameter allowing partial responses.
+const partialResponseParam = "partial_response"
+
+// fanout sends the request to every shard in parallel, or to the shards
+// owning its series if shards are pruned. It fails if any shard fails,
+// unless partial responses are allowed and some shard succeeded; the
+// results of failed shards are then kept for warnings.
+func (q *Querier) fanout(ctx context.Context, path string, params url.Values) ([]shardResult, error) {
+	addrs := q.shards(path, paramSelectors(params))
+	if len(addrs) == 0 {
+		return nil, Errorf(ErrUnavailable, "no backend endpoint available")
+	}
+	partial := q.partialResponse
+	if v := params.Get(partialResponseParam); v != "" {
+		var err error
+		if partial, err = strconv.ParseBool(v); err != nil {
+			return nil, Errorf(ErrBadData, "invalid parameter %q: %v", partialResponseParam, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+
+	results := make([]shardResult, len(addrs))
+	err := q.parallel(ctx, path, addrs, func(i int, addr string) error {
+		resp, err := NewClient(addr, q.client).Get(ctx, path, params)
+		results[i] = shardResult{addr: addr, resp: resp, err: err}
+		return err
+	})
+	if err != nil && !(partial && tolerable(results)) {
+		return nil, err
+	}
+	if err != nil {
+		partialResponses.WithLabelValues(path).Inc()
+	}
+	return results, nil
+}
+
+// tolerable reports whether a partial response can be built from the
+// results: some shard succeeded and no shard rejected the query itself.
+func tolerable(results []shardResult) bool {
+	ok := false
+	for _, r := range results {
+		if r.err == nil {
+			ok = true
+			continue
+		}
+		if e, isErr := r.err.(*Error); isErr && (e.Type == ErrBadData || e.Type == ErrExecution) {
+			return false
+		}
+	}
+	return ok
+}
+
+// parallel calls f for every shard in parallel, recording the request
+// metrics of path, the stats of ctx and logging the failures, it returns
+// the first error in addrs order.
+func (q *Querier) parallel(ctx context.Context, path string, addrs []string, f func(i int, addr string) error) error {
+	addShards(ctx, addrs)
+	route := path
+	if strings.HasPrefix(path, "/api/v1/label/") {
+		route = "/api/v1/label/:name/values"
+	}
+
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			start := time.Now()
+			err := f(i, addr)
+			shardRequestDuration.WithLabelValues(route, addr).Observe(time.Since(start).Seconds())
+			if err != nil {
+				typ := ErrInternal
+				if e, ok := err.(*Error); ok {
+					typ = e.Type
+				}
+				shardRequestFailed.WithLabelValues(route, addr, typ).Inc()
+				q.logger.Error("shard request", zap.String("endpoint", addr), zap.String("path", path), zap.Error(err))
+			}
+			errs[i] = err
+		}(i, addr)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query evaluates an instant query on every shard.
+func (q *Querier) Query(ctx context.Context, params url.Values) (*QueryData, []string, error) {
+	return q.query(ctx, "/api/v1/query", params)
+}
+
+// QueryRange evaluates a range query on every shard.
+func (q *Querier) QueryRange(ctx context.Context, params url.Values) (*QueryData, []string, error) {
+	return q.query(ctx, "/api/v1/query_range", params)
+}
+
+// query evaluates a query on every shard. Series-local queries are
+// evaluated on every shard and the resulting series are merged, other
+// queries are planned, see pushdown. Queries which cannot be parsed are
+// rejected.
+func (q *Querier) query(ctx context.Context, path string, params url.Values) (*QueryData, []string, error) {
+	replicaLabels, err := q.dedupLabels(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	params = pinTime(path, params, time.Now())
+	// the queries the proxy cannot analyse are rejected, the merged per
+	// shard results of an aggregation would be wrong.
+	e, err := promql.ParseExpr(params.Get("query"))
+	if err != nil {
+		return nil, nil, Errorf(ErrBadData, "invalid parameter \"query\": %v", err)
+	}
+	if !shardSafe(e) {
+		r, err := queryRange(path, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan, err := planQuery(e, replicaLabels, q.replicated, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q.pushdown(ctx, params, plan, r)
+	}
+
+	results, err := q.fanout(ctx, path, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	ds := make([]*QueryData, 0, len(results))
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var d QueryData
+		if err := json.Unmarshal(r.resp.Data, &d); err != nil {
+			return nil, nil, Errorf(ErrInternal, "%s: decode query result: %v", r.addr, err)
+		}
+		ds = append(ds, &d)
+	}
+	d, err := mergeData(ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dedupData(d, replicaLabels), warnings(results), nil
+}
+
+// pinTime returns a copy of params evaluated at the same time by every
+// shard and every query of a plan: instant queries are evaluated at now
+// unless their time is set. The range of range queries is left as is, it
+// is aligned to the step by the frontend.
+func pinTime(path string, params url.Values, now time.Time) url.Values {
+	if path != "/api/v1/query" || params.Get("time") != "" {
+		return params
+	}
+	p := make(url.Values, len(params)+1)
+	for k, v := range params {
+		p[k] = v
+	}
+	p.Set("time", formatMillis(now.UnixNano()/int64(time.Millisecond)))
+	return p
+}
+
+// warnings returns the deduplicated warnings of every shard, and a
+// warning naming every failed shard of a partial response.
+func warnings(results []shardResult) []string {
+	ws := make([][]string, 0, len(results))
+	for _, r := range results {
+		if r.resp != nil {
+			ws = append(ws, r.resp.Warnings)
+		} else if r.err != nil {
+			ws = append(ws, []string{fmt.Sprintf("partial response: shard %s failed: %v", r.addr, r.err)})
+		}
+	}
+	if res := mergeStrings(ws); len(res) > 0 {
+		return res
+	}
+	return nil
+}
+
+// Series returns the union of the series matching the selectors on every shard.
+func (q *Querier) Series(ctx context.Context, params url.Values) ([]model.LabelSet, []string, error) {
+	replicaLabels, err := q.dedupLabels(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := q.fanout(ctx, "/api/v1/series", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	ls := make([][]model.LabelSet, 0, len(results))
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var l []model.LabelSet
+		if err := json.Unmarshal(r.resp.Data, &l); err != nil {
+			return nil, nil, Errorf(ErrInternal, "%s: decode series: %v", r.addr, err)
+		}
+		ls = append(ls, l)
+	}
+	return dedupLabelSets(mergeLabelSets(ls), replicaLabels), warnings(results), nil
+}
+
+// LabelNames returns the union of the label names on every shard.
+func (q *Querier) LabelNames(ctx context.Context, params url.Values) ([]string, []string, error) {
+	return q.strings(ctx, "/api/v1/labels", params)
+}
+
+// LabelValues returns the union of the values of label name on every shard.
+func (q *Querier) LabelValues(ctx context.Context, name string, params url.Values) ([]string, []string, error) {
+	return q.strings(ctx, "/api/v1/label/"+url.PathEscape(name)+"/values", params)
+}
+
+func (q *Querier) strings(ctx context.Context, path string, params url.Values) ([]string, []string, error) {
+	results, err := q.fanout(ctx, path, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	ls := make([][]string, 0, len(results))
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var l []string
+		if err := json.Unmarshal(r.resp.Data, &l); err != nil {
+			return nil, nil, Errorf(ErrInternal, "%s: decode strings: %v", r.addr, err)
+		}
+		ls = append(ls, l)
+	}
+	return mergeStrings(ls), warnings(results), nil
+}
@@ -0,0 +1,205 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+type staticTargets []string
+
+func (t staticTargets) Addrs() []string { return t }
+
+// newShard starts a fake prometheus answering every API call with body.
+func newShard(t *testing.T, body string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newRoutedShard returns a shard answering the paths of bodies, and 404
+// to any other path.
+func newRoutedShard(t *testing.T, bodies map[string]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestQuerier(addrs ...string) *Querier {
+	return NewQuerier(prometheus.NewRegistry(), staticTargets(addrs), time.Second, false, nil, zap.NewNop())
+}
+
+func TestQuerierVector(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"__name__":"up","instance":"a"},"value":[1600000000,"1"]}]}}`)
+	b := newShard(t, `{"status":"success","warnings":["w"],"data":{"resultType":"vector","result":[
+		{"metric":{"__name__":"up","instance":"b"},"value":[1600000000,"0"]},
+		{"metric":{"__name__":"up","instance":"a"},"value":[1600000000,"1"]}]}}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	d, ws, err := q.Query(context.Background(), url.Values{"query": []string{"up"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := d.Result.(model.Vector)
+	if len(v) != 2 {
+		t.Fatalf("got %d samples, want 2", len(v))
+	}
+	if v[0].Metric["instance"] != "a" || v[1].Metric["instance"] != "b" {
+		t.Fatalf("unexpected result %v", v)
+	}
+	if len(ws) != 1 || ws[0] != "w" {
+		t.Fatalf("unexpected warnings %v", ws)
+	}
+}
+
+func TestQuerierMatrix(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"__name__":"up","instance":"a"},"values":[[1,"1"],[3,"1"]]}]}}`)
+	b := newShard(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"__name__":"up","instance":"a"},"values":[[2,"1"],[3,"1"]]}]}}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	d, _, err := q.QueryRange(context.Background(), url.Values{"query": []string{"up"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := d.Result.(model.Matrix)
+	if len(m) != 1 || len(m[0].Values) != 3 {
+		t.Fatalf("unexpected result %v", m)
+	}
+}
+
+func TestQuerierShardError(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	b := newShard(t, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	_, _, err := q.Query(context.Background(), url.Values{"query": []string{"up{"}})
+	e, ok := err.(*Error)
+	if !ok || e.Type != ErrBadData {
+		t.Fatalf("got error %v, want bad_data", err)
+	}
+}
+
+func TestQuerierUnparsableQuery(t *testing.T) {
+	// the shards would answer aggregations with partial results.
+	a := newShard(t, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[100,"5"]}]}}`)
+	b := newShard(t, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[100,"7"]}]}}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	for _, query := range []string{`sum(x @ 100)`, `sum(x offset -5m)`} {
+		d, _, err := q.Query(context.Background(), url.Values{"query": []string{query}})
+		if e, ok := err.(*Error); !ok || e.Type != ErrBadData {
+			t.Errorf("%s: got %v, %v, want bad_data", query, d, err)
+		}
+	}
+}
+
+func TestQuerierPartialResponse(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"__name__":"up","instance":"a"},"value":[1600000000,"1"]}]}}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(b.Close)
+	c := newShard(t, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	if _, _, err := q.Query(context.Background(), url.Values{"query": []string{"up"}}); err == nil {
+		t.Fatal("expected error without partial responses")
+	}
+	d, ws, err := q.Query(context.Background(), url.Values{"query": []string{"up"}, "partial_response": []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.Result.(model.Vector); len(v) != 1 || v[0].Metric["instance"] != "a" {
+		t.Fatalf("unexpected result %v", v)
+	}
+	if len(ws) != 1 || !strings.Contains(ws[0], b.URL) {
+		t.Fatalf("unexpected warnings %v", ws)
+	}
+
+	// the configured default applies without the parameter.
+	q = NewQuerier(prometheus.NewRegistry(), staticTargets{a.URL, b.URL}, time.Second, true, nil, zap.NewNop())
+	if _, _, err := q.Query(context.Background(), url.Values{"query": []string{"up"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := q.Query(context.Background(), url.Values{"query": []string{"up"}, "partial_response": []string{"0"}}); err == nil {
+		t.Fatal("expected error with partial responses disabled")
+	}
+
+	// invalid queries are not hidden in warnings.
+	q = newTestQuerier(a.URL, c.URL)
+	if _, _, err := q.Query(context.Background(), url.Values{"query": []string{"up"}, "partial_response": []string{"true"}}); err == nil {
+		t.Fatal("expected bad_data error")
+	}
+}
+
+func TestQuerierNoTargets(t *testing.T) {
+	q := newTestQuerier()
+	if _, _, err := q.Query(context.Background(), url.Values{}); err == nil {
+		t.Fatal("expected error without targets")
+	}
+}
+
+func TestQuerierSeriesAndLabels(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":[{"__name__":"up","instance":"b"},{"__name__":"up","instance":"a"}]}`)
+	b := newShard(t, `{"status":"success","data":[{"__name__":"up","instance":"a"}]}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	ls, _, err := q.Series(context.Background(), url.Values{"match[]": []string{"up"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 || ls[0]["instance"] != "a" || ls[1]["instance"] != "b" {
+		t.Fatalf("unexpected series %v", ls)
+	}
+
+	c := newRoutedShard(t, map[string]string{
+		"/api/v1/labels":           `{"status":"success","data":["job","instance"]}`,
+		"/api/v1/label/job/values": `{"status":"success","data":["node","api"]}`,
+	})
+	d := newRoutedShard(t, map[string]string{
+		"/api/v1/labels":           `{"status":"success","data":["__name__","job"]}`,
+		"/api/v1/label/job/values": `{"status":"success","data":["node","db"]}`,
+	})
+	q = newTestQuerier(c.URL, d.URL)
+	names, _, err := q.LabelNames(context.Background(), url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[__name__ instance job]" {
+		t.Fatalf("unexpected label names %v", names)
+	}
+	values, _, err := q.LabelValues(context.Background(), "job", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[api db node]" {
+		t.Fatalf("unexpected label values %v", values)
+	}
+	if _, _, err := q.LabelValues(context.Background(), "instance", url.Values{}); err == nil {
+		t.Fatal("expected error for the values of an unknown label path")
+	}
+}
@@ -0,0 +1,283 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/promcluster/proxy/pkg/remote"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const readPath = "/api/v1/read"
+
+// maxShardFrameBytes limits the frame size of a streamed shard response.
+const maxShardFrameBytes = 50 * 1024 * 1024
+
+// SeriesFunc is called with every merged series of a remote read.
+type SeriesFunc func(queryIndex int, s *remote.ChunkedSeries) error
+
+// RemoteRead sends the remote read request to every shard and calls fn
+// with the series of each query in label order, merging the series
+// found on several shards. Streamed shard responses are merged as they
+// are read, so that the whole result is never buffered, unless the
+// series of HA replicas are deduplicated.
+func (q *Querier) RemoteRead(ctx context.Context, req *remote.ReadRequest, fn SeriesFunc) error {
+	addrs := q.shards(readPath, readSelectors(req))
+	if len(addrs) == 0 {
+		return Errorf(ErrUnavailable, "no backend endpoint available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+
+	// shards are always asked for chunks, samples are converted.
+	data, err := (&remote.ReadRequest{
+		Queries:               req.Queries,
+		AcceptedResponseTypes: []remote.ResponseType{remote.StreamedXORChunks, remote.Samples},
+	}).Marshal()
+	if err != nil {
+		return Errorf(ErrInternal, "encode read request: %v", err)
+	}
+	body := snappy.Encode(nil, data)
+
+	streams := make([]*shardStream, len(addrs))
+	defer func() {
+		for _, s := range streams {
+			if s != nil {
+				s.close()
+			}
+		}
+	}()
+	err = q.parallel(ctx, readPath, addrs, func(i int, addr string) error {
+		var err error
+		streams[i], err = q.openRead(ctx, addr, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range req.Queries {
+		if len(q.replicaLabels) == 0 {
+			if err := mergeStreams(i, streams, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		d := newReadDedup(q.replicaLabels)
+		if err := mergeStreams(i, streams, d.add); err != nil {
+			return err
+		}
+		if err := d.flush(i, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openRead sends the read request to the shard at addr and returns
+// its response once the headers are received.
+func (q *Querier) openRead(ctx context.Context, addr string, body []byte) (*shardStream, error) {
+	c := NewClient(addr, q.client)
+	req, err := http.NewRequest(http.MethodPost, c.Addr()+readPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, Errorf(ErrInternal, "%v", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, err := q.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, requestError(ctx, c.Addr(), err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		typ := ErrUnavailable
+		if resp.StatusCode == http.StatusBadRequest {
+			typ = ErrBadData
+		}
+		return nil, Errorf(typ, "%s: remote read: %s: %s", c.Addr(), resp.Status, bytes.TrimSpace(msg))
+	}
+
+	s := &shardStream{addr: c.Addr(), body: resp.Body}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-streamed-protobuf") {
+		s.reader = remote.NewChunkedReader(resp.Body, maxShardFrameBytes)
+		return s, nil
+	}
+
+	// older prometheus answers with samples only.
+	defer resp.Body.Close()
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, requestError(ctx, c.Addr(), err)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, Errorf(ErrInternal, "%s: decode read response: %v", s.addr, err)
+	}
+	var rr prompb.ReadResponse
+	if err := rr.Unmarshal(data); err != nil {
+		return nil, Errorf(ErrInternal, "%s: decode read response: %v", s.addr, err)
+	}
+	for _, res := range rr.Results {
+		series := make([]*remote.ChunkedSeries, 0, len(res.Timeseries))
+		for _, ts := range res.Timeseries {
+			cs, err := remote.FromTimeSeries(ts)
+			if err != nil {
+				return nil, Errorf(ErrInternal, "%s: encode chunks: %v", s.addr, err)
+			}
+			series = append(series, cs)
+		}
+		sort.Slice(series, func(i, j int) bool {
+			return remote.CompareLabels(series[i].Labels, series[j].Labels) < 0
+		})
+		s.results = append(s.results, series)
+	}
+	return s, nil
+}
+
+// shardStream iterates over the series of a shard's read response
+// in query order.
+type shardStream struct {
+	addr string
+	body io.ReadCloser
+
+	// streamed responses.
+	reader *remote.ChunkedReader
+	frame  remote.ChunkedReadResponse
+	pos    int
+	eof    bool
+
+	// sampled responses, by query.
+	results [][]*remote.ChunkedSeries
+	query   int
+
+	// joined is the peeked series of query joinedQuery, nil if not peeked.
+	joined      *remote.ChunkedSeries
+	joinedQuery int
+}
+
+// peek returns the next series and its query index, or a nil series
+// at the end of the response. Prometheus splits the chunks of large
+// series across consecutive frames, they are joined into one series.
+func (s *shardStream) peek() (int, *remote.ChunkedSeries, error) {
+	if s.joined != nil {
+		return s.joinedQuery, s.joined, nil
+	}
+	idx, cs, err := s.peekFrame()
+	if err != nil || cs == nil {
+		return idx, cs, err
+	}
+	s.pos++
+	joined := cs
+	for {
+		nidx, ncs, err := s.peekFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if ncs == nil || nidx != idx || remote.CompareLabels(ncs.Labels, cs.Labels) != 0 {
+			break
+		}
+		if joined == cs {
+			joined = &remote.ChunkedSeries{Labels: cs.Labels, Chunks: append([]remote.Chunk(nil), cs.Chunks...)}
+		}
+		joined.Chunks = append(joined.Chunks, ncs.Chunks...)
+		s.pos++
+	}
+	s.joinedQuery, s.joined = idx, joined
+	return idx, joined, nil
+}
+
+// peekFrame returns the next series of the response as read.
+func (s *shardStream) peekFrame() (int, *remote.ChunkedSeries, error) {
+	if s.reader == nil {
+		for s.query < len(s.results) && s.pos >= len(s.results[s.query]) {
+			s.query++
+			s.pos = 0
+		}
+		if s.query >= len(s.results) {
+			return 0, nil, nil
+		}
+		return s.query, s.results[s.query][s.pos], nil
+	}
+
+	for !s.eof && s.pos >= len(s.frame.ChunkedSeries) {
+		s.frame = remote.ChunkedReadResponse{}
+		s.pos = 0
+		if err := s.reader.NextProto(&s.frame); err != nil {
+			if err == io.EOF {
+				s.eof = true
+				break
+			}
+			return 0, nil, Errorf(ErrInternal, "%s: read frame: %v", s.addr, err)
+		}
+	}
+	if s.eof {
+		return 0, nil, nil
+	}
+	return int(s.frame.QueryIndex), s.frame.ChunkedSeries[s.pos], nil
+}
+
+func (s *shardStream) next() {
+	s.joined = nil
+}
+
+func (s *shardStream) close() {
+	if s.reader != nil {
+		s.body.Close()
+	}
+}
+
+// mergeStreams merges the series of query index i of every shard.
+// Shards return the series of a query sorted by labels, so the merge
+// only holds the current series of each shard.
+func mergeStreams(i int, streams []*shardStream, fn SeriesFunc) error {
+	heads := make([]*remote.ChunkedSeries, len(streams))
+	for {
+		var min *remote.ChunkedSeries
+		for j, s := range streams {
+			idx, cs, err := s.peek()
+			if err != nil {
+				return err
+			}
+			if cs == nil || idx > i {
+				heads[j] = nil
+				continue
+			}
+			if idx < i {
+				return Errorf(ErrInternal, "%s: series of query %d out of order", s.addr, idx)
+			}
+			heads[j] = cs
+			if min == nil || remote.CompareLabels(cs.Labels, min.Labels) < 0 {
+				min = cs
+			}
+		}
+		if min == nil {
+			return nil
+		}
+
+		var same []*remote.ChunkedSeries
+		for j, cs := range heads {
+			if cs != nil && remote.CompareLabels(cs.Labels, min.Labels) == 0 {
+				same = append(same, cs)
+				streams[j].next()
+			}
+		}
+		merged, err := remote.MergeSeries(same)
+		if err != nil {
+			return Errorf(ErrInternal, "merge series: %v", err)
+		}
+		if err := fn(i, merged); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package query
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/promcluster/proxy/pkg/remote"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newReadShard starts a fake prometheus answering remote reads with
+// series, keyed by query index, streamed if the shard supports it.
+func newReadShard(t *testing.T, streamed bool, series [][]*prompb.TimeSeries) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+		}
+		var req remote.ReadRequest
+		if err := req.Unmarshal(data); err != nil {
+			t.Error(err)
+		}
+		if len(req.Queries) != len(series) {
+			t.Errorf("got %d queries, want %d", len(req.Queries), len(series))
+		}
+
+		if !streamed {
+			var resp prompb.ReadResponse
+			for _, ts := range series {
+				resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+			}
+			b, _ := resp.Marshal()
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			_, _ = w.Write(snappy.Encode(nil, b))
+			return
+		}
+
+		w.Header().Set("Content-Type", remote.StreamedContentType)
+		cw := remote.NewChunkedWriter(w, nil)
+		for i, tss := range series {
+			for _, ts := range tss {
+				cs, err := remote.FromTimeSeries(ts)
+				if err != nil {
+					t.Error(err)
+				}
+				b, _ := (&remote.ChunkedReadResponse{
+					ChunkedSeries: []*remote.ChunkedSeries{cs},
+					QueryIndex:    int64(i),
+				}).Marshal()
+				_, _ = cw.Write(b)
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func timeSeries(instance string, ts ...int64) *prompb.TimeSeries {
+	s := &prompb.TimeSeries{Labels: []*prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: instance},
+	}}
+	for _, t := range ts {
+		s.Samples = append(s.Samples, prompb.Sample{Timestamp: t, Value: 1})
+	}
+	return s
+}
+
+func TestQuerierRemoteRead(t *testing.T) {
+	a := newReadShard(t, true, [][]*prompb.TimeSeries{
+		{timeSeries("a", 1, 2), timeSeries("c", 1)},
+		{timeSeries("x", 1)},
+	})
+	b := newReadShard(t, false, [][]*prompb.TimeSeries{
+		{timeSeries("b", 1), timeSeries("a", 2, 3)},
+		{},
+	})
+	q := newTestQuerier(a.URL, b.URL)
+
+	req := &remote.ReadRequest{Queries: []*prompb.Query{{}, {}}}
+	got := map[int][]string{}
+	samples := map[string]int{}
+	err := q.RemoteRead(context.Background(), req, func(i int, cs *remote.ChunkedSeries) error {
+		instance := cs.Labels[1].Value
+		got[i] = append(got[i], instance)
+		ss, err := remote.DecodeChunks(cs.Chunks)
+		samples[instance] = len(ss)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0]) != 3 || got[0][0] != "a" || got[0][1] != "b" || got[0][2] != "c" {
+		t.Fatalf("unexpected series of query 0: %v", got[0])
+	}
+	if len(got[1]) != 1 || got[1][0] != "x" {
+		t.Fatalf("unexpected series of query 1: %v", got[1])
+	}
+	if samples["a"] != 3 {
+		t.Fatalf("got %d samples of merged series, want 3", samples["a"])
+	}
+}
+
+func TestQuerierRemoteReadSplitSeries(t *testing.T) {
+	// the chunks of series a are split across frames.
+	a := newReadShard(t, true, [][]*prompb.TimeSeries{
+		{timeSeries("a", 1, 2), timeSeries("a", 3), timeSeries("c", 1)},
+	})
+	b := newReadShard(t, true, [][]*prompb.TimeSeries{
+		{timeSeries("a", 2, 4)},
+	})
+	q := newTestQuerier(a.URL, b.URL)
+
+	req := &remote.ReadRequest{Queries: []*prompb.Query{{}}}
+	var got []string
+	samples := map[string]int{}
+	err := q.RemoteRead(context.Background(), req, func(i int, cs *remote.ChunkedSeries) error {
+		instance := cs.Labels[1].Value
+		got = append(got, instance)
+		ss, err := remote.DecodeChunks(cs.Chunks)
+		samples[instance] = len(ss)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Fatalf("unexpected series: %v", got)
+	}
+	if samples["a"] != 4 {
+		t.Fatalf("got %d samples of split series, want 4", samples["a"])
+	}
+}
+
+func TestQuerierRemoteReadShardError(t *testing.T) {
+	a := newReadShard(t, true, [][]*prompb.TimeSeries{{timeSeries("a", 1)}})
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer b.Close()
+
+	q := newTestQuerier(a.URL, b.URL)
+	err := q.RemoteRead(context.Background(), &remote.ReadRequest{Queries: []*prompb.Query{{}}},
+		func(int, *remote.ChunkedSeries) error { return nil })
+	if e, ok := err.(*Error); !ok || e.Type != ErrUnavailable {
+		t.Fatalf("got %v, want unavailable error", err)
+	}
+}
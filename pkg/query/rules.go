@@ -0,0 +1,85 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+)
+
+// shardField annotates the rule groups and alerts with their shard.
+const shardField = "shard"
+
+// RulesData is the data of a rules response. The groups are kept as
+// decoded so that fields unknown to the proxy are passed through.
+type RulesData struct {
+	Groups []map[string]interface{} `json:"groups"`
+}
+
+// AlertsData is the data of an alerts response.
+type AlertsData struct {
+	Alerts []map[string]interface{} `json:"alerts"`
+}
+
+// Rules returns the rule groups of every shard, annotated with their shard.
+func (q *Querier) Rules(ctx context.Context, params url.Values) (*RulesData, []string, error) {
+	results, err := q.fanout(ctx, "/api/v1/rules", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := &RulesData{Groups: []map[string]interface{}{}}
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var d RulesData
+		if err := json.Unmarshal(r.resp.Data, &d); err != nil {
+			return nil, nil, Errorf(ErrInternal, "%s: decode rules: %v", r.addr, err)
+		}
+		for _, g := range d.Groups {
+			g[shardField] = r.addr
+			res.Groups = append(res.Groups, g)
+		}
+	}
+	sort.SliceStable(res.Groups, func(i, j int) bool {
+		return entryKey(res.Groups[i], "file", "name") < entryKey(res.Groups[j], "file", "name")
+	})
+	return res, warnings(results), nil
+}
+
+// Alerts returns the active alerts of every shard, annotated with their shard.
+func (q *Querier) Alerts(ctx context.Context, params url.Values) (*AlertsData, []string, error) {
+	results, err := q.fanout(ctx, "/api/v1/alerts", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := &AlertsData{Alerts: []map[string]interface{}{}}
+	for _, r := range results {
+		if r.resp == nil {
+			continue
+		}
+		var d AlertsData
+		if err := json.Unmarshal(r.resp.Data, &d); err != nil {
+			return nil, nil, Errorf(ErrInternal, "%s: decode alerts: %v", r.addr, err)
+		}
+		for _, a := range d.Alerts {
+			a[shardField] = r.addr
+			res.Alerts = append(res.Alerts, a)
+		}
+	}
+	sort.SliceStable(res.Alerts, func(i, j int) bool {
+		return entryKey(res.Alerts[i], "labels") < entryKey(res.Alerts[j], "labels")
+	})
+	return res, warnings(results), nil
+}
+
+// entryKey returns the sort key of a rule group or alert, made of the
+// given fields and the shard.
+func entryKey(e map[string]interface{}, fields ...string) string {
+	var key string
+	for _, f := range append(fields, shardField) {
+		b, _ := json.Marshal(e[f])
+		key += string(b) + "\xff"
+	}
+	return key
+}
@@ -0,0 +1,61 @@
+package query
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestQuerierRules(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"groups":[
+		{"name":"node","file":"b.yml","interval":60,"rules":[{"name":"NodeDown","type":"alerting"}]},
+		{"name":"api","file":"a.yml","interval":60,"rules":[]}]}}`)
+	b := newShard(t, `{"status":"success","data":{"groups":[
+		{"name":"node","file":"b.yml","interval":60,"rules":[]}]}}`)
+
+	q := newTestQuerier(a.URL, b.URL)
+	d, _, err := q.Rules(context.Background(), url.Values{"type": []string{"alert"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Groups) != 3 {
+		t.Fatalf("got %d groups, want 3", len(d.Groups))
+	}
+	// groups are sorted by file, name and shard.
+	first, second := a.URL, b.URL
+	if second < first {
+		first, second = second, first
+	}
+	want := []struct{ name, shard string }{{"api", a.URL}, {"node", first}, {"node", second}}
+	for i, w := range want {
+		g := d.Groups[i]
+		if g["name"] != w.name || g["shard"] != w.shard {
+			t.Errorf("group %d: got %v/%v, want %s/%s", i, g["name"], g["shard"], w.name, w.shard)
+		}
+		// unknown fields are passed through.
+		if g["interval"] != float64(60) {
+			t.Errorf("group %d: got interval %v, want 60", i, g["interval"])
+		}
+	}
+}
+
+func TestQuerierAlerts(t *testing.T) {
+	a := newShard(t, `{"status":"success","data":{"alerts":[
+		{"labels":{"alertname":"NodeDown","instance":"b"},"state":"firing","value":"0"}]}}`)
+	b := newShard(t, `{"status":"success","data":{"alerts":[
+		{"labels":{"alertname":"NodeDown","instance":"a"},"state":"pending","value":"0"}]}}`)
+	q := newTestQuerier(a.URL, b.URL)
+	d, ws, err := q.Alerts(context.Background(), url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ws) != 0 {
+		t.Fatalf("got warnings %v, want none", ws)
+	}
+	if len(d.Alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2", len(d.Alerts))
+	}
+	if d.Alerts[0]["shard"] != b.URL || d.Alerts[1]["shard"] != a.URL {
+		t.Errorf("got alerts %v, want the alert of instance a first", d.Alerts)
+	}
+}
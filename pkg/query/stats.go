@@ -0,0 +1,47 @@
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type statsKey struct{}
+
+// Stats collects the shards a request was sent to, across every
+// sub-query of the request.
+type Stats struct {
+	mu     sync.Mutex
+	shards map[string]struct{}
+}
+
+// WithStats returns a context collecting the stats of the requests made with it.
+func WithStats(ctx context.Context) (context.Context, *Stats) {
+	s := &Stats{shards: make(map[string]struct{})}
+	return context.WithValue(ctx, statsKey{}, s), s
+}
+
+// addShards records the shards of a request made with ctx.
+func addShards(ctx context.Context, addrs []string) {
+	s, ok := ctx.Value(statsKey{}).(*Stats)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range addrs {
+		s.shards[addr] = struct{}{}
+	}
+}
+
+// Shards returns the sorted addresses of the shards requested.
+func (s *Stats) Shards() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]string, 0, len(s.shards))
+	for addr := range s.shards {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,256 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var queueOldestMessageAge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "queue_oldest_message_age_seconds",
+		Help:      "The age of the oldest message of the queue in seconds.",
+	},
+)
+
+// markInterval is the minimal interval between two write marks.
+const markInterval = time.Second
+
+// Stats is the state of a queue.
+type Stats struct {
+	Type  string `json:"type"`
+	Depth int64  `json:"depth"`
+	// DiskBytes and Files are the size and number of the data files.
+	DiskBytes    int64 `json:"diskBytes"`
+	Files        int   `json:"files"`
+	ReadFileNum  int64 `json:"readFileNum"`
+	ReadPos      int64 `json:"readPos"`
+	WriteFileNum int64 `json:"writeFileNum"`
+	WritePos     int64 `json:"writePos"`
+	// OldestMessageAge is the age of the oldest message in seconds, at
+	// a second resolution.
+	OldestMessageAge float64 `json:"oldestMessageAgeSeconds"`
+	Paused           bool    `json:"paused"`
+}
+
+// Admin is implemented by the queues that can be inspected and controlled.
+type Admin interface {
+	// Stats returns the state of the queue.
+	Stats() (Stats, error)
+	// Pause stops handing out messages until Resume, Pop blocks meanwhile.
+	Pause() error
+	// Resume resumes handing out messages.
+	Resume() error
+	// Purge drops every pending message.
+	Purge() error
+}
+
+// writeMark records that the messages from a position on were written
+// at t or later.
+type writeMark struct {
+	fileNum int64
+	pos     int64
+	t       time.Time
+}
+
+// before reports whether the mark is at or before the position.
+func (m writeMark) before(fileNum, pos int64) bool {
+	return m.fileNum < fileNum || (m.fileNum == fileNum && m.pos <= pos)
+}
+
+// mark records a write at the position, at most once per markInterval.
+func (d *diskQueue) mark(fileNum, pos int64) {
+	now := time.Now()
+	if n := len(d.marks); n > 0 && now.Sub(d.marks[n-1].t) < markInterval {
+		return
+	}
+	d.marks = append(d.marks, writeMark{fileNum: fileNum, pos: pos, t: now})
+}
+
+// trimMarks drops the marks of read messages, the first mark left is the
+// last one at or before the read position.
+func (d *diskQueue) trimMarks() {
+	if d.depth <= 0 {
+		d.marks = nil
+		return
+	}
+	i := 0
+	for i+1 < len(d.marks) && d.marks[i+1].before(d.readFileNum, d.readPos) {
+		i++
+	}
+	d.marks = d.marks[i:]
+}
+
+// seedMarks marks the pending messages of a previous run with the
+// modification time of the read file, the age is underestimated.
+func (d *diskQueue) seedMarks() {
+	if d.depth <= 0 {
+		return
+	}
+	t := time.Now()
+	if fi, err := os.Stat(d.fileName(d.readFileNum)); err == nil {
+		t = fi.ModTime()
+	}
+	d.marks = []writeMark{{fileNum: d.readFileNum, pos: d.readPos, t: t}}
+}
+
+// stats returns the state of the queue kept by ioLoop.
+func (d *diskQueue) stats() Stats {
+	s := Stats{
+		Type:         "disk",
+		Depth:        d.depth,
+		ReadFileNum:  d.readFileNum,
+		ReadPos:      d.readPos,
+		WriteFileNum: d.writeFileNum,
+		WritePos:     d.writePos,
+		Paused:       d.paused,
+	}
+	if d.depth > 0 && len(d.marks) > 0 {
+		s.OldestMessageAge = time.Since(d.marks[0].t).Seconds()
+	}
+	return s
+}
+
+// Stats returns the state of the queue.
+func (d *diskQueue) Stats() (Stats, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return Stats{}, errors.New("exiting")
+	}
+
+	ch := make(chan Stats, 1)
+	d.statsChan <- ch
+	s := <-ch
+
+	files, err := filepath.Glob(path.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.*.dat", d.name)))
+	if err != nil {
+		return s, err
+	}
+	meta := d.metaDataFileName()
+	for _, fn := range files {
+		if fn == meta {
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		s.Files++
+		s.DiskBytes += fi.Size()
+	}
+	return s, nil
+}
+
+// Pause stops handing out messages until Resume.
+func (d *diskQueue) Pause() error {
+	return d.setPaused(true)
+}
+
+// Resume resumes handing out messages.
+func (d *diskQueue) Resume() error {
+	return d.setPaused(false)
+}
+
+func (d *diskQueue) setPaused(paused bool) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.logger.Info("set paused", zap.Bool("paused", paused))
+	d.pauseChan <- paused
+	return nil
+}
+
+// Purge drops every pending message and its data files.
+func (d *diskQueue) Purge() error {
+	return d.Empty()
+}
+
+// gate blocks the consumers of a paused queue.
+type gate struct {
+	mu     sync.Mutex
+	open   chan struct{}
+	paused bool
+}
+
+func newGate() *gate {
+	g := &gate{open: make(chan struct{})}
+	close(g.open)
+	return g
+}
+
+// wait blocks while paused.
+func (g *gate) wait() {
+	g.mu.Lock()
+	open := g.open
+	g.mu.Unlock()
+	<-open
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.open = make(chan struct{})
+	}
+}
+
+func (g *gate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.open)
+	}
+}
+
+func (g *gate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Stats returns the state of the queue, a memory queue has no files and
+// does not track the age of its messages.
+func (c *ChanQueue) Stats() (Stats, error) {
+	return Stats{Type: "memory", Depth: int64(len(c.C)), Paused: c.gate.isPaused()}, nil
+}
+
+// Pause stops handing out messages until Resume. A consumer already
+// waiting for a message still receives one.
+func (c *ChanQueue) Pause() error {
+	c.gate.pause()
+	return nil
+}
+
+// Resume resumes handing out messages.
+func (c *ChanQueue) Resume() error {
+	c.gate.resume()
+	return nil
+}
+
+// Purge drops every pending message.
+func (c *ChanQueue) Purge() error {
+	for {
+		select {
+		case <-c.C:
+		default:
+			return nil
+		}
+	}
+}
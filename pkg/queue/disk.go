@@ -72,6 +72,10 @@ type diskQueue struct {
 	syncTimeout     time.Duration // duration of time per fsync
 	exitFlag        int32
 	needSync        bool
+	paused          bool
+
+	// marks of the unread writes, the first one dates the oldest message
+	marks []writeMark
 
 	// keeps track of the position where we have read
 	// (but not yet sent over readChan)
@@ -88,6 +92,8 @@ type diskQueue struct {
 
 	// internal channels
 	depthChan         chan int64
+	statsChan         chan chan Stats
+	pauseChan         chan bool
 	writeChan         chan []byte
 	writeResponseChan chan error
 	emptyChan         chan int
@@ -113,6 +119,7 @@ func NewDiskQueue(reg prometheus.Registerer, conf Config, logger *zap.Logger) *d
 		queueMessagePushTotal,
 		queueMessagePopTotal,
 		queueDepth,
+		queueOldestMessageAge,
 	)
 
 	d := diskQueue{
@@ -123,6 +130,8 @@ func NewDiskQueue(reg prometheus.Registerer, conf Config, logger *zap.Logger) *d
 		maxMsgSize:        conf.MsgSizeLimit,
 		readChan:          make(chan []byte),
 		depthChan:         make(chan int64),
+		statsChan:         make(chan chan Stats),
+		pauseChan:         make(chan bool),
 		writeChan:         make(chan []byte),
 		writeResponseChan: make(chan error),
 		emptyChan:         make(chan int),
@@ -144,6 +153,7 @@ func NewDiskQueue(reg prometheus.Registerer, conf Config, logger *zap.Logger) *d
 	if err != nil && !os.IsNotExist(err) {
 		d.logger.Error("failed to retrieveMetaData", zap.Error(err))
 	}
+	d.seedMarks()
 
 	go d.ioLoop()
 	go d.reportDepth()
@@ -166,6 +176,9 @@ func (d *diskQueue) reportDepth() {
 		select {
 		case <-ticker.C:
 			queueDepth.Set(float64(d.Depth()))
+			if s, err := d.Stats(); err == nil {
+				queueOldestMessageAge.Set(s.OldestMessageAge)
+			}
 		}
 	}
 }
@@ -299,6 +312,7 @@ func (d *diskQueue) skipToNextRWFile() error {
 	d.nextReadFileNum = d.writeFileNum
 	d.nextReadPos = 0
 	d.depth = 0
+	d.marks = nil
 
 	return err
 }
@@ -425,6 +439,8 @@ func (d *diskQueue) writeOne(data []byte) error {
 		return err
 	}
 
+	d.mark(d.writeFileNum, d.writePos)
+
 	totalBytes := int64(4 + dataLen)
 	d.writePos += totalBytes
 	d.depth++
@@ -577,6 +593,7 @@ func (d *diskQueue) moveForward() {
 	d.readFileNum = d.nextReadFileNum
 	d.readPos = d.nextReadPos
 	d.depth--
+	d.trimMarks()
 
 	// see if we need to clean up the old file
 	if oldReadFileNum != d.nextReadFileNum {
@@ -677,15 +694,24 @@ func (d *diskQueue) ioLoop() {
 			r = nil
 		}
 
+		// a paused queue keeps the data read until resumed
+		out := r
+		if d.paused {
+			out = nil
+		}
+
 		select {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
-		case r <- dataRead:
+		case out <- dataRead:
 			r = nil
 			count++
 			// moveForward sets needSync flag if a file is removed
 			d.moveForward()
 		case d.depthChan <- d.depth:
+		case ch := <-d.statsChan:
+			ch <- d.stats()
+		case d.paused = <-d.pauseChan:
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
 			count = 0
@@ -25,12 +25,15 @@ type Queue interface {
 // ChanQueue implements a simple queue.
 type ChanQueue struct {
 	C chan []byte
+
+	gate *gate
 }
 
 // NewChanQueue creates a chan queue.
 func NewChanQueue(reg prometheus.Registerer, logger *zap.Logger) *ChanQueue {
 	return &ChanQueue{
-		C: make(chan []byte, DefaultQueueSize),
+		C:    make(chan []byte, DefaultQueueSize),
+		gate: newGate(),
 	}
 }
 
@@ -46,6 +49,7 @@ func (c *ChanQueue) Push(msg []byte) error {
 
 // Pop pops a message from the queue.
 func (c *ChanQueue) Pop() ([]byte, error) {
+	c.gate.wait()
 	msg := <-c.C
 	return msg, nil
 }
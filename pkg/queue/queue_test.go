@@ -1,7 +1,10 @@
 package queue
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
@@ -22,3 +25,86 @@ func TestChanQueue(t *testing.T) {
 		t.Fatal("got: " + string(got) + ", but want: " + string(msg))
 	}
 }
+
+func TestChanQueueAdmin(t *testing.T) {
+	q := NewChanQueue(prometheus.NewRegistry(), zap.NewNop())
+	for i := 0; i < 3; i++ {
+		if err := q.Push([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, _ := q.Stats(); s.Depth != 3 || s.Paused {
+		t.Fatalf("stats: %+v", s)
+	}
+
+	_ = q.Pause()
+	popped := make(chan []byte)
+	go func() {
+		msg, _ := q.Pop()
+		popped <- msg
+	}()
+	select {
+	case <-popped:
+		t.Fatal("popped from a paused queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = q.Resume()
+	<-popped
+
+	_ = q.Purge()
+	if s, _ := q.Stats(); s.Depth != 0 {
+		t.Fatalf("depth after purge: %d", s.Depth)
+	}
+}
+
+func TestDiskQueueAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := NewDiskQueue(prometheus.NewRegistry(), Config{Name: "test", DataPath: dir, MsgSizeLimit: 1024}, zap.NewNop())
+	defer q.Close()
+	for i := 0; i < 3; i++ {
+		if err := q.Push([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Depth != 3 || s.Files != 1 || s.DiskBytes != 3*8 || s.WritePos != 3*8 || s.ReadPos != 0 {
+		t.Fatalf("stats: %+v", s)
+	}
+
+	_ = q.Pause()
+	popped := make(chan []byte)
+	go func() {
+		msg, _ := q.Pop()
+		popped <- msg
+	}()
+	select {
+	case <-popped:
+		t.Fatal("popped from a paused queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s, _ := q.Stats(); !s.Paused || s.Depth != 3 {
+		t.Fatalf("paused stats: %+v", s)
+	}
+	_ = q.Resume()
+	if msg := <-popped; string(msg) != "test" {
+		t.Fatalf("popped %q", msg)
+	}
+	if s, _ := q.Stats(); s.Depth != 2 || s.ReadPos != 8 || s.OldestMessageAge < 0 {
+		t.Fatalf("stats after pop: %+v", s)
+	}
+
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := q.Stats(); s.Depth != 0 || s.Files != 0 || s.OldestMessageAge != 0 {
+		t.Fatalf("stats after purge: %+v", s)
+	}
+}
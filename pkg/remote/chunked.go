@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+)
+
+// StreamedContentType is the content type of a streamed remote read response.
+const StreamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// DefaultMaxFrameBytes is the default frame size limit of a streamed
+// remote read response, the same as the prometheus default.
+const DefaultMaxFrameBytes = 1 * 1024 * 1024
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkedWriter writes the frames of a streamed remote read response.
+// A frame is the uvarint size of the message, the big endian CRC32
+// (Castagnoli) of the message and the message itself.
+type ChunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// NewChunkedWriter returns a writer flushing every frame to the client
+// if f is not nil.
+func NewChunkedWriter(w io.Writer, f http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{w: w, flusher: f}
+}
+
+// Write writes a single frame.
+func (w *ChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	if _, err := w.w.Write(buf[:n]); err != nil {
+		return 0, err
+	}
+	binary.BigEndian.PutUint32(buf[:4], crc32.Checksum(b, castagnoliTable))
+	if _, err := w.w.Write(buf[:4]); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, nil
+}
+
+// ChunkedReader reads the frames of a streamed remote read response.
+type ChunkedReader struct {
+	b         *bufio.Reader
+	sizeLimit uint64
+	data      []byte
+}
+
+// NewChunkedReader returns a reader rejecting frames larger than sizeLimit.
+func NewChunkedReader(r io.Reader, sizeLimit uint64) *ChunkedReader {
+	return &ChunkedReader{b: bufio.NewReader(r), sizeLimit: sizeLimit}
+}
+
+// Next returns the next frame, the returned slice is only valid until
+// the next call. It returns io.EOF at the end of the stream.
+func (r *ChunkedReader) Next() ([]byte, error) {
+	size, err := binary.ReadUvarint(r.b)
+	if err != nil {
+		return nil, err
+	}
+	if size > r.sizeLimit {
+		return nil, fmt.Errorf("chunked reader: frame size %d exceeds limit %d", size, r.sizeLimit)
+	}
+
+	var crc [4]byte
+	if _, err := io.ReadFull(r.b, crc[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if cap(r.data) < int(size) {
+		r.data = make([]byte, size)
+	}
+	r.data = r.data[:size]
+	if _, err := io.ReadFull(r.b, r.data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if crc32.Checksum(r.data, castagnoliTable) != binary.BigEndian.Uint32(crc[:]) {
+		return nil, errors.New("chunked reader: frame checksum mismatch")
+	}
+	return r.data, nil
+}
+
+// NextProto reads the next frame into resp.
+func (r *ChunkedReader) NextProto(resp *ChunkedReadResponse) error {
+	b, err := r.Next()
+	if err != nil {
+		return err
+	}
+	return resp.Unmarshal(b)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
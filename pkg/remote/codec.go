@@ -0,0 +1,362 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// The remote read messages below are newer than the vendored prompb,
+// they are encoded by hand following prometheus/prompb/remote.proto.
+
+// ResponseType is the response type a remote read client accepts.
+type ResponseType int32
+
+const (
+	// Samples is a snappy compressed ReadResponse.
+	Samples ResponseType = 0
+	// StreamedXORChunks is a stream of ChunkedReadResponse frames.
+	StreamedXORChunks ResponseType = 1
+)
+
+// ChunkEncoding is the encoding of a chunk.
+type ChunkEncoding int32
+
+const (
+	// ChunkUnknown is an unknown chunk encoding.
+	ChunkUnknown ChunkEncoding = 0
+	// ChunkXOR is the Gorilla XOR chunk encoding.
+	ChunkXOR ChunkEncoding = 1
+)
+
+// ReadRequest is a remote read request.
+type ReadRequest struct {
+	Queries               []*prompb.Query
+	AcceptedResponseTypes []ResponseType
+}
+
+// Chunk is an encoded chunk of samples.
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Type      ChunkEncoding
+	Data      []byte
+}
+
+// ChunkedSeries is a series with its chunks.
+type ChunkedSeries struct {
+	Labels []prompb.Label
+	Chunks []Chunk
+}
+
+// ChunkedReadResponse is a frame of a streamed remote read response.
+type ChunkedReadResponse struct {
+	ChunkedSeries []*ChunkedSeries
+	QueryIndex    int64
+}
+
+// protobuf wire types.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendInt64(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+// decoder iterates over the fields of a protobuf message.
+type decoder struct {
+	b []byte
+}
+
+var errTruncated = errors.New("proto: truncated message")
+
+func (d *decoder) done() bool {
+	return len(d.b) == 0
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *decoder) field() (int, int, error) {
+	v, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	l, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	b := d.b[:l]
+	d.b = d.b[l:]
+	return b, nil
+}
+
+func (d *decoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case 1: // fixed64
+		if len(d.b) < 8 {
+			return errTruncated
+		}
+		d.b = d.b[8:]
+	case 5: // fixed32
+		if len(d.b) < 4 {
+			return errTruncated
+		}
+		d.b = d.b[4:]
+	default:
+		return fmt.Errorf("proto: unsupported wire type %d", wireType)
+	}
+	return nil
+}
+
+// Marshal encodes the request.
+func (r *ReadRequest) Marshal() ([]byte, error) {
+	var b []byte
+	for _, q := range r.Queries {
+		data, err := q.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, 1, data)
+	}
+	if len(r.AcceptedResponseTypes) > 0 {
+		var packed []byte
+		for _, t := range r.AcceptedResponseTypes {
+			packed = appendVarint(packed, uint64(t))
+		}
+		b = appendBytes(b, 2, packed)
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the request.
+func (r *ReadRequest) Unmarshal(data []byte) error {
+	d := &decoder{b: data}
+	for !d.done() {
+		field, wireType, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			var q prompb.Query
+			if err := q.Unmarshal(b); err != nil {
+				return err
+			}
+			r.Queries = append(r.Queries, &q)
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ResponseType(v))
+		case field == 2 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			packed := &decoder{b: b}
+			for !packed.done() {
+				v, err := packed.varint()
+				if err != nil {
+					return err
+				}
+				r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ResponseType(v))
+			}
+		default:
+			if err := d.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the frame.
+func (r *ChunkedReadResponse) Marshal() ([]byte, error) {
+	var b []byte
+	for _, s := range r.ChunkedSeries {
+		var sb []byte
+		for i := range s.Labels {
+			data, err := s.Labels[i].Marshal()
+			if err != nil {
+				return nil, err
+			}
+			sb = appendBytes(sb, 1, data)
+		}
+		for _, c := range s.Chunks {
+			var cb []byte
+			cb = appendInt64(cb, 1, c.MinTimeMs)
+			cb = appendInt64(cb, 2, c.MaxTimeMs)
+			cb = appendInt64(cb, 3, int64(c.Type))
+			if len(c.Data) > 0 {
+				cb = appendBytes(cb, 4, c.Data)
+			}
+			sb = appendBytes(sb, 2, cb)
+		}
+		b = appendBytes(b, 1, sb)
+	}
+	return appendInt64(b, 2, r.QueryIndex), nil
+}
+
+// Unmarshal decodes the frame.
+func (r *ChunkedReadResponse) Unmarshal(data []byte) error {
+	d := &decoder{b: data}
+	for !d.done() {
+		field, wireType, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			s, err := unmarshalChunkedSeries(b)
+			if err != nil {
+				return err
+			}
+			r.ChunkedSeries = append(r.ChunkedSeries, s)
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			r.QueryIndex = int64(v)
+		default:
+			if err := d.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unmarshalChunkedSeries(data []byte) (*ChunkedSeries, error) {
+	s := &ChunkedSeries{}
+	d := &decoder{b: data}
+	for !d.done() {
+		field, wireType, err := d.field()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return nil, err
+			}
+			var l prompb.Label
+			if err := l.Unmarshal(b); err != nil {
+				return nil, err
+			}
+			s.Labels = append(s.Labels, l)
+		case field == 2 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return nil, err
+			}
+			c, err := unmarshalChunk(b)
+			if err != nil {
+				return nil, err
+			}
+			s.Chunks = append(s.Chunks, c)
+		default:
+			if err := d.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func unmarshalChunk(data []byte) (Chunk, error) {
+	var c Chunk
+	d := &decoder{b: data}
+	for !d.done() {
+		field, wireType, err := d.field()
+		if err != nil {
+			return c, err
+		}
+		if field == 4 && wireType == wireBytes {
+			b, err := d.bytes()
+			if err != nil {
+				return c, err
+			}
+			// frames are read into a reused buffer.
+			c.Data = append([]byte(nil), b...)
+			continue
+		}
+		if wireType != wireVarint || field < 1 || field > 3 {
+			if err := d.skip(wireType); err != nil {
+				return c, err
+			}
+			continue
+		}
+		v, err := d.varint()
+		if err != nil {
+			return c, err
+		}
+		switch field {
+		case 1:
+			c.MinTimeMs = int64(v)
+		case 2:
+			c.MaxTimeMs = int64(v)
+		case 3:
+			if v > math.MaxInt32 {
+				return c, fmt.Errorf("proto: invalid chunk encoding %d", v)
+			}
+			c.Type = ChunkEncoding(v)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,140 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestReadRequestRoundTrip(t *testing.T) {
+	req := &ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   2000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		}},
+		AcceptedResponseTypes: []ResponseType{StreamedXORChunks, Samples},
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ReadRequest
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, req) {
+		t.Fatalf("got %+v, want %+v", got, req)
+	}
+
+	// a request of an old client is a plain prompb.ReadRequest.
+	old, err := (&prompb.ReadRequest{Queries: req.Queries}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = ReadRequest{}
+	if err := got.Unmarshal(old); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Queries) != 1 || len(got.AcceptedResponseTypes) != 0 {
+		t.Fatalf("unexpected request %+v", got)
+	}
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	chunks, err := EncodeChunks(samples(0, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	frames := []*ChunkedReadResponse{
+		{ChunkedSeries: []*ChunkedSeries{{Labels: []prompb.Label{{Name: "a", Value: "1"}}, Chunks: chunks}}},
+		{ChunkedSeries: []*ChunkedSeries{{Labels: []prompb.Label{{Name: "a", Value: "2"}}, Chunks: chunks[:1]}}, QueryIndex: 1},
+	}
+
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nil)
+	for _, f := range frames {
+		b, err := f.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewChunkedReader(&buf, DefaultMaxFrameBytes)
+	for _, want := range frames {
+		var got ChunkedReadResponse
+		if err := r.NextProto(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+func TestChunkedReaderChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewChunkedWriter(&buf, nil).Write([]byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+	if _, err := NewChunkedReader(bytes.NewReader(b), DefaultMaxFrameBytes).Next(); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	if _, err := NewChunkedReader(bytes.NewReader(buf.Bytes()), 2).Next(); err == nil {
+		t.Fatal("expected size limit error")
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	ls := []prompb.Label{{Name: "a", Value: "1"}}
+	a, err := EncodeChunks(samples(0, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeChunks(samples(50, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := MergeSeries([]*ChunkedSeries{{Labels: ls, Chunks: a}, {Labels: ls, Chunks: b}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeChunks(s.Chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, samples(0, 200)) {
+		t.Fatalf("unexpected merged samples %v", got)
+	}
+
+	ts, err := ToTimeSeries(s, 10000, 19000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Samples) != 10 || ts.Samples[0].Timestamp != 10000 {
+		t.Fatalf("unexpected samples %v", ts.Samples)
+	}
+}
+
+// samples returns a sample every second from index from to to, exclusive.
+func samples(from, to int) []prompb.Sample {
+	var res []prompb.Sample
+	for i := from; i < to; i++ {
+		res = append(res, prompb.Sample{Timestamp: int64(i) * 1000, Value: float64(i)})
+	}
+	return res
+}
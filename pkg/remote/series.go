@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// samplesPerChunk is the number of samples of a re-encoded chunk,
+// the same as a prometheus head chunk.
+const samplesPerChunk = 120
+
+// CompareLabels compares two sorted label sets.
+func CompareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// FromTimeSeries converts a series of samples to a chunked series.
+func FromTimeSeries(ts *prompb.TimeSeries) (*ChunkedSeries, error) {
+	ls := make([]prompb.Label, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		ls = append(ls, *l)
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+
+	chunks, err := EncodeChunks(ts.Samples)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedSeries{Labels: ls, Chunks: chunks}, nil
+}
+
+// ToTimeSeries converts a chunked series to a series of the samples
+// between mint and maxt inclusive.
+func ToTimeSeries(s *ChunkedSeries, mint, maxt int64) (*prompb.TimeSeries, error) {
+	samples, err := DecodeChunks(s.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	res := samples[:0]
+	for _, sample := range samples {
+		if sample.Timestamp >= mint && sample.Timestamp <= maxt {
+			res = append(res, sample)
+		}
+	}
+
+	ls := make([]*prompb.Label, 0, len(s.Labels))
+	for i := range s.Labels {
+		ls = append(ls, &s.Labels[i])
+	}
+	return &prompb.TimeSeries{Labels: ls, Samples: res}, nil
+}
+
+// EncodeChunks encodes samples sorted by timestamp into XOR chunks.
+func EncodeChunks(samples []prompb.Sample) ([]Chunk, error) {
+	var chunks []Chunk
+	for len(samples) > 0 {
+		n := samplesPerChunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples[:n] {
+			app.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, Chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[n-1].Timestamp,
+			Type:      ChunkXOR,
+			Data:      c.Bytes(),
+		})
+		samples = samples[n:]
+	}
+	return chunks, nil
+}
+
+// DecodeChunks decodes the samples of chunks.
+func DecodeChunks(chunks []Chunk) ([]prompb.Sample, error) {
+	var samples []prompb.Sample
+	pool := chunkenc.NewPool()
+	for _, c := range chunks {
+		if c.Type != ChunkXOR {
+			return nil, fmt.Errorf("unsupported chunk encoding %d", c.Type)
+		}
+		chk, err := pool.Get(chunkenc.EncXOR, c.Data)
+		if err != nil {
+			return nil, err
+		}
+		it := chk.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			samples = append(samples, prompb.Sample{Timestamp: t, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// MergeSeries merges the chunks of the same series from several sources.
+// A single series is returned as is, otherwise the samples of every
+// source are merged by timestamp and encoded into new chunks.
+func MergeSeries(series []*ChunkedSeries) (*ChunkedSeries, error) {
+	if len(series) == 1 {
+		return series[0], nil
+	}
+
+	var samples []prompb.Sample
+	for _, s := range series {
+		ss, err := DecodeChunks(s.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, ss...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	res := samples[:0]
+	for _, s := range samples {
+		if len(res) > 0 && res[len(res)-1].Timestamp == s.Timestamp {
+			continue
+		}
+		res = append(res, s)
+	}
+
+	chunks, err := EncodeChunks(res)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedSeries{Labels: series[0].Labels, Chunks: chunks}, nil
+}
+
+// Size returns the approximate encoded size of the series.
+func (s *ChunkedSeries) Size() int {
+	n := 0
+	for _, l := range s.Labels {
+		n += len(l.Name) + len(l.Value) + 4
+	}
+	for _, c := range s.Chunks {
+		n += len(c.Data) + 24
+	}
+	return n
+}
@@ -0,0 +1,195 @@
+package ruler
+
+import (
+	"bytes"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Alert states.
+const (
+	statePending  = "pending"
+	stateFiring   = "firing"
+	stateInactive = "inactive"
+)
+
+// alertsMetric is the series recording the pending and firing alerts.
+const (
+	alertsMetric    = "ALERTS"
+	alertStateLabel = "alertstate"
+)
+
+// resolvedRetention is how long resolved alerts are resent to Alertmanager.
+const resolvedRetention = 15 * time.Minute
+
+// alert is an active or recently resolved alert of an alerting rule.
+type alert struct {
+	labels      model.LabelSet
+	annotations model.LabelSet
+	value       float64
+	state       string
+
+	activeAt   time.Time
+	firedAt    time.Time
+	resolvedAt time.Time
+}
+
+// rule is a loaded recording or alerting rule, alerting rules keep the
+// state of their alerts between evaluations.
+type rule struct {
+	Rule
+	active map[model.Fingerprint]*alert
+}
+
+func newRule(r Rule) *rule {
+	return &rule{Rule: r, active: make(map[model.Fingerprint]*alert)}
+}
+
+// record returns the series recorded by a recording rule.
+func (r *rule) record(v model.Vector) model.Vector {
+	res := make(model.Vector, 0, len(v))
+	for _, s := range v {
+		m := make(model.Metric, len(s.Metric)+len(r.Labels)+1)
+		for k, v := range s.Metric {
+			m[k] = v
+		}
+		for k, v := range r.Labels {
+			m[model.LabelName(k)] = model.LabelValue(v)
+		}
+		m[model.MetricNameLabel] = model.LabelValue(r.Record)
+		res = append(res, &model.Sample{Metric: m, Value: s.Value, Timestamp: s.Timestamp})
+	}
+	return res
+}
+
+// alert updates the alerts of an alerting rule with the result of its
+// evaluation at ts.
+func (r *rule) alert(v model.Vector, ts time.Time) {
+	seen := make(map[model.Fingerprint]bool, len(v))
+	for _, s := range v {
+		// templates see the labels of the sample.
+		base := model.LabelSet(s.Metric).Clone()
+		delete(base, model.MetricNameLabel)
+		ls := base.Clone()
+		for k, v := range r.Labels {
+			ls[model.LabelName(k)] = model.LabelValue(expand(v, base, float64(s.Value)))
+		}
+		ls[model.AlertNameLabel] = model.LabelValue(r.Alert)
+
+		annotations := make(model.LabelSet, len(r.Annotations))
+		for k, v := range r.Annotations {
+			annotations[model.LabelName(k)] = model.LabelValue(expand(v, base, float64(s.Value)))
+		}
+
+		fp := ls.Fingerprint()
+		seen[fp] = true
+		a, ok := r.active[fp]
+		if !ok || a.state == stateInactive {
+			a = &alert{labels: ls, state: statePending, activeAt: ts}
+			r.active[fp] = a
+		}
+		a.value = float64(s.Value)
+		a.annotations = annotations
+	}
+
+	for fp, a := range r.active {
+		if !seen[fp] {
+			switch {
+			case a.state == statePending:
+				delete(r.active, fp)
+			case a.state == stateFiring:
+				a.state = stateInactive
+				a.resolvedAt = ts
+			case ts.Sub(a.resolvedAt) > resolvedRetention:
+				delete(r.active, fp)
+			}
+			continue
+		}
+		if a.state == statePending && ts.Sub(a.activeAt) >= time.Duration(r.For) {
+			a.state = stateFiring
+			a.firedAt = ts
+		}
+	}
+}
+
+// alertsSeries returns the ALERTS series of the pending and firing alerts.
+func (r *rule) alertsSeries(ts time.Time) model.Vector {
+	var res model.Vector
+	for _, a := range r.active {
+		if a.state == stateInactive {
+			continue
+		}
+		m := make(model.Metric, len(a.labels)+2)
+		for k, v := range a.labels {
+			m[k] = v
+		}
+		m[model.MetricNameLabel] = alertsMetric
+		m[alertStateLabel] = model.LabelValue(a.state)
+		res = append(res, &model.Sample{Metric: m, Value: 1, Timestamp: model.TimeFromUnixNano(ts.UnixNano())})
+	}
+	return res
+}
+
+// notifications returns the firing and recently resolved alerts of rl, firing
+// alerts are valid for four evaluation intervals unless resent.
+func (rl *rule) notifications(ts time.Time, interval time.Duration) []amAlert {
+	var res []amAlert
+	for _, a := range rl.active {
+		if a.state == statePending {
+			continue
+		}
+		am := amAlert{
+			Labels:      labelsMap(a.labels),
+			Annotations: labelsMap(a.annotations),
+			StartsAt:    a.firedAt,
+			EndsAt:      ts.Add(4 * interval),
+		}
+		if a.state == stateInactive {
+			am.EndsAt = a.resolvedAt
+		}
+		res = append(res, am)
+	}
+	return res
+}
+
+// templateDefs makes the labels and value of an alert available to its
+// label and annotation templates as in Prometheus.
+const templateDefs = "{{$labels := .Labels}}{{$value := .Value}}"
+
+// expand executes the template text, the error is returned as text as
+// the alert should still be sent.
+func expand(text string, ls model.LabelSet, value float64) string {
+	tmpl, err := template.New("alert").Option("missingkey=zero").Parse(templateDefs + text)
+	if err != nil {
+		return "error parsing template: " + err.Error()
+	}
+	labels := make(map[string]string, len(ls))
+	for k, v := range ls {
+		labels[string(k)] = string(v)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "error executing template: " + err.Error()
+	}
+	return buf.String()
+}
+
+// formatTime formats ts as a query time parameter.
+func formatTime(ts time.Time) string {
+	return strconv.FormatFloat(float64(ts.UnixNano())/1e9, 'f', -1, 64)
+}
+
+func labelsMap(ls model.LabelSet) map[string]string {
+	m := make(map[string]string, len(ls))
+	for k, v := range ls {
+		m[string(k)] = string(v)
+	}
+	return m
+}
@@ -0,0 +1,63 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// amAlert is an alert of the Alertmanager API.
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// notifier posts alerts to an Alertmanager.
+type notifier struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newNotifier(addr string, timeout time.Duration) *notifier {
+	addr = strings.TrimRight(addr, "/")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &notifier{url: addr + "/api/v2/alerts", timeout: timeout, client: &http.Client{}}
+}
+
+func (n *notifier) send(ctx context.Context, alerts []amAlert) error {
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: unexpected status %s", n.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package ruler
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/query"
+	"github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+var namespace = "proxy"
+var subsystem = "ruler"
+
+var (
+	evaluations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "evaluations_total",
+			Help:      "The number of rule evaluations by group.",
+		},
+		[]string{"group"},
+	)
+	evaluationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "evaluation_failures_total",
+			Help:      "The number of failed rule evaluations by group.",
+		},
+		[]string{"group"},
+	)
+	evaluationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "group_evaluation_duration_seconds",
+			Help:      "The time taken to evaluate a rule group in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"group"},
+	)
+	alertsSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "alerts_sent_total",
+			Help:      "The number of alerts sent to Alertmanager.",
+		},
+	)
+	alertsSendFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "alerts_send_failures_total",
+			Help:      "The number of failed requests sending alerts to Alertmanager.",
+		},
+	)
+)
+
+// defaults of the zero Config values.
+var (
+	defaultEvaluationInterval  = time.Minute
+	defaultAlertmanagerTimeout = 10 * time.Second
+)
+
+// Config configuration
+type Config struct {
+	Enable bool `yaml:"enable"`
+	// RuleFiles are globs of Prometheus rule files.
+	RuleFiles []string `yaml:"ruleFiles"`
+	// EvaluationInterval of the groups without interval.
+	EvaluationInterval time.Duration `yaml:"evaluationInterval"`
+	// AlertmanagerURL is the base URL firing alerts are sent to, alerts
+	// are not sent if empty.
+	AlertmanagerURL     string        `yaml:"alertmanagerURL"`
+	AlertmanagerTimeout time.Duration `yaml:"alertmanagerTimeout"`
+}
+
+// QueryFunc evaluates an instant query, such as Querier.Query.
+type QueryFunc func(ctx context.Context, params url.Values) (*query.QueryData, []string, error)
+
+// Ruler evaluates recording and alerting rules against every backend.
+// Recorded series are pushed into the write queue once their group is
+// evaluated and firing alerts are sent to Alertmanager. The later rules of
+// a group thus do not see the series recorded by the earlier ones in the
+// same evaluation, only those of the previous evaluations once written.
+type Ruler struct {
+	conf     Config
+	groups   []*Group
+	query    QueryFunc
+	queue    queue.Queue
+	notifier *notifier
+
+	logger *zap.Logger
+}
+
+// New loads the rule files of conf.
+func New(reg prometheus.Registerer, conf Config, q QueryFunc, wq queue.Queue, logger *zap.Logger) (*Ruler, error) {
+	if conf.EvaluationInterval <= 0 {
+		conf.EvaluationInterval = defaultEvaluationInterval
+	}
+	if conf.AlertmanagerTimeout <= 0 {
+		conf.AlertmanagerTimeout = defaultAlertmanagerTimeout
+	}
+	groups, err := LoadFiles(conf.RuleFiles, conf.EvaluationInterval)
+	if err != nil {
+		return nil, err
+	}
+	reg.MustRegister(evaluations, evaluationFailures, evaluationDuration, alertsSent, alertsSendFailures)
+
+	r := &Ruler{
+		conf:   conf,
+		groups: groups,
+		query:  q,
+		queue:  wq,
+		logger: logger.With(zap.String("service", "ruler")),
+	}
+	if conf.AlertmanagerURL != "" {
+		r.notifier = newNotifier(conf.AlertmanagerURL, conf.AlertmanagerTimeout)
+	}
+	return r, nil
+}
+
+// Run evaluates every group at its interval until ctx is done.
+func (r *Ruler) Run(ctx context.Context) {
+	r.logger.Info("starting ruler", zap.Int("groups", len(r.groups)))
+	var wg sync.WaitGroup
+	for _, g := range r.groups {
+		wg.Add(1)
+		go func(g *Group) {
+			defer wg.Done()
+			ticker := time.NewTicker(g.Interval)
+			defer ticker.Stop()
+			for {
+				r.Eval(ctx, g, time.Now())
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// Eval evaluates the rules of g at ts.
+func (r *Ruler) Eval(ctx context.Context, g *Group, ts time.Time) {
+	start := time.Now()
+	defer func() {
+		evaluationDuration.WithLabelValues(g.Name).Observe(time.Since(start).Seconds())
+	}()
+
+	var (
+		series model.Vector
+		alerts []amAlert
+	)
+	for _, rl := range g.Rules {
+		evaluations.WithLabelValues(g.Name).Inc()
+		v, err := r.eval(ctx, rl, ts)
+		if err != nil {
+			evaluationFailures.WithLabelValues(g.Name).Inc()
+			r.logger.Warn("rule evaluation",
+				zap.String("group", g.Name), zap.String("expr", rl.Expr), zap.Error(err))
+			continue
+		}
+		if rl.Record != "" {
+			series = append(series, rl.record(v)...)
+			continue
+		}
+		rl.alert(v, ts)
+		series = append(series, rl.alertsSeries(ts)...)
+		alerts = append(alerts, rl.notifications(ts, g.Interval)...)
+	}
+
+	if len(series) > 0 {
+		if err := r.write(series); err != nil {
+			r.logger.Error("write recorded series", zap.String("group", g.Name), zap.Error(err))
+		}
+	}
+	if len(alerts) > 0 && r.notifier != nil {
+		if err := r.notifier.send(ctx, alerts); err != nil {
+			alertsSendFailures.Inc()
+			r.logger.Error("send alerts", zap.String("group", g.Name), zap.Error(err))
+			return
+		}
+		alertsSent.Add(float64(len(alerts)))
+	}
+}
+
+// eval evaluates the expression of rl at ts. Partial responses and results
+// with warnings are not accepted as they would record wrong values and
+// resolve alerts.
+func (r *Ruler) eval(ctx context.Context, rl *rule, ts time.Time) (model.Vector, error) {
+	params := url.Values{
+		"query":            []string{rl.Expr},
+		"time":             []string{formatTime(ts)},
+		"partial_response": []string{"false"},
+	}
+	d, warns, err := r.query(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(warns) > 0 {
+		return nil, query.Errorf(query.ErrExecution, "rule result has warnings: %s", strings.Join(warns, "; "))
+	}
+	switch v := d.Result.(type) {
+	case model.Vector:
+		return v, nil
+	case *model.Scalar:
+		return model.Vector{{Metric: model.Metric{}, Value: v.Value, Timestamp: v.Timestamp}}, nil
+	}
+	return nil, query.Errorf(query.ErrExecution, "rule result type %q is not a vector or scalar", d.ResultType)
+}
+
+// write pushes the series into the write queue as a remote write request.
+func (r *Ruler) write(v model.Vector) error {
+	sort.Slice(v, func(i, j int) bool { return v[i].Metric.Before(v[j].Metric) })
+	var wq prompb.WriteRequest
+	for _, s := range v {
+		ts := &prompb.TimeSeries{
+			Samples: []prompb.Sample{{Value: float64(s.Value), Timestamp: int64(s.Timestamp)}},
+		}
+		for k, v := range s.Metric {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: string(k), Value: string(v)})
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		wq.Timeseries = append(wq.Timeseries, ts)
+	}
+	data, err := proto.Marshal(&wq)
+	if err != nil {
+		return err
+	}
+	return r.queue.Push(snappy.Encode(nil, data))
+}
@@ -0,0 +1,238 @@
+package ruler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/query"
+	"github.com/promcluster/proxy/pkg/queue"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+const testRules = `
+groups:
+- name: test
+  interval: 30s
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+    labels:
+      source: ruler
+  - alert: InstanceDown
+    expr: up == 0
+    for: 1m
+    labels:
+      severity: page
+    annotations:
+      summary: "{{ $labels.instance }} is down ({{ $value }})"
+`
+
+func writeRules(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "ruler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "*.yml")
+}
+
+func TestLoadFilesInvalid(t *testing.T) {
+	for _, content := range []string{
+		"groups:\n- name: a\n  rules:\n  - record: a\n    alert: b\n    expr: up\n",
+		"groups:\n- name: a\n  rules:\n  - record: a-b\n    expr: up\n",
+		"groups:\n- name: a\n  rules:\n  - alert: a\n    expr: sum(up\n",
+		"groups:\n- name: a\n  rules: []\n- name: a\n  rules: []\n",
+		// not evaluable by the proxy.
+		"groups:\n- name: a\n  rules:\n  - alert: a\n    expr: unknown(sum(up))\n",
+		"groups:\n- name: a\n  rules:\n  - record: a\n    expr: sum(up) and 1\n",
+	} {
+		if _, err := LoadFiles([]string{writeRules(t, content)}, time.Minute); err == nil {
+			t.Errorf("loading %q: got no error", content)
+		}
+	}
+
+	// the error names the file and the rule.
+	glob := writeRules(t, "groups:\n- name: a\n  rules:\n  - record: up:sum\n    expr: sum(up) and 1\n")
+	_, err := LoadFiles([]string{glob}, time.Minute)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	file := strings.TrimSuffix(glob, "*.yml") + "rules.yml"
+	if !strings.Contains(err.Error(), file) || !strings.Contains(err.Error(), `"up:sum"`) {
+		t.Errorf("got error %q, want it to name %s and up:sum", err, file)
+	}
+}
+
+func TestRuler(t *testing.T) {
+	var down bool
+	q := func(ctx context.Context, params url.Values) (*query.QueryData, []string, error) {
+		if params.Get("partial_response") != "false" {
+			t.Errorf("got partial_response %q, want false", params.Get("partial_response"))
+		}
+		ts := model.TimeFromUnixNano(int64(mustFloat(t, params.Get("time")) * 1e9))
+		var v model.Vector
+		switch params.Get("query") {
+		case "sum by (job) (up)":
+			v = model.Vector{{Metric: model.Metric{"job": "node"}, Value: 1, Timestamp: ts}}
+		case "up == 0":
+			if down {
+				v = model.Vector{{Metric: model.Metric{"__name__": "up", "instance": "a"}, Value: 0, Timestamp: ts}}
+			}
+		}
+		return &query.QueryData{ResultType: model.ValVector, Result: v}, nil, nil
+	}
+
+	received := make(chan []amAlert, 10)
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" {
+			t.Errorf("got path %s, want /api/v2/alerts", r.URL.Path)
+		}
+		var alerts []amAlert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Error(err)
+		}
+		received <- alerts
+	}))
+	defer am.Close()
+
+	wq := queue.NewChanQueue(prometheus.NewRegistry(), zap.NewNop())
+	r, err := New(prometheus.NewRegistry(), Config{
+		RuleFiles:       []string{writeRules(t, testRules)},
+		AlertmanagerURL: am.URL,
+	}, q, wq, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.groups) != 1 || r.groups[0].Interval != 30*time.Second {
+		t.Fatalf("got groups %v, want one group of interval 30s", r.groups)
+	}
+	g := r.groups[0]
+
+	t0 := time.Unix(1600000000, 0)
+	r.Eval(context.Background(), g, t0)
+	series := readSeries(t, wq)
+	if len(series) != 1 || series[0] != `job:up:sum{job="node", source="ruler"} => 1 @[1600000000]` {
+		t.Fatalf("got series %v, want the recorded job:up:sum", series)
+	}
+
+	// the alert is pending until it was active for 1m.
+	down = true
+	r.Eval(context.Background(), g, t0.Add(30*time.Second))
+	series = readSeries(t, wq)
+	if !contains(series, `ALERTS{alertname="InstanceDown", alertstate="pending", instance="a", severity="page"} => 1 @[1600000030]`) {
+		t.Fatalf("got series %v, want the pending alert", series)
+	}
+	if len(received) != 0 {
+		t.Fatalf("got %d notifications of a pending alert, want none", len(received))
+	}
+
+	t2 := t0.Add(90 * time.Second)
+	r.Eval(context.Background(), g, t2)
+	readSeries(t, wq)
+	alerts := <-received
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(alerts))
+	}
+	a := alerts[0]
+	if a.Labels["alertname"] != "InstanceDown" || a.Labels["instance"] != "a" || a.Labels["severity"] != "page" {
+		t.Errorf("got labels %v", a.Labels)
+	}
+	if a.Annotations["summary"] != "a is down (0)" {
+		t.Errorf("got summary %q, want %q", a.Annotations["summary"], "a is down (0)")
+	}
+	if !a.StartsAt.Equal(t2) || !a.EndsAt.Equal(t2.Add(2*time.Minute)) {
+		t.Errorf("got alert from %v to %v, want from %v to %v", a.StartsAt, a.EndsAt, t2, t2.Add(2*time.Minute))
+	}
+
+	// resolved alerts are sent with their resolution time.
+	down = false
+	t3 := t0.Add(120 * time.Second)
+	r.Eval(context.Background(), g, t3)
+	alerts = <-received
+	if len(alerts) != 1 || !alerts[0].EndsAt.Equal(t3) {
+		t.Fatalf("got alerts %v, want the alert resolved at %v", alerts, t3)
+	}
+}
+
+func TestRulerWarnings(t *testing.T) {
+	q := func(ctx context.Context, params url.Values) (*query.QueryData, []string, error) {
+		v := model.Vector{{Metric: model.Metric{"job": "node"}, Value: 1}}
+		return &query.QueryData{ResultType: model.ValVector, Result: v}, []string{"shard b:9090 failed"}, nil
+	}
+	wq := queue.NewChanQueue(prometheus.NewRegistry(), zap.NewNop())
+	r, err := New(prometheus.NewRegistry(), Config{RuleFiles: []string{writeRules(t, testRules)}}, q, wq, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := testutil.ToFloat64(evaluationFailures.WithLabelValues("test"))
+	r.Eval(context.Background(), r.groups[0], time.Unix(1600000000, 0))
+	if got := testutil.ToFloat64(evaluationFailures.WithLabelValues("test")) - failures; got != 2 {
+		t.Fatalf("got %v failed evaluations, want 2", got)
+	}
+	if n := len(wq.C); n != 0 {
+		t.Fatalf("got %d messages written, want none", n)
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func mustFloat(t *testing.T, s string) float64 {
+	var f float64
+	if err := json.Unmarshal([]byte(s), &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// readSeries returns the series of the write request in the queue.
+func readSeries(t *testing.T, wq *queue.ChanQueue) []string {
+	msg, err := wq.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := snappy.Decode(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, ts := range req.Timeseries {
+		m := model.Metric{}
+		for _, l := range ts.Labels {
+			m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		s := model.Sample{Metric: m, Value: model.SampleValue(ts.Samples[0].Value), Timestamp: model.Time(ts.Samples[0].Timestamp)}
+		res = append(res, s.String())
+	}
+	return res
+}
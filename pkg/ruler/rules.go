@@ -0,0 +1,135 @@
+package ruler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/promql"
+	"github.com/promcluster/proxy/pkg/query"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RuleGroups is a Prometheus rule file.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of rules evaluated at the same interval.
+type RuleGroup struct {
+	Name     string         `yaml:"name"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+	Rules    []Rule         `yaml:"rules"`
+}
+
+// Rule is a recording or alerting rule.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Group is a loaded rule group.
+type Group struct {
+	Name     string
+	File     string
+	Interval time.Duration
+	Rules    []*rule
+}
+
+// LoadFiles loads the rule groups of the files matching the globs, groups
+// without interval are evaluated every interval.
+func LoadFiles(globs []string, interval time.Duration) ([]*Group, error) {
+	var files []string
+	for _, g := range globs {
+		matches, err := filepath.Glob(g)
+		if err != nil {
+			return nil, fmt.Errorf("rule files %q: %w", g, err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	var groups []*Group
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var rgs RuleGroups
+		if err := yaml.UnmarshalStrict(b, &rgs); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		seen := make(map[string]bool, len(rgs.Groups))
+		for _, rg := range rgs.Groups {
+			if rg.Name == "" {
+				return nil, fmt.Errorf("%s: group name is empty", f)
+			}
+			if seen[rg.Name] {
+				return nil, fmt.Errorf("%s: group %q is repeated", f, rg.Name)
+			}
+			seen[rg.Name] = true
+
+			g := &Group{Name: rg.Name, File: f, Interval: time.Duration(rg.Interval)}
+			if g.Interval <= 0 {
+				g.Interval = interval
+			}
+			for i, r := range rg.Rules {
+				if err := r.validate(); err != nil {
+					return nil, fmt.Errorf("%s: group %q, rule %d %q: %w", f, rg.Name, i, r.name(), err)
+				}
+				g.Rules = append(g.Rules, newRule(r))
+			}
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// name is the recorded series or the alert of the rule.
+func (r *Rule) name() string {
+	if r.Record != "" {
+		return r.Record
+	}
+	return r.Alert
+}
+
+func (r *Rule) validate() error {
+	switch {
+	case r.Record != "" && r.Alert != "":
+		return fmt.Errorf("only one of record and alert must be set")
+	case r.Record == "" && r.Alert == "":
+		return fmt.Errorf("one of record or alert must be set")
+	case r.Record != "" && !model.IsValidMetricName(model.LabelValue(r.Record)):
+		return fmt.Errorf("invalid recording rule name %q", r.Record)
+	case r.Record != "" && len(r.Annotations) > 0:
+		return fmt.Errorf("recording rules cannot have annotations")
+	case r.Record != "" && r.For != 0:
+		return fmt.Errorf("recording rules cannot have a for duration")
+	}
+	e, err := promql.ParseExpr(r.Expr)
+	if err != nil {
+		return fmt.Errorf("expr %q: %w", r.Expr, err)
+	}
+	if err := query.Validate(e); err != nil {
+		return fmt.Errorf("expr %q: %w", r.Expr, err)
+	}
+	for name := range r.Labels {
+		if !model.LabelName(name).IsValid() || name == model.MetricNameLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	for name := range r.Annotations {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid annotation name %q", name)
+		}
+	}
+	return nil
+}
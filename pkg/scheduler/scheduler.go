@@ -0,0 +1,265 @@
+package scheduler
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var namespace = "proxy"
+var subsystem = "scheduler"
+
+var (
+	queueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queue_length",
+			Help:      "The number of queued requests by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "inflight_requests",
+			Help:      "The number of running requests by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	shed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "shed_requests_total",
+			Help:      "The number of rejected requests by tenant and reason.",
+		},
+		[]string{"tenant", "reason"},
+	)
+	queueDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queue_duration_seconds",
+			Help:      "The time requests waited in the queue in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+)
+
+// Errors of shed requests.
+var (
+	ErrQueueFull    = errors.New("too many queued requests")
+	ErrQueueTimeout = errors.New("request waited too long in the queue")
+)
+
+// Config configuration
+type Config struct {
+	Enable bool `yaml:"enable"`
+	// MaxConcurrent is the number of requests running at once across
+	// every tenant, unlimited if zero.
+	MaxConcurrent int `yaml:"maxConcurrent"`
+	// MaxQueueLength is the number of queued requests of a tenant,
+	// unlimited if zero.
+	MaxQueueLength int `yaml:"maxQueueLength"`
+	// MaxQueueWait sheds the requests queued for longer, unlimited if zero.
+	MaxQueueWait time.Duration `yaml:"maxQueueWait"`
+}
+
+// Scheduler runs the requests of every tenant up to the tenant's
+// concurrency limit. Once all slots are taken, requests are queued per
+// tenant and the queues are served in weighted round-robin order, a
+// tenant of weight w runs up to w requests in its turn.
+type Scheduler struct {
+	conf Config
+
+	mu      sync.Mutex
+	running int
+	tenants map[string]*tenantQueue
+	// ring holds the tenants with queued or running requests,
+	// next indexes the tenant whose turn it is.
+	ring []*tenantQueue
+	next int
+}
+
+type tenantQueue struct {
+	name    string
+	limit   int
+	weight  int
+	running int
+	served  int
+	waiters *list.List
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// New creates a scheduler.
+func New(reg prometheus.Registerer, conf Config) *Scheduler {
+	reg.MustRegister(queueLength, inflight, shed, queueDuration)
+	return &Scheduler{conf: conf, tenants: make(map[string]*tenantQueue)}
+}
+
+// Acquire waits for a slot of the tenant, which runs at most limit
+// requests at once if limit is positive. The returned function must be
+// called once the request is done.
+func (s *Scheduler) Acquire(ctx context.Context, tenant string, limit, weight int) (func(), error) {
+	if weight < 1 {
+		weight = 1
+	}
+	s.mu.Lock()
+	t := s.tenant(tenant)
+	t.limit, t.weight = limit, weight
+	if t.waiters.Len() == 0 && s.available(t) {
+		s.start(t)
+		s.mu.Unlock()
+		return s.releaser(t), nil
+	}
+	if s.conf.MaxQueueLength > 0 && t.waiters.Len() >= s.conf.MaxQueueLength {
+		s.mu.Unlock()
+		shed.WithLabelValues(tenant, "queueFull").Inc()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	e := t.waiters.PushBack(w)
+	queueLength.WithLabelValues(tenant).Inc()
+	s.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if s.conf.MaxQueueWait > 0 {
+		timer := time.NewTimer(s.conf.MaxQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	err := ErrQueueTimeout
+	select {
+	case <-w.ready:
+		queueDuration.Observe(time.Since(start).Seconds())
+		return s.releaser(t), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+	}
+
+	s.mu.Lock()
+	if w.granted {
+		// the slot was granted concurrently.
+		s.mu.Unlock()
+		queueDuration.Observe(time.Since(start).Seconds())
+		return s.releaser(t), nil
+	}
+	t.waiters.Remove(e)
+	queueLength.WithLabelValues(tenant).Dec()
+	s.cleanup(t)
+	s.mu.Unlock()
+	if err == ErrQueueTimeout {
+		shed.WithLabelValues(tenant, "queueTimeout").Inc()
+	}
+	return nil, err
+}
+
+func (s *Scheduler) tenant(name string) *tenantQueue {
+	t, ok := s.tenants[name]
+	if !ok {
+		t = &tenantQueue{name: name, waiters: list.New()}
+		s.tenants[name] = t
+		s.ring = append(s.ring, t)
+	}
+	return t
+}
+
+// available reports whether a request of t can start.
+func (s *Scheduler) available(t *tenantQueue) bool {
+	if s.conf.MaxConcurrent > 0 && s.running >= s.conf.MaxConcurrent {
+		return false
+	}
+	return t.limit <= 0 || t.running < t.limit
+}
+
+func (s *Scheduler) start(t *tenantQueue) {
+	t.running++
+	s.running++
+	inflight.WithLabelValues(t.name).Inc()
+}
+
+func (s *Scheduler) releaser(t *tenantQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			t.running--
+			s.running--
+			inflight.WithLabelValues(t.name).Dec()
+			s.dispatch()
+			s.cleanup(t)
+		})
+	}
+}
+
+// dispatch starts the queued requests while slots are available.
+func (s *Scheduler) dispatch() {
+	for {
+		t := s.pick()
+		if t == nil {
+			return
+		}
+		w := t.waiters.Remove(t.waiters.Front()).(*waiter)
+		queueLength.WithLabelValues(t.name).Dec()
+		s.start(t)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// pick returns the tenant whose queued request starts next, or nil.
+func (s *Scheduler) pick() *tenantQueue {
+	n := len(s.ring)
+	for i := 0; i < n; i++ {
+		idx := (s.next + i) % n
+		t := s.ring[idx]
+		if t.waiters.Len() == 0 || !s.available(t) {
+			continue
+		}
+		if idx != s.next {
+			s.next = idx
+			t.served = 0
+		}
+		t.served++
+		if t.served >= t.weight {
+			t.served = 0
+			s.next = (idx + 1) % n
+		}
+		return t
+	}
+	return nil
+}
+
+// cleanup forgets t once it has no queued or running request.
+func (s *Scheduler) cleanup(t *tenantQueue) {
+	if t.running > 0 || t.waiters.Len() > 0 {
+		return
+	}
+	delete(s.tenants, t.name)
+	for i, rt := range s.ring {
+		if rt != t {
+			continue
+		}
+		s.ring = append(s.ring[:i], s.ring[i+1:]...)
+		if i < s.next {
+			s.next--
+		}
+		if s.next >= len(s.ring) {
+			s.next = 0
+		}
+		return
+	}
+}
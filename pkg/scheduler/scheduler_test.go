@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queued returns the number of queued requests of tenant.
+func queued(s *Scheduler, tenant string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tenants[tenant]; ok {
+		return t.waiters.Len()
+	}
+	return 0
+}
+
+func waitQueued(t *testing.T, s *Scheduler, tenant string, n int) {
+	deadline := time.Now().Add(time.Second)
+	for queued(s, tenant) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %d queued requests, want %d", tenant, queued(s, tenant), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s := New(prometheus.NewRegistry(), Config{MaxConcurrent: 1})
+	release, err := s.Acquire(context.Background(), "a", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(tenant string, weight int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Acquire(context.Background(), tenant, 0, weight)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, tenant)
+			mu.Unlock()
+			r()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		enqueue("a", 1)
+		waitQueued(t, s, "a", i+1)
+	}
+	for i := 0; i < 2; i++ {
+		enqueue("b", 2)
+		waitQueued(t, s, "b", i+1)
+	}
+	release()
+	wg.Wait()
+
+	// b catches up with a, running two requests in its turns.
+	want := []string{"a", "b", "b", "a", "a", "a"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSchedulerTenantLimit(t *testing.T) {
+	s := New(prometheus.NewRegistry(), Config{MaxQueueWait: 20 * time.Millisecond})
+	release, err := s.Acquire(context.Background(), "a", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Acquire(context.Background(), "a", 1, 1); err != ErrQueueTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrQueueTimeout)
+	}
+	// other tenants are not limited by a.
+	rb, err := s.Acquire(context.Background(), "b", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb()
+
+	done := make(chan error)
+	go func() {
+		r, err := s.Acquire(context.Background(), "a", 1, 1)
+		if err == nil {
+			r()
+		}
+		done <- err
+	}()
+	waitQueued(t, s, "a", 1)
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	s := New(prometheus.NewRegistry(), Config{MaxConcurrent: 1, MaxQueueLength: 1})
+	release, err := s.Acquire(context.Background(), "a", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := s.Acquire(ctx, "b", 0, 1)
+		done <- err
+	}()
+	waitQueued(t, s, "b", 1)
+	if _, err := s.Acquire(context.Background(), "b", 0, 1); err != ErrQueueFull {
+		t.Fatalf("got error %v, want %v", err, ErrQueueFull)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if n := queued(s, "b"); n != 0 {
+		t.Fatalf("got %d queued requests, want 0", n)
+	}
+}
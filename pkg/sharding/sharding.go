@@ -0,0 +1,131 @@
+package sharding
+
+import (
+	"github.com/promcluster/proxy/pkg/filter"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Config configuration
+type Config struct {
+	// Labels are the shard key labels of every metric, the whole label
+	// set is hashed if empty.
+	Labels []string `yaml:"labels"`
+	// Metrics overrides the shard key labels of some metrics.
+	Metrics []MetricKey `yaml:"metrics"`
+	// PruneQueries sends the reads whose selectors pin every shard key
+	// label only to the shards owning the key.
+	PruneQueries bool `yaml:"pruneQueries"`
+	// ReplicationFactor is the number of distinct endpoints every series
+	// is written to, 1 if zero.
+	ReplicationFactor int `yaml:"replicationFactor"`
+	// WriteQuorum is the number of replicas which must accept a series
+	// for a message to be delivered, a majority of the replicas if zero.
+	WriteQuorum int `yaml:"writeQuorum"`
+}
+
+// Replicas returns the replication factor, at least 1.
+func (c Config) Replicas() int {
+	if c.ReplicationFactor < 1 {
+		return 1
+	}
+	return c.ReplicationFactor
+}
+
+// Quorum returns the write quorum, between 1 and the replication factor.
+func (c Config) Quorum() int {
+	rf := c.Replicas()
+	switch {
+	case c.WriteQuorum <= 0:
+		return rf/2 + 1
+	case c.WriteQuorum > rf:
+		return rf
+	}
+	return c.WriteQuorum
+}
+
+// MetricKey is the shard key of a metric.
+type MetricKey struct {
+	Name   string   `yaml:"name"`
+	Labels []string `yaml:"labels"`
+}
+
+// Key computes the shard key of series, the string hashed to find the
+// owners of a series on the write path and of a selector on the read path.
+type Key struct {
+	labels  []model.LabelName
+	metrics map[string][]model.LabelName
+}
+
+// NewKey creates the shard key of conf.
+func NewKey(conf Config) *Key {
+	k := &Key{labels: labelNames(conf.Labels), metrics: make(map[string][]model.LabelName, len(conf.Metrics))}
+	for _, m := range conf.Metrics {
+		k.metrics[m.Name] = labelNames(m.Labels)
+	}
+	return k
+}
+
+func labelNames(ls []string) []model.LabelName {
+	res := make([]model.LabelName, 0, len(ls))
+	for _, l := range ls {
+		res = append(res, model.LabelName(l))
+	}
+	return res
+}
+
+// labelsOf returns the key labels of a metric, none if the whole label
+// set is hashed.
+func (k *Key) labelsOf(name string) []model.LabelName {
+	if ls, ok := k.metrics[name]; ok {
+		return ls
+	}
+	return k.labels
+}
+
+// Of returns the shard key of a series.
+func (k *Key) Of(lset model.LabelSet) string {
+	ls := k.labelsOf(string(lset[model.MetricNameLabel]))
+	if len(ls) == 0 {
+		return filter.LabelsString(&lset)
+	}
+	return keyString(ls, lset)
+}
+
+// Select returns the shard key of the series selected by the matchers,
+// it reports false unless they pin every key label to a single value.
+func (k *Key) Select(ms []*labels.Matcher) (string, bool) {
+	eq := make(model.LabelSet, len(ms))
+	for _, m := range ms {
+		if m.Type == labels.MatchEqual {
+			eq[model.LabelName(m.Name)] = model.LabelValue(m.Value)
+		}
+	}
+	name, named := eq[model.MetricNameLabel]
+	if !named && len(k.metrics) > 0 {
+		// the key labels depend on the metric.
+		return "", false
+	}
+	ls := k.labelsOf(string(name))
+	if len(ls) == 0 {
+		return "", false
+	}
+	for _, l := range ls {
+		if _, ok := eq[l]; !ok {
+			return "", false
+		}
+	}
+	return keyString(ls, eq), true
+}
+
+// keyString formats the key labels of lset, empty labels are absent.
+func keyString(ls []model.LabelName, lset model.LabelSet) string {
+	key := make(model.LabelSet, len(ls))
+	for _, l := range ls {
+		if v := lset[l]; v != "" {
+			key[l] = v
+		}
+	}
+	return filter.LabelsString(&key)
+}
@@ -0,0 +1,87 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/promcluster/proxy/pkg/promql"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestKey(t *testing.T) {
+	k := NewKey(Config{
+		Labels:  []string{"__name__", "namespace"},
+		Metrics: []MetricKey{{Name: "kube_pod_info", Labels: []string{"namespace"}}},
+	})
+
+	cases := []struct {
+		lset model.LabelSet
+		key  string
+	}{
+		{model.LabelSet{"__name__": "up", "namespace": "a", "pod": "p"}, `{__name__="up", namespace="a"}`},
+		{model.LabelSet{"__name__": "up", "pod": "p"}, `{__name__="up"}`},
+		{model.LabelSet{"__name__": "kube_pod_info", "namespace": "a", "pod": "p"}, `{namespace="a"}`},
+	}
+	for _, c := range cases {
+		if got := k.Of(c.lset); got != c.key {
+			t.Errorf("key of %v: got %s, want %s", c.lset, got, c.key)
+		}
+	}
+
+	selectors := []struct {
+		selector string
+		key      string
+		ok       bool
+	}{
+		{`up{namespace="a"}`, `{__name__="up", namespace="a"}`, true},
+		{`up{namespace="a",pod=~"p.*"}`, `{__name__="up", namespace="a"}`, true},
+		{`up{namespace=""}`, `{__name__="up"}`, true},
+		{`kube_pod_info{namespace="a"}`, `{namespace="a"}`, true},
+		{`up{namespace=~"a|b"}`, "", false},
+		{`up`, "", false},
+		{`{namespace="a"}`, "", false},
+	}
+	for _, c := range selectors {
+		ms, err := promql.ParseMetricSelector(c.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, ok := k.Select(ms)
+		if key != c.key || ok != c.ok {
+			t.Errorf("key of %s: got %s, %v, want %s, %v", c.selector, key, ok, c.key, c.ok)
+		}
+	}
+}
+
+func TestKeyFullLabelSet(t *testing.T) {
+	k := NewKey(Config{})
+	lset := model.LabelSet{"__name__": "up", "job": "node"}
+	if got, want := k.Of(lset), `{__name__="up", job="node"}`; got != want {
+		t.Errorf("got key %s, want %s", got, want)
+	}
+	ms, _ := promql.ParseMetricSelector(`up{job="node"}`)
+	if _, ok := k.Select(ms); ok {
+		t.Error("got a key of a selector without key labels")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	cases := []struct {
+		conf             Config
+		replicas, quorum int
+	}{
+		{Config{}, 1, 1},
+		{Config{ReplicationFactor: 2}, 2, 2},
+		{Config{ReplicationFactor: 3}, 3, 2},
+		{Config{ReplicationFactor: 3, WriteQuorum: 1}, 3, 1},
+		{Config{ReplicationFactor: 3, WriteQuorum: 5}, 3, 3},
+	}
+	for _, c := range cases {
+		if got := c.conf.Replicas(); got != c.replicas {
+			t.Errorf("%+v: got %d replicas, want %d", c.conf, got, c.replicas)
+		}
+		if got := c.conf.Quorum(); got != c.quorum {
+			t.Errorf("%+v: got quorum %d, want %d", c.conf, got, c.quorum)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Config configuration
+type Config struct {
+	// RefreshInterval is the DNS refresh interval of dns+ and dnssrv+ addresses.
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+	// MaxRetries is the number of other replicas tried for a failed idempotent request.
+	MaxRetries int `yaml:"maxRetries"`
+	// FailureThreshold consecutive failures eject a replica for EjectDuration.
+	FailureThreshold int           `yaml:"failureThreshold"`
+	EjectDuration    time.Duration `yaml:"ejectDuration"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	// Credentials sent upstream instead of the client's Authorization header.
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	BearerToken     string `yaml:"bearerToken"`
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+}
+
+// TLSConfig configures https upstreams.
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// ClientConfig builds the client TLS configuration, a client certificate
+// is presented for mTLS when CertFile and KeyFile are set.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, //nolint: gosec
+	}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,341 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/promcluster/proxy/pkg/dns"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var namespace = "proxy"
+var subsystem = "upstream"
+
+var (
+	upstreamRequestFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_failed",
+			Help:      "The failed number of requests to query upstream replicas.",
+		},
+		[]string{"target"},
+	)
+	upstreamRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retries_total",
+			Help:      "The number of requests retried on another replica.",
+		},
+	)
+	upstreamEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "ejections_total",
+			Help:      "The number of times a replica was ejected after consecutive failures.",
+		},
+		[]string{"target"},
+	)
+	upstreamTargets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "target_num",
+			Help:      "The replicas number of query upstream.",
+		},
+	)
+)
+
+// defaults of the zero Config values.
+var (
+	defaultRefreshInterval  = 30 * time.Second
+	defaultFailureThreshold = 3
+	defaultEjectDuration    = 30 * time.Second
+)
+
+var errNoTarget = errors.New("no query upstream replica available")
+
+// target is a replica of the upstream.
+type target struct {
+	url      *url.URL
+	failures int
+	ejected  time.Time
+}
+
+// Upstream balances requests across the replicas of the query upstream.
+// Replicas failing FailureThreshold times in a row are ejected for
+// EjectDuration, idempotent requests are retried on other replicas.
+type Upstream struct {
+	addrs     []string
+	provider  *dns.Provider
+	transport http.RoundTripper
+	conf      Config
+
+	mu      sync.Mutex
+	targets []*target
+	next    int
+	now     func() time.Time
+
+	logger *zap.Logger
+}
+
+// New creates an upstream of the comma separated addrs. Addresses
+// prefixed with `dns+` or `dnssrv+` are resolved and refreshed until
+// ctx is done, addresses without scheme use http.
+func New(
+	ctx context.Context,
+	reg prometheus.Registerer,
+	addrs string,
+	conf Config,
+	logger *zap.Logger) (*Upstream, error) {
+	reg.MustRegister(upstreamRequestFailed, upstreamRetries, upstreamEjections, upstreamTargets)
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = defaultRefreshInterval
+	}
+	if conf.FailureThreshold <= 0 {
+		conf.FailureThreshold = defaultFailureThreshold
+	}
+	if conf.EjectDuration <= 0 {
+		conf.EjectDuration = defaultEjectDuration
+	}
+
+	tlsConfig, err := conf.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{
+		provider: dns.NewProvider("golang", logger),
+		transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: 30,
+			IdleConnTimeout:     10 * time.Minute,
+		},
+		conf:   conf,
+		now:    time.Now,
+		logger: logger.With(zap.String("service", "upstream")),
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			u.addrs = append(u.addrs, addr)
+		}
+	}
+	if len(u.addrs) == 0 {
+		return nil, fmt.Errorf("no query upstream address")
+	}
+
+	if err := u.resolve(ctx); err != nil {
+		u.logger.Error("init DNS resolve", zap.Error(err))
+	}
+	if u.dynamic() {
+		go u.refresh(ctx)
+	}
+	return u, nil
+}
+
+// dynamic reports whether any address is resolved through DNS.
+func (u *Upstream) dynamic() bool {
+	for _, addr := range u.addrs {
+		if qtype, _ := dns.GetQTypeName(addr); qtype != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upstream) refresh(ctx context.Context) {
+	t := time.NewTicker(u.conf.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := u.resolve(ctx); err != nil {
+				u.logger.Error("DNS resolve", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resolve updates the replicas, keeping the health of known replicas.
+func (u *Upstream) resolve(ctx context.Context) error {
+	var resolved []string
+	for _, addr := range u.addrs {
+		if qtype, _ := dns.GetQTypeName(addr); qtype == "" {
+			resolved = append(resolved, addr)
+			continue
+		}
+		res, err := u.provider.Resolve(ctx, addr)
+		if err != nil {
+			return err
+		}
+		resolved = append(resolved, res...)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	known := make(map[string]*target, len(u.targets))
+	for _, t := range u.targets {
+		known[t.url.String()] = t
+	}
+	targets := make([]*target, 0, len(resolved))
+	for _, addr := range resolved {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		tu, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("parse upstream address %q: %w", addr, err)
+		}
+		t, ok := known[tu.String()]
+		if !ok {
+			t = &target{url: tu}
+		}
+		targets = append(targets, t)
+	}
+	u.targets = targets
+	upstreamTargets.Set(float64(len(targets)))
+	return nil
+}
+
+// pick returns the next healthy replica not in tried. When every
+// replica is ejected the ejected ones are used rather than failing.
+func (u *Upstream) pick(tried map[*target]bool) *target {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.now()
+	var fallback *target
+	for i := 0; i < len(u.targets); i++ {
+		t := u.targets[(u.next+i)%len(u.targets)]
+		if tried[t] {
+			continue
+		}
+		if now.Before(t.ejected) {
+			if fallback == nil {
+				fallback = t
+			}
+			continue
+		}
+		u.next = (u.next + i + 1) % len(u.targets)
+		return t
+	}
+	return fallback
+}
+
+func (u *Upstream) succeed(t *target) {
+	u.mu.Lock()
+	t.failures = 0
+	u.mu.Unlock()
+}
+
+func (u *Upstream) fail(t *target) {
+	upstreamRequestFailed.WithLabelValues(t.url.Host).Inc()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	t.failures++
+	if t.failures >= u.conf.FailureThreshold {
+		t.failures = 0
+		t.ejected = u.now().Add(u.conf.EjectDuration)
+		upstreamEjections.WithLabelValues(t.url.Host).Inc()
+		u.logger.Warn("eject upstream replica", zap.String("target", t.url.Host),
+			zap.Duration("duration", u.conf.EjectDuration))
+	}
+}
+
+// RoundTrip implements http.RoundTripper, it sends the request to a
+// replica with the upstream credentials.
+func (u *Upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if idempotent(req) {
+		retries = u.conf.MaxRetries
+	}
+
+	tried := map[*target]bool{}
+	t := u.pick(tried)
+	if t == nil {
+		return nil, errNoTarget
+	}
+	for attempt := 0; ; attempt++ {
+		tried[t] = true
+		r, err := u.request(req, t)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := u.transport.RoundTrip(r)
+		if err == nil && !retryable(resp.StatusCode) {
+			u.succeed(t)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		u.fail(t)
+
+		if attempt >= retries {
+			return resp, err
+		}
+		if t = u.pick(tried); t == nil {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body) // Avoid resource leak.
+			resp.Body.Close()
+		}
+		upstreamRetries.Inc()
+	}
+}
+
+// request returns a copy of req for the replica t.
+func (u *Upstream) request(req *http.Request, t *target) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.url.Scheme
+	r.URL.Host = t.url.Host
+	if t.url.Path != "" && t.url.Path != "/" {
+		r.URL.Path = strings.TrimRight(t.url.Path, "/") + r.URL.Path
+	}
+	r.Host = t.url.Host
+	r.Header.Set("X-Origin-Host", t.url.Host)
+
+	// the client's credentials are for the proxy only.
+	r.Header.Del("Authorization")
+	switch {
+	case u.conf.Username != "":
+		r.SetBasicAuth(u.conf.Username, u.conf.Password)
+	case u.conf.BearerToken != "":
+		r.Header.Set("Authorization", "Bearer "+u.conf.BearerToken)
+	case u.conf.BearerTokenFile != "":
+		// read on every request to pick up rotated tokens.
+		b, err := ioutil.ReadFile(u.conf.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read bearer token file: %w", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(b)))
+	}
+	return r, nil
+}
+
+// idempotent reports whether req can be sent again.
+func idempotent(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+// retryable reports whether a response status means the replica is unhealthy.
+func retryable(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
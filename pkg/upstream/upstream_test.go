@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// newReplica starts a fake query replica answering with code and
+// counting its requests.
+func newReplica(t *testing.T, code int, hits *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestUpstream(t *testing.T, conf Config, addrs ...string) *Upstream {
+	u, err := New(context.Background(), prometheus.NewRegistry(), strings.Join(addrs, ","), conf, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func get(t *testing.T, u *Upstream, method string) *http.Response {
+	req, err := http.NewRequest(method, "http://proxy/api/v1/query?query=up", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer client")
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestUpstreamBalance(t *testing.T) {
+	var a, b int32
+	u := newTestUpstream(t, Config{}, newReplica(t, 200, &a).URL, newReplica(t, 200, &b).URL)
+	for i := 0; i < 4; i++ {
+		get(t, u, http.MethodGet)
+	}
+	if a != 2 || b != 2 {
+		t.Fatalf("got %d and %d requests, want 2 each", a, b)
+	}
+}
+
+func TestUpstreamRetryAndEject(t *testing.T) {
+	var a, b int32
+	u := newTestUpstream(t, Config{MaxRetries: 1, FailureThreshold: 2, EjectDuration: time.Minute},
+		newReplica(t, http.StatusServiceUnavailable, &a).URL, newReplica(t, 200, &b).URL)
+
+	for i := 0; i < 4; i++ {
+		if resp := get(t, u, http.MethodGet); resp.StatusCode != 200 {
+			t.Fatalf("got status %d, want 200", resp.StatusCode)
+		}
+	}
+	// the failing replica is ejected after its second failure.
+	if a != 2 || b != 4 {
+		t.Fatalf("got %d and %d requests, want 2 and 4", a, b)
+	}
+
+	// POST requests are not retried.
+	u = newTestUpstream(t, Config{MaxRetries: 1}, newReplica(t, http.StatusServiceUnavailable, &a).URL)
+	if resp := get(t, u, http.MethodPost); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestUpstreamCredentials(t *testing.T) {
+	var hits int32
+	addr := newReplica(t, 200, &hits).URL
+
+	resp := get(t, newTestUpstream(t, Config{}, addr), http.MethodGet)
+	if got := resp.Header.Get("X-Authorization"); got != "" {
+		t.Fatalf("client credentials forwarded: %q", got)
+	}
+	resp = get(t, newTestUpstream(t, Config{BearerToken: "upstream"}, addr), http.MethodGet)
+	if got := resp.Header.Get("X-Authorization"); got != "Bearer upstream" {
+		t.Fatalf("got %q, want upstream bearer token", got)
+	}
+	resp = get(t, newTestUpstream(t, Config{Username: "u", Password: "p"}, addr), http.MethodGet)
+	if got := resp.Header.Get("X-Authorization"); !strings.HasPrefix(got, "Basic ") {
+		t.Fatalf("got %q, want basic auth", got)
+	}
+}